@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// abrLevels caps the publisher resolution and picks a cheaper x264 preset as
+// a camera is degraded. Level 0 is full quality.
+var abrLevels = []struct {
+	maxHeight int
+	preset    string
+}{
+	{0, "veryfast"},
+	{720, "veryfast"},
+	{480, "superfast"},
+	{360, "ultrafast"},
+}
+
+// abrSlowSpeed is the ffmpeg speed below which an encoder is falling behind
+// its live input.
+const abrSlowSpeed = 0.95
+
+// abrLoop lowers publisher quality while the host is overloaded and restores
+// it once load drops. Each pass changes at most one level per camera, and
+// restores one camera at a time, so a restart storm cannot follow a spike.
+func (a *Agent) abrLoop() {
+	for {
+		time.Sleep(a.config().AbrInterval)
+		load, ok := cpuLoad()
+		a.mu.Lock()
+		a.adaptQualityLocked(load, ok)
+		a.mu.Unlock()
+	}
+}
+
+func (a *Agent) adaptQualityLocked(load float64, haveLoad bool) {
+	cfg := a.config()
+	uids := make([]string, 0, len(a.cameras))
+	for uid := range a.cameras {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	if !cfg.AbrEnabled {
+		for _, uid := range uids {
+			if a.cameras[uid].QualityLevel > 0 {
+				a.setQualityLocked(a.cameras[uid], 0, "adaptive bitrate disabled")
+			}
+		}
+		return
+	}
+
+	var publishing []*Camera
+	for _, uid := range uids {
+		if cam := a.cameras[uid]; a.publishers[uid] != nil && cam.Backend == backendFFmpeg && !a.encodingProfile(cam).isCopy() {
+			publishing = append(publishing, cam)
+		}
+	}
+
+	// An encoder that cannot keep up is degraded whatever the load says,
+	// and nothing is restored while one is behind.
+	slow := false
+	for _, cam := range publishing {
+		if cam.Speed <= 0 || cam.Speed >= abrSlowSpeed {
+			continue
+		}
+		slow = true
+		if cam.QualityLevel < len(abrLevels)-1 {
+			a.setQualityLocked(cam, cam.QualityLevel+1, fmt.Sprintf("encoding at %.2fx", cam.Speed))
+		}
+	}
+	if slow || !haveLoad {
+		return
+	}
+
+	switch {
+	case load >= cfg.AbrHighLoad:
+		// Degrade the camera at the best quality; it frees the most CPU.
+		var target *Camera
+		for _, cam := range publishing {
+			if cam.QualityLevel < len(abrLevels)-1 && (target == nil || cam.QualityLevel < target.QualityLevel) {
+				target = cam
+			}
+		}
+		if target != nil {
+			a.setQualityLocked(target, target.QualityLevel+1, fmt.Sprintf("cpu load %.2f", load))
+		}
+	case load < cfg.AbrLowLoad:
+		var target *Camera
+		for _, cam := range publishing {
+			if cam.QualityLevel > 0 && (target == nil || cam.QualityLevel > target.QualityLevel) {
+				target = cam
+			}
+		}
+		if target != nil {
+			a.setQualityLocked(target, target.QualityLevel-1, fmt.Sprintf("cpu load %.2f", load))
+		}
+	}
+}
+
+// setQualityLocked restarts a camera's publisher at a new quality level.
+func (a *Agent) setQualityLocked(cam *Camera, level int, reason string) {
+	logInfo("quality level %d -> %d for %s: %s", cam.QualityLevel, level, cam.DeviceUID, reason)
+	a.emit("quality_changed", cam.DeviceUID, map[string]interface{}{"level": level, "reason": reason})
+	cam.QualityLevel = level
+	cam.Speed = 0
+	if a.publishers[cam.DeviceUID] != nil {
+		a.stopPublisherLocked(cam.DeviceUID)
+		a.ensurePublisherLocked(cam)
+	}
+}
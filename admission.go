@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// admitPublisherLocked decides whether another publisher may start under
+// MAX_PUBLISHERS and MAX_CPU_LOAD. It returns the reason when it may not.
+func (a *Agent) admitPublisherLocked() (bool, string) {
+	cfg := a.config()
+	if cfg.MaxPublishers > 0 && len(a.publishers) >= cfg.MaxPublishers {
+		return false, fmt.Sprintf("publisher limit %d reached", cfg.MaxPublishers)
+	}
+	if cfg.MaxCPULoad > 0 {
+		if load, ok := cpuLoad(); ok && load >= cfg.MaxCPULoad {
+			return false, fmt.Sprintf("cpu load %.2f above %.2f", load, cfg.MaxCPULoad)
+		}
+	}
+	return true, ""
+}
+
+// startQueuedLocked gives freed capacity to cameras waiting in the queue.
+func (a *Agent) startQueuedLocked() {
+	uids := make([]string, 0)
+	for uid, cam := range a.cameras {
+		if cam.Queued && a.activeLocked(cam) {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Strings(uids)
+	for _, uid := range uids {
+		if ok, _ := a.admitPublisherLocked(); !ok {
+			return
+		}
+		a.ensurePublisherLocked(a.cameras[uid])
+	}
+}
+
+func (a *Agent) queuedCountLocked() int {
+	count := 0
+	for _, cam := range a.cameras {
+		if cam.Queued {
+			count++
+		}
+	}
+	return count
+}
+
+// cpuLoad returns the one-minute load average per CPU. It is only available
+// where /proc/loadavg exists.
+func cpuLoad() (float64, bool) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	return load / float64(runtime.NumCPU()), true
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// audioFloor is reported for digital silence, which astats prints as -inf.
+const audioFloor = -120.0
+
+var audioRMSPattern = regexp.MustCompile(`lavfi\.astats\.Overall\.RMS_level=(-?inf|-?[0-9.]+)`)
+
+type AudioWorker struct {
+	cancel context.CancelFunc
+}
+
+// audioInput returns the ffmpeg arguments that open a microphone. On Windows
+// the device is a DirectShow spec such as "audio=Microphone (USB Camera)",
+// elsewhere an ALSA (Linux) or OSS (FreeBSD) device such as "hw:1,0".
+func audioInput(device string) []string {
+	if isTestNode(device) {
+		return []string{"-re", "-f", "lavfi", "-i", strings.TrimPrefix(device, testNodePrefix)}
+	}
+	format := "alsa"
+	switch runtime.GOOS {
+	case "windows":
+		format = "dshow"
+	case "freebsd":
+		format = "oss"
+	}
+	return []string{"-f", format, "-i", device}
+}
+
+// audioMeterArgs resamples to 8 kHz in one-second frames so astats reports
+// one RMS level per second.
+func audioMeterArgs(device string) []string {
+	args := append([]string{"-hide_banner", "-nostats"}, audioInput(device)...)
+	return append(args,
+		"-vn",
+		"-af", "aresample=8000,asetnsamples=n=8000,astats=metadata=1:reset=1,ametadata=mode=print:key=lavfi.astats.Overall.RMS_level",
+		"-f", "null", "-",
+	)
+}
+
+func parseAudioLevel(line string) (float64, bool) {
+	m := audioRMSPattern.FindStringSubmatch(line)
+	if m == nil {
+		return 0, false
+	}
+	if strings.HasSuffix(m[1], "inf") {
+		return audioFloor, true
+	}
+	level, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	return math.Max(level, audioFloor), true
+}
+
+func (a *Agent) ensureAudioMeterLocked(camera *Camera) {
+	if camera.AudioDevice == "" || a.audioMeters[camera.DeviceUID] != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a.audioMeters[camera.DeviceUID] = &AudioWorker{cancel: cancel}
+	go a.runAudioMeterLoop(ctx, camera.DeviceUID, camera.AudioDevice)
+}
+
+func (a *Agent) stopAudioMeterLocked(uid string) {
+	worker := a.audioMeters[uid]
+	if worker == nil {
+		return
+	}
+	worker.cancel()
+	delete(a.audioMeters, uid)
+	if cam := a.cameras[uid]; cam != nil {
+		cam.AudioLevel = nil
+		cam.Silent = false
+	}
+}
+
+func (a *Agent) runAudioMeterLoop(ctx context.Context, deviceUID, device string) {
+	for {
+		err := a.runAudioMeter(ctx, deviceUID, device)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logWarn("audio meter ended for %s: %v", deviceUID, err)
+		}
+		time.Sleep(a.config().RestartDelay)
+	}
+}
+
+// runAudioMeter reads per-second RMS levels from ffmpeg. A camera whose level
+// stays below AUDIO_SILENCE_DB for AUDIO_SILENCE_MS raises audio_silent, again
+// for every further period, so a dead microphone keeps being reported with
+// how long it has been silent.
+func (a *Agent) runAudioMeter(ctx context.Context, deviceUID, device string) error {
+	cmd := exec.CommandContext(ctx, a.config().FfmpegPath, audioMeterArgs(device)...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var quietSince time.Time
+	reported := 0
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		level, ok := parseAudioLevel(scanner.Text())
+		if !ok {
+			continue
+		}
+		now := time.Now()
+		cfg := a.config()
+		if level >= cfg.AudioSilenceDB {
+			if reported > 0 {
+				a.emit("audio_restored", deviceUID, map[string]interface{}{
+					"level":         level,
+					"silentMinutes": int(now.Sub(quietSince).Minutes()),
+				})
+			}
+			quietSince, reported = time.Time{}, 0
+		} else if quietSince.IsZero() {
+			quietSince = now
+		} else if silent := now.Sub(quietSince); cfg.AudioSilenceAfter > 0 && silent >= time.Duration(reported+1)*cfg.AudioSilenceAfter {
+			reported++
+			if reported == 1 {
+				logWarn("no audio from %s for %s", deviceUID, silent.Round(time.Second))
+			}
+			a.emit("audio_silent", deviceUID, map[string]interface{}{
+				"level":   level,
+				"minutes": int(silent.Minutes()),
+			})
+		}
+
+		a.mu.Lock()
+		if cam := a.cameras[deviceUID]; cam != nil && a.audioMeters[deviceUID] != nil {
+			cam.AudioLevel = &level
+			cam.Silent = reported > 0
+		}
+		a.mu.Unlock()
+	}
+	err = cmd.Wait()
+	if ctx.Err() == nil && err == nil {
+		err = fmt.Errorf("audio input closed")
+	}
+	return err
+}
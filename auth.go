@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"strings"
+)
+
+const (
+	roleAdmin  = "admin"
+	roleViewer = "viewer"
+)
+
+// apiCredential is one API_CREDENTIALS entry, written name:role:token. The
+// token works as a bearer token, or as the password with the name as user
+// for HTTP basic auth, which is what browsers use for the local UI.
+type apiCredential struct {
+	Name  string
+	Role  string
+	Token string
+}
+
+func parseAPICredentials(entries []string) ([]apiCredential, error) {
+	creds := make([]apiCredential, 0, len(entries))
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("entries must be name:role:token")
+		}
+		if parts[1] != roleAdmin && parts[1] != roleViewer {
+			return nil, fmt.Errorf("%s: role must be admin or viewer", parts[0])
+		}
+		creds = append(creds, apiCredential{Name: parts[0], Role: parts[1], Token: parts[2]})
+	}
+	return creds, nil
+}
+
+// credentials are API_CREDENTIALS plus API_TOKEN, which is an admin token.
+func (a *Agent) credentials() []apiCredential {
+	cfg := a.config()
+	creds, _ := parseAPICredentials(cfg.APICredentials)
+	if cfg.APIToken != "" {
+		creds = append(creds, apiCredential{Name: "api-token", Role: roleAdmin, Token: cfg.APIToken})
+	}
+	return creds
+}
+
+// rolesEnforced reports whether the whole API needs credentials, which is
+// the case once API_CREDENTIALS or OIDC sign-in is configured.
+func (a *Agent) rolesEnforced() bool {
+	return len(a.config().APICredentials) > 0 || a.oidcEnabled()
+}
+
+// requestCredential returns the credential the request authenticates with:
+// a bearer token, basic auth or an OIDC session. Wrong tokens count towards
+// the client's lockout.
+func (a *Agent) requestCredential(r *http.Request) (apiCredential, bool) {
+	if r.Header.Get("Authorization") == "" && a.oidcEnabled() {
+		return a.sessionCredential(r)
+	}
+	user, token, basic := r.BasicAuth()
+	if !basic {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	for _, cred := range a.credentials() {
+		if basic && user != cred.Name {
+			continue
+		}
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cred.Token)) == 1 {
+			a.authSucceeded(r)
+			return cred, true
+		}
+	}
+	if token != "" {
+		a.authFailed(r)
+	}
+	return apiCredential{}, false
+}
+
+func (a *Agent) unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	if len(a.config().APICredentials) > 0 && !a.oidcEnabled() {
+		w.Header().Add("WWW-Authenticate", `Basic realm="camhub-agent"`)
+	}
+	writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+}
+
+// requireAuth guards a handler for admins. Without any configured
+// credentials the handler is left open.
+func (a *Agent) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(a.credentials()) == 0 && !a.oidcEnabled() {
+			next(w, r)
+			return
+		}
+		if a.lockedOut(w, r) {
+			return
+		}
+		cred, ok := a.requestCredential(r)
+		if !ok {
+			a.unauthorized(w)
+			return
+		}
+		if cred.Role != roleAdmin {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin role required"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authorize enforces roles on the whole local API once API_CREDENTIALS or
+// OIDC is set: viewers may read (list cameras, snapshots, previews, events)
+// and signal demand, everything else needs an admin. With only API_TOKEN the
+// API stays open as before and just the requireAuth endpoints are protected.
+// /health, the sign-in pages and ONVIF, which has its own credentials, are
+// exempt.
+func (a *Agent) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if !a.rolesEnforced() || path == "/health" || strings.HasPrefix(path, "/auth/") || strings.HasPrefix(path, "/onvif/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if a.lockedOut(w, r) {
+			return
+		}
+		if viewerAllowed(r) && path == "/api/demand" && a.demandHook(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cred, ok := a.requestCredential(r)
+		if !ok && a.oidcEnabled() && r.Method == http.MethodGet && !strings.HasPrefix(path, "/api/") {
+			// Browsers opening the UI are sent to sign in.
+			base := a.config().BasePath
+			http.Redirect(w, r, base+"/auth/login?return="+url.QueryEscape(base+r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		if !ok {
+			a.unauthorized(w)
+			return
+		}
+		if cred.Role != roleAdmin && !viewerAllowed(r) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin role required"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// demandHook reports whether the request carries demandToken, which the
+// managed MediaMTX's runOnDemand hook sends.
+func (a *Agent) demandHook(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtleEqual(token, a.demandToken)
+}
+
+func viewerAllowed(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return r.Method == http.MethodPost && r.URL.Path == "/api/demand"
+}
+
+// handleSession tells the UI who is signed in, so it can hide controls a
+// viewer is not allowed to use.
+func (a *Agent) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.rolesEnforced() {
+		writeJSON(w, http.StatusOK, map[string]string{"role": roleAdmin})
+		return
+	}
+	cred, _ := a.requestCredential(r)
+	session := map[string]string{"name": cred.Name, "role": cred.Role}
+	if a.oidcEnabled() {
+		session["logoutUrl"] = a.config().BasePath + "/auth/logout"
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+func (a *Agent) mountPprof(mux *http.ServeMux) {
+	if len(a.credentials()) == 0 {
+		logWarn("pprof enabled without API_TOKEN; diagnostics are unauthenticated")
+	}
+	mux.HandleFunc("/debug/pprof/", a.requireAuth(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", a.requireAuth(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", a.requireAuth(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", a.requireAuth(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", a.requireAuth(pprof.Trace))
+}
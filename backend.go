@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+)
+
+// Discoverer finds cameras of one kind. Every registered discoverer is asked
+// on each discovery pass and their devices are combined.
+type Discoverer interface {
+	Discover(cfg *Config) []DeviceInfo
+}
+
+// Publisher publishes a camera with one backend. Command is also used to
+// tell whether a configuration change requires a restart, so it must be
+// deterministic.
+type Publisher interface {
+	Command(a *Agent, camera *Camera) []string
+	Start(argv []string) (Process, error)
+}
+
+// Process is a running publisher. Output carries its log output and is
+// closed when the process exits.
+type Process interface {
+	Argv() []string
+	Output() io.Reader
+	// Interrupt asks the process to finish cleanly; Kill ends it at once.
+	Interrupt() error
+	Kill() error
+	Wait() error
+	// Exited is closed once Wait has returned.
+	Exited() <-chan struct{}
+}
+
+var (
+	discoverers       []Discoverer
+	publisherBackends = map[string]Publisher{}
+)
+
+func registerDiscoverer(d Discoverer) {
+	discoverers = append(discoverers, d)
+}
+
+func registerPublisher(name string, p Publisher) {
+	publisherBackends[name] = p
+}
+
+func init() {
+	registerDiscoverer(systemDiscoverer{})
+	registerDiscoverer(testDiscoverer{})
+	registerPublisher(backendFFmpeg, ffmpegPublisher{})
+	registerPublisher(backendGStreamer, gstreamerPublisher{})
+}
+
+// listDevices asks every discoverer for its devices.
+func listDevices(cfg *Config) []DeviceInfo {
+	var devices []DeviceInfo
+	for _, d := range discoverers {
+		devices = append(devices, d.Discover(cfg)...)
+	}
+	return devices
+}
+
+// systemDiscoverer finds the platform's local cameras (V4L2 or DirectShow)
+// that pass DEVICE_INCLUDE and DEVICE_EXCLUDE.
+type systemDiscoverer struct{}
+
+func (systemDiscoverer) Discover(cfg *Config) []DeviceInfo {
+	return filterDevices(discoverDevices(cfg.FfmpegPath), cfg.DeviceInclude, cfg.DeviceExclude)
+}
+
+type testDiscoverer struct{}
+
+func (testDiscoverer) Discover(cfg *Config) []DeviceInfo {
+	return testDevices(cfg)
+}
+
+// publisherFor returns the camera's publisher backend, falling back to
+// ffmpeg for names nothing is registered under.
+func publisherFor(camera *Camera) Publisher {
+	if p := publisherBackends[camera.Backend]; p != nil {
+		return p
+	}
+	return publisherBackends[backendFFmpeg]
+}
+
+type ffmpegPublisher struct{}
+
+func (ffmpegPublisher) Command(a *Agent, camera *Camera) []string {
+	return append([]string{a.config().FfmpegPath}, a.publisherArgs(camera)...)
+}
+
+func (ffmpegPublisher) Start(argv []string) (Process, error) {
+	return startExec(argv, false)
+}
+
+type gstreamerPublisher struct{}
+
+func (gstreamerPublisher) Command(a *Agent, camera *Camera) []string {
+	return append([]string{a.config().GstLaunchPath}, a.gstreamerArgs(camera)...)
+}
+
+// gst-launch reports pipeline state on stdout and errors on stderr.
+func (gstreamerPublisher) Start(argv []string) (Process, error) {
+	return startExec(argv, true)
+}
+
+// execProcess is a Process backed by a child process whose stderr (and
+// optionally stdout) is its output.
+type execProcess struct {
+	cmd    *exec.Cmd
+	output io.Reader
+	exited chan struct{}
+}
+
+func startExec(argv []string, withStdout bool) (Process, error) {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if withStdout {
+		cmd.Stdout = cmd.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &execProcess{cmd: cmd, output: stderr, exited: make(chan struct{})}, nil
+}
+
+func (p *execProcess) Argv() []string          { return p.cmd.Args }
+func (p *execProcess) Output() io.Reader       { return p.output }
+func (p *execProcess) Kill() error             { return p.cmd.Process.Kill() }
+func (p *execProcess) Exited() <-chan struct{} { return p.exited }
+
+func (p *execProcess) Wait() error {
+	defer close(p.exited)
+	return p.cmd.Wait()
+}
+
+func (p *execProcess) Interrupt() error {
+	return p.cmd.Process.Signal(os.Interrupt)
+}
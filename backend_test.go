@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeBackend = "fake"
+
+// fakeDiscoverer reports a fixed set of devices.
+type fakeDiscoverer []DeviceInfo
+
+func (d fakeDiscoverer) Discover(cfg *Config) []DeviceInfo {
+	return append([]DeviceInfo(nil), d...)
+}
+
+// fakePublisher records the commands it is asked to start instead of
+// running them.
+type fakePublisher struct {
+	mu      sync.Mutex
+	started [][]string
+}
+
+func (p *fakePublisher) Command(a *Agent, camera *Camera) []string {
+	return []string{"fake-publisher", camera.StreamPath, camera.RtspURL}
+}
+
+func (p *fakePublisher) Start(argv []string) (Process, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.started = append(p.started, argv)
+	return &fakeProcess{argv: argv, exited: make(chan struct{})}, nil
+}
+
+func (p *fakePublisher) starts() [][]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([][]string(nil), p.started...)
+}
+
+// fakeProcess runs until it is interrupted or killed.
+type fakeProcess struct {
+	argv   []string
+	exited chan struct{}
+	once   sync.Once
+}
+
+func (p *fakeProcess) Argv() []string          { return p.argv }
+func (p *fakeProcess) Output() io.Reader       { return strings.NewReader("") }
+func (p *fakeProcess) Exited() <-chan struct{} { return p.exited }
+func (p *fakeProcess) Interrupt() error        { return p.Kill() }
+
+func (p *fakeProcess) Kill() error {
+	p.once.Do(func() { close(p.exited) })
+	return nil
+}
+
+func (p *fakeProcess) Wait() error {
+	<-p.exited
+	return nil
+}
+
+// useFakeBackend replaces the registered discoverers with one reporting
+// devices and registers a fake publisher backend, until the test ends.
+func useFakeBackend(t *testing.T, devices ...DeviceInfo) *fakePublisher {
+	t.Helper()
+	savedDiscoverers := discoverers
+	savedBackends := publisherBackends
+	t.Cleanup(func() {
+		discoverers = savedDiscoverers
+		publisherBackends = savedBackends
+	})
+
+	discoverers = []Discoverer{fakeDiscoverer(devices)}
+	publisherBackends = map[string]Publisher{}
+	for name, p := range savedBackends {
+		publisherBackends[name] = p
+	}
+	publisher := &fakePublisher{}
+	registerPublisher(fakeBackend, publisher)
+	return publisher
+}
+
+// testConfig is a configuration that needs no camera, media server or hub.
+func testConfig(t *testing.T) Config {
+	cfg := Config{
+		StateFile:        filepath.Join(t.TempDir(), "agent_state.json"),
+		FfmpegPath:       "ffmpeg",
+		GstLaunchPath:    "gst-launch-1.0",
+		GstEncoder:       "x264enc tune=zerolatency",
+		MediaMtxRtspBase: "rtsp://127.0.0.1:8554",
+		MediaMtxWhipBase: "http://127.0.0.1:8889",
+		MediaMtxSrtBase:  "srt://127.0.0.1:8890",
+		SrtLatency:       200 * time.Millisecond,
+		PublishOutput:    outputRTSP,
+		PublishBackend:   backendFFmpeg,
+		SubstreamHeight:  360,
+		CameraLogLines:   10,
+	}
+	cfg.Profiles, _ = loadProfiles("")
+	return cfg
+}
+
+// newTestAgent builds an agent as runAgent does, without starting any of
+// its loops.
+func newTestAgent(t *testing.T, cfg Config) *Agent {
+	t.Helper()
+	agent := &Agent{
+		hostname:      "test-host",
+		agentID:       "agent-1",
+		cameras:       make(map[string]*Camera),
+		missing:       make(map[string]KnownCamera),
+		state:         make(map[string]*CameraSettings),
+		publishers:    make(map[string]Process),
+		pendingStarts: make(map[string]*time.Timer),
+		lastDemand:    make(map[string]time.Time),
+		terminating:   make(map[string]Process),
+		unkillable:    make(map[string]bool),
+		motions:       make(map[string]*MotionWorker),
+		audioMeters:   make(map[string]*AudioWorker),
+		talkbacks:     make(map[string]*talkbackSession),
+		recorders:     make(map[string]*RecordWorker),
+		events:        NewEventLog(),
+		logs:          make(map[string]*LogBuffer),
+		thumbs:        make(map[string]*thumbnail),
+	}
+	agent.cfg.Store(&cfg)
+	agent.mediaReady.Store(true)
+	store, err := openStore(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	agent.store = store
+	return agent
+}
+
+func TestListDevicesCombinesDiscoverers(t *testing.T) {
+	useFakeBackend(t, DeviceInfo{Name: "Front", Node: "/dev/video0"})
+	registerDiscoverer(fakeDiscoverer{{Name: "Back", Node: "/dev/video2"}})
+
+	devices := listDevices(&Config{})
+	if len(devices) != 2 || devices[0].Name != "Front" || devices[1].Name != "Back" {
+		t.Fatalf("listDevices() = %+v, want Front and Back", devices)
+	}
+}
+
+func TestPublisherFor(t *testing.T) {
+	publisher := useFakeBackend(t)
+	tests := []struct {
+		backend string
+		want    Publisher
+	}{
+		{fakeBackend, publisher},
+		{backendFFmpeg, ffmpegPublisher{}},
+		{backendGStreamer, gstreamerPublisher{}},
+		{"unknown", ffmpegPublisher{}},
+	}
+	for _, tt := range tests {
+		if got := publisherFor(&Camera{Backend: tt.backend}); got != tt.want {
+			t.Errorf("publisherFor(%q) = %T, want %T", tt.backend, got, tt.want)
+		}
+	}
+}
+
+func TestEnabledCameraStartsItsPublisher(t *testing.T) {
+	publisher := useFakeBackend(t,
+		DeviceInfo{Name: "Front", Node: "/dev/video0", ID: "usb-front"},
+		DeviceInfo{Name: "Back", Node: "/dev/video2", ID: "usb-back"},
+	)
+	cfg := testConfig(t)
+	cfg.PublishBackend = fakeBackend
+	agent := newTestAgent(t, cfg)
+	agent.state["agent-1:usb-front"] = &CameraSettings{Enabled: true}
+
+	agent.refreshCameras()
+
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if len(agent.cameras) != 2 {
+		t.Fatalf("got %d cameras, want 2", len(agent.cameras))
+	}
+	front := agent.cameras["agent-1:usb-front"]
+	if front == nil || agent.publishers[front.DeviceUID] == nil || !front.Publishing {
+		t.Fatalf("enabled camera is not publishing: %+v", front)
+	}
+	if agent.publishers["agent-1:usb-back"] != nil {
+		t.Error("disabled camera is publishing")
+	}
+	starts := publisher.starts()
+	want := publisher.Command(agent, front)
+	if len(starts) != 1 || !equalArgs(starts[0], want) {
+		t.Fatalf("started %q, want %q", starts, want)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// clockSkew estimates how far the local clock is ahead of the hub's (behind
+// when negative), assuming the hub answered halfway through the round trip.
+// serverTime from the registration reply is preferred; the Date header only
+// has whole seconds, so its middle is used.
+func clockSkew(date string, serverTime, sent, received time.Time) (time.Duration, bool) {
+	if serverTime.IsZero() {
+		parsed, err := http.ParseTime(date)
+		if err != nil {
+			return 0, false
+		}
+		serverTime = parsed.Add(500 * time.Millisecond)
+	}
+	local := sent.Add(received.Sub(sent) / 2)
+	return local.Sub(serverTime), true
+}
+
+// setClockSkew records the latest measurement against the primary hub and
+// reports when the skew crosses CLOCK_SKEW_MAX_MS either way.
+func (a *Agent) setClockSkew(skew time.Duration) {
+	limit := a.config().ClockSkewMax
+	skewed := skew > limit || skew < -limit
+	a.mu.Lock()
+	changed := skewed != a.clockSkewed
+	a.clockSkew, a.clockSkewed, a.clockMeasured = skew, skewed, time.Now()
+	a.mu.Unlock()
+	if !changed {
+		return
+	}
+	skewMs := skew.Milliseconds()
+	if skewed {
+		logWarn("system clock is %s; recording timestamps and token checks may fail", describeSkew(skew))
+		a.emit("clock_skewed", "", map[string]interface{}{"skewMs": skewMs})
+		return
+	}
+	logInfo("system clock is back within %s of the hub", limit)
+	a.emit("clock_ok", "", map[string]interface{}{"skewMs": skewMs})
+}
+
+func describeSkew(skew time.Duration) string {
+	if skew < 0 {
+		return fmt.Sprintf("%s behind the hub", (-skew).Round(time.Millisecond))
+	}
+	return fmt.Sprintf("%s ahead of the hub", skew.Round(time.Millisecond))
+}
+
+// checkClockSync warns at startup when no time daemon has synchronized the
+// clock, before any hub is there to compare with.
+func checkClockSync() {
+	if synced, ok := ntpSynchronized(); ok && !synced {
+		logWarn("system clock is not synchronized; enable NTP (e.g. systemd-timesyncd or chrony)")
+	}
+}
+
+// clockHealth is degraded when the clock is off from the primary hub by more
+// than CLOCK_SKEW_MAX_MS, or when the kernel says it is not synchronized.
+func (a *Agent) clockHealth() componentHealth {
+	health := componentHealth{Name: "clock", Status: healthOK}
+	a.mu.Lock()
+	skew, skewed := a.clockSkew, a.clockSkewed
+	a.mu.Unlock()
+	if skewed {
+		health.Status, health.Reason, health.Message = healthDegraded, "skewed", describeSkew(skew)
+		return health
+	}
+	if synced, ok := ntpSynchronized(); ok && !synced {
+		health.Status, health.Reason, health.Message = healthDegraded, "not_synchronized", "the system clock is not synchronized with NTP"
+	}
+	return health
+}
+
+// clockTelemetry adds the clock state to the heartbeat's system section.
+func (a *Agent) clockTelemetry(system map[string]interface{}) {
+	a.mu.Lock()
+	skew, measured := a.clockSkew, !a.clockMeasured.IsZero()
+	a.mu.Unlock()
+	if measured {
+		system["clockSkewMs"] = skew.Milliseconds()
+	}
+	if synced, ok := ntpSynchronized(); ok {
+		system["ntpSynchronized"] = synced
+	}
+}
@@ -0,0 +1,16 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// ntpSynchronized asks the kernel whether a time daemon keeps the clock in
+// sync; it reports unsynchronized until chrony, ntpd or timesyncd first
+// disciplines it.
+func ntpSynchronized() (synced, ok bool) {
+	state, err := unix.Adjtimex(&unix.Timex{})
+	if err != nil {
+		return false, false
+	}
+	return state != unix.TIME_ERROR, true
+}
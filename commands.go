@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+const (
+	commandRestartAgent     = "restart_agent"
+	commandRestartPublisher = "restart_publisher"
+	commandUpdate           = "update"
+
+	// commandsDoneKept is how many handled command IDs are remembered and
+	// acknowledged in heartbeats.
+	commandsDoneKept = 50
+)
+
+// hubCommand is an action the primary hub asks for in its registration
+// reply. The hub repeats a command until a heartbeat lists its ID in
+// commandsDone, so each ID is carried out once even across a restart.
+type hubCommand struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	DeviceUID string `json:"deviceUid,omitempty"`
+	// Update is the build to install for an update command.
+	Update *updateManifest `json:"update,omitempty"`
+}
+
+// commandsDonePath keeps the handled command IDs, so a restart_agent is not
+// repeated by the agent it started.
+func commandsDonePath(cfg *Config) string {
+	return filepath.Join(filepath.Dir(cfg.StateFile), "hub_commands")
+}
+
+func loadCommandsDone(cfg *Config) []string {
+	var done []string
+	if data, err := os.ReadFile(commandsDonePath(cfg)); err == nil {
+		_ = json.Unmarshal(data, &done)
+	}
+	return done
+}
+
+// runHubCommands carries out the commands not handled before. Agent
+// restarts and updates go last so the other commands are acknowledged first.
+func (a *Agent) runHubCommands(commands []hubCommand) {
+	restart, handled := false, false
+	var update *updateManifest
+	a.mu.Lock()
+	for _, command := range commands {
+		if command.ID == "" || containsString(a.commandsDone, command.ID) {
+			continue
+		}
+		handled = true
+		switch command.Type {
+		case commandRestartAgent:
+			restart = true
+		case commandRestartPublisher:
+			a.restartPublisherLocked(command.DeviceUID)
+		case commandUpdate:
+			update = command.Update
+		default:
+			logWarn("ignoring unknown hub command %q", command.Type)
+		}
+		a.commandsDone = append(a.commandsDone, command.ID)
+		if len(a.commandsDone) > commandsDoneKept {
+			a.commandsDone = a.commandsDone[len(a.commandsDone)-commandsDoneKept:]
+		}
+	}
+	done := append([]string(nil), a.commandsDone...)
+	a.mu.Unlock()
+	if !handled {
+		return
+	}
+
+	data, _ := json.Marshal(done)
+	if err := writeFileAtomic(commandsDonePath(a.config()), data, 0o600); err != nil {
+		logError("hub command state save failed: %v", err)
+		if restart || update != nil {
+			// Restarting without a record of it would restart again.
+			return
+		}
+	}
+	switch {
+	case update != nil:
+		// Downloads can take minutes; heartbeats go on meanwhile.
+		go func() {
+			if err := a.installUpdate(update); err != nil {
+				logWarn("hub update not installed: %v", err)
+			}
+		}()
+	case restart:
+		a.requestRestart("requested by hub")
+	}
+}
+
+// restartPublisherLocked restarts a camera's publisher, for one that runs
+// but has stopped delivering video. Cameras that are not publishing are
+// left alone.
+func (a *Agent) restartPublisherLocked(uid string) {
+	cam := a.cameras[uid]
+	if cam == nil || a.publishers[uid] == nil {
+		logWarn("hub asked to restart the publisher for %s, which is not running", uid)
+		return
+	}
+	logInfo("restarting publisher for %s at the hub's request", uid)
+	a.emit("publisher_restart_requested", uid, nil)
+	a.stopPublisherLocked(uid)
+	a.ensurePublisherLocked(cam)
+}
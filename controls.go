@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const controlTimeout = 5 * time.Second
+
+// CameraControl is one V4L2 control as reported by v4l2-ctl --list-ctrls,
+// e.g. brightness, exposure_time_absolute or power_line_frequency.
+type CameraControl struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Min      *int   `json:"min,omitempty"`
+	Max      *int   `json:"max,omitempty"`
+	Step     *int   `json:"step,omitempty"`
+	Default  *int   `json:"default,omitempty"`
+	Value    int    `json:"value"`
+	Inactive bool   `json:"inactive,omitempty"`
+	Saved    *int   `json:"saved,omitempty"`
+}
+
+var controlLine = regexp.MustCompile(`^\s*(\w+)\s+0x[0-9a-f]+\s+\((\w+)\)\s*:\s*(.*)$`)
+
+func listControls(ctx context.Context, node string) ([]CameraControl, error) {
+	out, err := exec.CommandContext(ctx, "v4l2-ctl", "-d", node, "--list-ctrls").Output()
+	if err != nil {
+		return nil, fmt.Errorf("v4l2-ctl: %w", err)
+	}
+	return parseControls(string(out)), nil
+}
+
+func parseControls(output string) []CameraControl {
+	var controls []CameraControl
+	for _, line := range strings.Split(output, "\n") {
+		m := controlLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		control := CameraControl{Name: m[1], Type: m[2]}
+		for _, field := range strings.Fields(m[3]) {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			if key == "flags" {
+				control.Inactive = strings.Contains(value, "inactive")
+				continue
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "min":
+				control.Min = &n
+			case "max":
+				control.Max = &n
+			case "step":
+				control.Step = &n
+			case "default":
+				control.Default = &n
+			case "value":
+				control.Value = n
+			}
+		}
+		controls = append(controls, control)
+	}
+	return controls
+}
+
+// setControls writes controls in one v4l2-ctl call. Auto modes are listed
+// first so that, e.g., switching auto exposure off happens before the manual
+// exposure value is set.
+func setControls(ctx context.Context, node string, values map[string]int) error {
+	if len(values) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		autoI, autoJ := strings.Contains(names[i], "auto"), strings.Contains(names[j], "auto")
+		if autoI != autoJ {
+			return autoI
+		}
+		return names[i] < names[j]
+	})
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", name, values[name]))
+	}
+	out, err := exec.CommandContext(ctx, "v4l2-ctl", "-d", node, "--set-ctrl="+strings.Join(pairs, ",")).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("v4l2-ctl: %v %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// applySavedControlsLocked restores a camera's persisted controls, which
+// the driver forgets when the device is re-plugged.
+func (a *Agent) applySavedControlsLocked(camera *Camera) {
+	settings := a.state[camera.DeviceUID]
+	if settings == nil || len(settings.Controls) == 0 {
+		return
+	}
+	values := make(map[string]int, len(settings.Controls))
+	for name, value := range settings.Controls {
+		values[name] = value
+	}
+
+	go func(uid, node string) {
+		ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+		defer cancel()
+		if err := setControls(ctx, node, values); err != nil {
+			logWarn("restoring controls failed for %s: %v", uid, err)
+		}
+	}(camera.DeviceUID, camera.Node)
+}
+
+// handleControls lists a camera's controls (GET) or sets them (PUT). A PUT
+// body maps control names to values; null forgets the saved value and
+// restores the driver default.
+func (a *Agent) handleControls(w http.ResponseWriter, r *http.Request, deviceUID string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if runtime.GOOS != "linux" && runtime.GOOS != "freebsd" {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "controls require V4L2"})
+		return
+	}
+
+	var payload map[string]*int
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || len(payload) == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid payload"})
+			return
+		}
+	}
+
+	a.mu.Lock()
+	cam := a.cameras[deviceUID]
+	var node string
+	if cam != nil {
+		node = cam.Node
+	}
+	a.mu.Unlock()
+	if cam == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "camera not found"})
+		return
+	}
+	if isTestNode(node) {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "test cameras have no controls"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), controlTimeout)
+	defer cancel()
+	controls, err := listControls(ctx, node)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		byName := make(map[string]CameraControl, len(controls))
+		for _, control := range controls {
+			byName[control.Name] = control
+		}
+
+		values := make(map[string]int, len(payload))
+		for name, value := range payload {
+			control, ok := byName[name]
+			if !ok {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("unknown control %q", name)})
+				return
+			}
+			if value == nil {
+				if control.Default != nil {
+					values[name] = *control.Default
+				}
+				continue
+			}
+			if (control.Min != nil && *value < *control.Min) || (control.Max != nil && *value > *control.Max) {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("%s out of range", name)})
+				return
+			}
+			values[name] = *value
+		}
+		if err := setControls(ctx, node, values); err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+
+		a.mu.Lock()
+		settings := a.settingsLocked(deviceUID)
+		if settings.Controls == nil {
+			settings.Controls = map[string]int{}
+		}
+		for name, value := range payload {
+			if value == nil {
+				delete(settings.Controls, name)
+			} else {
+				settings.Controls[name] = *value
+			}
+		}
+		a.saveStateLocked()
+		a.mu.Unlock()
+
+		if controls, err = listControls(ctx, node); err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	a.mu.Lock()
+	if settings := a.state[deviceUID]; settings != nil {
+		for idx := range controls {
+			if value, ok := settings.Controls[controls[idx].Name]; ok {
+				controls[idx].Saved = &value
+			}
+		}
+	}
+	a.mu.Unlock()
+	writeJSON(w, http.StatusOK, controls)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultCorsMethods = "GET, POST, PUT, PATCH, DELETE"
+	defaultCorsHeaders = "Authorization, Content-Type"
+)
+
+// cors lets browser frontends on other origins, such as the hub's web app,
+// call /api directly. Origins come from CORS_ORIGINS ("*" allows any);
+// requests from other origins get no CORS headers and are refused by the
+// browser. Preflight requests are answered here, before authentication.
+func (a *Agent) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := a.config()
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(cfg.CorsOrigins) == 0 || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !corsAllowed(cfg.CorsOrigins, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			methods, headers := defaultCorsMethods, defaultCorsHeaders
+			if len(cfg.CorsMethods) > 0 {
+				methods = strings.Join(cfg.CorsMethods, ", ")
+			}
+			if len(cfg.CorsHeaders) > 0 {
+				headers = strings.Join(cfg.CorsHeaders, ", ")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func corsAllowed(origins []string, origin string) bool {
+	for _, allowed := range origins {
+		if allowed == "*" || strings.EqualFold(strings.TrimRight(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	devWatchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_ATTRIB | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+	// devWatchSettle lets udev finish a plug (node, permissions and the
+	// /dev/v4l/by-id links the device UID comes from) before discovery runs.
+	devWatchSettle = time.Second
+)
+
+// v4lDirs are udev's links to the video nodes. They only exist while a
+// camera is attached, so they are watched again whenever they reappear.
+var v4lDirs = []string{"/dev/v4l", "/dev/v4l/by-id", "/dev/v4l/by-path"}
+
+// watchDevices runs discovery when a video node or one of its /dev/v4l
+// links appears, disappears or changes permissions. Discovery then reacts
+// within seconds instead of at the next poll, and the poll can run rarely.
+// It returns, leaving polling alone, when inotify is unavailable.
+func (a *Agent) watchDevices() {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		logWarn("device watch unavailable, polling for cameras: %v", err)
+		return
+	}
+	defer syscall.Close(fd)
+	devWd, err := syscall.InotifyAddWatch(fd, "/dev", devWatchMask)
+	if err != nil {
+		logWarn("device watch unavailable, polling for cameras: %v", err)
+		return
+	}
+	watchV4L := func() {
+		for _, dir := range v4lDirs {
+			_, _ = syscall.InotifyAddWatch(fd, dir, devWatchMask)
+		}
+	}
+	watchV4L()
+	a.devWatch.Store(true)
+	defer a.devWatch.Store(false)
+	logInfo("watching /dev for cameras")
+
+	var settle *time.Timer
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(fd, buf)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			logWarn("device watch stopped, polling for cameras: %v", err)
+			return
+		}
+		relevant := false
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[start:start+int(event.Len)]), "\x00")
+			offset = start + int(event.Len)
+			switch {
+			case event.Mask&syscall.IN_IGNORED != 0:
+				// A /dev/v4l directory went away with its last camera.
+			case int(event.Wd) != devWd:
+				relevant = true
+			case strings.HasPrefix(name, "video"):
+				relevant = true
+			case name == "v4l":
+				watchV4L()
+				relevant = true
+			}
+		}
+		if !relevant {
+			continue
+		}
+		if settle == nil {
+			settle = time.AfterFunc(devWatchSettle, func() { a.discoverCameras(true) })
+		} else {
+			settle.Reset(devWatchSettle)
+		}
+	}
+}
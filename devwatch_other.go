@@ -0,0 +1,6 @@
+//go:build !linux
+
+package main
+
+// watchDevices is Linux only; elsewhere discovery relies on polling.
+func (a *Agent) watchDevices() {}
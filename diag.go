@@ -0,0 +1,232 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	diagCommandTimeout = 10 * time.Second
+	diagLogTail        = 256 * 1024
+)
+
+// writeDiagBundle writes a zip for support: sanitized configuration,
+// version, devices with their V4L2 capabilities, the ffmpeg build and the
+// tail of LOG_FILE. With a running agent it also holds the camera list,
+// recent events, per-camera ffmpeg output and each camera's last errors.
+func writeDiagBundle(w io.Writer, cfg Config, agent *Agent) error {
+	zw := zip.NewWriter(w)
+	add := func(name string, data []byte) error {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+	addJSON := func(name string, v interface{}) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return add(name, data)
+	}
+
+	if err := add("config.txt", []byte(sanitizedConfig())); err != nil {
+		return err
+	}
+	if err := addJSON("version.json", versionInfo()); err != nil {
+		return err
+	}
+	if err := add("ffmpeg.txt", diagCommand(cfg.FfmpegPath, "-hide_banner", "-version")); err != nil {
+		return err
+	}
+
+	devices := listDevices(&cfg)
+	if devices == nil {
+		devices = []DeviceInfo{}
+	}
+	if err := addJSON("devices.json", devices); err != nil {
+		return err
+	}
+	if runtime.GOOS == "linux" || runtime.GOOS == "freebsd" {
+		for idx, device := range devices {
+			if isTestNode(device.Node) {
+				continue
+			}
+			name := fmt.Sprintf("v4l2/%d-%s.txt", idx, slugify(device.Name))
+			if err := add(name, diagCommand("v4l2-ctl", "-d", device.Node, "--all", "--list-formats-ext")); err != nil {
+				return err
+			}
+		}
+	}
+
+	if cfg.LogFile != "" {
+		if data, err := readTail(cfg.LogFile, diagLogTail); err == nil {
+			if err := add("agent.log", data); err != nil {
+				return err
+			}
+		}
+	}
+
+	if agent != nil {
+		if err := agent.addDiagState(add, addJSON); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func (a *Agent) addDiagState(add func(string, []byte) error, addJSON func(string, interface{}) error) error {
+	a.mu.Lock()
+	cameras := make([]Camera, 0, len(a.cameras))
+	for _, cam := range a.cameras {
+		cameras = append(cameras, *cam)
+	}
+	a.mu.Unlock()
+
+	if err := addJSON("cameras.json", cameras); err != nil {
+		return err
+	}
+	if err := addJSON("system.json", a.systemTelemetry()); err != nil {
+		return err
+	}
+	events := a.events.List("", 0)
+	if err := addJSON("events.json", events); err != nil {
+		return err
+	}
+
+	type cameraErrors struct {
+		LastPublisherError *Event    `json:"lastPublisherError,omitempty"`
+		ErrorLines         []LogLine `json:"errorLines"`
+	}
+	errs := map[string]*cameraErrors{}
+	for _, cam := range cameras {
+		entry := &cameraErrors{ErrorLines: []LogLine{}}
+		lines := a.cameraLog(cam.DeviceUID).Lines()
+		var text strings.Builder
+		for _, line := range lines {
+			fmt.Fprintf(&text, "%s %s\n", line.Time.Format(time.RFC3339), line.Line)
+			if outputLineLevel(line.Line) == levelError {
+				entry.ErrorLines = append(entry.ErrorLines, line)
+			}
+		}
+		if err := add("logs/"+slugify(cam.DeviceUID)+".log", []byte(text.String())); err != nil {
+			return err
+		}
+		errs[cam.DeviceUID] = entry
+	}
+	for idx := range events {
+		event := events[idx]
+		if entry := errs[event.DeviceUID]; entry != nil && event.Type == "publisher_error" {
+			entry.LastPublisherError = &event
+		}
+	}
+	return addJSON("errors.json", errs)
+}
+
+// sanitizedConfig lists every option that is set, with secrets replaced and
+// credentials stripped from URLs.
+func sanitizedConfig() string {
+	var b strings.Builder
+	for _, option := range configOptions {
+		value, ok := os.LookupEnv(option.Env)
+		if option.Secret {
+			if path := os.Getenv(option.Env + "_FILE"); path != "" {
+				fmt.Fprintf(&b, "%s_FILE=%s\n", option.Env, path)
+			}
+			if ok && value != "" {
+				value = "<redacted>"
+			}
+		} else if strings.Contains(value, "://") {
+			value = redactURL(value)
+		}
+		if ok {
+			fmt.Fprintf(&b, "%s=%s\n", option.Env, value)
+		}
+	}
+	return b.String()
+}
+
+// diagCommand runs a command and returns its output, or the error in its
+// place, since a missing tool is itself useful to know.
+func diagCommand(name string, args ...string) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), diagCommandTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		out = append(out, fmt.Sprintf("\n%s: %v\n", name, err)...)
+	}
+	return out
+}
+
+func readTail(path string, size int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > size {
+		if _, err := f.Seek(-size, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+	return io.ReadAll(f)
+}
+
+func diagFileName(hostname string) string {
+	return fmt.Sprintf("camhub-diag-%s-%s.zip", slugify(hostname), time.Now().Format("20060102-150405"))
+}
+
+func runDiag(cfg Config, args []string) int {
+	hostname, _ := os.Hostname()
+	path := diagFileName(hostname)
+	if len(args) > 0 {
+		path = args[0]
+	}
+
+	var out io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := writeDiagBundle(out, cfg, nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if path != "-" {
+		fmt.Fprintln(os.Stderr, "wrote", path)
+	}
+	return 0
+}
+
+// handleDiag streams the diagnostics bundle of the running agent.
+func (a *Agent) handleDiag(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", diagFileName(a.hostname)))
+	if err := writeDiagBundle(w, *a.config(), a); err != nil {
+		logWarn("diagnostics bundle failed: %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !freebsd && !darwin
+
+package main
+
+func diskFree(path string) (uint64, bool) {
+	return 0, false
+}
+
+func diskSpace(path string) (free, total uint64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,22 @@
+//go:build linux || freebsd || darwin
+
+package main
+
+import "syscall"
+
+func diskFree(path string) (uint64, bool) {
+	free, _, ok := diskSpace(path)
+	return free, ok
+}
+
+// diskSpace returns the bytes available to the agent and the size of the
+// filesystem holding path. Like df, the total leaves out blocks reserved for
+// root so a full disk reads as 100%.
+func diskSpace(path string) (free, total uint64, ok bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, false
+	}
+	used := uint64(st.Blocks) - uint64(st.Bfree)
+	return uint64(st.Bavail) * uint64(st.Bsize), (used + uint64(st.Bavail)) * uint64(st.Bsize), true
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// diskGuardLoop watches free space on the recording volume. Below
+// DISK_MIN_FREE_MB it prunes the oldest finished segments and, when nothing
+// is left to prune, pauses recording until space comes back. Passing
+// DISK_WARN_PERCENT raises a warning event and heartbeat flag.
+func (a *Agent) diskGuardLoop() {
+	for {
+		a.checkDisk()
+		time.Sleep(a.config().DiskCheckInterval)
+	}
+}
+
+func (a *Agent) checkDisk() {
+	cfg := a.config()
+	dir := cfg.RecordingDir
+	if _, err := os.Stat(dir); err != nil {
+		return
+	}
+	free, total, ok := diskSpace(dir)
+	if !ok || total == 0 {
+		return
+	}
+	minFree := uint64(cfg.DiskMinFreeMB) * 1024 * 1024
+
+	if free < minFree && cfg.DiskPrune {
+		pruned, freed := pruneRecordings(dir, cfg.RecordingSegment, minFree-free)
+		if pruned > 0 {
+			logWarn("disk low on %s: pruned %d recording(s), %d MB", dir, pruned, freed/(1024*1024))
+			a.emit("recordings_pruned", "", map[string]interface{}{"files": pruned, "bytes": freed})
+			free, total, _ = diskSpace(dir)
+		}
+	}
+	usedPercent := float64(total-free) * 100 / float64(total)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	warning := usedPercent >= float64(cfg.DiskWarnPercent) || free < minFree
+	if warning != a.diskWarning {
+		a.diskWarning = warning
+		data := map[string]interface{}{"path": dir, "freeBytes": free, "usedPercent": usedPercent}
+		if warning {
+			logWarn("disk usage on %s at %.1f%%, %d MB free", dir, usedPercent, free/(1024*1024))
+			a.emit("disk_warning", "", data)
+		} else {
+			logInfo("disk usage on %s back to %.1f%%", dir, usedPercent)
+			a.emit("disk_ok", "", data)
+		}
+	}
+
+	switch {
+	case free < minFree && !a.recordingPaused:
+		logError("recording paused: %d MB free on %s, below %d MB", free/(1024*1024), dir, cfg.DiskMinFreeMB)
+		a.recordingPaused = true
+		for uid := range a.recorders {
+			a.stopRecorderLocked(uid)
+		}
+		a.emit("recording_paused", "", map[string]interface{}{"freeBytes": free})
+	case free >= minFree && a.recordingPaused:
+		logInfo("recording resumed: %d MB free on %s", free/(1024*1024), dir)
+		a.recordingPaused = false
+		for _, cam := range a.cameras {
+			if cam.Record && a.activeLocked(cam) {
+				a.ensureRecorderLocked(cam)
+			}
+		}
+		a.emit("recording_resumed", "", nil)
+	}
+}
+
+// pruneRecordings deletes the oldest finished segments across all cameras
+// until need bytes are freed. Segments still being written are kept.
+func pruneRecordings(root string, segment time.Duration, need uint64) (int, uint64) {
+	type candidate struct {
+		path    string
+		size    uint64
+		modTime time.Time
+	}
+	var candidates []candidate
+	dirs, err := os.ReadDir(root)
+	if err != nil {
+		return 0, 0
+	}
+	for _, entry := range dirs {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		names, err := completedSegments(dir, segment)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			info, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				continue
+			}
+			candidates = append(candidates, candidate{filepath.Join(dir, name), uint64(info.Size()), info.ModTime()})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].modTime.Before(candidates[j].modTime)
+	})
+
+	pruned, freed := 0, uint64(0)
+	for _, c := range candidates {
+		if freed >= need {
+			break
+		}
+		if err := os.Remove(c.path); err != nil {
+			logWarn("prune %s: %v", c.path, err)
+			continue
+		}
+		pruned++
+		freed += c.size
+	}
+	return pruned, freed
+}
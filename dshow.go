@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+var (
+	dshowPrefix  = regexp.MustCompile(`^\[dshow @ [0-9a-fA-Fx]+\]\s?`)
+	dshowDevice  = regexp.MustCompile(`^\s*"(.+)"(?:\s+\(([a-z, ]+)\))?$`)
+	dshowAltName = regexp.MustCompile(`^\s*Alternative name "(.+)"$`)
+)
+
+// captureFormat is the ffmpeg input format for local cameras.
+func captureFormat() string {
+	if runtime.GOOS == "windows" {
+		return "dshow"
+	}
+	return "v4l2"
+}
+
+// captureInput returns the ffmpeg arguments that open a camera node. On
+// Windows the node is a DirectShow spec such as "video=HD Webcam". Test
+// sources are read at their native rate, as a camera would deliver them.
+func captureInput(node string) []string {
+	if isTestNode(node) {
+		return []string{"-re", "-f", "lavfi", "-i", strings.TrimPrefix(node, testNodePrefix)}
+	}
+	return []string{"-f", captureFormat(), "-i", node}
+}
+
+// discoverDshowDevices lists DirectShow video devices using ffmpeg, which
+// prints them on stderr and then exits with an error for the dummy input.
+func discoverDshowDevices(ffmpegPath string) []DeviceInfo {
+	out, _ := exec.Command(ffmpegPath, "-hide_banner", "-list_devices", "true", "-f", "dshow", "-i", "dummy").CombinedOutput()
+	return parseDshowDevices(string(out))
+}
+
+// parseDshowDevices understands both the per-device "(video)" suffix printed
+// by current ffmpeg and the older "DirectShow video devices" section headers.
+// The alternative name is the device path, which is stable across reboots
+// and tells apart identically named cameras.
+func parseDshowDevices(output string) []DeviceInfo {
+	var devices []DeviceInfo
+	section := ""
+	lastVideo := -1
+	for _, line := range strings.Split(strings.ReplaceAll(output, "\r\n", "\n"), "\n") {
+		line = dshowPrefix.ReplaceAllString(line, "")
+		switch {
+		case strings.Contains(line, "DirectShow video devices"):
+			section = "video"
+			continue
+		case strings.Contains(line, "DirectShow audio devices"):
+			section = "audio"
+			continue
+		}
+
+		if m := dshowAltName.FindStringSubmatch(line); m != nil {
+			if lastVideo >= 0 {
+				devices[lastVideo].ID = m[1]
+			}
+			continue
+		}
+		m := dshowDevice.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		kind := section
+		if m[2] != "" {
+			kind = m[2]
+		}
+		if !strings.Contains(kind, "video") {
+			lastVideo = -1
+			continue
+		}
+		devices = append(devices, DeviceInfo{Name: m[1], Node: "video=" + m[1]})
+		lastVideo = len(devices) - 1
+	}
+
+	names := map[string]int{}
+	for _, device := range devices {
+		names[device.Name]++
+	}
+	for idx, device := range devices {
+		if names[device.Name] > 1 && device.ID != "" {
+			devices[idx].Node = "video=" + device.ID
+		}
+		devices[idx].Nodes = []string{devices[idx].Node}
+	}
+	return devices
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const defaultGOP = 10
+
+// x264Tunes are the libx264 -tune values accepted per camera; "none" leaves
+// the tune unset.
+var x264Tunes = map[string]bool{
+	"zerolatency": true, "film": true, "animation": true, "grain": true,
+	"stillimage": true, "fastdecode": true, "psnr": true, "ssim": true, "none": true,
+}
+
+var rtBufSizePattern = regexp.MustCompile(`^[1-9][0-9]*[KMG]?$`)
+
+// EncoderTuning trades latency against quality for one camera. Zero values
+// keep the low-latency defaults: a 10-frame GOP, no B-frames, zerolatency.
+type EncoderTuning struct {
+	GOP     int    `json:"gop,omitempty"`
+	BFrames int    `json:"bframes,omitempty"`
+	Tune    string `json:"tune,omitempty"`
+	// RtBufSize is ffmpeg's capture buffer, e.g. "100M", for devices that
+	// drop frames when the encoder falls behind.
+	RtBufSize string `json:"rtbufsize,omitempty"`
+}
+
+func (t EncoderTuning) validate() error {
+	switch {
+	case t.GOP < 0 || t.GOP > 600:
+		return fmt.Errorf("gop must be between 1 and 600, or 0 for the default of %d", defaultGOP)
+	case t.BFrames < 0 || t.BFrames > 16:
+		return fmt.Errorf("bframes must be between 0 and 16")
+	case t.Tune != "" && !x264Tunes[t.Tune]:
+		return fmt.Errorf("unknown tune %q", t.Tune)
+	case t.RtBufSize != "" && !rtBufSizePattern.MatchString(t.RtBufSize):
+		return fmt.Errorf("rtbufsize must be a size such as 100M: %q", t.RtBufSize)
+	}
+	return nil
+}
+
+// x264Args returns the encoder options for a camera's tuning at the preset
+// its quality level calls for. Baseline profile has no B-frames, so asking
+// for them switches to main.
+func x264Args(t EncoderTuning, preset string) []string {
+	gop := t.GOP
+	if gop == 0 {
+		gop = defaultGOP
+	}
+	tune := t.Tune
+	if tune == "" {
+		tune = "zerolatency"
+	}
+	profile := "baseline"
+	if t.BFrames > 0 {
+		profile = "main"
+	}
+
+	args := []string{"-c:v", "libx264", "-preset", preset}
+	if tune != "none" {
+		args = append(args, "-tune", tune)
+	}
+	return append(args,
+		"-g", strconv.Itoa(gop),
+		"-keyint_min", strconv.Itoa(gop),
+		"-sc_threshold", "0",
+		"-bf", strconv.Itoa(t.BFrames),
+		"-profile:v", profile,
+		"-level:v", "3.1",
+		"-pix_fmt", "yuv420p",
+	)
+}
+
+const maxOverrideArgs = 32
+
+// FFmpegOverrides are per-camera escape hatches for devices the generated
+// publisher command cannot handle, such as thermal cameras with unusual
+// pixel formats. InputArgs go before -i, Filters run first in the filter
+// chain and OutputArgs go after the encoder options of every rendition.
+// They apply to the ffmpeg backend only. Since they can make ffmpeg read
+// and write arbitrary files, they come from OVERRIDES_FILE and cannot be
+// set through the API.
+type FFmpegOverrides struct {
+	InputArgs  []string `json:"inputArgs,omitempty"`
+	Filters    string   `json:"filters,omitempty"`
+	OutputArgs []string `json:"outputArgs,omitempty"`
+}
+
+func (o FFmpegOverrides) validate() error {
+	for _, args := range [][]string{o.InputArgs, o.OutputArgs} {
+		if len(args) > maxOverrideArgs {
+			return fmt.Errorf("at most %d extra arguments are allowed", maxOverrideArgs)
+		}
+		for _, arg := range args {
+			if arg == "" || strings.ContainsAny(arg, "\r\n\x00") {
+				return fmt.Errorf("invalid extra argument %q", arg)
+			}
+		}
+	}
+	// The chain is spliced into a larger graph when a substream is split
+	// off, so it must stay a single unlabelled chain.
+	if strings.ContainsAny(o.Filters, ";[]\r\n") {
+		return fmt.Errorf("filters must be a single filter chain without labels")
+	}
+	return nil
+}
+
+// loadOverrides reads the JSON object in OVERRIDES_FILE, keyed by device
+// UID, device ID or node, e.g. {"/dev/video2": {"inputArgs": ["-input_format", "gray16le"]}}.
+func loadOverrides(path string) (map[string]FFmpegOverrides, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var listed map[string]FFmpegOverrides
+	if err := json.Unmarshal(data, &listed); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for key, overrides := range listed {
+		overrides.Filters = strings.TrimSpace(overrides.Filters)
+		if err := overrides.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %q: %w", path, key, err)
+		}
+		listed[key] = overrides
+	}
+	return listed, nil
+}
+
+// overridesFor looks a camera up in OVERRIDES_FILE by its device UID, then
+// by the device ID or node the UID is made of.
+func (a *Agent) overridesFor(deviceUID, node string) FFmpegOverrides {
+	listed := a.config().Overrides
+	for _, key := range []string{deviceUID, strings.TrimPrefix(deviceUID, a.agentID+":"), node} {
+		if overrides, ok := listed[key]; ok {
+			return overrides
+		}
+	}
+	return FFmpegOverrides{}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestEncoderTuningValidate(t *testing.T) {
+	tests := []struct {
+		tuning EncoderTuning
+		err    string
+	}{
+		{EncoderTuning{}, ""},
+		{EncoderTuning{GOP: 1, BFrames: 16, Tune: "none", RtBufSize: "100M"}, ""},
+		{EncoderTuning{GOP: 600}, ""},
+		{EncoderTuning{GOP: -1}, "gop must be between 1 and 600, or 0 for the default of 10"},
+		{EncoderTuning{GOP: 601}, "gop must be between 1 and 600, or 0 for the default of 10"},
+		{EncoderTuning{BFrames: 17}, "bframes must be between 0 and 16"},
+		{EncoderTuning{Tune: "fast"}, `unknown tune "fast"`},
+		{EncoderTuning{RtBufSize: "100MB"}, `rtbufsize must be a size such as 100M: "100MB"`},
+	}
+	for _, tt := range tests {
+		err := tt.tuning.validate()
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("%+v.validate() = %q, want %q", tt.tuning, got, tt.err)
+		}
+	}
+}
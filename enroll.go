@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// claimAlphabet avoids characters that are easy to misread (0/O, 1/I/L).
+const claimAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+type enrollReply struct {
+	Status string `json:"status"`
+	Token  string `json:"token"`
+}
+
+func newClaimCode() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	code := make([]byte, 0, 9)
+	for idx, v := range b {
+		if idx == 4 {
+			code = append(code, '-')
+		}
+		code = append(code, claimAlphabet[int(v)%len(claimAlphabet)])
+	}
+	return string(code), nil
+}
+
+// enrollLoop offers a claim code to the hub and polls until an admin
+// approves it. The token the hub then issues is persisted and used for all
+// later hub requests. A rejected or expired code is replaced with a new one.
+func (a *Agent) enrollLoop() {
+	for {
+		code, err := newClaimCode()
+		if err != nil {
+			logError("claim code error: %v", err)
+			return
+		}
+		a.mu.Lock()
+		a.claimCode = code
+		a.mu.Unlock()
+		logInfo("enrollment pending: approve claim code %s in the hub", code)
+		a.emit("enrollment_pending", "", map[string]interface{}{"claimCode": code})
+
+		for {
+			reply, err := a.pollEnrollment(code)
+			if err != nil {
+				logWarn("enrollment poll failed: %v", err)
+			} else if reply.Status == "approved" && reply.Token != "" {
+				a.saveEnrolledToken(reply.Token)
+				a.mu.Lock()
+				a.enrolling = false
+				a.claimCode = ""
+				a.mu.Unlock()
+				logInfo("enrollment approved")
+				a.emit("enrollment_approved", "", nil)
+				a.registerCameras()
+				return
+			} else if reply.Status == "rejected" || reply.Status == "expired" {
+				logInfo("claim code %s %s", code, reply.Status)
+				break
+			}
+			time.Sleep(a.config().EnrollPollInterval)
+		}
+	}
+}
+
+// saveEnrolledToken persists the token from an approved enrollment. The hub
+// hands it out once, so a failed write is retried until it succeeds instead
+// of losing the enrollment; the agent stays pending meanwhile.
+func (a *Agent) saveEnrolledToken(token string) {
+	for failed := false; ; failed = true {
+		err := a.storeHubToken(token)
+		if err == nil {
+			if failed {
+				logInfo("hub token saved")
+			}
+			return
+		}
+		if !failed {
+			logError("saving hub token failed, retrying: %v", err)
+		}
+		time.Sleep(a.config().EnrollPollInterval)
+	}
+}
+
+func (a *Agent) pollEnrollment(code string) (enrollReply, error) {
+	var reply enrollReply
+	cfg := a.config()
+	body, _ := json.Marshal(map[string]interface{}{
+		"agentId":   a.agentID,
+		"host":      a.hostname,
+		"claimCode": code,
+		"version":   versionInfo(),
+	})
+	req, err := a.newHubRequest(hubTarget{URL: cfg.CamhubURL, Primary: true}, http.MethodPost, "/api/agents/enroll", body)
+	if err != nil {
+		return reply, err
+	}
+
+	client := &http.Client{Timeout: cfg.RegisterTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return reply, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(res.Body)
+		return reply, fmt.Errorf("%s %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	err = json.NewDecoder(res.Body).Decode(&reply)
+	return reply, err
+}
+
+// enrollmentPendingLocked reports whether the agent is waiting for approval
+// and so has no credentials for the hub yet.
+func (a *Agent) enrollmentPendingLocked() bool {
+	return a.enrolling
+}
+
+func (a *Agent) handleEnrollment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	a.mu.Lock()
+	code := a.claimCode
+	a.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enrolled":  a.hubToken() != "",
+		"claimCode": code,
+	})
+}
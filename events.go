@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventLogSize        = 500
+	eventSubscriberSize = 64
+	eventKeepAlive      = 15 * time.Second
+)
+
+type Event struct {
+	ID        int64                  `json:"id"`
+	Type      string                 `json:"type"`
+	DeviceUID string                 `json:"deviceUid,omitempty"`
+	Time      time.Time              `json:"ts"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// EventLog keeps the most recent agent events in memory for the local API
+// and fans new events out to live subscribers.
+type EventLog struct {
+	mu          sync.Mutex
+	nextID      int64
+	events      []Event
+	subscribers map[chan Event]struct{}
+}
+
+func NewEventLog() *EventLog {
+	return &EventLog{
+		events:      make([]Event, 0, eventLogSize),
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+func (l *EventLog) Add(eventType, deviceUID string, data map[string]interface{}) Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.nextID++
+	event := Event{
+		ID:        l.nextID,
+		Type:      eventType,
+		DeviceUID: deviceUID,
+		Time:      time.Now(),
+		Data:      data,
+	}
+	if len(l.events) >= eventLogSize {
+		copy(l.events, l.events[1:])
+		l.events = l.events[:len(l.events)-1]
+	}
+	l.events = append(l.events, event)
+
+	// Slow subscribers miss events rather than stalling the agent.
+	for ch := range l.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+	return event
+}
+
+// Subscribe registers a live listener. The returned function unsubscribes.
+func (l *EventLog) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventSubscriberSize)
+	l.mu.Lock()
+	l.subscribers[ch] = struct{}{}
+	l.mu.Unlock()
+
+	return ch, func() {
+		l.mu.Lock()
+		delete(l.subscribers, ch)
+		l.mu.Unlock()
+	}
+}
+
+// List returns events newer than since, optionally limited to one camera.
+func (l *EventLog) List(deviceUID string, since int64) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	list := make([]Event, 0)
+	for _, event := range l.events {
+		if event.ID <= since {
+			continue
+		}
+		if deviceUID != "" && event.DeviceUID != deviceUID {
+			continue
+		}
+		list = append(list, event)
+	}
+	return list
+}
+
+func (a *Agent) emit(eventType, deviceUID string, data map[string]interface{}) {
+	event := a.events.Add(eventType, deviceUID, data)
+	if historyEvents[eventType] {
+		a.history.push(event)
+	}
+}
+
+func (a *Agent) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var since int64
+	value := r.URL.Query().Get("since")
+	if value == "" {
+		value = r.Header.Get("Last-Event-ID")
+	}
+	if value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid since"})
+			return
+		}
+		since = n
+	}
+
+	deviceUID := r.URL.Query().Get("deviceUid")
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		a.streamEvents(w, r, deviceUID, since)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.events.List(deviceUID, since))
+}
+
+// streamEvents serves events as server-sent events: the backlog after since
+// first, then live events until the client disconnects.
+func (a *Agent) streamEvents(w http.ResponseWriter, r *http.Request, deviceUID string, since int64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "stream unsupported"})
+		return
+	}
+
+	live, unsubscribe := a.events.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	lastID := since
+	send := func(event Event) {
+		if event.ID <= lastID {
+			return
+		}
+		lastID = event.ID
+		if deviceUID != "" && event.DeviceUID != deviceUID {
+			return
+		}
+		data, _ := json.Marshal(event)
+		_, _ = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.ID, data)
+	}
+
+	if since > 0 {
+		for _, event := range a.events.List(deviceUID, since) {
+			send(event)
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-live:
+			send(event)
+			flusher.Flush()
+		case <-keepAlive.C:
+			_, _ = fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// FFmpegCaps is what the local ffmpeg build supports, probed once at startup
+// so impossible camera settings are refused up front instead of failing with
+// ffmpeg's stderr at stream time.
+type FFmpegCaps struct {
+	Version  string   `json:"version"`
+	Encoders []string `json:"encoders"`
+	Demuxers []string `json:"demuxers"`
+	Muxers   []string `json:"muxers"`
+	// Hardware lists the H.264 hardware encoders that are compiled in.
+	Hardware []string `json:"hardware"`
+}
+
+// interestingEncoders are the encoders reported to the hub. Reporting every
+// encoder of a full build would add a few kilobytes to each heartbeat.
+var interestingEncoders = []string{
+	"libx264", "h264_vaapi", "h264_nvenc", "h264_qsv", "h264_v4l2m2m",
+	"h264_videotoolbox", "h264_amf", "h264_mf", "mjpeg", "aac", "libopus",
+}
+
+// probeFFmpeg runs ffmpeg with -version, -encoders, -demuxers and -muxers.
+func probeFFmpeg(ffmpegPath string) (*FFmpegCaps, error) {
+	out, err := exec.Command(ffmpegPath, "-hide_banner", "-version").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", ffmpegPath, err)
+	}
+	caps := &FFmpegCaps{Version: strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])}
+
+	lists := []struct {
+		flag string
+		dest *[]string
+	}{
+		{"-encoders", &caps.Encoders},
+		{"-demuxers", &caps.Demuxers},
+		{"-muxers", &caps.Muxers},
+	}
+	for _, list := range lists {
+		out, err := exec.Command(ffmpegPath, "-hide_banner", list.flag).Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %v", ffmpegPath, list.flag, err)
+		}
+		*list.dest = parseFFmpegList(string(out))
+	}
+
+	all := caps.Encoders
+	caps.Encoders = nil
+	for _, name := range interestingEncoders {
+		if containsString(all, name) {
+			caps.Encoders = append(caps.Encoders, name)
+			if strings.HasPrefix(name, "h264_") {
+				caps.Hardware = append(caps.Hardware, name)
+			}
+		}
+	}
+	return caps, nil
+}
+
+// parseFFmpegList reads the names from ffmpeg's -encoders, -demuxers and
+// -muxers tables. Rows follow a dashed separator line and start with a flags
+// column; formats may list several comma-separated names, as in "mov,mp4".
+func parseFFmpegList(output string) []string {
+	var names []string
+	started := false
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if !started {
+			started = len(fields) > 0 && strings.HasPrefix(fields[0], "--")
+			continue
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		names = append(names, strings.Split(fields[1], ",")...)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *FFmpegCaps) hasEncoder(name string) bool { return containsString(c.Encoders, name) }
+func (c *FFmpegCaps) hasDemuxer(name string) bool { return containsString(c.Demuxers, name) }
+func (c *FFmpegCaps) hasMuxer(name string) bool   { return containsString(c.Muxers, name) }
+
+// checkCamera reports why this ffmpeg cannot publish a camera, or nil when it
+// can with the given encoding profile. Cameras on other backends are not
+// checked.
+func (c *FFmpegCaps) checkCamera(camera *Camera, profile EncodingProfile) error {
+	if c == nil || camera.Backend != backendFFmpeg {
+		return nil
+	}
+	input := captureFormat()
+	if isTestNode(camera.Node) {
+		input = "lavfi"
+	}
+	if !c.hasDemuxer(input) {
+		return fmt.Errorf("ffmpeg has no %s input support", input)
+	}
+	switch {
+	case profile.isCopy():
+	case profile.isX264():
+		if !c.hasEncoder("libx264") {
+			return fmt.Errorf("ffmpeg was built without libx264")
+		}
+	case containsString(interestingEncoders, profile.Encoder) && !c.hasEncoder(profile.Encoder):
+		// Only the encoders the probe keeps can be checked.
+		return fmt.Errorf("ffmpeg has no %s encoder", profile.Encoder)
+	}
+	muxer := "rtsp"
+	switch camera.Output {
+	case outputSRT:
+		muxer = "mpegts"
+	case outputWHIP:
+		muxer = "whip"
+	case outputRTMP:
+		muxer = "flv"
+	}
+	if !c.hasMuxer(muxer) {
+		return fmt.Errorf("ffmpeg has no %s output support", muxer)
+	}
+	return nil
+}
+
+// refreshFFmpegCaps records the capabilities of the configured ffmpeg.
+func (a *Agent) refreshFFmpegCaps() {
+	caps, err := probeFFmpeg(a.config().FfmpegPath)
+	if err != nil {
+		logWarn("ffmpeg probe failed, camera settings are not checked: %v", err)
+		a.ffmpegCaps.Store(nil)
+		return
+	}
+	hardware := "none"
+	if len(caps.Hardware) > 0 {
+		hardware = strings.Join(caps.Hardware, ", ")
+	}
+	logInfo("ffmpeg: %s (hardware encoders: %s)", caps.Version, hardware)
+	a.ffmpegCaps.Store(caps)
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type configOption struct {
+	Env    string
+	Usage  string
+	IsBool bool
+	// Secret options can also be read from the file named by <Env>_FILE,
+	// e.g. a Docker secret or a systemd credential.
+	Secret bool
+}
+
+// configOptions lists every environment variable that can also be given as a
+// command-line flag. The flag name is the lowercased key with dashes, e.g.
+// CAMHUB_URL becomes --camhub-url.
+var configOptions = []configOption{
+	{Env: "CAMHUB_URL", Usage: "hub base URL"},
+	{Env: "AUTH_TOKEN", Usage: "bearer token for hub requests", Secret: true},
+	{Env: "CAMHUB_URLS", Usage: "comma-separated additional hub URLs"},
+	{Env: "CAMHUB_TOKENS", Usage: "comma-separated tokens for CAMHUB_URLS, in order", Secret: true},
+	{Env: "PROXY_URL", Usage: "proxy for hub and upload traffic when HTTP(S)_PROXY is unset", Secret: true},
+	{Env: "MEDIAMTX_RTSP_BASE", Usage: "MediaMTX RTSP base URL"},
+	{Env: "HEARTBEAT_MS", Usage: "hub registration interval"},
+	{Env: "DISCOVERY_INTERVAL_MS", Usage: "camera discovery interval"},
+	{Env: "FFMPEG_PATH", Usage: "ffmpeg binary"},
+	{Env: "AGENT_ADDR", Usage: "comma-separated local HTTP listen addresses (host:port, [ipv6]:port or unix:///path.sock), each optionally ?cert=...&key=... for HTTPS"},
+	{Env: "BASE_PATH", Usage: "URL prefix the UI and API are served under, e.g. /agents/garage"},
+	{Env: "CORS_ORIGINS", Usage: "comma-separated origins allowed to call /api from a browser (* for any)"},
+	{Env: "CORS_METHODS", Usage: "comma-separated methods allowed in CORS requests"},
+	{Env: "CORS_HEADERS", Usage: "comma-separated request headers allowed in CORS requests"},
+	{Env: "STATE_FILE", Usage: "state location; settings live in a .db file beside it"},
+	{Env: "AGENT_ID", Usage: "override the persisted agent UUID"},
+	{Env: "RESTART_DELAY_MS", Usage: "delay before restarting ffmpeg"},
+	{Env: "REGISTER_USER_AGENT", Usage: "User-Agent for hub requests"},
+	{Env: "REGISTER_TIMEOUT_MS", Usage: "hub registration timeout"},
+	{Env: "MOTION_ENABLED", Usage: "enable motion detection", IsBool: true},
+	{Env: "MOTION_SOURCE", Usage: "motion input: rtsp or device"},
+	{Env: "MOTION_FPS", Usage: "motion analysis frame rate"},
+	{Env: "MOTION_WIDTH", Usage: "motion analysis width"},
+	{Env: "MOTION_HEIGHT", Usage: "motion analysis height"},
+	{Env: "MOTION_THRESHOLD", Usage: "mean pixel difference that counts as motion"},
+	{Env: "MOTION_CONSECUTIVE", Usage: "changed frames needed to start motion"},
+	{Env: "MOTION_COOLDOWN_MS", Usage: "quiet period before motion stops"},
+	{Env: "MOTION_TIMEOUT_MS", Usage: "motion event request timeout"},
+	{Env: "SNAPSHOT_TIMEOUT_MS", Usage: "snapshot capture timeout"},
+	{Env: "PUBLISH_OUTPUT", Usage: "default output: rtsp, whip or srt"},
+	{Env: "MEDIAMTX_WHIP_BASE", Usage: "MediaMTX WHIP base URL"},
+	{Env: "MEDIAMTX_SRT_BASE", Usage: "MediaMTX SRT base URL"},
+	{Env: "SRT_LATENCY_MS", Usage: "SRT latency"},
+	{Env: "SRT_PASSPHRASE", Usage: "SRT encryption passphrase", Secret: true},
+	{Env: "RECORDING_ENABLED", Usage: "record enabled cameras by default", IsBool: true},
+	{Env: "RECORDING_DIR", Usage: "recording directory"},
+	{Env: "RECORDING_SEGMENT_MS", Usage: "recording segment length"},
+	{Env: "RECORDING_FORMAT", Usage: "recording container: mp4 or mkv"},
+	{Env: "RECORDING_MODE", Usage: "continuous, or motion to save only motion clips (needs MOTION_ENABLED)"},
+	{Env: "RECORDING_PREROLL_MS", Usage: "video kept from before the motion trigger in motion clips"},
+	{Env: "UPLOAD_ENABLED", Usage: "upload recordings to S3", IsBool: true},
+	{Env: "UPLOAD_INTERVAL_MS", Usage: "upload scan interval"},
+	{Env: "UPLOAD_TIMEOUT_MS", Usage: "upload request timeout"},
+	{Env: "UPLOAD_RETRIES", Usage: "upload retries per segment"},
+	{Env: "UPLOAD_DELETE_AFTER", Usage: "delete segments after upload", IsBool: true},
+	{Env: "S3_ENDPOINT", Usage: "S3 endpoint URL"},
+	{Env: "S3_REGION", Usage: "S3 region"},
+	{Env: "S3_BUCKET", Usage: "S3 bucket"},
+	{Env: "S3_PREFIX", Usage: "S3 key prefix"},
+	{Env: "S3_ACCESS_KEY", Usage: "S3 access key", Secret: true},
+	{Env: "S3_SECRET_KEY", Usage: "S3 secret key", Secret: true},
+	{Env: "S3_PATH_STYLE", Usage: "use path-style S3 URLs", IsBool: true},
+	{Env: "DEVICE_INCLUDE", Usage: "comma-separated device patterns to include"},
+	{Env: "DEVICE_EXCLUDE", Usage: "comma-separated device patterns to exclude"},
+	{Env: "OVERLAY_FONT", Usage: "font file for the timestamp overlay"},
+	{Env: "CAMERA_LOG_LINES", Usage: "ffmpeg log lines kept per camera"},
+	{Env: "API_TOKEN", Usage: "bearer token for protected local endpoints", Secret: true},
+	{Env: "API_CREDENTIALS", Usage: "comma-separated name:role:token credentials (roles admin, viewer); enforces roles on the whole API", Secret: true},
+	{Env: "PPROF_ENABLED", Usage: "mount /debug/pprof", IsBool: true},
+	{Env: "PUBLISH_STAGGER_MS", Usage: "minimum gap between publisher starts"},
+	{Env: "MAX_PUBLISHERS", Usage: "maximum concurrent publishers (0 = unlimited)"},
+	{Env: "MAX_CPU_LOAD", Usage: "load average per CPU above which publishers queue"},
+	{Env: "MEDIAMTX_API_BASE", Usage: "MediaMTX control API URL (enables reader counts)"},
+	{Env: "MEDIAMTX_API_USER", Usage: "MediaMTX control API user"},
+	{Env: "MEDIAMTX_API_PASS", Usage: "MediaMTX control API password", Secret: true},
+	{Env: "MEDIAMTX_POLL_MS", Usage: "MediaMTX API poll interval"},
+	{Env: "ON_DEMAND", Usage: "only publish while a stream has readers", IsBool: true},
+	{Env: "ON_DEMAND_IDLE_MS", Usage: "idle time before an on-demand publisher stops"},
+	{Env: "MEDIAMTX_MANAGED", Usage: "launch and supervise a local MediaMTX", IsBool: true},
+	{Env: "MEDIAMTX_BINARY", Usage: "MediaMTX binary for managed mode"},
+	{Env: "MEDIAMTX_VERSION", Usage: "MediaMTX release to download when the binary is missing"},
+	{Env: "MEDIAMTX_SHA256", Usage: "expected SHA-256 of the MediaMTX release archive; default: the release's checksums file"},
+	{Env: "RTSP_SERVER", Usage: "serve streams from the built-in RTSP server instead of MediaMTX", IsBool: true},
+	{Env: "RTSP_SERVER_ADDR", Usage: "built-in RTSP server listen address"},
+	{Env: "PUBLISH_BACKEND", Usage: "default publisher backend: ffmpeg or gstreamer"},
+	{Env: "GST_LAUNCH_PATH", Usage: "gst-launch-1.0 binary"},
+	{Env: "GST_ENCODER", Usage: "GStreamer H.264 encoder element and properties"},
+	{Env: "ENROLL_ENABLED", Usage: "enroll with a hub claim code when no token is set", IsBool: true},
+	{Env: "ENROLL_POLL_MS", Usage: "enrollment approval poll interval"},
+	{Env: "LOG_FILE", Usage: "write logs to this file instead of stdout"},
+	{Env: "LOG_MAX_SIZE_MB", Usage: "rotate LOG_FILE at this size (0 = no limit)"},
+	{Env: "LOG_MAX_AGE_MS", Usage: "rotate LOG_FILE at this age (0 = no limit)"},
+	{Env: "LOG_MAX_FILES", Usage: "rotated log files to keep (0 = keep all)"},
+	{Env: "LOG_OUTPUT", Usage: "log destination: stdout, syslog, journald or eventlog (Windows)"},
+	{Env: "SYSLOG_ADDR", Usage: "remote syslog server as udp://host:port or tcp://host:port (default local)"},
+	{Env: "WEBHOOK_URL", Usage: "URL to POST event notifications to", Secret: true},
+	{Env: "WEBHOOK_EVENTS", Usage: "comma-separated event types for WEBHOOK_URL (* for all)"},
+	{Env: "WEBHOOK_TEMPLATE", Usage: "text/template for the WEBHOOK_URL request body"},
+	{Env: "WEBHOOKS_FILE", Usage: "JSON file listing more webhooks ({url, events, template, headers})"},
+	{Env: "TEST_CAMERAS", Usage: "comma-separated synthetic cameras: testsrc, testsrc2, smptebars, smptehdbars, rgbtestsrc"},
+	{Env: "TEST_CAMERA_SIZE", Usage: "synthetic camera resolution"},
+	{Env: "TEST_CAMERA_FPS", Usage: "synthetic camera frame rate"},
+	{Env: "PUBLISH_USER", Usage: "user for publishing to MediaMTX (RTSP and SRT) or the built-in RTSP server, which otherwise only accepts local publishers"},
+	{Env: "PUBLISH_PASS", Usage: "password for PUBLISH_USER", Secret: true},
+	{Env: "RTSP_TLS_CA", Usage: "CA bundle for verifying an rtsps:// MediaMTX"},
+	{Env: "RTSP_TLS_CERT", Usage: "client certificate for rtsps://"},
+	{Env: "RTSP_TLS_KEY", Usage: "client certificate key for rtsps://"},
+	{Env: "RTSP_TLS_VERIFY", Usage: "verify the rtsps:// server certificate", IsBool: true},
+	{Env: "SUBSTREAM_ENABLED", Usage: "also publish a low-resolution <path>-sub rendition (ffmpeg backend)", IsBool: true},
+	{Env: "SUBSTREAM_HEIGHT", Usage: "substream height in pixels"},
+	{Env: "ABR_ENABLED", Usage: "lower publisher resolution while the host is overloaded", IsBool: true},
+	{Env: "ABR_HIGH_LOAD", Usage: "load average per CPU that triggers a quality step down"},
+	{Env: "ABR_LOW_LOAD", Usage: "load average per CPU below which quality is restored"},
+	{Env: "ABR_INTERVAL_MS", Usage: "adaptive bitrate check interval"},
+	{Env: "DISK_MIN_FREE_MB", Usage: "free space on RECORDING_DIR below which recordings are pruned or paused"},
+	{Env: "DISK_WARN_PERCENT", Usage: "RECORDING_DIR usage that raises a disk warning"},
+	{Env: "DISK_PRUNE", Usage: "delete the oldest recordings when space runs low", IsBool: true},
+	{Env: "DISK_CHECK_INTERVAL_MS", Usage: "disk space check interval"},
+	{Env: "RETENTION_MAX_AGE_MS", Usage: "delete recordings older than this, e.g. 168h (0 keeps them)"},
+	{Env: "RETENTION_MAX_SIZE_MB", Usage: "total size of all recordings above which the oldest are deleted (0 is unlimited)"},
+	{Env: "RETENTION_CAMERA_QUOTA_MB", Usage: "default per-camera recording quota (0 is unlimited)"},
+	{Env: "RETENTION_INTERVAL_MS", Usage: "how often the retention rules are applied"},
+	{Env: "EVENT_HISTORY_SIZE", Usage: "significant events kept in the state store for /api/events/history (0 disables)"},
+	{Env: "OIDC_ISSUER", Usage: "OpenID Connect issuer URL; enables single sign-on for the UI and API"},
+	{Env: "OIDC_CLIENT_ID", Usage: "OIDC client ID"},
+	{Env: "OIDC_CLIENT_SECRET", Usage: "OIDC client secret", Secret: true},
+	{Env: "OIDC_REDIRECT_URL", Usage: "OIDC callback URL registered with the provider (default: derived from the request, .../auth/callback)"},
+	{Env: "OIDC_SCOPES", Usage: "OIDC scopes to request"},
+	{Env: "OIDC_GROUPS_CLAIM", Usage: "ID token claim that lists the user's groups"},
+	{Env: "OIDC_ALLOWED_GROUPS", Usage: "groups allowed to sign in (empty allows everyone the provider signs in)"},
+	{Env: "OIDC_ADMIN_GROUPS", Usage: "groups that get the admin role; others are viewers (empty makes everyone admin)"},
+	{Env: "OIDC_SESSION_TTL_MS", Usage: "how long an OIDC sign-in lasts"},
+	{Env: "RATE_LIMIT_RPS", Usage: "requests per second each client IP may make to /api/ (0 disables)"},
+	{Env: "RATE_LIMIT_BURST", Usage: "requests a client IP may make at once before RATE_LIMIT_RPS applies"},
+	{Env: "AUTH_LOCKOUT_FAILURES", Usage: "failed sign-ins in a row that lock a client IP out (0 disables)"},
+	{Env: "AUTH_LOCKOUT_MS", Usage: "first lockout; each further lockout doubles it"},
+	{Env: "AUTH_LOCKOUT_MAX_MS", Usage: "longest lockout"},
+	{Env: "UPDATE_PUBLIC_KEYS", Usage: "comma-separated base64 Ed25519 keys that sign agent builds; empty disables self-update"},
+	{Env: "UPDATE_URL", Usage: "update manifest URL for POST /api/update; {os} and {arch} are filled in"},
+	{Env: "PUBLISHER_STOP_TIMEOUT_MS", Usage: "time a publisher gets to exit after SIGINT before it is killed"},
+	{Env: "DISCOVERY_DEBOUNCE_MS", Usage: "time a camera must stay added or removed before discovery acts on it (0 acts at once)"},
+	{Env: "DISCOVERY_WATCH", Usage: "watch /dev for cameras (Linux); polling then only runs every 5 minutes as a fallback", IsBool: true},
+	{Env: "SATELLITE_URLS", Usage: "comma-separated base URLs of other agents whose cameras this agent registers as its own"},
+	{Env: "SATELLITE_TOKEN", Usage: "API token for SATELLITE_URLS", Secret: true},
+	{Env: "SATELLITE_POLL_MS", Usage: "how often satellites' camera lists are fetched"},
+	{Env: "MDNS_ENABLED", Usage: "advertise the agent on the LAN as _camhub-agent._tcp", IsBool: true},
+	{Env: "MDNS_NAME", Usage: "mDNS instance name (default: hostname)"},
+	{Env: "HUB_DISCOVERY", Usage: "find the hub on the LAN over mDNS (_camhub._tcp) when CAMHUB_URL is not set; trusts any host answering, so only on trusted networks", IsBool: true},
+	{Env: "CLOCK_SKEW_MAX_MS", Usage: "clock difference from the primary hub above which health is degraded"},
+	{Env: "STREAM_VERIFY", Usage: "check with RTSP DESCRIBE that the media server serves each published stream", IsBool: true},
+	{Env: "THUMBNAIL_INTERVAL_MS", Usage: "post a JPEG thumbnail of each publishing camera to the hub this often (0 = off)"},
+	{Env: "THUMBNAIL_WIDTH", Usage: "thumbnail width in pixels"},
+	{Env: "THUMBNAIL_CACHE_MS", Usage: "how long /api/cameras/{uid}/thumbnail reuses a captured frame"},
+	{Env: "AUDIO_SILENCE_DB", Usage: "RMS level in dBFS below which a camera microphone counts as silent"},
+	{Env: "AUDIO_SILENCE_MS", Usage: "silence before audio_silent is raised, and between repeats (0 disables)"},
+	{Env: "TALKBACK_DEVICE", Usage: "default ALSA/OSS output device for talkback, e.g. plughw:1,0"},
+	{Env: "ONVIF_ENABLED", Usage: "answer ONVIF device and media requests under /onvif/ for NVRs", IsBool: true},
+	{Env: "ONVIF_USER", Usage: "ONVIF username (WS-Security); empty leaves ONVIF open"},
+	{Env: "ONVIF_PASS", Usage: "ONVIF password", Secret: true},
+	{Env: "PROFILES_FILE", Usage: "JSON object of named encoding profiles ({encoder, preset, height, fps, bitrateKbps})"},
+	{Env: "OVERRIDES_FILE", Usage: "JSON object of per-camera ffmpeg overrides ({inputArgs, filters, outputArgs}) keyed by device UID, ID or node"},
+}
+
+// envFlag sets its environment variable when the flag is given, so flags
+// take precedence over both the environment and .env.
+type envFlag struct {
+	env    string
+	isBool bool
+}
+
+func (f *envFlag) String() string { return "" }
+
+func (f *envFlag) Set(value string) error {
+	return os.Setenv(f.env, value)
+}
+
+func (f *envFlag) IsBoolFlag() bool { return f.isBool }
+
+func flagName(env string) string {
+	return strings.ToLower(strings.ReplaceAll(env, "_", "-"))
+}
+
+// parseFlags applies command-line flags and returns the remaining arguments.
+func parseFlags(args []string) ([]string, error) {
+	fs := flag.NewFlagSet("camhub-agent", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	for _, option := range configOptions {
+		fs.Var(&envFlag{env: option.Env, isBool: option.IsBool}, flagName(option.Env), option.Usage)
+		if option.Secret {
+			fs.Var(&envFlag{env: option.Env + "_FILE"}, flagName(option.Env+"_FILE"), "file containing "+option.Env)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return fs.Args(), nil
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprint(w, usage)
+	fmt.Fprintln(w, "\nOptions (flags override environment variables and .env):")
+	for _, option := range configOptions {
+		name := "--" + flagName(option.Env)
+		if !option.IsBool {
+			name += " value"
+		}
+		fmt.Fprintf(w, "  %-32s %s (%s)\n", name, option.Usage, option.Env)
+		if option.Secret {
+			fmt.Fprintf(w, "  %-32s file containing %s (%s_FILE)\n", "--"+flagName(option.Env+"_FILE")+" path", option.Env, option.Env)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CropRect is the region of the captured frame to keep, in pixels.
+type CropRect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// FrameGeometry crops a camera's frame to the area of interest and scales
+// it before encoding, so wide-angle cameras do not spend bandwidth on what
+// nobody watches. A zero scale dimension keeps the aspect ratio. It applies
+// to the ffmpeg backend only.
+type FrameGeometry struct {
+	Crop        *CropRect `json:"crop,omitempty"`
+	ScaleWidth  int       `json:"scaleWidth,omitempty"`
+	ScaleHeight int       `json:"scaleHeight,omitempty"`
+}
+
+func (g FrameGeometry) validate() error {
+	if c := g.Crop; c != nil {
+		if c.X < 0 || c.Y < 0 || c.Width < 2 || c.Height < 2 {
+			return fmt.Errorf("crop needs a non-negative x and y and a width and height of at least 2")
+		}
+	}
+	for _, dim := range []int{g.ScaleWidth, g.ScaleHeight} {
+		if dim < 0 || dim%2 != 0 || dim > 8192 {
+			return fmt.Errorf("scale dimensions must be even numbers up to 8192")
+		}
+	}
+	return nil
+}
+
+func (g FrameGeometry) equal(other FrameGeometry) bool {
+	if (g.Crop == nil) != (other.Crop == nil) || (g.Crop != nil && *g.Crop != *other.Crop) {
+		return false
+	}
+	return g.ScaleWidth == other.ScaleWidth && g.ScaleHeight == other.ScaleHeight
+}
+
+// filters returns the crop and scale steps of the filter chain. The crop is
+// clamped to the frame, so a rectangle drawn for a larger mode still works.
+func (g FrameGeometry) filters() []string {
+	var filters []string
+	if c := g.Crop; c != nil {
+		filters = append(filters, fmt.Sprintf("crop='min(%d,iw-%d)':'min(%d,ih-%d)':%d:%d", c.Width, c.X, c.Height, c.Y, c.X, c.Y))
+	}
+	if g.ScaleWidth > 0 || g.ScaleHeight > 0 {
+		dims := []string{"-2", "-2"}
+		if g.ScaleWidth > 0 {
+			dims[0] = fmt.Sprint(g.ScaleWidth)
+		}
+		if g.ScaleHeight > 0 {
+			dims[1] = fmt.Sprint(g.ScaleHeight)
+		}
+		filters = append(filters, "scale="+strings.Join(dims, ":"))
+	}
+	return filters
+}
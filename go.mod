@@ -1,3 +1,8 @@
 module camhub-agent
 
 go 1.21
+
+require (
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/sys v0.4.0
+)
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	backendFFmpeg    = "ffmpeg"
+	backendGStreamer = "gstreamer"
+)
+
+func normalizeBackend(value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if isValidBackend(value) {
+		return value
+	}
+	return backendFFmpeg
+}
+
+func isValidBackend(value string) bool {
+	return publisherBackends[value] != nil
+}
+
+// gstreamerArgs builds a gst-launch-1.0 pipeline equivalent to the ffmpeg
+// publisher. GST_ENCODER replaces the software x264enc with a hardware
+// element (e.g. v4l2h264enc) on boards that have one.
+func (a *Agent) gstreamerArgs(camera *Camera) []string {
+	cfg := a.config()
+	args := append([]string{"-e"}, gstSource(camera.Node)...)
+	args = append(args, "!", "videoconvert")
+	if camera.Deinterlace {
+		args = append(args, "!", "deinterlace")
+	}
+	for _, method := range gstFlipMethods(camera) {
+		args = append(args, "!", "videoflip", "method="+method)
+	}
+	if camera.Overlay {
+		args = append(args, "!", "clockoverlay", `time-format="%Y-%m-%d %H:%M:%S"`, "halignment=left", "valignment=top", "shaded-background=true")
+		if name := strings.TrimSpace(overlayUnsafe.ReplaceAllString(camera.Name, "")); name != "" {
+			args = append(args, fmt.Sprintf(`text="%s"`, name))
+		}
+	}
+	args = append(args, "!", "video/x-raw,format=I420", "!")
+	args = append(args, strings.Fields(cfg.GstEncoder)...)
+	args = append(args, "!", "video/x-h264,profile=baseline", "!", "h264parse")
+
+	switch camera.Output {
+	case outputSRT:
+		args = append(args, "!", "mpegtsmux", "!", "srtsink", "uri="+a.gstSrtURI(camera, camera.StreamPath))
+	case outputRTMP:
+		args = append(args, "!", "flvmux", "streamable=true", "!", "rtmp2sink", "location="+camera.RtmpURL)
+	case outputWHIP:
+		args = append(args,
+			"!", "rtph264pay", "config-interval=-1",
+			"!", "whipsink", fmt.Sprintf("whip-endpoint=%s/%s/whip", strings.TrimRight(cfg.MediaMtxWhipBase, "/"), camera.StreamPath),
+		)
+	default:
+		args = append(args, "!", "rtspclientsink", "location="+camera.RtspURL, "protocols=tcp")
+		if camera.PublishUser != "" {
+			args = append(args, "user-id="+camera.PublishUser, "user-pw="+camera.PublishPass)
+		}
+		if isRTSPS(camera.RtspURL) && !cfg.RtspTLSVerify {
+			args = append(args, "tls-validation-flags=0")
+		}
+	}
+	return args
+}
+
+func gstSource(node string) []string {
+	if isTestNode(node) {
+		return gstTestSource(node)
+	}
+	if runtime.GOOS == "windows" {
+		return []string{"mfvideosrc", fmt.Sprintf(`device-name="%s"`, strings.TrimPrefix(node, "video="))}
+	}
+	return []string{"v4l2src", "device=" + node}
+}
+
+func gstFlipMethods(camera *Camera) []string {
+	var methods []string
+	switch camera.Rotate {
+	case 90:
+		methods = append(methods, "clockwise")
+	case 180:
+		methods = append(methods, "rotate-180")
+	case 270:
+		methods = append(methods, "counterclockwise")
+	}
+	if camera.HFlip {
+		methods = append(methods, "horizontal-flip")
+	}
+	if camera.VFlip {
+		methods = append(methods, "vertical-flip")
+	}
+	return methods
+}
+
+// gstSrtURI is the srtsink counterpart of srtURL; srtsink takes the latency
+// in milliseconds rather than microseconds.
+func (a *Agent) gstSrtURI(camera *Camera, streamPath string) string {
+	cfg := a.config()
+	query := url.Values{}
+	query.Set("mode", "caller")
+	query.Set("streamid", srtStreamID(camera, streamPath))
+	query.Set("latency", strconv.FormatInt(cfg.SrtLatency.Milliseconds(), 10))
+	if cfg.SrtPassphrase != "" {
+		query.Set("passphrase", cfg.SrtPassphrase)
+	}
+	return strings.TrimRight(cfg.MediaMtxSrtBase, "/") + "?" + query.Encode()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGstreamerArgs(t *testing.T) {
+	device := DeviceInfo{Name: "Front", Node: testNode, ID: "test-0"}
+	tests := []struct {
+		name   string
+		setup  func(cfg *Config, cam *Camera)
+		want   [][]string
+		absent []string
+	}{
+		{
+			name: "defaults",
+			want: [][]string{
+				{"-e", "videotestsrc", "is-live=true", "pattern=ball", "!", "video/x-raw,width=640,height=480,framerate=10/1"},
+				{"!", "videoconvert", "!", "video/x-raw,format=I420", "!", "x264enc", "tune=zerolatency", "!"},
+				{"!", "rtspclientsink", "location=rtsp://127.0.0.1:8554/test-host-cam-0", "protocols=tcp"},
+			},
+			absent: []string{"videoflip", "deinterlace", "clockoverlay", "user-id=", "tls-validation-flags=0"},
+		},
+		{
+			name: "publish credentials",
+			setup: func(cfg *Config, cam *Camera) {
+				cam.PublishUser, cam.PublishPass = "pub", "secret"
+			},
+			want: [][]string{{"protocols=tcp", "user-id=pub", "user-pw=secret"}},
+		},
+		{
+			name: "transforms",
+			setup: func(cfg *Config, cam *Camera) {
+				cam.Deinterlace = true
+				cam.Rotate = 180
+				cam.HFlip = true
+			},
+			want: [][]string{{
+				"!", "deinterlace",
+				"!", "videoflip", "method=rotate-180",
+				"!", "videoflip", "method=horizontal-flip",
+			}},
+		},
+		{
+			name: "overlay",
+			setup: func(cfg *Config, cam *Camera) {
+				cam.Overlay = true
+				cam.Name = "Front <door>"
+			},
+			want: [][]string{{"shaded-background=true", `text="Front door"`}},
+		},
+		{
+			name: "hardware encoder",
+			setup: func(cfg *Config, cam *Camera) {
+				cfg.GstEncoder = "v4l2h264enc extra-controls=controls,video_bitrate=2000000"
+			},
+			want:   [][]string{{"!", "v4l2h264enc", "extra-controls=controls,video_bitrate=2000000", "!"}},
+			absent: []string{"x264enc"},
+		},
+		{
+			name: "rtsps without verification",
+			setup: func(cfg *Config, cam *Camera) {
+				cam.RtspURL = "rtsps://127.0.0.1:8322/test-host-cam-0"
+			},
+			want: [][]string{{"location=rtsps://127.0.0.1:8322/test-host-cam-0", "protocols=tcp", "tls-validation-flags=0"}},
+		},
+		{
+			name: "srt",
+			setup: func(cfg *Config, cam *Camera) {
+				cam.Output = outputSRT
+			},
+			want:   [][]string{{"!", "mpegtsmux", "!", "srtsink", "uri=srt://127.0.0.1:8890?latency=200&mode=caller&streamid=publish%3Atest-host-cam-0"}},
+			absent: []string{"rtspclientsink"},
+		},
+		{
+			name: "rtmp",
+			setup: func(cfg *Config, cam *Camera) {
+				cam.Output = outputRTMP
+				cam.RtmpURL = "rtmp://live.example.com/app/KEY"
+			},
+			want: [][]string{{"!", "flvmux", "streamable=true", "!", "rtmp2sink", "location=rtmp://live.example.com/app/KEY"}},
+		},
+		{
+			name: "whip",
+			setup: func(cfg *Config, cam *Camera) {
+				cam.Output = outputWHIP
+			},
+			want: [][]string{{"!", "whipsink", "whip-endpoint=http://127.0.0.1:8889/test-host-cam-0/whip"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeBackend(t, device)
+			cfg := testConfig(t)
+			cfg.PublishBackend = backendGStreamer
+			cam := testCamera(cfg, listDevices(&cfg)[0])
+			if tt.setup != nil {
+				tt.setup(&cfg, cam)
+			}
+			agent := newTestAgent(t, cfg)
+
+			args := agent.gstreamerArgs(cam)
+			for _, want := range tt.want {
+				if !hasArgs(args, want) {
+					t.Errorf("args lack %q:\n%s", want, strings.Join(args, " "))
+				}
+			}
+			for _, absent := range tt.absent {
+				for _, arg := range args {
+					if strings.HasPrefix(arg, absent) {
+						t.Errorf("args contain %q:\n%s", absent, strings.Join(args, " "))
+						break
+					}
+				}
+			}
+			if got := publisherFor(cam).Command(agent, cam); got[0] != cfg.GstLaunchPath || !equalArgs(got[1:], args) {
+				t.Errorf("Command() = %q, want gst-launch and the pipeline", got)
+			}
+		})
+	}
+}
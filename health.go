@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"os/exec"
+	"runtime"
+	"sort"
+	"time"
+)
+
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthDown     = "down"
+)
+
+// componentHealth is one entry of /health/details. Reason is a stable code
+// for monitoring rules; Message is the underlying error for people.
+type componentHealth struct {
+	Name      string `json:"name"`
+	Target    string `json:"target,omitempty"`
+	DeviceUID string `json:"deviceUid,omitempty"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+	Message   string `json:"message,omitempty"`
+	// State is the publisher's camera status, as sent to the hub.
+	State string `json:"state,omitempty"`
+}
+
+// handleHealthDetails checks each dependency and publisher. It answers 503
+// when a component every camera needs is down, so it can back a load
+// balancer or monitoring check directly; a failing hub or camera only
+// degrades the agent.
+func (a *Agent) handleHealthDetails(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	components := []componentHealth{a.ffmpegHealth(), a.mediaServerHealth(), a.storeHealth(), a.clockHealth()}
+	if runtime.GOOS == "linux" || runtime.GOOS == "freebsd" {
+		components = append(components, v4l2Health())
+	}
+	components = append(components, a.hubHealth()...)
+	components = append(components, a.satelliteHealth()...)
+	components = append(components, a.publisherHealth()...)
+
+	status, code := healthOK, http.StatusOK
+	for _, component := range components {
+		switch {
+		case component.Status == healthDown && component.DeviceUID == "":
+			status, code = healthDown, http.StatusServiceUnavailable
+		case component.Status != healthOK && status == healthOK:
+			status = healthDegraded
+		}
+	}
+	writeJSON(w, code, map[string]interface{}{
+		"status":     status,
+		"time":       time.Now().UTC(),
+		"components": components,
+	})
+}
+
+func (a *Agent) ffmpegHealth() componentHealth {
+	health := componentHealth{Name: "ffmpeg", Target: a.config().FfmpegPath, Status: healthOK}
+	if _, err := exec.LookPath(a.config().FfmpegPath); err != nil {
+		health.Status, health.Reason, health.Message = healthDown, "not_found", err.Error()
+	} else if a.ffmpegCaps.Load() == nil {
+		health.Status, health.Reason = healthDegraded, "probe_failed"
+		health.Message = "capabilities unknown; camera settings are not checked"
+	}
+	return health
+}
+
+// v4l2Health checks for v4l2-ctl, which camera controls and the support
+// bundle need; capture itself works without it.
+func v4l2Health() componentHealth {
+	health := componentHealth{Name: "v4l2-ctl", Status: healthOK}
+	if _, err := exec.LookPath("v4l2-ctl"); err != nil {
+		health.Status, health.Reason, health.Message = healthDegraded, "not_found", err.Error()
+	}
+	return health
+}
+
+func (a *Agent) mediaServerHealth() componentHealth {
+	health := componentHealth{Name: "mediamtx", Target: redactURL(a.config().MediaMtxRtspBase), Status: healthOK}
+	if a.rtspServer != nil {
+		health.Name, health.Target = "rtsp-server", ""
+		return health
+	}
+	if a.mediaReady.Load() {
+		return health
+	}
+	health.Status, health.Reason = healthDown, "unreachable"
+	if err := probeRTSP(a.config(), mediaProbeTimeout); err != nil {
+		health.Message = err.Error()
+	}
+	return health
+}
+
+func (a *Agent) storeHealth() componentHealth {
+	health := componentHealth{Name: "store", Status: healthOK}
+	if err := a.store.Ping(); err != nil {
+		health.Status, health.Reason, health.Message = healthDown, "not_writable", err.Error()
+	}
+	return health
+}
+
+// hubHealth reports the outcome of the latest registration with each hub.
+func (a *Agent) hubHealth() []componentHealth {
+	hubs := a.hubs()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := make([]componentHealth, 0, len(hubs))
+	for _, hub := range hubs {
+		health := componentHealth{Name: "hub", Target: redactURL(hub.URL), Status: healthOK}
+		connected, registered := a.hubConnected[hub.URL]
+		switch {
+		case a.maintenance:
+			health.Reason = "maintenance"
+		case hub.Primary && a.enrollmentPendingLocked():
+			health.Status, health.Reason = healthDegraded, "enrollment_pending"
+		case !registered:
+			health.Status, health.Reason = healthDegraded, "not_registered"
+		case !connected:
+			health.Status, health.Reason = healthDegraded, "unreachable"
+			health.Message = a.hubErrors[hub.URL]
+		}
+		list = append(list, health)
+	}
+	return list
+}
+
+// publisherHealth reports every attached camera. Cameras that are meant to
+// be stopped (disabled, privacy, off schedule, idle or queued) are healthy.
+func (a *Agent) publisherHealth() []componentHealth {
+	lastErrors := make(map[string]string)
+	for _, event := range a.events.List("", 0) {
+		switch event.Type {
+		case "publisher_started":
+			delete(lastErrors, event.DeviceUID)
+		case "publisher_error":
+			message, _ := event.Data["error"].(string)
+			lastErrors[event.DeviceUID] = message
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := make([]componentHealth, 0, len(a.cameras))
+	for _, cam := range a.cameras {
+		health := componentHealth{Name: "publisher", DeviceUID: cam.DeviceUID, Status: healthOK, State: a.cameraStatusLocked(cam)}
+		switch health.State {
+		case "unsupported":
+			health.Status, health.Reason, health.Message = healthDown, "unsupported", cam.Unsupported
+		case "process_stuck":
+			health.Status, health.Reason = healthDown, "unkillable"
+			health.Message = "publisher process survived SIGKILL and holds the device"
+		case "waiting_media_server":
+			health.Status, health.Reason = healthDown, "media_server_unreachable"
+		case "publishing_unreadable":
+			health.Status, health.Reason, health.Message = healthDegraded, "unreadable", cam.Unreadable
+		case "starting":
+			if message, failed := lastErrors[cam.DeviceUID]; failed {
+				health.Status, health.Reason, health.Message = healthDown, "publisher_error", message
+			}
+		}
+		list = append(list, health)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeviceUID < list[j].DeviceUID })
+	return list
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyEvents are the event types kept in the state store, so they survive
+// restarts and answer questions like "when did camera 3 go down?". Frequent
+// events such as motion, uploads and quality changes stay in the in-memory
+// log only.
+var historyEvents = map[string]bool{
+	"camera_added": true, "camera_removed": true, "camera_enabled": true, "camera_disabled": true,
+	"publisher_started": true, "publisher_stopped": true, "publisher_error": true, "publisher_queued": true,
+	"hub_connected": true, "hub_disconnected": true, "media_server_ready": true, "media_server_down": true,
+	"privacy_enabled": true, "privacy_disabled": true, "schedule_started": true, "schedule_stopped": true,
+	"maintenance_enabled": true, "maintenance_disabled": true, "maintenance_drained": true,
+	"disk_warning": true, "disk_ok": true, "recording_paused": true, "recording_resumed": true, "recordings_pruned": true,
+	"audio_silent": true, "audio_restored": true, "talkback_started": true, "talkback_stopped": true,
+	"config_reloaded": true, "token_rotated": true, "enrollment_approved": true,
+	"agent_restarting": true, "publisher_restart_requested": true, "update_installed": true, "update_failed": true,
+	"publisher_unkillable": true, "satellite_connected": true, "satellite_disconnected": true,
+	"hub_discovered": true, "clock_skewed": true, "clock_ok": true, "stream_unreadable": true, "stream_readable": true,
+}
+
+const (
+	historyPageSize    = 100
+	historyMaxPageSize = 1000
+)
+
+func enabledEvent(enabled bool) string {
+	if enabled {
+		return "camera_enabled"
+	}
+	return "camera_disabled"
+}
+
+// historyQueue hands history events from emit to historyLoop. Unlike an
+// event subscription it never drops events, so bursts such as a bulk enable
+// are stored in full.
+type historyQueue struct {
+	mu      sync.Mutex
+	pending []Event
+	ready   chan struct{}
+}
+
+func (q *historyQueue) push(event Event) {
+	q.mu.Lock()
+	q.pending = append(q.pending, event)
+	ready := q.readyLocked()
+	q.mu.Unlock()
+	select {
+	case ready <- struct{}{}:
+	default:
+	}
+}
+
+// take waits for events and returns all that have queued up.
+func (q *historyQueue) take() []Event {
+	for {
+		q.mu.Lock()
+		if len(q.pending) > 0 {
+			batch := q.pending
+			q.pending = nil
+			q.mu.Unlock()
+			return batch
+		}
+		ready := q.readyLocked()
+		q.mu.Unlock()
+		<-ready
+	}
+}
+
+func (q *historyQueue) readyLocked() chan struct{} {
+	if q.ready == nil {
+		q.ready = make(chan struct{}, 1)
+	}
+	return q.ready
+}
+
+// historyLoop writes significant events to the store, all those queued
+// since the last write in one transaction. Events emitted before the store
+// opens wait in the queue, so startup is kept too.
+func (a *Agent) historyLoop() {
+	for {
+		events := a.history.take()
+		limit := a.config().EventHistorySize
+		if limit <= 0 {
+			continue
+		}
+		if err := a.store.AppendEvents(events, limit); err != nil {
+			logWarn("event history: %v", err)
+		}
+	}
+}
+
+// handleEventHistory pages through the stored events, newest first. Filters
+// are deviceUid, type (comma-separated) and from/to (RFC 3339); before takes
+// the nextBefore of the previous page.
+func (a *Agent) handleEventHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := EventFilter{DeviceUID: query.Get("deviceUid"), Limit: historyPageSize}
+	for _, eventType := range strings.Split(query.Get("type"), ",") {
+		if eventType = strings.TrimSpace(eventType); eventType != "" {
+			filter.Types = append(filter.Types, eventType)
+		}
+	}
+	for _, bound := range []struct {
+		key  string
+		dest *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		value := query.Get(bound.key)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid %s: use RFC 3339", bound.key)})
+			return
+		}
+		*bound.dest = parsed
+	}
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > historyMaxPageSize {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("limit must be between 1 and %d", historyMaxPageSize)})
+			return
+		}
+		filter.Limit = n
+	}
+	if value := query.Get("before"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid before"})
+			return
+		}
+		filter.Before = n
+	}
+
+	events, next, err := a.store.ListEvents(filter)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	page := map[string]interface{}{"events": events}
+	if next > 0 {
+		page["nextBefore"] = next
+	}
+	writeJSON(w, http.StatusOK, page)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// storedToken is a hub-issued token. Replaces records a hash of the
+// AUTH_TOKEN it superseded, so a token rotated away from an old AUTH_TOKEN
+// is not used once an operator configures a different one.
+type storedToken struct {
+	Token    string `json:"token"`
+	Replaces string `json:"replaces,omitempty"`
+}
+
+// hubTokenPath stores the token the hub issued by enrollment or rotation.
+func hubTokenPath(cfg *Config) string {
+	return filepath.Join(filepath.Dir(cfg.StateFile), "hub_token")
+}
+
+func tokenHash(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func loadStoredToken(cfg *Config) *storedToken {
+	data, err := os.ReadFile(hubTokenPath(cfg))
+	if err != nil {
+		return nil
+	}
+	var stored storedToken
+	if err := json.Unmarshal(data, &stored); err != nil {
+		// Tokens saved by enrollment before rotation support are plain text.
+		stored = storedToken{Token: strings.TrimSpace(string(data))}
+	}
+	if stored.Token == "" {
+		return nil
+	}
+	return &stored
+}
+
+// loadHubToken returns the stored token if it applies to the configured
+// AUTH_TOKEN.
+func loadHubToken(cfg *Config) string {
+	if stored := loadStoredToken(cfg); stored != nil && stored.Replaces == tokenHash(cfg.AuthToken) {
+		return stored.Token
+	}
+	return ""
+}
+
+// hubToken returns the hub-issued token when there is one for the current
+// AUTH_TOKEN, otherwise AUTH_TOKEN itself.
+func (a *Agent) hubToken() string {
+	cfg := a.config()
+	if stored := a.storedToken.Load(); stored != nil && stored.Replaces == tokenHash(cfg.AuthToken) {
+		return stored.Token
+	}
+	return cfg.AuthToken
+}
+
+// storeHubToken persists a token issued by the hub and switches to it. The
+// file is replaced atomically so a crash never leaves the agent without a
+// usable token.
+func (a *Agent) storeHubToken(token string) error {
+	cfg := a.config()
+	stored := &storedToken{Token: token, Replaces: tokenHash(cfg.AuthToken)}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(hubTokenPath(cfg), data, 0o600); err != nil {
+		return err
+	}
+	a.storedToken.Store(stored)
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and
+// renames it over path.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// hubTarget is one hub the agent reports to. The primary hub is CAMHUB_URL,
+// whose token can come from enrollment or rotation; CAMHUB_URLS adds more
+// hubs with static tokens from CAMHUB_TOKENS.
+type hubTarget struct {
+	URL     string
+	Token   string
+	Primary bool
+}
+
+func (a *Agent) hubs() []hubTarget {
+	cfg := a.config()
+	hubs := []hubTarget{{URL: cfg.CamhubURL, Token: a.hubToken(), Primary: true}}
+	for idx, hubURL := range cfg.ExtraHubURLs {
+		hub := hubTarget{URL: hubURL}
+		if idx < len(cfg.ExtraHubTokens) {
+			hub.Token = cfg.ExtraHubTokens[idx]
+		}
+		hubs = append(hubs, hub)
+	}
+	return hubs
+}
+
+// newHubRequest builds a JSON request to a hub with the user agent and
+// credentials shared by every hub call.
+func (a *Agent) newHubRequest(hub hubTarget, method, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(hub.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", a.config().RegisterUserAgent)
+	if hub.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+hub.Token)
+	}
+	return req, nil
+}
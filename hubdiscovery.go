@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// mdnsHubService is the DNS-SD service type hubs advertise. A hub's TXT
+	// record may carry scheme=https and path=/base for a hub behind a path.
+	mdnsHubService       = "_camhub._tcp.local."
+	hubDiscoveryInterval = 30 * time.Second
+	hubDiscoveryWait     = 3 * time.Second
+)
+
+// discoveredHubPath keeps the last hub found over mDNS, so a restart can
+// register at once instead of waiting for discovery.
+func discoveredHubPath(cfg *Config) string {
+	return filepath.Join(filepath.Dir(cfg.StateFile), "hub_discovered")
+}
+
+func loadDiscoveredHub(cfg *Config) string {
+	data, err := os.ReadFile(discoveredHubPath(cfg))
+	if err != nil {
+		return ""
+	}
+	hubURL := strings.TrimSpace(string(data))
+	if !validURL(hubURL, "http", "https") {
+		return ""
+	}
+	return hubURL
+}
+
+// hubDiscoveryLoop looks for a hub on the LAN while CAMHUB_URL is not set
+// and the current hub cannot be reached, which also follows a hub that
+// moved to another address. It first gives the hub found before a restart
+// a couple of heartbeats to answer; enrollment, which does not register,
+// may use them too.
+func (a *Agent) hubDiscoveryLoop() {
+	missing := false
+	started := time.Now()
+	for {
+		cfg := a.config()
+		connected, tried := a.primaryHubState()
+		if cfg.HubDiscovery && !tried && time.Since(started) < 2*cfg.HeartbeatInterval {
+			time.Sleep(time.Second)
+			continue
+		}
+		if cfg.HubDiscovery && !connected {
+			hubURL, err := findHub()
+			switch {
+			case err != nil:
+				if !missing {
+					logInfo("mdns: no hub found on the LAN (%v); retrying every %s", err, hubDiscoveryInterval)
+				}
+				missing = true
+			case hubURL != cfg.CamhubURL:
+				missing = false
+				a.useDiscoveredHub(hubURL)
+			default:
+				missing = false
+			}
+		}
+		time.Sleep(hubDiscoveryInterval)
+	}
+}
+
+// primaryHubState reports whether the primary hub answered the latest
+// registration, and whether one was tried yet.
+func (a *Agent) primaryHubState() (connected, tried bool) {
+	hubURL := a.config().CamhubURL
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	connected, tried = a.hubConnected[hubURL]
+	return connected, tried
+}
+
+// useDiscoveredHub makes hubURL the primary hub and remembers it.
+func (a *Agent) useDiscoveredHub(hubURL string) {
+	a.reloadMu.Lock()
+	next := *a.config()
+	next.CamhubURL = hubURL
+	a.cfg.Store(&next)
+	a.reloadMu.Unlock()
+
+	logInfo("mdns: using hub %s", redactURL(hubURL))
+	a.emit("hub_discovered", "", map[string]interface{}{"hub": redactURL(hubURL)})
+	if err := writeFileAtomic(discoveredHubPath(&next), []byte(hubURL+"\n"), 0o600); err != nil {
+		logWarn("mdns: discovered hub not saved: %v", err)
+	}
+}
+
+// findHub browses for _camhub._tcp and returns the URL of the first hub by
+// instance name. Finding several is logged, since the agent then picks one
+// arbitrarily; set CAMHUB_URL to choose.
+func findHub() (string, error) {
+	hubs, err := browseMDNS(mdnsHubService, hubDiscoveryWait)
+	if err != nil {
+		return "", err
+	}
+	if len(hubs) == 0 {
+		return "", errors.New("no " + strings.TrimSuffix(mdnsHubService, ".local.") + " service answered")
+	}
+	if len(hubs) > 1 {
+		names := make([]string, 0, len(hubs))
+		for _, hub := range hubs {
+			names = append(names, hub.Instance)
+		}
+		logWarn("mdns: found %d hubs (%s); using %s", len(hubs), strings.Join(names, ", "), hubs[0].Instance)
+	}
+	return hubs[0].URL(), nil
+}
+
+// mdnsService is one instance found by browseMDNS.
+type mdnsService struct {
+	Instance string
+	Host     string
+	Port     int
+	IP       net.IP
+	TXT      map[string]string
+}
+
+// URL builds the base URL from the address and the scheme and path TXT
+// entries.
+func (s mdnsService) URL() string {
+	scheme := s.TXT["scheme"]
+	if scheme != "https" {
+		scheme = "http"
+	}
+	path := strings.TrimRight(s.TXT["path"], "/")
+	if path != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(s.IP.String(), strconv.Itoa(s.Port)), path)
+}
+
+// browseMDNS sends a one-shot query for service from an ephemeral port and
+// collects the unicast replies for wait, asking again for the addresses of
+// hosts the replies left out. Instances without an IPv4 address are
+// dropped.
+func browseMDNS(service string, wait time.Duration) ([]mdnsService, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	records := map[uint16][]dnsRecord{}
+	query := func(name string, qtype uint16, wait time.Duration) error {
+		msg := dnsMessage{ID: uint16(time.Now().UnixNano()), Questions: []dnsQuestion{{Name: name, Type: qtype}}}
+		if _, err := conn.WriteToUDP(msg.encode(), mdnsGroup); err != nil {
+			return err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(wait))
+		buf := make([]byte, mdnsMaxPacketSize)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return nil
+			}
+			reply, err := parseDNSMessage(buf[:n])
+			if err != nil || !reply.Response {
+				continue
+			}
+			for _, r := range append(reply.Answers, reply.Additional...) {
+				r.Data = append([]byte(nil), r.Data...)
+				records[r.Type] = append(records[r.Type], r)
+			}
+		}
+	}
+	if err := query(service, dnsTypePTR, wait); err != nil {
+		return nil, err
+	}
+
+	find := func(qtype uint16, name string) []dnsRecord {
+		var found []dnsRecord
+		for _, r := range records[qtype] {
+			if strings.EqualFold(r.Name, name) {
+				found = append(found, r)
+			}
+		}
+		return found
+	}
+	var services []mdnsService
+	seen := map[string]bool{}
+	for _, ptr := range find(dnsTypePTR, service) {
+		instance, _, err := readDNSName(ptr.Data, 0)
+		// A TTL of 0 is a service saying goodbye.
+		if err != nil || ptr.TTL == 0 || seen[strings.ToLower(instance)] {
+			continue
+		}
+		seen[strings.ToLower(instance)] = true
+		srvs := find(dnsTypeSRV, instance)
+		if len(srvs) == 0 || len(srvs[0].Data) < 7 {
+			continue
+		}
+		host, _, err := readDNSName(srvs[0].Data, 6)
+		if err != nil {
+			continue
+		}
+		s := mdnsService{
+			Instance: strings.TrimSuffix(instance, "."+service),
+			Host:     host,
+			Port:     int(binary.BigEndian.Uint16(srvs[0].Data[4:])),
+			TXT:      map[string]string{},
+		}
+		for _, txt := range find(dnsTypeTXT, instance) {
+			for data := txt.Data; len(data) > 0 && int(data[0]) < len(data); data = data[1+int(data[0]):] {
+				key, value, _ := strings.Cut(string(data[1:1+int(data[0])]), "=")
+				s.TXT[strings.ToLower(key)] = value
+			}
+		}
+		addresses := find(dnsTypeA, host)
+		if len(addresses) == 0 {
+			_ = query(host, dnsTypeA, time.Second)
+			addresses = find(dnsTypeA, host)
+		}
+		if len(addresses) == 0 || len(addresses[0].Data) != net.IPv4len {
+			continue
+		}
+		s.IP = net.IP(addresses[0].Data)
+		services = append(services, s)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Instance < services[j].Instance })
+	return services, nil
+}
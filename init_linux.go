@@ -0,0 +1,79 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// forwardedSignals reach the agent through the init process unchanged.
+var forwardedSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2}
+
+// runInit makes a PID 1 agent a minimal init, as in a container started
+// without --init: it runs the agent as its child, forwards signals to it and
+// reaps every process that ends up reparented to it, such as the children of
+// a killed ffmpeg or gst-launch. The agent cannot reap those itself without
+// stealing exit statuses from exec.Cmd.Wait. runInit returns only when the
+// agent should run in this process; otherwise it exits with the agent.
+func runInit() {
+	if os.Getpid() != 1 {
+		return
+	}
+	exe, err := agentExecutable()
+	if err != nil {
+		return
+	}
+	// Subscribe before starting the child so no exit is missed.
+	children := make(chan os.Signal, 1)
+	signal.Notify(children, syscall.SIGCHLD)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		logWarn("running without a child reaper: %v", err)
+		signal.Reset(syscall.SIGCHLD)
+		signal.Reset(forwardedSignals...)
+		return
+	}
+	pid := cmd.Process.Pid
+
+	for {
+		select {
+		case sig := <-signals:
+			_ = cmd.Process.Signal(sig)
+		case <-children:
+			if code, exited := reapChildren(pid); exited {
+				os.Exit(code)
+			}
+		}
+	}
+}
+
+// reapChildren collects every exited child and reports whether the agent was
+// one of them, with the exit code to pass on.
+func reapChildren(agentPID int) (int, bool) {
+	code, exited := 0, false
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return code, exited
+		}
+		if pid == agentPID {
+			exited = true
+			code = status.ExitStatus()
+			if status.Signaled() {
+				code = 128 + int(status.Signal())
+			}
+		}
+	}
+}
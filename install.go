@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	serviceName     = "camhub-agent"
+	installStateDir = "/var/lib/" + serviceName
+	installBinary   = "/opt/" + serviceName + "/" + serviceName
+	installEnvFile  = "/etc/" + serviceName + "/" + serviceName + ".env"
+	installUnitFile = "/etc/systemd/system/" + serviceName + ".service"
+)
+
+// deviceGroups own the device nodes the agent opens: V4L2 cameras, DRM
+// render nodes for hardware encoding and ALSA for audio capture.
+var deviceGroups = []string{"video", "render", "audio"}
+
+type installOptions struct {
+	User    string
+	Binary  string
+	EnvFile string
+	Unit    string
+	NoStart bool
+	Print   bool
+}
+
+// runInstall sets the agent up as a systemd service: a dedicated system
+// user, the binary under /opt, an environment file holding the current
+// configuration (flags, environment and .env) and a hardened unit, which it
+// then enables and starts. An existing environment file is kept, so running
+// it again after an upgrade only refreshes the binary and the unit.
+func runInstall(cfg Config, args []string) int {
+	opts := installOptions{}
+	fs := flag.NewFlagSet("install", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&opts.User, "user", serviceName, "user the service runs as; created when missing")
+	fs.StringVar(&opts.Binary, "binary", installBinary, "where to install the agent binary")
+	fs.StringVar(&opts.EnvFile, "env-file", installEnvFile, "environment file for the service")
+	fs.StringVar(&opts.Unit, "unit", installUnitFile, "systemd unit file to write")
+	fs.BoolVar(&opts.NoStart, "no-start", false, "enable the service without starting it")
+	fs.BoolVar(&opts.Print, "print", false, "print the unit instead of installing")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if runtime.GOOS != "linux" {
+		fmt.Fprintln(os.Stderr, "install needs systemd; on Windows use service install")
+		return 1
+	}
+	groups := existingGroups(deviceGroups)
+	unit := systemdUnit(&cfg, opts, groups)
+	if opts.Print {
+		fmt.Print(unit)
+		return 0
+	}
+	if os.Geteuid() != 0 {
+		fmt.Fprintln(os.Stderr, "install must run as root")
+		return 1
+	}
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		fmt.Fprintln(os.Stderr, "systemctl not found; is this a systemd host?")
+		return 1
+	}
+
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"user", func() error { return ensureServiceUser(opts.User, groups) }},
+		{"binary", func() error { return installAgentBinary(&cfg, opts) }},
+		{"env file", func() error { return writeServiceEnv(opts) }},
+		{"unit", func() error { return os.WriteFile(opts.Unit, []byte(unit), 0o644) }},
+		{"enable", func() error { return enableService(filepath.Base(opts.Unit), !opts.NoStart) }},
+	}
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			fmt.Printf("FAIL  %-10s %v\n", step.name, err)
+			return 1
+		}
+		fmt.Printf("ok    %s\n", step.name)
+	}
+	fmt.Printf("installed %s; logs: journalctl -u %s\n", filepath.Base(opts.Unit), strings.TrimSuffix(filepath.Base(opts.Unit), ".service"))
+	return 0
+}
+
+// systemdUnit renders the service unit. The sandbox leaves the agent write
+// access to its state directory only; absolute paths configured outside it
+// are added to ReadWritePaths. Devices are limited to cameras, render nodes
+// and sound cards.
+func systemdUnit(cfg *Config, opts installOptions, groups []string) string {
+	var b strings.Builder
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, format+"\n", args...)
+	}
+	line("[Unit]")
+	line("Description=CamHub camera agent")
+	line("Wants=network-online.target")
+	line("After=network-online.target")
+	line("")
+	line("[Service]")
+	line("Type=simple")
+	line("User=%s", opts.User)
+	line("Group=%s", opts.User)
+	if len(groups) > 0 {
+		line("SupplementaryGroups=%s", strings.Join(groups, " "))
+	}
+	line("EnvironmentFile=-%s", opts.EnvFile)
+	line("StateDirectory=%s", filepath.Base(installStateDir))
+	line("StateDirectoryMode=0750")
+	line("WorkingDirectory=%s", installStateDir)
+	line("ExecStart=%s", opts.Binary)
+	line("ExecReload=/bin/kill -HUP $MAINPID")
+	line("Restart=on-failure")
+	line("RestartSec=5")
+	line("UMask=0027")
+	line("")
+	line("NoNewPrivileges=yes")
+	line("ProtectSystem=strict")
+	line("ProtectHome=yes")
+	line("PrivateTmp=yes")
+	line("ProtectKernelTunables=yes")
+	line("ProtectKernelModules=yes")
+	line("ProtectKernelLogs=yes")
+	line("ProtectControlGroups=yes")
+	line("ProtectClock=yes")
+	line("ProtectHostname=yes")
+	line("RestrictNamespaces=yes")
+	line("RestrictRealtime=yes")
+	line("RestrictSUIDSGID=yes")
+	line("LockPersonality=yes")
+	line("SystemCallArchitectures=native")
+	line("RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6 AF_NETLINK")
+	if privilegedListener(cfg) {
+		line("CapabilityBoundingSet=CAP_NET_BIND_SERVICE")
+		line("AmbientCapabilities=CAP_NET_BIND_SERVICE")
+	} else {
+		line("CapabilityBoundingSet=")
+	}
+	line("DevicePolicy=closed")
+	line("DeviceAllow=char-video4linux rw")
+	line("DeviceAllow=char-drm rw")
+	line("DeviceAllow=char-alsa rw")
+	for _, path := range writablePaths(cfg, opts) {
+		// "-" lets the unit start when a path does not exist yet.
+		line("ReadWritePaths=-%s", path)
+	}
+	line("")
+	line("[Install]")
+	line("WantedBy=multi-user.target")
+	return b.String()
+}
+
+// writablePaths lists the configured absolute paths the agent writes to
+// outside its state directory. Relative ones resolve inside it. The binary's
+// directory is writable only when self-update is enabled.
+func writablePaths(cfg *Config, opts installOptions) []string {
+	var paths []string
+	add := func(path string) {
+		if !filepath.IsAbs(path) || path == installStateDir || strings.HasPrefix(path, installStateDir+"/") {
+			return
+		}
+		if !containsString(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+	add(filepath.Dir(cfg.StateFile))
+	add(cfg.RecordingDir)
+	if cfg.LogFile != "" {
+		add(filepath.Dir(cfg.LogFile))
+	}
+	addrs, _ := parseListenAddrs(cfg.AgentAddr)
+	for _, addr := range addrs {
+		if path, ok := unixSocketPath(addr.Addr); ok {
+			add(filepath.Dir(path))
+		}
+	}
+	if len(cfg.UpdatePublicKeys) > 0 {
+		add(filepath.Dir(opts.Binary))
+	}
+	return paths
+}
+
+func privilegedListener(cfg *Config) bool {
+	addrs, err := parseListenAddrs(cfg.AgentAddr)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if _, ok := unixSocketPath(addr.Addr); ok {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(addr.Addr); err == nil {
+			if n, err := strconv.Atoi(port); err == nil && n > 0 && n < 1024 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// existingGroups keeps the groups that exist on this host; render, for one,
+// only exists where a GPU driver created it.
+func existingGroups(names []string) []string {
+	var groups []string
+	for _, name := range names {
+		if _, err := user.LookupGroup(name); err == nil {
+			groups = append(groups, name)
+		}
+	}
+	return groups
+}
+
+// ensureServiceUser creates the system user and its group, or adds the
+// device groups to an existing user.
+func ensureServiceUser(name string, groups []string) error {
+	if _, err := user.Lookup(name); err == nil {
+		if len(groups) == 0 {
+			return nil
+		}
+		return runQuiet("usermod", "--append", "--groups", strings.Join(groups, ","), name)
+	}
+	args := []string{"--system", "--user-group", "--no-create-home", "--home-dir", installStateDir, "--shell", "/usr/sbin/nologin"}
+	if len(groups) > 0 {
+		args = append(args, "--groups", strings.Join(groups, ","))
+	}
+	return runQuiet("useradd", append(args, name)...)
+}
+
+// installAgentBinary copies the running binary into place. When self-update
+// is enabled the service user owns the directory, so it can swap in new
+// builds.
+func installAgentBinary(cfg *Config, opts installOptions) error {
+	exe, err := agentExecutable()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(opts.Binary)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if len(cfg.UpdatePublicKeys) > 0 {
+		uid, gid, err := lookupIDs(opts.User)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return err
+		}
+	}
+	if exe == opts.Binary {
+		return nil
+	}
+	src, err := os.Open(exe)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(opts.Binary, data, 0o755)
+}
+
+// writeServiceEnv saves every configured option, secrets included, readable
+// by root and the service group only.
+func writeServiceEnv(opts installOptions) error {
+	if _, err := os.Stat(opts.EnvFile); err == nil {
+		return nil
+	}
+	var b bytes.Buffer
+	for _, option := range configOptions {
+		for _, env := range []string{option.Env, option.Env + "_FILE"} {
+			if value, ok := os.LookupEnv(env); ok && value != "" {
+				fmt.Fprintf(&b, "%s=%s\n", env, envFileValue(value))
+			}
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(opts.EnvFile), 0o755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(opts.EnvFile, b.Bytes(), 0o640); err != nil {
+		return err
+	}
+	_, gid, err := lookupIDs(opts.User)
+	if err != nil {
+		return err
+	}
+	return os.Chown(opts.EnvFile, 0, gid)
+}
+
+// envFileValue quotes values systemd would otherwise split or strip.
+func envFileValue(value string) string {
+	if !strings.ContainsAny(value, " \t\"'\\#;$") {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+func lookupIDs(name string) (int, int, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+func enableService(unit string, start bool) error {
+	if err := runQuiet("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	if start {
+		// restart rather than enable --now, so a reinstall picks up the new
+		// binary.
+		if err := runQuiet("systemctl", "enable", unit); err != nil {
+			return err
+		}
+		return runQuiet("systemctl", "restart", unit)
+	}
+	return runQuiet("systemctl", "enable", unit)
+}
+
+// runQuiet runs a setup command, returning its output as the error when it
+// fails.
+func runQuiet(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return errors.New(name + ": " + msg)
+		}
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
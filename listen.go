@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const unixScheme = "unix:"
+
+// unixSocketPath returns the socket path of a unix:///path or unix:/path
+// listen address.
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(addr, unixScheme), "//"), true
+}
+
+// listenAddr is one AGENT_ADDR entry. A listener serves HTTPS when it has a
+// certificate and key, given as query parameters:
+// 0.0.0.0:8443?cert=/etc/agent/tls.crt&key=/etc/agent/tls.key.
+type listenAddr struct {
+	Addr string
+	Cert string
+	Key  string
+}
+
+func (l listenAddr) tls() bool { return l.Cert != "" }
+
+// parseListenAddrs splits AGENT_ADDR, a comma-separated list of host:port
+// (IPv6 hosts in brackets, as in [::1]:8091) and unix socket addresses, each
+// with its own optional TLS settings.
+func parseListenAddrs(value string) ([]listenAddr, error) {
+	var addrs []listenAddr
+	seen := make(map[string]bool)
+	for _, entry := range splitList(value) {
+		addr, rawQuery, _ := strings.Cut(entry, "?")
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry, err)
+		}
+		for key := range query {
+			if key != "cert" && key != "key" {
+				return nil, fmt.Errorf("%s: unknown option %q", entry, key)
+			}
+		}
+		l := listenAddr{Addr: addr, Cert: query.Get("cert"), Key: query.Get("key")}
+		if path, ok := unixSocketPath(addr); ok {
+			if path == "" {
+				return nil, fmt.Errorf("%s: unix socket path must not be empty", entry)
+			}
+		} else if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("%s: must be host:port or unix:///path: %v", entry, err)
+		}
+		if (l.Cert == "") != (l.Key == "") {
+			return nil, fmt.Errorf("%s: cert and key must be set together", entry)
+		}
+		if seen[addr] {
+			return nil, fmt.Errorf("%s is listed twice", addr)
+		}
+		seen[addr] = true
+		addrs = append(addrs, l)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no listen address")
+	}
+	return addrs, nil
+}
+
+// listenAll opens every AGENT_ADDR listener, closing the ones already open
+// if any fails.
+func listenAll(addrs []listenAddr) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, l := range addrs {
+		ln, err := listen(l.Addr)
+		if err == nil && l.tls() {
+			var cert tls.Certificate
+			if cert, err = tls.LoadX509KeyPair(l.Cert, l.Key); err == nil {
+				ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12, NextProtos: []string{"h2", "http/1.1"}})
+			} else {
+				ln.Close()
+			}
+		}
+		if err != nil {
+			for _, open := range listeners {
+				open.Close()
+			}
+			return nil, fmt.Errorf("listen %s: %w", l.Addr, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// listen opens a listen address, which is either host:port or
+// unix:///path/to.sock.
+// A socket left behind by an unclean exit is replaced; the socket is made
+// group-writable so a reverse proxy in the agent's group can connect.
+func listen(addr string) (net.Listener, error) {
+	path, ok := unixSocketPath(addr)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New(path + " exists and is not a socket")
+		}
+		_ = os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// normalizeBasePath turns BASE_PATH into "" (served at the root) or a path
+// with a leading and no trailing slash, e.g. "/agents/garage".
+func normalizeBasePath(value string) string {
+	value = strings.Trim(strings.TrimSpace(value), "/")
+	if value == "" {
+		return ""
+	}
+	return "/" + value
+}
+
+// mountBasePath serves handler under basePath, for agents reached through a
+// reverse proxy that does not strip the prefix itself.
+func mountBasePath(basePath string, handler http.Handler) http.Handler {
+	if basePath == "" {
+		return handler
+	}
+	mux := http.NewServeMux()
+	mux.Handle(basePath+"/", http.StripPrefix(basePath, handler))
+	mux.Handle(basePath, http.RedirectHandler(basePath+"/", http.StatusMovedPermanently))
+	return mux
+}
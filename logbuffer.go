@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+type LogLine struct {
+	Time time.Time `json:"ts"`
+	Line string    `json:"line"`
+}
+
+// LogBuffer is a fixed-size ring of the most recent log lines for a camera.
+type LogBuffer struct {
+	mu    sync.Mutex
+	lines []LogLine
+	next  int
+	full  bool
+}
+
+func NewLogBuffer(size int) *LogBuffer {
+	if size <= 0 {
+		size = 1
+	}
+	return &LogBuffer{lines: make([]LogLine, size)}
+}
+
+func (b *LogBuffer) Add(line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lines[b.next] = LogLine{Time: time.Now(), Line: line}
+	b.next = (b.next + 1) % len(b.lines)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Lines returns the buffered lines, oldest first.
+func (b *LogBuffer) Lines() []LogLine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.full {
+		return append([]LogLine(nil), b.lines[:b.next]...)
+	}
+	out := make([]LogLine, 0, len(b.lines))
+	out = append(out, b.lines[b.next:]...)
+	out = append(out, b.lines[:b.next]...)
+	return out
+}
+
+func (a *Agent) cameraLog(deviceUID string) *LogBuffer {
+	a.logsMu.Lock()
+	defer a.logsMu.Unlock()
+
+	buf := a.logs[deviceUID]
+	if buf == nil {
+		buf = NewLogBuffer(a.config().CameraLogLines)
+		a.logs[deviceUID] = buf
+	}
+	return buf
+}
+
+func (a *Agent) handleCameraLogs(w http.ResponseWriter, r *http.Request, deviceUID string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.mu.Lock()
+	cam := a.cameras[deviceUID]
+	a.mu.Unlock()
+	if cam == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "camera not found"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.cameraLog(deviceUID).Lines())
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rotatingFile is a log file that is renamed to <name>.<timestamp> once it
+// grows past maxSize or gets older than maxAge. Only the newest maxFiles
+// rotated files are kept.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+
+	file    *os.File
+	size    int64
+	created time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxFiles int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	// The modification time of a reopened file is the best guess at when it
+	// was started that survives restarts without extra bookkeeping.
+	r.created = time.Now()
+	if r.size > 0 {
+		r.created = info.ModTime()
+	}
+	return nil
+}
+
+// Write is called with logMu held.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	due := (r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize) ||
+		(r.maxAge > 0 && time.Since(r.created) > r.maxAge)
+	if due && r.size > 0 {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	rotated := r.path + "." + time.Now().Format("20060102-150405")
+	if err := os.Rename(r.path, rotated); err != nil {
+		// Keep logging to the existing file rather than losing lines.
+		if openErr := r.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.created = time.Now()
+	r.prune()
+	return nil
+}
+
+// prune removes the oldest rotated files beyond maxFiles. Timestamps sort
+// lexically, so the name order is the age order.
+func (r *rotatingFile) prune() {
+	if r.maxFiles <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	var rotated []string
+	prefix := filepath.Base(r.path) + "."
+	for _, match := range matches {
+		if suffix := strings.TrimPrefix(filepath.Base(match), prefix); len(suffix) == len("20060102-150405") {
+			rotated = append(rotated, match)
+		}
+	}
+	sort.Strings(rotated)
+	for len(rotated) > r.maxFiles {
+		_ = os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+}
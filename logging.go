@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logOutputStdout   = "stdout"
+	logOutputSyslog   = "syslog"
+	logOutputJournald = "journald"
+	logOutputEventlog = "eventlog"
+
+	logIdentifier  = "camhub-agent"
+	journaldSocket = "/run/systemd/journal/socket"
+)
+
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelWarn
+	levelInfo
+)
+
+// logSink receives every log line. The stdout and LOG_FILE sinks keep the
+// plain "timestamp message" format; syslog, journald and the Windows event
+// log carry the level as the message priority instead.
+type logSink interface {
+	Log(level logLevel, msg string) error
+}
+
+var (
+	logMu sync.Mutex
+	sink  logSink = writerSink{os.Stdout}
+)
+
+func logInfo(format string, args ...interface{}) {
+	logAt(levelInfo, fmt.Sprintf(format, args...))
+}
+
+func logWarn(format string, args ...interface{}) {
+	logAt(levelWarn, fmt.Sprintf(format, args...))
+}
+
+func logError(format string, args ...interface{}) {
+	logAt(levelError, fmt.Sprintf(format, args...))
+}
+
+func logAt(level logLevel, msg string) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	if err := sink.Log(level, msg); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s (log output failed: %v)\n", time.Now().Format("2006-01-02 15:04:05"), msg, err)
+	}
+}
+
+// outputLineLevel guesses the severity of a line printed by ffmpeg,
+// gst-launch or MediaMTX, none of which say it in a form we can rely on.
+func outputLineLevel(line string) logLevel {
+	lower := strings.ToLower(line)
+	switch {
+	case strings.Contains(lower, "error"), strings.Contains(lower, "failed"),
+		strings.Contains(lower, "could not"), strings.Contains(lower, "cannot"),
+		strings.Contains(lower, "no such"), strings.Contains(lower, "invalid"):
+		return levelError
+	case strings.Contains(lower, "warning"), strings.Contains(lower, "warn "),
+		strings.Contains(lower, "deprecated"), strings.Contains(lower, "dropping"):
+		return levelWarn
+	}
+	return levelInfo
+}
+
+// setupLogging selects LOG_OUTPUT, or LOG_FILE for the stdout output.
+func setupLogging(cfg Config) error {
+	var next logSink
+	switch cfg.LogOutput {
+	case logOutputSyslog:
+		s, err := newSyslogSink(cfg.SyslogAddr)
+		if err != nil {
+			return err
+		}
+		next = s
+	case logOutputJournald:
+		s, err := newJournaldSink()
+		if err != nil {
+			return err
+		}
+		next = s
+	case logOutputEventlog:
+		s, err := newEventlogSink()
+		if err != nil {
+			return err
+		}
+		next = s
+	default:
+		if cfg.LogFile == "" {
+			return nil
+		}
+		file, err := openRotatingFile(cfg.LogFile, cfg.LogMaxSizeMB*1024*1024, cfg.LogMaxAge, cfg.LogMaxFiles)
+		if err != nil {
+			return err
+		}
+		next = writerSink{file}
+	}
+	logMu.Lock()
+	sink = next
+	logMu.Unlock()
+	return nil
+}
+
+type writerSink struct {
+	w io.Writer
+}
+
+func (s writerSink) Log(_ logLevel, msg string) error {
+	_, err := fmt.Fprintf(s.w, "%s %s\n", time.Now().Format("2006-01-02 15:04:05"), msg)
+	return err
+}
+
+// journaldSink speaks the journal's native datagram protocol, which needs
+// no library and keeps the priority as a proper field.
+type journaldSink struct {
+	conn net.Conn
+}
+
+func newJournaldSink() (*journaldSink, error) {
+	conn, err := net.Dial("unixgram", journaldSocket)
+	if err != nil {
+		return nil, fmt.Errorf("journald: %w", err)
+	}
+	return &journaldSink{conn: conn}, nil
+}
+
+func (s *journaldSink) Log(level logLevel, msg string) error {
+	var buf bytes.Buffer
+	journalField(&buf, "PRIORITY", fmt.Sprint(syslogPriority(level)))
+	journalField(&buf, "SYSLOG_IDENTIFIER", logIdentifier)
+	journalField(&buf, "MESSAGE", msg)
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
+
+// journalField writes KEY=value, or the length-prefixed form for values
+// that contain a newline.
+func journalField(buf *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", key, value)
+		return
+	}
+	buf.WriteString(key + "\n")
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+// syslogPriority maps a level to its syslog severity (err, warning, info).
+func syslogPriority(level logLevel) int {
+	switch level {
+	case levelError:
+		return 3
+	case levelWarn:
+		return 4
+	}
+	return 6
+}
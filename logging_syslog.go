@@ -0,0 +1,41 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+)
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+// newSyslogSink connects to the local syslog daemon, or to a remote one
+// when addr is given as udp://host:port or tcp://host:port.
+func newSyslogSink(addr string) (logSink, error) {
+	network, raddr := "", ""
+	if addr != "" {
+		var ok bool
+		network, raddr, ok = strings.Cut(addr, "://")
+		if !ok {
+			network, raddr = "udp", addr
+		}
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, logIdentifier)
+	if err != nil {
+		return nil, fmt.Errorf("syslog: %w", err)
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Log(level logLevel, msg string) error {
+	switch level {
+	case levelError:
+		return s.w.Err(msg)
+	case levelWarn:
+		return s.w.Warning(msg)
+	}
+	return s.w.Info(msg)
+}
@@ -4,11 +4,17 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"html"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -17,6 +23,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "embed"
@@ -32,52 +39,422 @@ var appJS []byte
 //go:embed web/styles.css
 var stylesCSS []byte
 
+//go:embed web/openapi.json
+var openAPIJSON []byte
+
 type Config struct {
-	CamhubURL         string
-	AuthToken         string
-	MediaMtxRtspBase  string
-	HeartbeatInterval time.Duration
-	DiscoveryInterval time.Duration
-	FfmpegPath        string
-	AgentAddr         string
-	StateFile         string
-	RestartDelay      time.Duration
-	RegisterUserAgent string
-	RegisterTimeout   time.Duration
-	MotionEnabled     bool
-	MotionSource      string
-	MotionFPS         int
-	MotionWidth       int
-	MotionHeight      int
-	MotionThreshold   float64
-	MotionConsecutive int
-	MotionCooldown    time.Duration
-	MotionTimeout     time.Duration
+	CamhubURL            string
+	AuthToken            string
+	MediaMtxRtspBase     string
+	HeartbeatInterval    time.Duration
+	DiscoveryInterval    time.Duration
+	FfmpegPath           string
+	AgentAddr            string
+	BasePath             string
+	CorsOrigins          []string
+	CorsMethods          []string
+	CorsHeaders          []string
+	StateFile            string
+	AgentID              string
+	RestartDelay         time.Duration
+	RegisterUserAgent    string
+	RegisterTimeout      time.Duration
+	MotionEnabled        bool
+	MotionSource         string
+	MotionFPS            int
+	MotionWidth          int
+	MotionHeight         int
+	MotionThreshold      float64
+	MotionConsecutive    int
+	MotionCooldown       time.Duration
+	MotionTimeout        time.Duration
+	SnapshotTimeout      time.Duration
+	PublishOutput        string
+	MediaMtxWhipBase     string
+	MediaMtxSrtBase      string
+	SrtLatency           time.Duration
+	SrtPassphrase        string
+	RecordingEnabled     bool
+	RecordingDir         string
+	RecordingSegment     time.Duration
+	RecordingFormat      string
+	RecordingMode        string
+	RecordingPreRoll     time.Duration
+	UploadEnabled        bool
+	UploadInterval       time.Duration
+	UploadTimeout        time.Duration
+	UploadRetries        int
+	UploadDeleteAfter    bool
+	S3Endpoint           string
+	S3Region             string
+	S3Bucket             string
+	S3Prefix             string
+	S3AccessKey          string
+	S3SecretKey          string
+	S3PathStyle          bool
+	DeviceInclude        []string
+	DeviceExclude        []string
+	OverlayFont          string
+	CameraLogLines       int
+	APIToken             string
+	PprofEnabled         bool
+	PublishStagger       time.Duration
+	MaxPublishers        int
+	MaxCPULoad           float64
+	MediamtxAPIBase      string
+	MediamtxAPIUser      string
+	MediamtxAPIPass      string
+	MediamtxPollInterval time.Duration
+	OnDemand             bool
+	OnDemandIdle         time.Duration
+	MediamtxManaged      bool
+	MediamtxBinary       string
+	MediamtxVersion      string
+	MediamtxSHA256       string
+	ExtraHubURLs         []string
+	ProxyURL             string
+	ExtraHubTokens       []string
+	EnrollEnabled        bool
+	EnrollPollInterval   time.Duration
+	RtspServer           bool
+	RtspServerAddr       string
+	PublishBackend       string
+	GstLaunchPath        string
+	GstEncoder           string
+	LogFile              string
+	LogMaxSizeMB         int64
+	LogMaxAge            time.Duration
+	LogMaxFiles          int
+	LogOutput            string
+	SyslogAddr           string
+	WebhookURL           string
+	WebhookEvents        []string
+	WebhookTemplate      string
+	WebhooksFile         string
+	TestCameras          []string
+	TestCameraSize       string
+	TestCameraFPS        int
+	PublishUser          string
+	PublishPass          string
+	RtspTLSCA            string
+	RtspTLSCert          string
+	RtspTLSKey           string
+	RtspTLSVerify        bool
+	SubstreamEnabled     bool
+	SubstreamHeight      int
+	AbrEnabled           bool
+	AbrHighLoad          float64
+	AbrLowLoad           float64
+	AbrInterval          time.Duration
+	DiskMinFreeMB        int
+	DiskWarnPercent      int
+	DiskPrune            bool
+	DiskCheckInterval    time.Duration
+	RetentionMaxAge      time.Duration
+	RetentionMaxSizeMB   int
+	RetentionQuotaMB     int
+	RetentionInterval    time.Duration
+	EventHistorySize     int
+	APICredentials       []string
+	OidcIssuer           string
+	OidcClientID         string
+	OidcClientSecret     string
+	OidcRedirectURL      string
+	OidcScopes           string
+	OidcGroupsClaim      string
+	OidcAllowedGroups    []string
+	OidcAdminGroups      []string
+	OidcSessionTTL       time.Duration
+	RateLimitRPS         int
+	RateLimitBurst       int
+	LockoutFailures      int
+	LockoutDuration      time.Duration
+	LockoutMax           time.Duration
+	UpdatePublicKeys     []string
+	UpdateURL            string
+	PublisherStopTimeout time.Duration
+	DiscoveryDebounce    time.Duration
+	DiscoveryWatch       bool
+	SatelliteURLs        []string
+	SatelliteToken       string
+	SatellitePoll        time.Duration
+	MdnsEnabled          bool
+	MdnsName             string
+	// HubDiscovery finds the hub over mDNS. It is opt-in, since any LAN host
+	// answering for _camhub._tcp receives the hub token, and it is off when
+	// CAMHUB_URL is set.
+	HubDiscovery      bool
+	ClockSkewMax      time.Duration
+	StreamVerify      bool
+	ThumbnailInterval time.Duration
+	ThumbnailWidth    int
+	ThumbnailCacheTTL time.Duration
+	AudioSilenceDB    float64
+	AudioSilenceAfter time.Duration
+	TalkbackDevice    string
+	OnvifEnabled      bool
+	OnvifUser         string
+	OnvifPass         string
+	ProfilesFile      string
+	Profiles          map[string]EncodingProfile
+	OverridesFile     string
+	Overrides         map[string]FFmpegOverrides
 }
 
 type DeviceInfo struct {
-	Name string `json:"name"`
-	Node string `json:"node"`
+	Name  string   `json:"name"`
+	Node  string   `json:"node"`
+	ID    string   `json:"id,omitempty"`
+	Nodes []string `json:"nodes,omitempty"`
+}
+
+type DeviceCapability struct {
+	Card    string
+	BusInfo string
+	Capture bool
 }
 
 type Camera struct {
 	DeviceUID  string `json:"deviceUid"`
 	Name       string `json:"name"`
+	DeviceName string `json:"deviceName"`
 	Node       string `json:"node"`
 	StreamPath string `json:"streamPath"`
 	RtspURL    string `json:"rtspUrl"`
 	Enabled    bool   `json:"enabled"`
-	Publishing bool   `json:"publishing"`
+	// Status is the state registered with the hub; see cameraStatusLocked.
+	Status      string `json:"status"`
+	Publishing  bool   `json:"publishing"`
+	Output      string `json:"output"`
+	Backend     string `json:"backend"`
+	Record      bool   `json:"record"`
+	Recording   bool   `json:"recording"`
+	Motion      bool   `json:"motion"`
+	Rotate      int    `json:"rotate"`
+	HFlip       bool   `json:"hflip"`
+	VFlip       bool   `json:"vflip"`
+	Overlay     bool   `json:"overlay"`
+	Deinterlace bool   `json:"deinterlace"`
+	Denoise     bool   `json:"denoise"`
+	Queued      bool   `json:"queued"`
+	QueueReason string `json:"queueReason,omitempty"`
+	// Unsupported says why the local ffmpeg cannot publish the camera.
+	Unsupported string `json:"unsupported,omitempty"`
+	// WaitingMedia is set while an RTSP publisher waits for MediaMTX.
+	WaitingMedia bool `json:"waitingMedia"`
+	// Unreadable says why the media server does not serve the stream of a
+	// running publisher; see verifyStream.
+	Unreadable  string  `json:"unreadable,omitempty"`
+	Readers     int     `json:"readers"`
+	Idle        bool    `json:"idle"`
+	Schedule    string  `json:"schedule,omitempty"`
+	OffSchedule bool    `json:"offSchedule"`
+	PTZ         bool    `json:"ptz"`
+	FPS         float64 `json:"fps"`
+	// PublishUser and PublishPass authenticate the publisher with MediaMTX.
+	// The password is never serialized.
+	PublishUser string `json:"publishUser,omitempty"`
+	PublishPass string `json:"-"`
+	// SubstreamPath and SubstreamURL address the low-resolution rendition,
+	// empty unless the camera publishes one.
+	SubstreamPath string `json:"substreamPath,omitempty"`
+	SubstreamURL  string `json:"substreamUrl,omitempty"`
+	EncoderTuning
+	// Speed is the encoder's ffmpeg speed (1.0 keeps up with the input) and
+	// QualityLevel how far adaptive bitrate has degraded the camera.
+	Speed        float64 `json:"speed"`
+	QualityLevel int     `json:"qualityLevel"`
+	// BytesSent counts what the current publisher has written and
+	// BitrateKbps is its rate over the last progress interval.
+	BytesSent   int64   `json:"bytesSent"`
+	BitrateKbps float64 `json:"bitrateKbps"`
+	// ThumbnailURL serves a small, briefly cached JPEG of the camera.
+	ThumbnailURL string `json:"thumbnailUrl"`
+	// AudioDevice is the microphone metered for the camera. AudioLevel is
+	// its RMS level in dBFS over the last second, nil while not metered, and
+	// Silent is set once it has stayed below AUDIO_SILENCE_DB too long.
+	AudioDevice string   `json:"audioDevice,omitempty"`
+	AudioLevel  *float64 `json:"audioLevel,omitempty"`
+	Silent      bool     `json:"silent"`
+	// TalkbackDevice is the speaker talkback plays on and Talking is set
+	// while a session is running.
+	TalkbackDevice string `json:"talkbackDevice,omitempty"`
+	Talking        bool   `json:"talking"`
+	// RtmpURL is the destination of the rtmp output. It holds the stream
+	// key, so only RtmpTarget, with the key masked, is serialized.
+	RtmpURL    string `json:"-"`
+	RtmpTarget string `json:"rtmpTarget,omitempty"`
+	FFmpegOverrides
+	// Profile names the camera's encoding profile; see EncodingProfile.
+	Profile string `json:"profile,omitempty"`
+	FrameGeometry
+	// RetentionQuotaMB overrides RETENTION_CAMERA_QUOTA_MB when set.
+	RetentionQuotaMB int `json:"retentionQuotaMB,omitempty"`
+	// Order places the camera in lists; 0 sorts it by name after the
+	// ordered ones.
+	Order int `json:"order,omitempty"`
+	// Tags group cameras, e.g. by site, for listing and bulk enable/disable.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// CameraSettings is the persisted per-camera configuration, keyed by DeviceUID
+// in the state file.
+type CameraSettings struct {
+	Enabled bool   `json:"enabled"`
+	Name    string `json:"name,omitempty"`
+	Output  string `json:"output,omitempty"`
+	Backend string `json:"backend,omitempty"`
+	Record  *bool  `json:"record,omitempty"`
+	Rotate  int    `json:"rotate,omitempty"`
+	HFlip   bool   `json:"hflip,omitempty"`
+	VFlip   bool   `json:"vflip,omitempty"`
+	Overlay bool   `json:"overlay,omitempty"`
+	// Deinterlace and Denoise clean up analog capture cards' video.
+	Deinterlace bool `json:"deinterlace,omitempty"`
+	Denoise     bool `json:"denoise,omitempty"`
+	// RetentionQuotaMB caps this camera's recordings; 0 uses the default.
+	RetentionQuotaMB int `json:"retentionQuotaMB,omitempty"`
+	// Schedule limits publishing to weekly windows; see parseSchedule.
+	Schedule string `json:"schedule,omitempty"`
+	// Controls holds V4L2 control values set through the API.
+	Controls   map[string]int         `json:"controls,omitempty"`
+	PTZPresets map[string]PTZPosition `json:"ptzPresets,omitempty"`
+	// PublishUser and PublishPass override PUBLISH_USER and PUBLISH_PASS.
+	PublishUser string `json:"publishUser,omitempty"`
+	PublishPass string `json:"publishPass,omitempty"`
+	// Substream overrides SUBSTREAM_ENABLED.
+	Substream *bool `json:"substream,omitempty"`
+	EncoderTuning
+	// AudioDevice is the microphone that belongs to the camera, e.g. "hw:1,0"
+	// or "audio=Microphone (USB Camera)".
+	AudioDevice string `json:"audioDevice,omitempty"`
+	// TalkbackDevice overrides TALKBACK_DEVICE.
+	TalkbackDevice string `json:"talkbackDevice,omitempty"`
+	// RtmpURL is where the rtmp output pushes, stream key included.
+	RtmpURL string `json:"rtmpUrl,omitempty"`
+	Profile string `json:"profile,omitempty"`
+	FrameGeometry
+	// Order is the camera's place in lists, set through the API.
+	Order int      `json:"order,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
 }
 
+const (
+	outputRTSP = "rtsp"
+	outputWHIP = "whip"
+	outputSRT  = "srt"
+	outputRTMP = "rtmp"
+)
+
 type Agent struct {
-	cfg        Config
+	cfg        atomic.Pointer[Config]
+	startedAt  time.Time
 	hostname   string
+	agentID    string
 	mu         sync.Mutex
 	cameras    map[string]*Camera
-	publishers map[string]*exec.Cmd
+	missing    map[string]KnownCamera
+	store      *Store
+	publishers map[string]Process
 	motions    map[string]*MotionWorker
-	state      map[string]bool
+	recorders  map[string]*RecordWorker
+	state      map[string]*CameraSettings
+	events     *EventLog
+	history    historyQueue
+	logsMu     sync.Mutex
+	logs       map[string]*LogBuffer
+
+	// pendingStarts holds publishers waiting for their staggered start slot.
+	pendingStarts      map[string]*time.Timer
+	nextPublisherStart time.Time
+	lastDemand         map[string]time.Time
+	// demandToken authenticates the managed MediaMTX's runOnDemand hook,
+	// and is accepted for POST /api/demand only.
+	demandToken string
+	// terminating holds stopped publishers that have not exited yet, and
+	// unkillable those that outlived SIGKILL; both guarded by mu.
+	terminating map[string]Process
+	unkillable  map[string]bool
+	// devices is the discovery result the cameras were built from, and
+	// pendingDevices a different one waiting out DISCOVERY_DEBOUNCE_MS
+	// since pendingSince; all guarded by mu.
+	devices        []DeviceInfo
+	pendingDevices []DeviceInfo
+	pendingSince   time.Time
+	// devWatch is set while watchDevices triggers discovery.
+	devWatch atomic.Bool
+	// clockSkew is the clock's offset from the primary hub, measured at
+	// clockMeasured; clockSkewed is set while it exceeds CLOCK_SKEW_MAX_MS.
+	// All guarded by mu.
+	clockSkew     time.Duration
+	clockSkewed   bool
+	clockMeasured time.Time
+	// mdns is the running mDNS responder, nil when not advertising.
+	mdns atomic.Pointer[mdnsResponder]
+	// satellites holds the latest camera list of each SATELLITE_URLS agent,
+	// guarded by mu.
+	satellites map[string]*satellite
+
+	hubConnected map[string]bool
+	hubErrors    map[string]string
+	reloadMu     sync.Mutex
+
+	// rtspServer is the built-in RTSP relay, nil when MediaMTX serves streams.
+	rtspServer *RTSPServer
+	// privacy stops every camera until lifted; guarded by mu.
+	privacy bool
+	// maintenance stops every camera and hub registration until lifted;
+	// draining holds the publishers still waiting for their viewers to
+	// leave. Both guarded by mu.
+	maintenance bool
+	draining    map[string]bool
+	// commandsDone lists the handled hub command IDs (guarded by mu);
+	// restartCh is closed and restarting set once a restart is requested.
+	commandsDone []string
+	restartCh    chan struct{}
+	restarting   atomic.Bool
+	// updating is set while an update is downloaded and installed;
+	// latestVersion is the newest version the primary hub advertises.
+	updating      atomic.Bool
+	latestVersion atomic.Pointer[string]
+	// stopping is set on shutdown so no worker restarts; guarded by mu.
+	stopping bool
+	// stopMediamtx stops the managed MediaMTX and waits for it; nil unless
+	// MEDIAMTX_MANAGED is set.
+	stopMediamtx func()
+
+	// storedToken is the hub token from enrollment or rotation. enrolling
+	// and claimCode are set while enrollment waits for approval (guarded by mu).
+	storedToken atomic.Pointer[storedToken]
+	enrolling   bool
+	claimCode   string
+
+	// ffmpegCaps is nil when ffmpeg could not be probed; cameras are then
+	// started unchecked.
+	ffmpegCaps atomic.Pointer[FFmpegCaps]
+	// mediaReady is set while MediaMTX answers on the RTSP base.
+	mediaReady atomic.Bool
+
+	// diskWarning and recordingPaused are set by the disk guard (guarded
+	// by mu).
+	diskWarning     bool
+	recordingPaused bool
+
+	// thumbs caches the latest thumbnail per camera (map guarded by mu).
+	thumbs map[string]*thumbnail
+	// audioMeters holds the microphone level workers (guarded by mu).
+	audioMeters map[string]*AudioWorker
+	// talkbacks holds the running talkback session per camera (guarded by mu).
+	talkbacks map[string]*talkbackSession
+
+	// retentionFiles and retentionBytes count what retention has deleted
+	// since startup; recordingBytes is the footage left after its last run.
+	retentionFiles atomic.Int64
+	retentionBytes atomic.Int64
+	recordingBytes atomic.Int64
+
+	oidc   oidcClient
+	limits clientLimits
 }
 
 type MotionWorker struct {
@@ -85,42 +462,247 @@ type MotionWorker struct {
 }
 
 func main() {
+	runInit()
+	args, err := parseFlags(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			printUsage(os.Stdout)
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+
+	if len(args) == 0 && runningAsService() {
+		os.Exit(runService())
+	}
 	cfg := loadConfig()
+	applyProxy(cfg)
+	if len(args) > 0 {
+		os.Exit(runCommand(cfg, args))
+	}
+	runAgent(cfg)
+}
+
+func runAgent(cfg Config) {
+	if err := setupLogging(cfg); err != nil {
+		logError("log output error: %v", err)
+		os.Exit(1)
+	}
+	// An unreadable *_FILE secret reads as empty, which would start the
+	// agent with that credential, or its API auth, switched off.
+	if problems := validateConfig(cfg); len(problems) > 0 {
+		for _, problem := range problems {
+			logError("config error: %s", problem)
+		}
+		os.Exit(1)
+	}
 	hostname, _ := os.Hostname()
+	agentID, err := loadAgentID(cfg)
+	if err != nil {
+		logError("agent id error: %v", err)
+		os.Exit(1)
+	}
 
 	agent := &Agent{
-		cfg:        cfg,
-		hostname:   hostname,
-		cameras:    make(map[string]*Camera),
-		publishers: make(map[string]*exec.Cmd),
-		motions:    make(map[string]*MotionWorker),
-		state:      loadState(cfg.StateFile),
+		startedAt:     time.Now(),
+		hostname:      hostname,
+		agentID:       agentID,
+		cameras:       make(map[string]*Camera),
+		hubConnected:  make(map[string]bool),
+		hubErrors:     make(map[string]string),
+		satellites:    make(map[string]*satellite),
+		draining:      make(map[string]bool),
+		restartCh:     make(chan struct{}),
+		publishers:    make(map[string]Process),
+		pendingStarts: make(map[string]*time.Timer),
+		lastDemand:    make(map[string]time.Time),
+		demandToken:   randomToken(),
+		terminating:   make(map[string]Process),
+		unkillable:    make(map[string]bool),
+		motions:       make(map[string]*MotionWorker),
+		audioMeters:   make(map[string]*AudioWorker),
+		talkbacks:     make(map[string]*talkbackSession),
+		recorders:     make(map[string]*RecordWorker),
+		events:        NewEventLog(),
+		logs:          make(map[string]*LogBuffer),
+		thumbs:        make(map[string]*thumbnail),
+	}
+	if cfg.HubDiscovery {
+		if hubURL := loadDiscoveredHub(&cfg); hubURL != "" {
+			cfg.CamhubURL = hubURL
+		}
+	}
+	agent.cfg.Store(&cfg)
+	store, err := openStore(&cfg)
+	if err != nil {
+		logError("state store error: %v", err)
+		os.Exit(1)
+	}
+	agent.store = store
+	go agent.historyLoop()
+	if agent.state, err = store.LoadSettings(); err != nil {
+		logError("state store error: %v", err)
+		os.Exit(1)
+	}
+	if agent.missing, err = store.LoadCameras(); err != nil {
+		logError("state store error: %v", err)
+		os.Exit(1)
+	}
+	agent.migrateStateKeys()
+	agent.refreshFFmpegCaps()
+	agent.privacy = loadPrivacy(&cfg)
+	agent.maintenance = loadMaintenance(&cfg)
+	agent.commandsDone = loadCommandsDone(&cfg)
+	if stored := loadStoredToken(&cfg); stored != nil {
+		agent.storedToken.Store(stored)
+	}
+	if agent.privacy {
+		logInfo("privacy mode is on; cameras stay stopped")
+	}
+	if agent.maintenance {
+		logInfo("maintenance mode is on; cameras stay stopped and the hub is not contacted")
+	}
+	checkClockSync()
+
+	if cfg.RtspServer {
+		agent.rtspServer = NewRTSPServer(agent.rtspPublishAllowed)
+		go func() {
+			if err := agent.rtspServer.ListenAndServe(cfg.RtspServerAddr); err != nil {
+				logError("rtsp server error: %v", err)
+				os.Exit(1)
+			}
+		}()
 	}
 
 	agent.refreshCameras()
 
+	if agent.rtspServer == nil {
+		go agent.mediaReadinessLoop()
+	}
+	if cfg.MediamtxManaged {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		agent.stopMediamtx = func() {
+			cancel()
+			<-done
+		}
+		go func() {
+			defer close(done)
+			agent.runManagedMediamtx(ctx)
+		}()
+	}
+	if cfg.EnrollEnabled && agent.hubToken() == "" {
+		agent.enrolling = true
+		go agent.enrollLoop()
+	}
 	go agent.discoveryLoop()
+	if cfg.DiscoveryWatch {
+		go agent.watchDevices()
+	}
 	go agent.heartbeatLoop()
+	go agent.satelliteLoop()
+	go agent.hubDiscoveryLoop()
+	go agent.watchReloadSignal()
+	go agent.scheduleLoop()
+	go agent.webhookLoop()
+	go agent.abrLoop()
+	go agent.diskGuardLoop()
+	go agent.retentionLoop()
+	go agent.thumbnailLoop()
+	if cfg.MediamtxAPIBase != "" || agent.rtspServer != nil {
+		go agent.mediamtxLoop()
+	}
+	if cfg.UploadEnabled {
+		if cfg.S3Bucket == "" {
+			logWarn("upload disabled: S3_BUCKET not set")
+		} else {
+			go agent.uploadLoop()
+		}
+	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", serveIndex)
+	mux.HandleFunc("/", agent.serveIndex)
 	mux.HandleFunc("/app.js", serveJS)
 	mux.HandleFunc("/styles.css", serveCSS)
 	mux.HandleFunc("/api/cameras", agent.handleCameras)
 	mux.HandleFunc("/api/cameras/toggle", agent.handleToggle)
+	mux.HandleFunc("/api/cameras/bulk", agent.handleBulkToggle)
+	mux.HandleFunc("/api/cameras/order", agent.handleCameraOrder)
+	mux.HandleFunc("/api/tags", agent.handleTags)
+	mux.HandleFunc("/api/satellites", agent.handleSatellites)
+	mux.HandleFunc("/api/cameras/", agent.handleCameraRoutes)
 	mux.HandleFunc("/api/preview", agent.handlePreviewStream)
+	mux.HandleFunc("/api/discover", agent.handleDiscover)
+	mux.HandleFunc("/api/demand", agent.handleDemand)
+	mux.HandleFunc("/api/events", agent.handleEvents)
+	mux.HandleFunc("/api/events/history", agent.handleEventHistory)
+	mux.HandleFunc("/api/version", agent.handleVersion)
+	mux.HandleFunc("/api/reload", agent.handleReload)
+	mux.HandleFunc("/api/privacy", agent.handlePrivacy)
+	mux.HandleFunc("/api/maintenance", agent.handleMaintenance)
+	mux.HandleFunc("/api/enrollment", agent.handleEnrollment)
+	mux.HandleFunc("/api/openapi.json", agent.serveOpenAPI)
+	mux.HandleFunc("/api/profiles", agent.handleProfiles)
+	mux.HandleFunc("/api/session", agent.handleSession)
+	mux.HandleFunc("/auth/login", agent.handleLogin)
+	mux.HandleFunc("/auth/callback", agent.handleCallback)
+	mux.HandleFunc("/auth/logout", agent.handleLogout)
+	mux.HandleFunc("/api/diag", agent.requireAuth(agent.handleDiag))
+	mux.HandleFunc("/api/update", agent.requireAuth(agent.handleUpdate))
+	mux.HandleFunc("/api/recordings", agent.requireAuth(agent.handleAllRecordings))
+	mux.HandleFunc("/api/recordings/", agent.requireAuth(agent.handleAllRecordings))
+	if cfg.OnvifEnabled {
+		mux.HandleFunc("/onvif/", agent.handleOnvif)
+	}
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 	})
+	mux.HandleFunc("/health/details", agent.handleHealthDetails)
+	if cfg.PprofEnabled {
+		agent.mountPprof(mux)
+	}
+
+	addrs, _ := parseListenAddrs(cfg.AgentAddr)
+	listeners, err := listenAll(addrs)
+	if err != nil {
+		logError("%v", err)
+		os.Exit(1)
+	}
+	server := &http.Server{Handler: mountBasePath(cfg.BasePath, agent.cors(agent.rateLimit(agent.authorize(mux))))}
 
-	server := &http.Server{
-		Addr:    cfg.AgentAddr,
-		Handler: mux,
+	go agent.watchShutdown(server)
+	if cfg.MdnsEnabled {
+		go agent.advertiseMDNS(addrs)
 	}
 
-	logInfo("agent listening on %s", cfg.AgentAddr)
-	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		logInfo("http server error: %v", err)
+	if cfg.ProxyURL != "" {
+		logInfo("using proxy %s for outbound requests", redactURL(cfg.ProxyURL))
+	}
+	served := make(chan error, len(listeners))
+	for i, ln := range listeners {
+		secure := ""
+		if addrs[i].tls() {
+			secure = " (https)"
+		}
+		logInfo("agent listening on %s%s/%s", addrs[i].Addr, cfg.BasePath, secure)
+		go func(ln net.Listener) { served <- server.Serve(ln) }(ln)
+	}
+	for range listeners {
+		// One listener failing takes the others down with it, as a single
+		// listener failing always stopped the agent.
+		if err := <-served; err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logError("http server error: %v", err)
+			server.Close()
+		}
+	}
+	if agent.restarting.Load() {
+		store.Close()
+		if err := reexec(); err != nil {
+			logError("restart failed: %v", err)
+			os.Exit(1)
+		}
 	}
 }
 
@@ -128,56 +710,281 @@ func loadConfig() Config {
 	envPath := filepath.Join(".", ".env")
 	_ = loadDotEnv(envPath)
 
-	return Config{
-		CamhubURL:         getEnv("CAMHUB_URL", "http://localhost:3001"),
-		AuthToken:         getEnv("AUTH_TOKEN", ""),
-		MediaMtxRtspBase:  getEnv("MEDIAMTX_RTSP_BASE", "rtsp://localhost:8554"),
-		HeartbeatInterval: getEnvDuration("HEARTBEAT_MS", 10000*time.Millisecond),
-		DiscoveryInterval: getEnvDuration("DISCOVERY_INTERVAL_MS", 15000*time.Millisecond),
-		FfmpegPath:        getEnv("FFMPEG_PATH", "ffmpeg"),
-		AgentAddr:         getEnv("AGENT_ADDR", "0.0.0.0:8091"),
-		StateFile:         getEnv("STATE_FILE", filepath.Join("data", "agent_state.json")),
-		RestartDelay:      getEnvDuration("RESTART_DELAY_MS", 2000*time.Millisecond),
-		RegisterUserAgent: getEnv("REGISTER_USER_AGENT", "camhub-agent/1.0"),
-		RegisterTimeout:   getEnvDuration("REGISTER_TIMEOUT_MS", 5000*time.Millisecond),
-		MotionEnabled:     getEnvBool("MOTION_ENABLED", false),
-		MotionSource:      getEnv("MOTION_SOURCE", "rtsp"),
-		MotionFPS:         getEnvInt("MOTION_FPS", 2),
-		MotionWidth:       getEnvInt("MOTION_WIDTH", 320),
-		MotionHeight:      getEnvInt("MOTION_HEIGHT", 240),
-		MotionThreshold:   getEnvFloat("MOTION_THRESHOLD", 12.0),
-		MotionConsecutive: getEnvInt("MOTION_CONSECUTIVE", 2),
-		MotionCooldown:    getEnvDuration("MOTION_COOLDOWN_MS", 10000*time.Millisecond),
-		MotionTimeout:     getEnvDuration("MOTION_TIMEOUT_MS", 3000*time.Millisecond),
-	}
+	cfg := Config{
+		CamhubURL:            getEnv("CAMHUB_URL", "http://localhost:3001"),
+		AuthToken:            getSecret("AUTH_TOKEN"),
+		MediaMtxRtspBase:     getEnv("MEDIAMTX_RTSP_BASE", "rtsp://localhost:8554"),
+		HeartbeatInterval:    getEnvDuration("HEARTBEAT_MS", 10000*time.Millisecond),
+		DiscoveryInterval:    getEnvDuration("DISCOVERY_INTERVAL_MS", 15000*time.Millisecond),
+		FfmpegPath:           getEnv("FFMPEG_PATH", "ffmpeg"),
+		AgentAddr:            getEnv("AGENT_ADDR", "0.0.0.0:8091"),
+		BasePath:             normalizeBasePath(getEnv("BASE_PATH", "")),
+		CorsOrigins:          getEnvList("CORS_ORIGINS"),
+		CorsMethods:          getEnvList("CORS_METHODS"),
+		CorsHeaders:          getEnvList("CORS_HEADERS"),
+		StateFile:            getEnv("STATE_FILE", filepath.Join("data", "agent_state.json")),
+		AgentID:              getEnv("AGENT_ID", ""),
+		RestartDelay:         getEnvDuration("RESTART_DELAY_MS", 2000*time.Millisecond),
+		RegisterUserAgent:    getEnv("REGISTER_USER_AGENT", "camhub-agent/1.0"),
+		RegisterTimeout:      getEnvDuration("REGISTER_TIMEOUT_MS", 5000*time.Millisecond),
+		MotionEnabled:        getEnvBool("MOTION_ENABLED", false),
+		MotionSource:         getEnv("MOTION_SOURCE", "rtsp"),
+		MotionFPS:            getEnvInt("MOTION_FPS", 2),
+		MotionWidth:          getEnvInt("MOTION_WIDTH", 320),
+		MotionHeight:         getEnvInt("MOTION_HEIGHT", 240),
+		MotionThreshold:      getEnvFloat("MOTION_THRESHOLD", 12.0),
+		MotionConsecutive:    getEnvInt("MOTION_CONSECUTIVE", 2),
+		MotionCooldown:       getEnvDuration("MOTION_COOLDOWN_MS", 10000*time.Millisecond),
+		MotionTimeout:        getEnvDuration("MOTION_TIMEOUT_MS", 3000*time.Millisecond),
+		SnapshotTimeout:      getEnvDuration("SNAPSHOT_TIMEOUT_MS", 5000*time.Millisecond),
+		PublishOutput:        normalizeOutput(getEnv("PUBLISH_OUTPUT", outputRTSP)),
+		MediaMtxWhipBase:     getEnv("MEDIAMTX_WHIP_BASE", "http://localhost:8889"),
+		MediaMtxSrtBase:      getEnv("MEDIAMTX_SRT_BASE", "srt://localhost:8890"),
+		SrtLatency:           getEnvDuration("SRT_LATENCY_MS", 200*time.Millisecond),
+		SrtPassphrase:        getSecret("SRT_PASSPHRASE"),
+		RecordingEnabled:     getEnvBool("RECORDING_ENABLED", false),
+		RecordingDir:         getEnv("RECORDING_DIR", filepath.Join("data", "recordings")),
+		RecordingSegment:     getEnvDuration("RECORDING_SEGMENT_MS", 5*time.Minute),
+		RecordingFormat:      getEnv("RECORDING_FORMAT", "mp4"),
+		RecordingMode:        getEnv("RECORDING_MODE", recordingModeContinuous),
+		RecordingPreRoll:     getEnvDuration("RECORDING_PREROLL_MS", 5*time.Second),
+		UploadEnabled:        getEnvBool("UPLOAD_ENABLED", false),
+		UploadInterval:       getEnvDuration("UPLOAD_INTERVAL_MS", 60000*time.Millisecond),
+		UploadTimeout:        getEnvDuration("UPLOAD_TIMEOUT_MS", 5*time.Minute),
+		UploadRetries:        getEnvInt("UPLOAD_RETRIES", 3),
+		UploadDeleteAfter:    getEnvBool("UPLOAD_DELETE_AFTER", false),
+		S3Endpoint:           getEnv("S3_ENDPOINT", "https://s3.amazonaws.com"),
+		S3Region:             getEnv("S3_REGION", "us-east-1"),
+		S3Bucket:             getEnv("S3_BUCKET", ""),
+		S3Prefix:             getEnv("S3_PREFIX", ""),
+		S3AccessKey:          getSecret("S3_ACCESS_KEY"),
+		S3SecretKey:          getSecret("S3_SECRET_KEY"),
+		S3PathStyle:          getEnvBool("S3_PATH_STYLE", true),
+		DeviceInclude:        getEnvList("DEVICE_INCLUDE"),
+		DeviceExclude:        getEnvList("DEVICE_EXCLUDE"),
+		OverlayFont:          getEnv("OVERLAY_FONT", ""),
+		CameraLogLines:       getEnvInt("CAMERA_LOG_LINES", 200),
+		APIToken:             getSecret("API_TOKEN"),
+		PprofEnabled:         getEnvBool("PPROF_ENABLED", false),
+		PublishStagger:       getEnvDuration("PUBLISH_STAGGER_MS", 2000*time.Millisecond),
+		MaxPublishers:        getEnvInt("MAX_PUBLISHERS", 0),
+		MaxCPULoad:           getEnvFloat("MAX_CPU_LOAD", 0),
+		MediamtxAPIBase:      getEnv("MEDIAMTX_API_BASE", ""),
+		MediamtxAPIUser:      getEnv("MEDIAMTX_API_USER", ""),
+		MediamtxAPIPass:      getSecret("MEDIAMTX_API_PASS"),
+		MediamtxPollInterval: getEnvDuration("MEDIAMTX_POLL_MS", 5000*time.Millisecond),
+		OnDemand:             getEnvBool("ON_DEMAND", false),
+		OnDemandIdle:         getEnvDuration("ON_DEMAND_IDLE_MS", 30000*time.Millisecond),
+		MediamtxManaged:      getEnvBool("MEDIAMTX_MANAGED", false),
+		MediamtxBinary:       getEnv("MEDIAMTX_BINARY", "mediamtx"),
+		MediamtxVersion:      getEnv("MEDIAMTX_VERSION", ""),
+		MediamtxSHA256:       getEnv("MEDIAMTX_SHA256", ""),
+		RtspServer:           getEnvBool("RTSP_SERVER", false),
+		RtspServerAddr:       getEnv("RTSP_SERVER_ADDR", ":8554"),
+		PublishBackend:       normalizeBackend(getEnv("PUBLISH_BACKEND", backendFFmpeg)),
+		GstLaunchPath:        getEnv("GST_LAUNCH_PATH", "gst-launch-1.0"),
+		GstEncoder:           getEnv("GST_ENCODER", "x264enc tune=zerolatency speed-preset=veryfast key-int-max=10 bframes=0"),
+		ExtraHubURLs:         getEnvList("CAMHUB_URLS"),
+		ProxyURL:             getSecret("PROXY_URL"),
+		ExtraHubTokens:       splitList(getSecret("CAMHUB_TOKENS")),
+		EnrollEnabled:        getEnvBool("ENROLL_ENABLED", false),
+		EnrollPollInterval:   getEnvDuration("ENROLL_POLL_MS", 5000*time.Millisecond),
+		LogFile:              getEnv("LOG_FILE", ""),
+		LogMaxSizeMB:         int64(getEnvInt("LOG_MAX_SIZE_MB", 10)),
+		LogMaxAge:            getEnvDuration("LOG_MAX_AGE_MS", 24*time.Hour),
+		LogMaxFiles:          getEnvInt("LOG_MAX_FILES", 7),
+		LogOutput:            strings.ToLower(getEnv("LOG_OUTPUT", logOutputStdout)),
+		SyslogAddr:           getEnv("SYSLOG_ADDR", ""),
+		WebhookURL:           getSecret("WEBHOOK_URL"),
+		WebhookEvents:        getEnvList("WEBHOOK_EVENTS"),
+		WebhookTemplate:      getEnv("WEBHOOK_TEMPLATE", ""),
+		WebhooksFile:         getEnv("WEBHOOKS_FILE", ""),
+		TestCameras:          getEnvList("TEST_CAMERAS"),
+		TestCameraSize:       getEnv("TEST_CAMERA_SIZE", "1280x720"),
+		TestCameraFPS:        getEnvInt("TEST_CAMERA_FPS", 15),
+		PublishUser:          getEnv("PUBLISH_USER", ""),
+		PublishPass:          getSecret("PUBLISH_PASS"),
+		RtspTLSCA:            getEnv("RTSP_TLS_CA", ""),
+		RtspTLSCert:          getEnv("RTSP_TLS_CERT", ""),
+		RtspTLSKey:           getEnv("RTSP_TLS_KEY", ""),
+		RtspTLSVerify:        getEnvBool("RTSP_TLS_VERIFY", true),
+		SubstreamEnabled:     getEnvBool("SUBSTREAM_ENABLED", false),
+		SubstreamHeight:      getEnvInt("SUBSTREAM_HEIGHT", 480),
+		AbrEnabled:           getEnvBool("ABR_ENABLED", false),
+		AbrHighLoad:          getEnvFloat("ABR_HIGH_LOAD", 0.9),
+		AbrLowLoad:           getEnvFloat("ABR_LOW_LOAD", 0.5),
+		AbrInterval:          getEnvDuration("ABR_INTERVAL_MS", 30*time.Second),
+		DiskMinFreeMB:        getEnvInt("DISK_MIN_FREE_MB", 1024),
+		DiskWarnPercent:      getEnvInt("DISK_WARN_PERCENT", 90),
+		DiskPrune:            getEnvBool("DISK_PRUNE", true),
+		DiskCheckInterval:    getEnvDuration("DISK_CHECK_INTERVAL_MS", time.Minute),
+		RetentionMaxAge:      getEnvDuration("RETENTION_MAX_AGE_MS", 0),
+		RetentionMaxSizeMB:   getEnvInt("RETENTION_MAX_SIZE_MB", 0),
+		RetentionQuotaMB:     getEnvInt("RETENTION_CAMERA_QUOTA_MB", 0),
+		RetentionInterval:    getEnvDuration("RETENTION_INTERVAL_MS", 10*time.Minute),
+		EventHistorySize:     getEnvInt("EVENT_HISTORY_SIZE", 10000),
+		APICredentials:       splitList(getSecret("API_CREDENTIALS")),
+		OidcIssuer:           getEnv("OIDC_ISSUER", ""),
+		OidcClientID:         getEnv("OIDC_CLIENT_ID", ""),
+		OidcClientSecret:     getSecret("OIDC_CLIENT_SECRET"),
+		OidcRedirectURL:      getEnv("OIDC_REDIRECT_URL", ""),
+		OidcScopes:           getEnv("OIDC_SCOPES", "openid profile email"),
+		OidcGroupsClaim:      getEnv("OIDC_GROUPS_CLAIM", "groups"),
+		OidcAllowedGroups:    getEnvList("OIDC_ALLOWED_GROUPS"),
+		OidcAdminGroups:      getEnvList("OIDC_ADMIN_GROUPS"),
+		OidcSessionTTL:       getEnvDuration("OIDC_SESSION_TTL_MS", 8*time.Hour),
+		RateLimitRPS:         getEnvInt("RATE_LIMIT_RPS", 20),
+		RateLimitBurst:       getEnvInt("RATE_LIMIT_BURST", 60),
+		LockoutFailures:      getEnvInt("AUTH_LOCKOUT_FAILURES", 5),
+		LockoutDuration:      getEnvDuration("AUTH_LOCKOUT_MS", time.Minute),
+		LockoutMax:           getEnvDuration("AUTH_LOCKOUT_MAX_MS", time.Hour),
+		UpdatePublicKeys:     getEnvList("UPDATE_PUBLIC_KEYS"),
+		UpdateURL:            getEnv("UPDATE_URL", ""),
+		PublisherStopTimeout: getEnvDuration("PUBLISHER_STOP_TIMEOUT_MS", 5*time.Second),
+		DiscoveryDebounce:    getEnvDuration("DISCOVERY_DEBOUNCE_MS", 3*time.Second),
+		DiscoveryWatch:       getEnvBool("DISCOVERY_WATCH", true),
+		SatelliteURLs:        getEnvList("SATELLITE_URLS"),
+		SatelliteToken:       getSecret("SATELLITE_TOKEN"),
+		SatellitePoll:        getEnvDuration("SATELLITE_POLL_MS", 10*time.Second),
+		MdnsEnabled:          getEnvBool("MDNS_ENABLED", true),
+		MdnsName:             getEnv("MDNS_NAME", ""),
+		HubDiscovery:         getEnvBool("HUB_DISCOVERY", false) && getEnv("CAMHUB_URL", "") == "",
+		ClockSkewMax:         getEnvDuration("CLOCK_SKEW_MAX_MS", 5*time.Second),
+		StreamVerify:         getEnvBool("STREAM_VERIFY", true),
+		ThumbnailInterval:    getEnvDuration("THUMBNAIL_INTERVAL_MS", 0),
+		ThumbnailWidth:       getEnvInt("THUMBNAIL_WIDTH", 320),
+		ThumbnailCacheTTL:    getEnvDuration("THUMBNAIL_CACHE_MS", 10*time.Second),
+		AudioSilenceDB:       getEnvFloat("AUDIO_SILENCE_DB", -60),
+		AudioSilenceAfter:    getEnvDuration("AUDIO_SILENCE_MS", 5*time.Minute),
+		TalkbackDevice:       getEnv("TALKBACK_DEVICE", ""),
+		OnvifEnabled:         getEnvBool("ONVIF_ENABLED", false),
+		OnvifUser:            getEnv("ONVIF_USER", ""),
+		OnvifPass:            getSecret("ONVIF_PASS"),
+		ProfilesFile:         getEnv("PROFILES_FILE", ""),
+		OverridesFile:        getEnv("OVERRIDES_FILE", ""),
+	}
+	// A broken PROFILES_FILE leaves the built-in profiles, and a broken
+	// OVERRIDES_FILE no overrides; validateConfig reports the error.
+	cfg.Profiles, _ = loadProfiles(cfg.ProfilesFile)
+	cfg.Overrides, _ = loadOverrides(cfg.OverridesFile)
+	return cfg
+}
+
+// config returns the active configuration. It is swapped atomically on
+// reload, so callers should not hold on to it across long operations.
+func (a *Agent) config() *Config {
+	return a.cfg.Load()
 }
 
+const watchedScanInterval = 5 * time.Minute
+
+// discoveryLoop polls for cameras. While the device watch runs, a full scan
+// (which execs v4l2-ctl) only happens every watchedScanInterval as a safety
+// net; the ticks in between just retry queued publishers.
 func (a *Agent) discoveryLoop() {
-	ticker := time.NewTicker(a.cfg.DiscoveryInterval)
+	interval := a.config().DiscoveryInterval
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	lastScan := time.Now()
 	for range ticker.C {
-		a.refreshCameras()
+		if a.devWatch.Load() && time.Since(lastScan) < watchedScanInterval {
+			a.mu.Lock()
+			a.startQueuedLocked()
+			a.mu.Unlock()
+			continue
+		}
+		lastScan = time.Now()
+		a.discoverCameras(true)
+		if next := a.config().DiscoveryInterval; next != interval {
+			interval = next
+			ticker.Reset(interval)
+		}
 	}
 }
 
 func (a *Agent) heartbeatLoop() {
-	ticker := time.NewTicker(a.cfg.HeartbeatInterval)
+	interval := a.config().HeartbeatInterval
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for range ticker.C {
 		a.registerCameras()
+		if next := a.config().HeartbeatInterval; next != interval {
+			interval = next
+			ticker.Reset(interval)
+		}
 	}
 }
 
+// refreshCameras rebuilds every camera from a fresh discovery, for startup
+// and configuration changes that affect all of them.
 func (a *Agent) refreshCameras() {
-	devices := discoverDevices()
+	a.applyDevices(scanDevices(a.config()), true)
+}
+
+// discoverCameras applies a discovery result only when the devices differ
+// from the ones the cameras were built from, and then only the cameras that
+// were added, removed or changed. With debounce, a change must still be
+// there DISCOVERY_DEBOUNCE_MS later, so a camera dropping off the bus for a
+// moment does not restart its publisher.
+func (a *Agent) discoverCameras(debounce bool) {
+	devices := scanDevices(a.config())
+	delay := a.config().DiscoveryDebounce
+	a.mu.Lock()
+	if devicesEqual(devices, a.devices) {
+		a.pendingDevices, a.pendingSince = nil, time.Time{}
+		// The periodic scan also retries publishers queued for CPU load.
+		a.startQueuedLocked()
+		a.mu.Unlock()
+		return
+	}
+	if debounce && delay > 0 {
+		if a.pendingSince.IsZero() || !devicesEqual(devices, a.pendingDevices) {
+			a.pendingDevices, a.pendingSince = devices, time.Now()
+			a.mu.Unlock()
+			time.AfterFunc(delay, func() { a.discoverCameras(true) })
+			return
+		}
+		if time.Since(a.pendingSince) < delay {
+			a.mu.Unlock()
+			return
+		}
+	}
+	a.pendingDevices, a.pendingSince = nil, time.Time{}
+	a.mu.Unlock()
+	a.applyDevices(devices, false)
+}
+
+func scanDevices(cfg *Config) []DeviceInfo {
+	devices := listDevices(cfg)
 	sort.Slice(devices, func(i, j int) bool {
 		return devices[i].Node < devices[j].Node
 	})
+	return devices
+}
+
+func devicesEqual(a, b []DeviceInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Node != b[i].Node || a[i].ID != b[i].ID || strings.Join(a[i].Nodes, ",") != strings.Join(b[i].Nodes, ",") {
+			return false
+		}
+	}
+	return true
+}
 
+// applyDevices builds the camera list from discovered devices. Unless all
+// is set, cameras whose device is unchanged are kept as they are, and the
+// settings are saved only when a camera came or went.
+func (a *Agent) applyDevices(devices []DeviceInfo, all bool) {
 	hostSlug := slugify(a.hostname)
 
+	if a.config().MediamtxManaged {
+		defer a.syncMediamtxConfig()
+	}
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
@@ -189,113 +996,422 @@ func (a *Agent) refreshCameras() {
 		}
 
 		streamPath := fmt.Sprintf("%s-%s-%d", hostSlug, slugify(name), idx)
-		deviceUID := fmt.Sprintf("%s:%s", a.hostname, device.Node)
-		enabled, ok := a.state[deviceUID]
-		if !ok {
-			enabled = false
-			a.state[deviceUID] = false
+		deviceUID := fmt.Sprintf("%s:%s", a.agentID, device.Node)
+		if device.ID != "" {
+			deviceUID = fmt.Sprintf("%s:%s", a.agentID, device.ID)
+			a.adoptNodeSettingsLocked(deviceUID, device.Node)
+		}
+		prev := a.cameras[deviceUID]
+		if prev != nil && !all && prev.Node == device.Node && prev.DeviceName == name && prev.StreamPath == streamPath {
+			next[deviceUID] = prev
+			continue
+		}
+		if prev != nil && prev.Node != device.Node {
+			// Replugged into another port: the workers still use the old node.
+			logInfo("%s moved from %s to %s", deviceUID, prev.Node, device.Node)
+			a.stopCameraLocked(deviceUID)
+		}
+		settings := a.settingsLocked(deviceUID)
+		displayName := name
+		if settings.Name != "" {
+			displayName = settings.Name
+		}
+		enabled := settings.Enabled
+		output := settings.Output
+		if output == "" {
+			output = a.config().PublishOutput
+		}
+		backend := settings.Backend
+		if backend == "" {
+			backend = a.config().PublishBackend
+		}
+		publishUser, publishPass := settings.PublishUser, settings.PublishPass
+		if publishUser == "" {
+			publishUser, publishPass = a.config().PublishUser, a.config().PublishPass
 		}
 
 		camera := &Camera{
 			DeviceUID:  deviceUID,
-			Name:       name,
+			Name:       displayName,
+			DeviceName: name,
 			Node:       device.Node,
 			StreamPath: streamPath,
-			RtspURL:    fmt.Sprintf("%s/%s", strings.TrimRight(a.cfg.MediaMtxRtspBase, "/"), streamPath),
+			RtspURL:    fmt.Sprintf("%s/%s", strings.TrimRight(a.config().MediaMtxRtspBase, "/"), streamPath),
 			Enabled:    enabled,
 			Publishing: a.publishers[deviceUID] != nil,
+			Output:     output,
+			Backend:    backend,
+			Record:     a.recordEnabledLocked(deviceUID),
+			Recording:  a.recorders[deviceUID] != nil,
+			Rotate:     settings.Rotate,
+			HFlip:      settings.HFlip,
+			VFlip:      settings.VFlip,
+			Overlay:    settings.Overlay,
+			Schedule:   settings.Schedule,
+
+			Deinterlace: settings.Deinterlace,
+			Denoise:     settings.Denoise,
+
+			RetentionQuotaMB: settings.RetentionQuotaMB,
+
+			PublishUser: publishUser,
+			PublishPass: publishPass,
+
+			EncoderTuning: settings.EncoderTuning,
+			ThumbnailURL:  thumbnailURL(a.config().BasePath, deviceUID),
+			AudioDevice:   settings.AudioDevice,
+
+			FFmpegOverrides: a.overridesFor(deviceUID, device.Node),
+			Profile:         settings.Profile,
+			FrameGeometry:   settings.FrameGeometry,
+			Order:           settings.Order,
+			Tags:            settings.Tags,
+		}
+		camera.TalkbackDevice = settings.TalkbackDevice
+		if camera.TalkbackDevice == "" {
+			camera.TalkbackDevice = a.config().TalkbackDevice
+		}
+		if settings.RtmpURL != "" {
+			camera.RtmpURL = settings.RtmpURL
+			camera.RtmpTarget = redactStreamKey(settings.RtmpURL)
+		}
+		if a.substreamEnabledLocked(camera) {
+			camera.SubstreamPath = streamPath + substreamSuffix
+			camera.SubstreamURL = camera.RtspURL + substreamSuffix
 		}
+		if prev != nil {
+			camera.Motion = prev.Motion
+			camera.Queued = prev.Queued
+			camera.QueueReason = prev.QueueReason
+			camera.Unsupported = prev.Unsupported
+			camera.WaitingMedia = prev.WaitingMedia
+			camera.Unreadable = prev.Unreadable
+			camera.Readers = prev.Readers
+			camera.Idle = prev.Idle
+			camera.PTZ = prev.PTZ
+			camera.FPS = prev.FPS
+			camera.Speed = prev.Speed
+			camera.BytesSent = prev.BytesSent
+			camera.BitrateKbps = prev.BitrateKbps
+			camera.QualityLevel = prev.QualityLevel
+			camera.Talking = prev.Talking
+			if prev.AudioDevice == camera.AudioDevice {
+				camera.AudioLevel = prev.AudioLevel
+				camera.Silent = prev.Silent
+			}
+		} else {
+			go a.detectPTZ(deviceUID, device.Node)
+		}
+
+		camera.OffSchedule = a.offScheduleLocked(camera, time.Now())
 
 		next[deviceUID] = camera
-		if enabled {
-			a.ensurePublisherLocked(camera)
-			a.ensureMotionLocked(camera)
+		if a.activeLocked(camera) {
+			a.startCameraLocked(camera)
 		} else {
-			a.stopPublisherLocked(deviceUID)
-			a.stopMotionLocked(deviceUID)
+			a.stopCameraLocked(deviceUID)
 		}
 	}
 
-	for uid := range a.cameras {
+	changed := all
+	for uid, cam := range a.cameras {
 		if next[uid] == nil {
-			a.stopPublisherLocked(uid)
-			a.stopMotionLocked(uid)
+			changed = true
+			a.rememberCameraLocked(cam)
+			a.stopCameraLocked(uid)
+			delete(a.thumbs, uid)
+			a.emit("camera_removed", uid, map[string]interface{}{"name": cam.Name, "node": cam.Node})
+		}
+	}
+	for uid, cam := range next {
+		if a.cameras[uid] == nil {
+			changed = true
+			a.rememberCameraLocked(cam)
+			a.emit("camera_added", uid, map[string]interface{}{"name": cam.Name, "node": cam.Node})
 		}
+		delete(a.missing, uid)
 	}
 
 	a.cameras = next
-	_ = saveState(a.cfg.StateFile, a.state)
+	a.devices = devices
+	if changed {
+		a.saveStateLocked()
+	}
 }
 
+// activeLocked reports whether a camera's workers should run: it is enabled,
+// inside its schedule, privacy and maintenance mode are off and the agent is
+// not stopping.
+func (a *Agent) activeLocked(cam *Camera) bool {
+	return cam.Enabled && !cam.OffSchedule && !a.privacy && !a.maintenance && !a.stopping
+}
+
+// cameraStatusLocked summarises a camera's state for the hub: publishing,
+// starting, queued, idle, off_schedule, privacy, maintenance, disabled, or
+// process_stuck while its last publisher cannot be killed.
+func (a *Agent) cameraStatusLocked(cam *Camera) string {
+	switch {
+	case a.unkillable[cam.DeviceUID]:
+		return "process_stuck"
+	case !cam.Enabled:
+		return "disabled"
+	case a.privacy:
+		return "privacy"
+	case a.maintenance:
+		return "maintenance"
+	case cam.OffSchedule:
+		return "off_schedule"
+	case cam.Publishing && cam.Unreadable != "":
+		return "publishing_unreadable"
+	case cam.Publishing:
+		return "publishing"
+	case cam.Unsupported != "":
+		return "unsupported"
+	case cam.WaitingMedia:
+		return "waiting_media_server"
+	case cam.Queued:
+		return "queued"
+	case cam.Idle:
+		return "idle"
+	}
+	return "starting"
+}
+
+// offlineCamerasLocked lists cameras this agent has seen, or has settings
+// for, that are not currently attached, so the hub can mark them offline
+// instead of keeping stale entries.
+func (a *Agent) offlineCamerasLocked() []map[string]interface{} {
+	entries := make([]map[string]interface{}, 0)
+	prefix := a.agentID + ":"
+	for uid, settings := range a.state {
+		if a.cameras[uid] != nil || !strings.HasPrefix(uid, prefix) {
+			continue
+		}
+		entry := map[string]interface{}{
+			"status":    "offline",
+			"deviceUid": uid,
+			"enabled":   settings.Enabled,
+		}
+		if known, ok := a.missing[uid]; ok {
+			entry["name"] = known.Name
+			entry["streamPath"] = known.StreamPath
+			entry["rtspUrl"] = known.RtspURL
+			entry["lastSeen"] = known.LastSeen
+		} else if settings.Name != "" {
+			entry["name"] = settings.Name
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// startCameraLocked brings up every worker that follows a camera's enabled
+// state; stopCameraLocked tears them down again.
+func (a *Agent) startCameraLocked(camera *Camera) {
+	a.ensurePublisherLocked(camera)
+	a.ensureMotionLocked(camera)
+	a.ensureRecorderLocked(camera)
+	a.ensureAudioMeterLocked(camera)
+}
+
+func (a *Agent) stopCameraLocked(uid string) {
+	a.stopPublisherLocked(uid)
+	a.stopMotionLocked(uid)
+	a.stopRecorderLocked(uid)
+	a.stopAudioMeterLocked(uid)
+	a.stopTalkbackLocked(uid)
+	if cam := a.cameras[uid]; cam != nil {
+		cam.Queued = false
+		cam.QueueReason = ""
+		cam.Unsupported = ""
+		cam.WaitingMedia = false
+	}
+	a.startQueuedLocked()
+}
+
+// adoptNodeSettingsLocked moves settings saved under the node-based UID used
+// before stable identities to the stable UID, the first time it is seen.
+func (a *Agent) adoptNodeSettingsLocked(deviceUID, node string) {
+	if a.state[deviceUID] != nil {
+		return
+	}
+	legacyUID := fmt.Sprintf("%s:%s", a.agentID, node)
+	if settings := a.state[legacyUID]; settings != nil {
+		a.state[deviceUID] = settings
+		delete(a.state, legacyUID)
+	}
+}
+
+// ensurePublisherLocked starts a publisher for the camera unless one is
+// running or scheduled. With PUBLISH_STAGGER_MS set, starts are spaced out so
+// many cameras do not spawn ffmpeg at the same moment.
 func (a *Agent) ensurePublisherLocked(camera *Camera) {
-	if a.publishers[camera.DeviceUID] != nil {
+	uid := camera.DeviceUID
+	if a.publishers[uid] != nil || a.pendingStarts[uid] != nil {
+		return
+	}
+	if a.onDemandLocked(camera) && !a.demandedLocked(uid) {
+		camera.Idle = true
 		return
 	}
+	camera.Idle = false
+
+	if stagger := a.config().PublishStagger; stagger > 0 {
+		now := time.Now()
+		if wait := a.nextPublisherStart.Sub(now); wait > 0 {
+			a.nextPublisherStart = a.nextPublisherStart.Add(stagger)
+			a.pendingStarts[uid] = time.AfterFunc(wait, func() {
+				a.mu.Lock()
+				defer a.mu.Unlock()
+				delete(a.pendingStarts, uid)
+				if cam := a.cameras[uid]; cam != nil && a.activeLocked(cam) {
+					a.startPublisherLocked(cam)
+				}
+			})
+			return
+		}
+		a.nextPublisherStart = now.Add(stagger)
+	}
+	a.startPublisherLocked(camera)
+}
 
-	args := []string{
-		"-f", "v4l2",
-		"-i", camera.Node,
-		"-vf", "format=yuv420p",
-		"-c:v", "libx264",
-		"-preset", "veryfast",
-		"-tune", "zerolatency",
-		"-g", "10",
-		"-keyint_min", "10",
-		"-sc_threshold", "0",
-		"-profile:v", "baseline",
-		"-level:v", "3.1",
-		"-pix_fmt", "yuv420p",
-		"-f", "rtsp",
-		"-rtsp_transport", "tcp",
-		camera.RtspURL,
+func (a *Agent) startPublisherLocked(camera *Camera) {
+	if a.publishers[camera.DeviceUID] != nil || a.terminating[camera.DeviceUID] != nil {
+		// A publisher still exiting holds the device; its exit restarts it.
+		return
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	cmd := exec.CommandContext(ctx, a.cfg.FfmpegPath, args...)
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		logInfo("ffmpeg stderr pipe error for %s: %v", camera.DeviceUID, err)
-		cancel()
+	if err := a.ffmpegCaps.Load().checkCamera(camera, a.encodingProfile(camera)); err != nil {
+		if camera.Unsupported != err.Error() {
+			logError("publisher not started for %s: %v", camera.DeviceUID, err)
+			a.cameraLog(camera.DeviceUID).Add(err.Error())
+			a.emit("publisher_error", camera.DeviceUID, map[string]interface{}{"error": err.Error()})
+		}
+		camera.Unsupported = err.Error()
 		return
 	}
+	camera.Unsupported = ""
 
-	if err := cmd.Start(); err != nil {
-		logInfo("ffmpeg start failed for %s: %v", camera.DeviceUID, err)
-		cancel()
+	if camera.Output == outputRTSP && !a.mediaServerReady() {
+		camera.WaitingMedia = true
+		return
+	}
+	camera.WaitingMedia = false
+
+	if ok, reason := a.admitPublisherLocked(); !ok {
+		if !camera.Queued || camera.QueueReason != reason {
+			logInfo("publisher queued for %s: %s", camera.DeviceUID, reason)
+			a.emit("publisher_queued", camera.DeviceUID, map[string]interface{}{"reason": reason})
+		}
+		camera.Queued = true
+		camera.QueueReason = reason
+		return
+	}
+	camera.Queued = false
+	camera.QueueReason = ""
+
+	a.applySavedControlsLocked(camera)
+	publisher := publisherFor(camera)
+	backend := camera.Backend
+
+	proc, err := publisher.Start(publisher.Command(a, camera))
+	if err != nil {
+		logError("%s start failed for %s: %v", backend, camera.DeviceUID, err)
 		return
 	}
 
-	a.publishers[camera.DeviceUID] = cmd
+	a.publishers[camera.DeviceUID] = proc
 	camera.Publishing = true
+	a.emit("publisher_started", camera.DeviceUID, map[string]interface{}{"output": camera.Output, "backend": backend})
+	if camera.Output != outputRTMP && a.config().StreamVerify {
+		go a.verifyStream(camera.DeviceUID, proc)
+	}
 
-	go func(uid string, stream io.ReadCloser) {
+	go func(uid, secret string, stream io.Reader, logs *LogBuffer) {
+		var lastSize int64
+		var lastAt time.Time
 		scanner := bufio.NewScanner(stream)
+		scanner.Split(scanOutputLines)
 		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
+			line := redactSecret(strings.TrimSpace(scanner.Text()), secret)
+			if fps, ok := parseProgressFPS(line); ok {
+				speed, hasSpeed := parseProgressSpeed(line)
+				size, hasSize := parseProgressSize(line)
+				now := time.Now()
+				a.mu.Lock()
+				if cam := a.cameras[uid]; cam != nil && a.publishers[uid] == proc {
+					cam.FPS = fps
+					if hasSpeed {
+						cam.Speed = speed
+					}
+					if hasSize {
+						if elapsed := now.Sub(lastAt).Seconds(); !lastAt.IsZero() && elapsed > 0 && size >= lastSize {
+							cam.BitrateKbps = float64(size-lastSize) * 8 / 1000 / elapsed
+						}
+						cam.BytesSent = size
+					}
+				}
+				a.mu.Unlock()
+				if hasSize {
+					lastSize, lastAt = size, now
+				}
+				continue
+			}
 			if line != "" {
-				logInfo("[ffmpeg:%s] %s", uid, line)
+				logAt(outputLineLevel(line), fmt.Sprintf("[%s:%s] %s", backend, uid, line))
+				logs.Add(line)
 			}
 		}
-	}(camera.DeviceUID, stderr)
+	}(camera.DeviceUID, a.publisherSecret(camera), proc.Output(), a.cameraLog(camera.DeviceUID))
 
 	go func(uid string) {
-		err := cmd.Wait()
-		cancel()
+		err := proc.Wait()
 		a.mu.Lock()
-		delete(a.publishers, uid)
+		// A publisher still in the map exited on its own rather than being
+		// stopped, so report it as an error.
+		unexpected := a.publishers[uid] == proc
+		if a.terminating[uid] == proc {
+			delete(a.terminating, uid)
+			if a.unkillable[uid] {
+				delete(a.unkillable, uid)
+				logInfo("stuck publisher for %s has exited", uid)
+			}
+		}
+		if unexpected {
+			delete(a.publishers, uid)
+			if cam := a.cameras[uid]; cam != nil {
+				cam.Publishing = false
+				cam.Unreadable = ""
+				cam.FPS = 0
+				cam.Speed = 0
+				cam.BitrateKbps = 0
+			}
+		}
 		cam := a.cameras[uid]
-		enabled := cam != nil && cam.Enabled
+		enabled := cam != nil && a.activeLocked(cam)
 		a.mu.Unlock()
 
 		if err != nil {
-			logInfo("ffmpeg exited for %s: %v", uid, err)
+			if unexpected {
+				logError("%s exited for %s: %v", backend, uid, err)
+			} else {
+				logInfo("%s exited for %s: %v", backend, uid, err)
+			}
+			a.cameraLog(uid).Add(fmt.Sprintf("%s exited: %v", backend, err))
+		}
+		if unexpected {
+			data := map[string]interface{}{}
+			if err != nil {
+				data["error"] = err.Error()
+			}
+			a.emit("publisher_error", uid, data)
 		}
 
 		if enabled {
-			time.Sleep(a.cfg.RestartDelay)
+			time.Sleep(a.config().RestartDelay)
 			a.mu.Lock()
 			cam = a.cameras[uid]
-			if cam != nil && cam.Enabled {
+			if cam != nil && a.activeLocked(cam) {
 				a.ensurePublisherLocked(cam)
 			}
 			a.mu.Unlock()
@@ -303,21 +1419,297 @@ func (a *Agent) ensurePublisherLocked(camera *Camera) {
 	}(camera.DeviceUID)
 }
 
+// publisherArgs builds the ffmpeg command line for a camera. The encoder
+// settings are shared; only the muxer and destination depend on the output.
+func (a *Agent) publisherArgs(camera *Camera) []string {
+	var args []string
+	if camera.RtBufSize != "" {
+		args = append(args, "-rtbufsize", camera.RtBufSize)
+	}
+	args = append(args, camera.InputArgs...)
+	args = append(args, captureInput(camera.Node)...)
+	profile := a.encodingProfile(camera)
+	if profile.isCopy() {
+		args = append(args, "-c:v", encoderCopy)
+		args = append(args, camera.OutputArgs...)
+		return append(args, a.outputArgs(camera, camera.StreamPath, camera.RtspURL)...)
+	}
+	encoder := profile.encoderArgs(camera)
+	if camera.SubstreamPath == "" {
+		args = append(args, "-vf", a.videoFilters(camera))
+		args = append(args, encoder...)
+		return append(args, a.outputArgs(camera, camera.StreamPath, camera.RtspURL)...)
+	}
+
+	// Both renditions share the capture and filter chain; split feeds the
+	// second copy through a scaler into its own encoder and output.
+	graph := fmt.Sprintf("[0:v]%s,split=2[main][s];[s]scale=-2:'min(ih,%d)'[sub]", a.videoFilters(camera), a.config().SubstreamHeight)
+	args = append(args, "-filter_complex", graph, "-map", "[main]")
+	args = append(args, encoder...)
+	args = append(args, a.outputArgs(camera, camera.StreamPath, camera.RtspURL)...)
+	args = append(args, "-map", "[sub]")
+	// The profile's bitrate is sized for the main rendition.
+	sub := profile
+	sub.BitrateKbps = 0
+	args = append(args, sub.encoderArgs(camera)...)
+	return append(args, a.outputArgs(camera, camera.SubstreamPath, camera.SubstreamURL)...)
+}
+
+// outputArgs returns the muxer and destination for one rendition of a camera.
+func (a *Agent) outputArgs(camera *Camera, streamPath, rtspURL string) []string {
+	switch camera.Output {
+	case outputSRT:
+		return []string{"-f", "mpegts", a.srtURL(camera, streamPath)}
+	case outputRTMP:
+		return []string{"-f", "flv", camera.RtmpURL}
+	case outputWHIP:
+		return []string{"-f", "whip", fmt.Sprintf("%s/%s/whip", strings.TrimRight(a.config().MediaMtxWhipBase, "/"), streamPath)}
+	}
+	args := []string{"-f", "rtsp", "-rtsp_transport", "tcp"}
+	args = append(args, a.rtspTLSArgs(rtspURL)...)
+	return append(args, publishURL(camera, rtspURL))
+}
+
+// videoFilters builds the publisher filter chain from the camera transforms
+// and the optional timestamp overlay.
+func (a *Agent) videoFilters(camera *Camera) string {
+	var filters []string
+	if camera.Filters != "" {
+		filters = append(filters, camera.Filters)
+	}
+	// Deinterlacing must see the full-height fields, so it runs before any
+	// crop or scale; denoising is cheapest before upscaling.
+	if camera.Deinterlace {
+		filters = append(filters, "yadif")
+	}
+	if camera.Denoise {
+		filters = append(filters, "hqdn3d")
+	}
+	filters = append(filters, camera.FrameGeometry.filters()...)
+	switch camera.Rotate {
+	case 90:
+		filters = append(filters, "transpose=clock")
+	case 180:
+		filters = append(filters, "hflip", "vflip")
+	case 270:
+		filters = append(filters, "transpose=cclock")
+	}
+	if camera.HFlip {
+		filters = append(filters, "hflip")
+	}
+	if camera.VFlip {
+		filters = append(filters, "vflip")
+	}
+	if camera.Overlay {
+		filters = append(filters, a.overlayFilter(camera.Name))
+	}
+	profile := a.encodingProfile(camera)
+	if profile.FPS > 0 {
+		filters = append(filters, fmt.Sprintf("fps=%d", profile.FPS))
+	}
+	if height := profile.maxHeight(camera.QualityLevel); height > 0 {
+		filters = append(filters, fmt.Sprintf("scale=-2:'min(ih,%d)'", height))
+	}
+	filters = append(filters, "format=yuv420p")
+	return strings.Join(filters, ",")
+}
+
+var overlayUnsafe = regexp.MustCompile(`[^A-Za-z0-9 ._()-]+`)
+
+// overlayFilter burns the local time and camera name into the frame. The name
+// is reduced to characters that need no drawtext escaping.
+func (a *Agent) overlayFilter(name string) string {
+	text := "%{localtime\\:%Y-%m-%d %T}"
+	if name = strings.TrimSpace(overlayUnsafe.ReplaceAllString(name, "")); name != "" {
+		text += "  " + name
+	}
+	filter := fmt.Sprintf("drawtext=text='%s':x=10:y=10:fontsize=20:fontcolor=white:box=1:boxcolor=black@0.5:boxborderw=4", text)
+	if a.config().OverlayFont != "" {
+		filter += ":fontfile='" + a.config().OverlayFont + "'"
+	}
+	return filter
+}
+
+// srtURL addresses the MediaMTX SRT listener. MediaMTX selects the path from
+// the streamid; ffmpeg expects the latency in microseconds.
+func (a *Agent) srtURL(camera *Camera, streamPath string) string {
+	cfg := a.config()
+	query := url.Values{}
+	query.Set("streamid", srtStreamID(camera, streamPath))
+	query.Set("pkt_size", "1316")
+	query.Set("latency", strconv.FormatInt(cfg.SrtLatency.Microseconds(), 10))
+	if cfg.SrtPassphrase != "" {
+		query.Set("passphrase", cfg.SrtPassphrase)
+	}
+	return strings.TrimRight(cfg.MediaMtxSrtBase, "/") + "?" + query.Encode()
+}
+
+// substreamSuffix names a camera's low-resolution path after its main one,
+// e.g. cam-1 and cam-1-sub.
+const substreamSuffix = "-sub"
+
+// substreamEnabledLocked reports whether a camera publishes a substream. A
+// per-camera setting overrides the SUBSTREAM_ENABLED default. Only an
+// ffmpeg publisher that decodes the video and publishes to MediaMTX can
+// produce one.
+func (a *Agent) substreamEnabledLocked(camera *Camera) bool {
+	if camera.Backend != backendFFmpeg || camera.Output == outputRTMP || a.encodingProfile(camera).isCopy() {
+		return false
+	}
+	if settings := a.state[camera.DeviceUID]; settings != nil && settings.Substream != nil {
+		return *settings.Substream
+	}
+	return a.config().SubstreamEnabled
+}
+
+// publishURL adds the camera's publish credentials, if any, to an RTSP URL.
+func publishURL(camera *Camera, rtspURL string) string {
+	if camera.PublishUser == "" {
+		return rtspURL
+	}
+	parsed, err := url.Parse(rtspURL)
+	if err != nil {
+		return rtspURL
+	}
+	parsed.User = url.UserPassword(camera.PublishUser, camera.PublishPass)
+	return parsed.String()
+}
+
+// rtspPublishAllowed decides who may publish to the built-in RTSP server:
+// a camera's path takes its publish credentials, any other path, such as
+// selftest's, PUBLISH_USER and PUBLISH_PASS. Without credentials only
+// local publishers are accepted.
+func (a *Agent) rtspPublishAllowed(path, user, pass string, loopback bool) bool {
+	cfg := a.config()
+	wantUser, wantPass := cfg.PublishUser, cfg.PublishPass
+	a.mu.Lock()
+	for _, cam := range a.cameras {
+		if cam.StreamPath == path || (cam.SubstreamPath != "" && cam.SubstreamPath == path) {
+			wantUser, wantPass = cam.PublishUser, cam.PublishPass
+			break
+		}
+	}
+	a.mu.Unlock()
+	if wantUser == "" {
+		return loopback
+	}
+	return user == wantUser && subtle.ConstantTimeCompare([]byte(pass), []byte(wantPass)) == 1
+}
+
+// srtStreamID follows MediaMTX's "publish:path:user:pass" convention.
+func srtStreamID(camera *Camera, streamPath string) string {
+	id := "publish:" + streamPath
+	if camera.PublishUser != "" {
+		id += ":" + camera.PublishUser + ":" + camera.PublishPass
+	}
+	return id
+}
+
+func normalizeOutput(value string) string {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case outputWHIP:
+		return outputWHIP
+	case outputSRT:
+		return outputSRT
+	case outputRTMP:
+		return outputRTMP
+	default:
+		return outputRTSP
+	}
+}
+
+func isValidOutput(value string) bool {
+	switch value {
+	case outputRTSP, outputWHIP, outputSRT, outputRTMP:
+		return true
+	}
+	return false
+}
+
 func (a *Agent) stopPublisherLocked(uid string) {
-	cmd := a.publishers[uid]
-	if cmd == nil {
+	if timer := a.pendingStarts[uid]; timer != nil {
+		timer.Stop()
+		delete(a.pendingStarts, uid)
+	}
+
+	proc := a.publishers[uid]
+	if proc == nil {
 		return
 	}
 
-	_ = cmd.Process.Signal(os.Interrupt)
+	a.terminatePublisherLocked(uid, proc)
 	delete(a.publishers, uid)
 	if cam := a.cameras[uid]; cam != nil {
 		cam.Publishing = false
+		cam.Unreadable = ""
+		cam.FPS = 0
+		cam.Speed = 0
+		cam.BitrateKbps = 0
+	}
+	a.emit("publisher_stopped", uid, nil)
+}
+
+// terminatePublisherLocked asks a publisher to stop with SIGINT, so ffmpeg
+// can finish its output, and kills it when it has not exited within
+// PUBLISHER_STOP_TIMEOUT_MS. A process that outlives SIGKILL too, typically
+// stuck in a camera driver, keeps the device busy; its camera reports
+// process_stuck until it is gone. The camera does not start again before
+// the old process has exited.
+func (a *Agent) terminatePublisherLocked(uid string, proc Process) {
+	a.terminating[uid] = proc
+	// Interrupt fails where there are no signals, as on Windows.
+	interrupted := proc.Interrupt() == nil
+	timeout := a.config().PublisherStopTimeout
+	go func() {
+		if interrupted {
+			select {
+			case <-proc.Exited():
+				return
+			case <-time.After(timeout):
+			}
+			logWarn("publisher for %s did not stop within %s, killing it", uid, timeout)
+		}
+		_ = proc.Kill()
+		select {
+		case <-proc.Exited():
+			return
+		case <-time.After(killWaitTimeout):
+		}
+		a.mu.Lock()
+		stuck := a.terminating[uid] == proc
+		if stuck {
+			a.unkillable[uid] = true
+		}
+		a.mu.Unlock()
+		if stuck {
+			logError("publisher for %s survived SIGKILL; %s stays busy until it exits", uid, proc.Argv()[0])
+			a.emit("publisher_unkillable", uid, nil)
+		}
+	}()
+}
+
+// waitTerminated waits for stopped publishers to exit, up to the time
+// terminatePublisherLocked gives them, so devices and recordings are released
+// before the agent exits or restarts.
+func (a *Agent) waitTerminated() {
+	a.mu.Lock()
+	procs := make([]Process, 0, len(a.terminating))
+	for _, proc := range a.terminating {
+		procs = append(procs, proc)
+	}
+	a.mu.Unlock()
+	deadline := time.After(a.config().PublisherStopTimeout + killWaitTimeout)
+	for _, proc := range procs {
+		select {
+		case <-proc.Exited():
+		case <-deadline:
+			return
+		}
 	}
 }
 
 func (a *Agent) ensureMotionLocked(camera *Camera) {
-	if !a.cfg.MotionEnabled {
+	if !a.config().MotionEnabled || camera.Output == outputRTMP {
 		return
 	}
 	if a.motions[camera.DeviceUID] != nil {
@@ -327,7 +1719,7 @@ func (a *Agent) ensureMotionLocked(camera *Camera) {
 	ctx, cancel := context.WithCancel(context.Background())
 	a.motions[camera.DeviceUID] = &MotionWorker{cancel: cancel}
 
-	source := strings.ToLower(strings.TrimSpace(a.cfg.MotionSource))
+	source := strings.ToLower(strings.TrimSpace(a.config().MotionSource))
 	if source == "" {
 		source = "rtsp"
 	}
@@ -345,14 +1737,14 @@ func (a *Agent) stopMotionLocked(uid string) {
 }
 
 func (a *Agent) runMotionLoop(ctx context.Context, deviceUID, node, streamPath, source string) {
-	width := a.cfg.MotionWidth
-	height := a.cfg.MotionHeight
+	width := a.config().MotionWidth
+	height := a.config().MotionHeight
 	if width <= 0 || height <= 0 {
-		logInfo("motion disabled for %s: invalid size %dx%d", deviceUID, width, height)
+		logWarn("motion disabled for %s: invalid size %dx%d", deviceUID, width, height)
 		return
 	}
 
-	fps := a.cfg.MotionFPS
+	fps := a.config().MotionFPS
 	if fps <= 0 {
 		fps = 1
 	}
@@ -366,18 +1758,18 @@ func (a *Agent) runMotionLoop(ctx context.Context, deviceUID, node, streamPath,
 			return
 		}
 		if err != nil {
-			logInfo("motion process ended for %s: %v", deviceUID, err)
+			logWarn("motion process ended for %s: %v", deviceUID, err)
 		}
-		time.Sleep(a.cfg.RestartDelay)
+		time.Sleep(a.config().RestartDelay)
 	}
 }
 
 func (a *Agent) runMotionProcess(ctx context.Context, deviceUID, node, streamPath, source string, fps, width, height int) error {
 	args := []string{}
 	if source == "device" {
-		args = append(args, "-f", "v4l2", "-i", node)
+		args = append(args, captureInput(node)...)
 	} else {
-		rtspURL := fmt.Sprintf("%s/%s", strings.TrimRight(a.cfg.MediaMtxRtspBase, "/"), streamPath)
+		rtspURL := fmt.Sprintf("%s/%s", strings.TrimRight(a.config().MediaMtxRtspBase, "/"), streamPath)
 		args = append(args,
 			"-rtsp_transport", "tcp",
 			"-timeout", "5000000",
@@ -385,8 +1777,9 @@ func (a *Agent) runMotionProcess(ctx context.Context, deviceUID, node, streamPat
 			"-flags", "low_delay",
 			"-analyzeduration", "0",
 			"-probesize", "32",
-			"-i", rtspURL,
 		)
+		args = append(args, a.rtspTLSArgs(rtspURL)...)
+		args = append(args, "-i", rtspURL)
 	}
 
 	filter := fmt.Sprintf("fps=%d,scale=%d:%d,format=gray", fps, width, height)
@@ -398,7 +1791,7 @@ func (a *Agent) runMotionProcess(ctx context.Context, deviceUID, node, streamPat
 		"pipe:1",
 	)
 
-	cmd := exec.CommandContext(ctx, a.cfg.FfmpegPath, args...)
+	cmd := exec.CommandContext(ctx, a.config().FfmpegPath, args...)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -421,9 +1814,15 @@ func (a *Agent) runMotionProcess(ctx context.Context, deviceUID, node, streamPat
 		return err
 	}
 
-	threshold := a.cfg.MotionThreshold
+	threshold := a.config().MotionThreshold
 	consecutive := 0
-	lastEvent := time.Time{}
+	active := false
+	lastMotion := time.Time{}
+	defer func() {
+		if active {
+			a.setMotionState(deviceUID, streamPath, false, time.Now(), 0)
+		}
+	}()
 
 	for {
 		select {
@@ -445,166 +1844,963 @@ func (a *Agent) runMotionProcess(ctx context.Context, deviceUID, node, streamPat
 			consecutive = 0
 		}
 
-		if consecutive >= a.cfg.MotionConsecutive {
-			now := time.Now()
-			if lastEvent.IsZero() || now.Sub(lastEvent) >= a.cfg.MotionCooldown {
-				if err := a.sendMotionEvent(deviceUID, streamPath, now, score); err != nil {
-					logInfo("motion event failed for %s: %v", deviceUID, err)
-				}
-				lastEvent = now
+		// Motion starts after enough consecutive changed frames and stops once
+		// the scene has been quiet for the cooldown period.
+		now := time.Now()
+		if consecutive >= a.config().MotionConsecutive {
+			lastMotion = now
+			if !active {
+				active = true
+				a.setMotionState(deviceUID, streamPath, true, now, score)
 			}
+		} else if active && now.Sub(lastMotion) >= a.config().MotionCooldown {
+			active = false
+			a.setMotionState(deviceUID, streamPath, false, now, score)
 		}
 	}
 }
 
+func (a *Agent) setMotionState(deviceUID, streamPath string, active bool, ts time.Time, score float64) {
+	eventType := "motion_stop"
+	if active {
+		eventType = "motion_start"
+	}
+
+	a.mu.Lock()
+	if cam := a.cameras[deviceUID]; cam != nil {
+		cam.Motion = active
+	}
+	a.markMotionClipLocked(deviceUID, active, ts)
+	a.mu.Unlock()
+
+	a.emit(eventType, deviceUID, map[string]interface{}{
+		"streamPath": streamPath,
+		"score":      score,
+	})
+	if err := a.sendMotionEvent(deviceUID, streamPath, eventType, ts, score); err != nil {
+		logWarn("motion event failed for %s: %v", deviceUID, err)
+	}
+}
+
 func meanAbsDiff(a, b []byte) float64 {
 	if len(a) == 0 || len(a) != len(b) {
 		return 0
 	}
-	var sum int64
-	for i := 0; i < len(a); i++ {
-		da := int(a[i])
-		db := int(b[i])
-		if da > db {
-			sum += int64(da - db)
-		} else {
-			sum += int64(db - da)
+	var sum int64
+	for i := 0; i < len(a); i++ {
+		da := int(a[i])
+		db := int(b[i])
+		if da > db {
+			sum += int64(da - db)
+		} else {
+			sum += int64(db - da)
+		}
+	}
+	return float64(sum) / float64(len(a))
+}
+
+func (a *Agent) sendMotionEvent(deviceUID, streamPath, eventType string, ts time.Time, score float64) error {
+	payload := map[string]interface{}{
+		"deviceUid":  deviceUID,
+		"streamPath": streamPath,
+		"event":      eventType,
+		"ts":         ts.UnixMilli(),
+		"score":      score,
+	}
+	body, _ := json.Marshal(payload)
+
+	var errs []error
+	for _, hub := range a.hubs() {
+		if err := a.postMotionEvent(hub, body); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", hub.URL, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (a *Agent) postMotionEvent(hub hubTarget, body []byte) error {
+	req, err := a.newHubRequest(hub, http.MethodPost, "/api/motion", body)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: a.config().MotionTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("motion event rejected: %s", strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (a *Agent) registerCameras() {
+	a.mu.Lock()
+	if a.stopping || a.maintenance || a.enrollmentPendingLocked() {
+		a.mu.Unlock()
+		return
+	}
+	cams := make([]map[string]interface{}, 0)
+	var uplinkKbps float64
+	for _, cam := range a.cameras {
+		cams = append(cams, cameraEntry(cam, a.cameraStatusLocked(cam)))
+		uplinkKbps += cam.BitrateKbps
+	}
+	cams = append(cams, a.offlineCamerasLocked()...)
+	cams = append(cams, a.satelliteCamerasLocked()...)
+	admission := map[string]interface{}{
+		"maxPublishers":    a.config().MaxPublishers,
+		"activePublishers": len(a.publishers),
+		"queued":           a.queuedCountLocked(),
+	}
+	privacy := a.privacy
+	commandsDone := append([]string(nil), a.commandsDone...)
+	diskWarning, recordingPaused := a.diskWarning, a.recordingPaused
+	a.mu.Unlock()
+	if load, ok := cpuLoad(); ok {
+		admission["cpuLoad"] = load
+	}
+	system := a.systemTelemetry()
+	system["uplinkKbps"] = uplinkKbps
+	system["diskWarning"] = diskWarning
+	system["recordingPaused"] = recordingPaused
+	a.clockTelemetry(system)
+
+	payload := map[string]interface{}{
+		"agentId":   a.agentID,
+		"host":      a.hostname,
+		"version":   a.versionStatus(),
+		"cameras":   cams,
+		"admission": admission,
+		"privacy":   privacy,
+		"ffmpeg":    a.ffmpegCaps.Load(),
+		"system":    system,
+	}
+	if len(commandsDone) > 0 {
+		payload["commandsDone"] = commandsDone
+	}
+	body, _ := json.Marshal(payload)
+
+	// Hubs are contacted in parallel so a slow remote hub does not delay a
+	// local one.
+	var wg sync.WaitGroup
+	for _, hub := range a.hubs() {
+		wg.Add(1)
+		go func(hub hubTarget) {
+			defer wg.Done()
+			a.registerWith(hub, body)
+		}(hub)
+	}
+	wg.Wait()
+}
+
+// cameraEntry is a camera as registered with the hubs.
+func cameraEntry(cam *Camera, status string) map[string]interface{} {
+	entry := map[string]interface{}{
+		"status":      status,
+		"enabled":     cam.Enabled,
+		"deviceUid":   cam.DeviceUID,
+		"name":        cam.Name,
+		"rtspUrl":     cam.RtspURL,
+		"streamPath":  cam.StreamPath,
+		"publishing":  cam.Publishing,
+		"queued":      cam.Queued,
+		"offSchedule": cam.OffSchedule,
+		"ptz":         cam.PTZ,
+		"fps":         cam.FPS,
+		"bitrateKbps": cam.BitrateKbps,
+		"bytesSent":   cam.BytesSent,
+		"recording":   cam.Recording,
+	}
+	if cam.QueueReason != "" {
+		entry["queueReason"] = cam.QueueReason
+	}
+	if cam.Unsupported != "" {
+		entry["unsupported"] = cam.Unsupported
+	}
+	if cam.WaitingMedia {
+		entry["waitingMedia"] = true
+	}
+	if cam.Unreadable != "" {
+		entry["unreadable"] = cam.Unreadable
+	}
+	if cam.QualityLevel > 0 {
+		entry["qualityLevel"] = cam.QualityLevel
+	}
+	if cam.SubstreamPath != "" {
+		entry["substreamPath"] = cam.SubstreamPath
+		entry["substreamUrl"] = cam.SubstreamURL
+	}
+	if cam.TalkbackDevice != "" {
+		entry["talkback"] = true
+	}
+	if cam.Output == outputRTMP {
+		entry["rtmpTarget"] = cam.RtmpTarget
+	}
+	if cam.Profile != "" {
+		entry["profile"] = cam.Profile
+	}
+	if cam.Order > 0 {
+		entry["order"] = cam.Order
+	}
+	if len(cam.Tags) > 0 {
+		entry["tags"] = cam.Tags
+	}
+	if cam.AudioLevel != nil {
+		entry["audioLevel"] = *cam.AudioLevel
+		entry["silent"] = cam.Silent
+	}
+	return entry
+}
+
+func (a *Agent) registerWith(hub hubTarget, body []byte) {
+	req, err := a.newHubRequest(hub, http.MethodPost, "/api/agents/register", body)
+	if err != nil {
+		logWarn("register request error for %s: %v", hub.URL, err)
+		return
+	}
+
+	client := &http.Client{Timeout: a.config().RegisterTimeout}
+	sent := time.Now()
+	res, err := client.Do(req)
+	received := time.Now()
+	if err != nil {
+		logWarn("register failed for %s: %v", hub.URL, err)
+		a.setHubConnected(hub.URL, false, err.Error())
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(res.Body)
+		logWarn("register failed for %s: %s %s", hub.URL, res.Status, strings.TrimSpace(string(body)))
+		a.setHubConnected(hub.URL, false, res.Status)
+		return
+	}
+	a.setHubConnected(hub.URL, true, "")
+
+	// Any hub can switch privacy mode in its registration response; only the
+	// primary hub can rotate the agent token or send commands. The primary
+	// hub's clock is the reference for the agent's.
+	var reply struct {
+		Privacy       *bool        `json:"privacy"`
+		Token         string       `json:"token"`
+		Commands      []hubCommand `json:"commands"`
+		LatestVersion string       `json:"latestVersion"`
+		ServerTime    time.Time    `json:"serverTime"`
+	}
+	decodeErr := json.NewDecoder(res.Body).Decode(&reply)
+	if hub.Primary {
+		if skew, ok := clockSkew(res.Header.Get("Date"), reply.ServerTime, sent, received); ok {
+			a.setClockSkew(skew)
+		}
+	}
+	if decodeErr != nil {
+		return
+	}
+	if reply.Privacy != nil {
+		a.mu.Lock()
+		a.setPrivacyLocked(*reply.Privacy, "hub")
+		a.mu.Unlock()
+	}
+	if hub.Primary && reply.Token != "" && reply.Token != a.hubToken() {
+		if err := a.storeHubToken(reply.Token); err != nil {
+			logError("token rotation failed: %v", err)
+			return
+		}
+		logInfo("hub token rotated")
+		a.emit("token_rotated", "", nil)
+	}
+	if hub.Primary {
+		a.setLatestVersion(reply.LatestVersion)
+	}
+	if hub.Primary && len(reply.Commands) > 0 {
+		a.runHubCommands(reply.Commands)
+	}
+}
+
+// setHubConnected records the outcome of the latest registration and emits
+// an event when hub connectivity changes.
+func (a *Agent) setHubConnected(hubURL string, connected bool, reason string) {
+	a.mu.Lock()
+	changed := a.hubConnected[hubURL] != connected
+	a.hubConnected[hubURL] = connected
+	a.hubErrors[hubURL] = reason
+	a.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	if connected {
+		a.emit("hub_connected", "", map[string]interface{}{"hub": hubURL})
+		return
+	}
+	a.emit("hub_disconnected", "", map[string]interface{}{"hub": hubURL, "error": reason})
+}
+
+func (a *Agent) handleCameras(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	a.writeCameraList(w, r.URL.Query().Get("tag"))
+}
+
+// handleDiscover runs discovery immediately instead of waiting for the next
+// tick and returns the resulting camera list.
+func (a *Agent) handleDiscover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	a.discoverCameras(false)
+	a.writeCameraList(w, "")
+}
+
+// writeCameraList writes the cameras in list order, only those carrying tag
+// when it is set. The cameras are copied under a.mu, since publishers keep
+// updating their stats while the list is encoded.
+func (a *Agent) writeCameraList(w http.ResponseWriter, tag string) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	a.mu.Lock()
+	list := make([]*Camera, 0, len(a.cameras))
+	for _, cam := range a.cameras {
+		if tag == "" || containsString(cam.Tags, tag) {
+			camera := *cam
+			camera.Status = a.cameraStatusLocked(cam)
+			list = append(list, &camera)
+		}
+	}
+	a.mu.Unlock()
+
+	sortCameras(list)
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (a *Agent) handleToggle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var payload struct {
+		DeviceUID string `json:"deviceUid"`
+		Enabled   bool   `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid payload"})
+		return
+	}
+
+	a.mu.Lock()
+	cam := a.cameras[payload.DeviceUID]
+	if cam == nil {
+		a.mu.Unlock()
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "camera not found"})
+		return
+	}
+	cam.Enabled = payload.Enabled
+	a.settingsLocked(payload.DeviceUID).Enabled = payload.Enabled
+	a.emit(enabledEvent(payload.Enabled), payload.DeviceUID, map[string]interface{}{"name": cam.Name})
+	if a.activeLocked(cam) {
+		a.startCameraLocked(cam)
+	} else {
+		a.stopCameraLocked(payload.DeviceUID)
+	}
+	a.saveStateLocked()
+	a.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+func (a *Agent) handleCameraRoutes(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), "/api/cameras/")
+	parts := strings.Split(rest, "/")
+	if len(parts) > 2 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	deviceUID, err := url.PathUnescape(parts[0])
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid deviceUid"})
+		return
+	}
+
+	if len(parts) == 1 {
+		if r.Method != http.MethodPatch {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		a.handleSettings(w, r, deviceUID)
+		return
+	}
+
+	switch parts[1] {
+	case "snapshot":
+		a.handleSnapshot(w, r, deviceUID)
+	case "thumbnail":
+		a.handleThumbnail(w, r, deviceUID)
+	case "settings":
+		a.handleSettings(w, r, deviceUID)
+	case "recordings":
+		// Guarded like /api/recordings, which lists the same files.
+		a.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+			a.handleRecordings(w, r, deviceUID)
+		})(w, r)
+	case "logs":
+		a.handleCameraLogs(w, r, deviceUID)
+	case "controls":
+		a.handleControls(w, r, deviceUID)
+	case "ptz":
+		a.handlePTZ(w, r, deviceUID)
+	case "talkback":
+		a.handleTalkback(w, r, deviceUID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleSettings updates persisted per-camera settings. It serves both
+// POST /api/cameras/{uid}/settings and PATCH /api/cameras/{uid}; fields left
+// out of the payload are unchanged.
+func (a *Agent) handleSettings(w http.ResponseWriter, r *http.Request, deviceUID string) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPatch {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var payload struct {
+		Name      *string `json:"name"`
+		Output    *string `json:"output"`
+		Backend   *string `json:"backend"`
+		Record    *bool   `json:"record"`
+		Rotate    *int    `json:"rotate"`
+		HFlip     *bool   `json:"hflip"`
+		VFlip     *bool   `json:"vflip"`
+		Overlay   *bool   `json:"overlay"`
+		Schedule  *string `json:"schedule"`
+		Substream *bool   `json:"substream"`
+		GOP       *int    `json:"gop"`
+		BFrames   *int    `json:"bframes"`
+		Tune      *string `json:"tune"`
+		RtBufSize *string `json:"rtbufsize"`
+		// PublishPass is write-only; it is never returned by the API.
+		PublishUser    *string `json:"publishUser"`
+		PublishPass    *string `json:"publishPass"`
+		AudioDevice    *string `json:"audioDevice"`
+		TalkbackDevice *string `json:"talkbackDevice"`
+		RtmpURL        *string `json:"rtmpUrl"`
+		Profile        *string `json:"profile"`
+		// An empty crop object removes the crop.
+		Crop        *CropRect `json:"crop"`
+		ScaleWidth  *int      `json:"scaleWidth"`
+		ScaleHeight *int      `json:"scaleHeight"`
+		Deinterlace *bool     `json:"deinterlace"`
+		Denoise     *bool     `json:"denoise"`
+		// 0 falls back to RETENTION_CAMERA_QUOTA_MB.
+		RetentionQuotaMB *int `json:"retentionQuotaMB"`
+		// 0 removes the camera's place in the order.
+		Order *int `json:"order"`
+		// Tags replaces the camera's tags; an empty list removes them.
+		Tags *[]string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid payload"})
+		return
+	}
+
+	var output string
+	if payload.Output != nil {
+		output = strings.ToLower(strings.TrimSpace(*payload.Output))
+		if output != "" && !isValidOutput(output) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid output"})
+			return
+		}
+	}
+	if payload.RtmpURL != nil && strings.TrimSpace(*payload.RtmpURL) != "" {
+		if err := validRTMPURL(strings.TrimSpace(*payload.RtmpURL)); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	var backend string
+	if payload.Backend != nil {
+		backend = strings.ToLower(strings.TrimSpace(*payload.Backend))
+		if backend != "" && !isValidBackend(backend) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid backend"})
+			return
+		}
+	}
+	if payload.Rotate != nil {
+		switch *payload.Rotate {
+		case 0, 90, 180, 270:
+		default:
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "rotate must be 0, 90, 180 or 270"})
+			return
+		}
+	}
+
+	if payload.RetentionQuotaMB != nil && *payload.RetentionQuotaMB < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "retentionQuotaMB must not be negative"})
+		return
+	}
+	if payload.Order != nil && *payload.Order < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "order must not be negative"})
+		return
+	}
+	var tags []string
+	if payload.Tags != nil {
+		var err error
+		if tags, err = normalizeTags(*payload.Tags); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	if payload.Schedule != nil {
+		if _, err := parseSchedule(*payload.Schedule); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid schedule: %v", err)})
+			return
+		}
+	}
+
+	a.mu.Lock()
+	cam := a.cameras[deviceUID]
+	if cam == nil {
+		a.mu.Unlock()
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "camera not found"})
+		return
+	}
+
+	tuning := cam.EncoderTuning
+	if payload.GOP != nil {
+		tuning.GOP = *payload.GOP
+	}
+	if payload.BFrames != nil {
+		tuning.BFrames = *payload.BFrames
+	}
+	if payload.Tune != nil {
+		tuning.Tune = strings.ToLower(strings.TrimSpace(*payload.Tune))
+	}
+	if payload.RtBufSize != nil {
+		tuning.RtBufSize = strings.ToUpper(strings.TrimSpace(*payload.RtBufSize))
+	}
+	if err := tuning.validate(); err != nil {
+		a.mu.Unlock()
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	geometry := cam.FrameGeometry
+	if payload.Crop != nil {
+		geometry.Crop = payload.Crop
+		if *payload.Crop == (CropRect{}) {
+			geometry.Crop = nil
+		}
+	}
+	if payload.ScaleWidth != nil {
+		geometry.ScaleWidth = *payload.ScaleWidth
+	}
+	if payload.ScaleHeight != nil {
+		geometry.ScaleHeight = *payload.ScaleHeight
+	}
+	if err := geometry.validate(); err != nil {
+		a.mu.Unlock()
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	profile := cam.Profile
+	if payload.Profile != nil {
+		profile = strings.TrimSpace(*payload.Profile)
+		if _, ok := a.config().Profiles[profile]; profile != "" && !ok {
+			a.mu.Unlock()
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("unknown profile %q", profile)})
+			return
+		}
+	}
+
+	nextOutput, nextRTMP := cam.Output, cam.RtmpURL
+	if payload.Output != nil {
+		nextOutput = normalizeOutput(output)
+		if output == "" {
+			nextOutput = a.config().PublishOutput
+		}
+	}
+	if payload.RtmpURL != nil {
+		nextRTMP = strings.TrimSpace(*payload.RtmpURL)
+	}
+	if nextOutput == outputRTMP && nextRTMP == "" {
+		a.mu.Unlock()
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "rtmp output needs an rtmpUrl"})
+		return
+	}
+
+	if payload.Output != nil || payload.Backend != nil || payload.Profile != nil {
+		next := *cam
+		next.Profile = profile
+		if payload.Output != nil {
+			next.Output = output
+			if output == "" {
+				next.Output = a.config().PublishOutput
+			}
+		}
+		if payload.Backend != nil {
+			next.Backend = backend
+			if backend == "" {
+				next.Backend = a.config().PublishBackend
+			}
+		}
+		if err := a.ffmpegCaps.Load().checkCamera(&next, a.encodingProfile(&next)); err != nil {
+			a.mu.Unlock()
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	settings := a.settingsLocked(deviceUID)
+	restart, outputChanged := false, false
+	if payload.Name != nil {
+		settings.Name = strings.TrimSpace(*payload.Name)
+		name := cam.DeviceName
+		if settings.Name != "" {
+			name = settings.Name
+		}
+		if cam.Name != name {
+			cam.Name = name
+			restart = cam.Overlay
+		}
+	}
+	if payload.Output != nil {
+		settings.Output = output
+		if output == "" {
+			output = a.config().PublishOutput
+		}
+		if cam.Output != output {
+			cam.Output = output
+			restart = true
+			outputChanged = true
+		}
+	}
+	if payload.Backend != nil {
+		settings.Backend = backend
+		if backend == "" {
+			backend = a.config().PublishBackend
+		}
+		if cam.Backend != backend {
+			cam.Backend = backend
+			restart = true
+		}
+	}
+	if payload.Rotate != nil && cam.Rotate != *payload.Rotate {
+		settings.Rotate = *payload.Rotate
+		cam.Rotate = *payload.Rotate
+		restart = true
+	}
+	if payload.HFlip != nil && cam.HFlip != *payload.HFlip {
+		settings.HFlip = *payload.HFlip
+		cam.HFlip = *payload.HFlip
+		restart = true
+	}
+	if payload.VFlip != nil && cam.VFlip != *payload.VFlip {
+		settings.VFlip = *payload.VFlip
+		cam.VFlip = *payload.VFlip
+		restart = true
+	}
+	if payload.Overlay != nil && cam.Overlay != *payload.Overlay {
+		settings.Overlay = *payload.Overlay
+		cam.Overlay = *payload.Overlay
+		restart = true
+	}
+	if payload.Deinterlace != nil && cam.Deinterlace != *payload.Deinterlace {
+		settings.Deinterlace = *payload.Deinterlace
+		cam.Deinterlace = *payload.Deinterlace
+		restart = true
+	}
+	if payload.Denoise != nil && cam.Denoise != *payload.Denoise {
+		settings.Denoise = *payload.Denoise
+		cam.Denoise = *payload.Denoise
+		restart = true
+	}
+	if payload.RetentionQuotaMB != nil {
+		settings.RetentionQuotaMB = *payload.RetentionQuotaMB
+		cam.RetentionQuotaMB = *payload.RetentionQuotaMB
+	}
+	if payload.Order != nil {
+		settings.Order = *payload.Order
+		cam.Order = *payload.Order
+	}
+	if payload.Tags != nil {
+		settings.Tags = tags
+		cam.Tags = tags
+	}
+	if tuning != cam.EncoderTuning {
+		settings.EncoderTuning = tuning
+		cam.EncoderTuning = tuning
+		restart = true
+	}
+	if profile != cam.Profile {
+		settings.Profile = profile
+		cam.Profile = profile
+		restart = true
+	}
+	if !geometry.equal(cam.FrameGeometry) {
+		settings.FrameGeometry = geometry
+		cam.FrameGeometry = geometry
+		restart = true
+	}
+	if payload.Substream != nil {
+		settings.Substream = payload.Substream
+	}
+	subPath, subURL := "", ""
+	if a.substreamEnabledLocked(cam) {
+		subPath, subURL = cam.StreamPath+substreamSuffix, cam.RtspURL+substreamSuffix
+	}
+	if cam.SubstreamPath != subPath {
+		cam.SubstreamPath, cam.SubstreamURL = subPath, subURL
+		restart = true
+	}
+	if payload.RtmpURL != nil && nextRTMP != cam.RtmpURL {
+		settings.RtmpURL = nextRTMP
+		cam.RtmpURL = nextRTMP
+		cam.RtmpTarget = redactStreamKey(nextRTMP)
+		restart = restart || cam.Output == outputRTMP
+	}
+	if payload.PublishUser != nil || payload.PublishPass != nil {
+		if payload.PublishUser != nil {
+			settings.PublishUser = strings.TrimSpace(*payload.PublishUser)
+		}
+		if payload.PublishPass != nil {
+			settings.PublishPass = *payload.PublishPass
+		}
+		user, pass := settings.PublishUser, settings.PublishPass
+		if user == "" {
+			user, pass = a.config().PublishUser, a.config().PublishPass
+		}
+		if cam.PublishUser != user || cam.PublishPass != pass {
+			cam.PublishUser = user
+			cam.PublishPass = pass
+			restart = true
 		}
 	}
-	return float64(sum) / float64(len(a))
-}
-
-func (a *Agent) sendMotionEvent(deviceUID, streamPath string, ts time.Time, score float64) error {
-	payload := map[string]interface{}{
-		"deviceUid":  deviceUID,
-		"streamPath": streamPath,
-		"ts":         ts.UnixMilli(),
-		"score":      score,
+	if outputChanged {
+		// Motion and recording read the MediaMTX stream, which an rtmp
+		// camera does not publish.
+		a.stopMotionLocked(deviceUID)
+		a.stopRecorderLocked(deviceUID)
 	}
-	body, _ := json.Marshal(payload)
-
-	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(a.cfg.CamhubURL, "/")+"/api/motion", bytes.NewReader(body))
-	if err != nil {
-		return err
+	if restart && a.activeLocked(cam) {
+		a.stopPublisherLocked(deviceUID)
+		a.ensurePublisherLocked(cam)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", a.cfg.RegisterUserAgent)
-	if a.cfg.AuthToken != "" {
-		req.Header.Set("Authorization", "Bearer "+a.cfg.AuthToken)
+	if outputChanged && a.activeLocked(cam) {
+		a.ensureMotionLocked(cam)
+		a.ensureRecorderLocked(cam)
 	}
-
-	client := &http.Client{Timeout: a.cfg.MotionTimeout}
-	res, err := client.Do(req)
-	if err != nil {
-		return err
+	if payload.AudioDevice != nil && cam.AudioDevice != strings.TrimSpace(*payload.AudioDevice) {
+		settings.AudioDevice = strings.TrimSpace(*payload.AudioDevice)
+		a.stopAudioMeterLocked(deviceUID)
+		cam.AudioDevice = settings.AudioDevice
+		if a.activeLocked(cam) {
+			a.ensureAudioMeterLocked(cam)
+		}
 	}
-	defer res.Body.Close()
-	if res.StatusCode < 200 || res.StatusCode > 299 {
-		body, _ := io.ReadAll(res.Body)
-		return fmt.Errorf("motion event rejected: %s", strings.TrimSpace(string(body)))
+	if payload.TalkbackDevice != nil {
+		settings.TalkbackDevice = strings.TrimSpace(*payload.TalkbackDevice)
+		cam.TalkbackDevice = settings.TalkbackDevice
+		if cam.TalkbackDevice == "" {
+			cam.TalkbackDevice = a.config().TalkbackDevice
+		}
 	}
-	return nil
-}
-
-func (a *Agent) registerCameras() {
-	a.mu.Lock()
-	cams := make([]map[string]string, 0)
-	for _, cam := range a.cameras {
-		if !cam.Enabled {
-			continue
+	if payload.Record != nil {
+		settings.Record = payload.Record
+		cam.Record = *payload.Record
+		if cam.Record && a.activeLocked(cam) {
+			a.ensureRecorderLocked(cam)
+		} else {
+			a.stopRecorderLocked(deviceUID)
 		}
-		cams = append(cams, map[string]string{
-			"deviceUid":  cam.DeviceUID,
-			"name":       cam.Name,
-			"rtspUrl":    cam.RtspURL,
-			"streamPath": cam.StreamPath,
-		})
 	}
+	if payload.Schedule != nil {
+		settings.Schedule = strings.TrimSpace(*payload.Schedule)
+		cam.Schedule = settings.Schedule
+		a.applyScheduleLocked(cam, time.Now())
+	}
+	a.saveStateLocked()
 	a.mu.Unlock()
 
-	payload := map[string]interface{}{
-		"host":    a.hostname,
-		"cameras": cams,
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+func (a *Agent) handleSnapshot(w http.ResponseWriter, r *http.Request, deviceUID string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
 	}
-	body, _ := json.Marshal(payload)
 
-	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(a.cfg.CamhubURL, "/")+"/api/agents/register", bytes.NewReader(body))
-	if err != nil {
-		logInfo("register request error: %v", err)
+	a.mu.Lock()
+	cam := a.cameras[deviceUID]
+	var node, rtspURL string
+	publishing := false
+	if cam != nil {
+		node = cam.Node
+		rtspURL = cam.RtspURL
+		publishing = a.publishers[deviceUID] != nil
+	}
+	privacy := a.privacy
+	a.mu.Unlock()
+	if cam == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "camera not found"})
 		return
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", a.cfg.RegisterUserAgent)
-	if a.cfg.AuthToken != "" {
-		req.Header.Set("Authorization", "Bearer "+a.cfg.AuthToken)
+	if privacy {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "privacy mode is on"})
+		return
 	}
 
-	client := &http.Client{Timeout: a.cfg.RegisterTimeout}
-	res, err := client.Do(req)
+	ctx, cancel := context.WithTimeout(r.Context(), a.config().SnapshotTimeout)
+	defer cancel()
+
+	frame, err := a.captureSnapshot(ctx, node, rtspURL, publishing, 0)
 	if err != nil {
-		logInfo("register failed: %v", err)
+		logWarn("snapshot failed for %s: %v", deviceUID, err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "snapshot failed"})
 		return
 	}
-	defer res.Body.Close()
-	if res.StatusCode < 200 || res.StatusCode > 299 {
-		body, _ := io.ReadAll(res.Body)
-		logInfo("register failed: %s %s", res.Status, strings.TrimSpace(string(body)))
-	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(frame)
 }
 
-func (a *Agent) handleCameras(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
+// captureSnapshot grabs a single JPEG frame, scaled to width when it is
+// positive. While the camera is publishing the device node is held by the
+// publisher, so the frame is read back from RTSP.
+func (a *Agent) captureSnapshot(ctx context.Context, node, rtspURL string, publishing bool, width int) ([]byte, error) {
+	args := []string{}
+	if publishing {
+		args = append(args, "-rtsp_transport", "tcp")
+		args = append(args, a.rtspTLSArgs(rtspURL)...)
+		args = append(args, "-i", rtspURL)
+	} else {
+		args = append(args, captureInput(node)...)
 	}
-
-	a.mu.Lock()
-	list := make([]*Camera, 0, len(a.cameras))
-	for _, cam := range a.cameras {
-		list = append(list, cam)
+	if width > 0 {
+		args = append(args, "-vf", fmt.Sprintf("scale=%d:-2", width))
 	}
-	a.mu.Unlock()
-
-	sort.Slice(list, func(i, j int) bool {
-		return list[i].Name < list[j].Name
-	})
+	args = append(args,
+		"-an",
+		"-frames:v", "1",
+		"-q:v", "3",
+		"-f", "image2",
+		"-c:v", "mjpeg",
+		"pipe:1",
+	)
 
-	writeJSON(w, http.StatusOK, list)
+	cmd := exec.CommandContext(ctx, a.config().FfmpegPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := lastLine(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, errors.New("empty frame")
+	}
+	return out, nil
 }
 
-func (a *Agent) handleToggle(w http.ResponseWriter, r *http.Request) {
+// handleBulkToggle enables or disables several cameras at once. deviceUids is
+// either a list of UIDs or the string "all"; tag instead selects the cameras
+// carrying that tag. The change is applied under one lock and one state save,
+// and nothing is changed if any UID is unknown.
+func (a *Agent) handleBulkToggle(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
 	var payload struct {
-		DeviceUID string `json:"deviceUid"`
-		Enabled   bool   `json:"enabled"`
+		DeviceUIDs json.RawMessage `json:"deviceUids"`
+		Tag        string          `json:"tag"`
+		Enabled    *bool           `json:"enabled"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Enabled == nil {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid payload"})
 		return
 	}
 
+	all := false
+	var uids []string
+	var selector string
+	tag := strings.ToLower(strings.TrimSpace(payload.Tag))
+	if tag != "" {
+		if len(payload.DeviceUIDs) > 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "give deviceUids or tag, not both"})
+			return
+		}
+	} else if err := json.Unmarshal(payload.DeviceUIDs, &selector); err == nil {
+		if selector != "all" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": `deviceUids must be a list or "all"`})
+			return
+		}
+		all = true
+	} else if err := json.Unmarshal(payload.DeviceUIDs, &uids); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": `deviceUids must be a list or "all"`})
+		return
+	}
+
 	a.mu.Lock()
-	cam := a.cameras[payload.DeviceUID]
-	if cam == nil {
+	if all {
+		uids = make([]string, 0, len(a.cameras))
+		for uid := range a.cameras {
+			uids = append(uids, uid)
+		}
+	}
+	if tag != "" {
+		for uid, cam := range a.cameras {
+			if containsString(cam.Tags, tag) {
+				uids = append(uids, uid)
+			}
+		}
+		if len(uids) == 0 {
+			a.mu.Unlock()
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no cameras tagged " + tag})
+			return
+		}
+	}
+	var missing []string
+	for _, uid := range uids {
+		if a.cameras[uid] == nil {
+			missing = append(missing, uid)
+		}
+	}
+	if len(missing) > 0 {
 		a.mu.Unlock()
-		writeJSON(w, http.StatusNotFound, map[string]string{"error": "camera not found"})
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "camera not found", "deviceUids": missing})
 		return
 	}
-	cam.Enabled = payload.Enabled
-	a.state[payload.DeviceUID] = payload.Enabled
-	if payload.Enabled {
-		a.ensurePublisherLocked(cam)
-	} else {
-		a.stopPublisherLocked(payload.DeviceUID)
+
+	for _, uid := range uids {
+		cam := a.cameras[uid]
+		cam.Enabled = *payload.Enabled
+		a.settingsLocked(uid).Enabled = *payload.Enabled
+		a.emit(enabledEvent(*payload.Enabled), uid, map[string]interface{}{"name": cam.Name})
+		if a.activeLocked(cam) {
+			a.startCameraLocked(cam)
+		} else {
+			a.stopCameraLocked(uid)
+		}
 	}
-	_ = saveState(a.cfg.StateFile, a.state)
+	a.saveStateLocked()
 	a.mu.Unlock()
 
-	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	sort.Strings(uids)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "deviceUids": uids})
 }
 
 func (a *Agent) handlePreviewStream(w http.ResponseWriter, r *http.Request) {
@@ -621,11 +2817,16 @@ func (a *Agent) handlePreviewStream(w http.ResponseWriter, r *http.Request) {
 
 	a.mu.Lock()
 	cam := a.cameras[deviceUID]
+	privacy := a.privacy
 	a.mu.Unlock()
 	if cam == nil {
 		writeJSON(w, http.StatusNotFound, map[string]string{"error": "camera not found"})
 		return
 	}
+	if privacy {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "privacy mode is on"})
+		return
+	}
 
 	logInfo("preview start %s", deviceUID)
 	flusher, ok := w.(http.Flusher)
@@ -637,16 +2838,14 @@ func (a *Agent) handlePreviewStream(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
-	args := []string{
-		"-f", "v4l2",
-		"-i", cam.Node,
+	args := append(captureInput(cam.Node),
 		"-vf", "fps=2,format=yuv420p",
 		"-q:v", "4",
 		"-f", "mjpeg",
 		"pipe:1",
-	}
+	)
 
-	cmd := exec.CommandContext(ctx, a.cfg.FfmpegPath, args...)
+	cmd := exec.CommandContext(ctx, a.config().FfmpegPath, args...)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "preview failed"})
@@ -697,6 +2896,14 @@ func (a *Agent) handlePreviewStream(w http.ResponseWriter, r *http.Request) {
 				}
 				frame := buf[:end+2]
 				buf = buf[end+2:]
+				// Privacy mode switched on ends a running preview.
+				a.mu.Lock()
+				privacy := a.privacy
+				a.mu.Unlock()
+				if privacy {
+					logInfo("preview stop %s: privacy mode", deviceUID)
+					return
+				}
 
 				_, _ = fmt.Fprintf(w, "%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", boundary, len(frame))
 				_, _ = w.Write(frame)
@@ -711,13 +2918,16 @@ func (a *Agent) handlePreviewStream(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func serveIndex(w http.ResponseWriter, r *http.Request) {
+// serveIndex serves the UI with its <base> set to BASE_PATH; the page and
+// script only use relative URLs, so they work wherever they are mounted.
+func (a *Agent) serveIndex(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		http.NotFound(w, r)
 		return
 	}
+	base := html.EscapeString(a.config().BasePath + "/")
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	_, _ = w.Write(indexHTML)
+	_, _ = w.Write(bytes.Replace(indexHTML, []byte(`<base href="/" />`), []byte(`<base href="`+base+`" />`), 1))
 }
 
 func serveJS(w http.ResponseWriter, r *http.Request) {
@@ -730,44 +2940,244 @@ func serveCSS(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(stylesCSS)
 }
 
+// serveOpenAPI serves web/openapi.json, which describes every endpoint
+// registered in runAgent and must be updated along with them. The server URL
+// is set to BASE_PATH so generated clients work behind a reverse proxy.
+func (a *Agent) serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	server, _ := json.Marshal(a.config().BasePath + "/")
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(bytes.Replace(openAPIJSON, []byte(`"url": "/"`), []byte(`"url": `+string(server)), 1))
+}
+
 func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	_ = json.NewEncoder(w).Encode(payload)
 }
 
-func discoverDevices() []DeviceInfo {
-	if runtime.GOOS != "linux" {
+func discoverDevices(ffmpegPath string) []DeviceInfo {
+	switch runtime.GOOS {
+	case "linux", "freebsd":
+		// FreeBSD cameras are /dev/video* nodes served by webcamd, which
+		// implements the V4L2 API.
+	case "windows":
+		return discoverDshowDevices(ffmpegPath)
+	default:
 		return nil
 	}
 
+	ids := stableDeviceIDs()
+
 	out, err := exec.Command("v4l2-ctl", "--list-devices").Output()
 	if err == nil {
-		devices := parseV4L2Output(string(out))
+		devices := selectCaptureNodes(parseV4L2Output(string(out)))
 		if len(devices) > 0 {
+			for idx := range devices {
+				devices[idx].ID = stableDeviceID(ids, devices[idx].Node)
+			}
 			return devices
 		}
 	}
 
 	matches, _ := filepath.Glob("/dev/video*")
 	sort.Strings(matches)
-	devices := make([]DeviceInfo, 0, len(matches))
-	for idx, node := range matches {
-		devices = append(devices, DeviceInfo{
-			Name: fmt.Sprintf("Camera %d", idx+1),
-			Node: node,
-		})
+	devices := groupDeviceNodes(matches)
+	for idx := range devices {
+		devices[idx].ID = stableDeviceID(ids, devices[idx].Node)
 	}
 	return devices
 }
 
+// selectCaptureNodes points each device at its first node that can capture
+// video, skipping UVC metadata nodes, and drops devices without one. Nodes
+// that cannot be queried are assumed to be capture nodes.
+func selectCaptureNodes(devices []DeviceInfo) []DeviceInfo {
+	selected := make([]DeviceInfo, 0, len(devices))
+	for _, device := range devices {
+		nodes := device.Nodes
+		if len(nodes) == 0 {
+			nodes = []string{device.Node}
+		}
+		device.Node = ""
+		for _, node := range nodes {
+			caps, err := queryCapability(node)
+			if err != nil || caps.Capture {
+				device.Node = node
+				break
+			}
+		}
+		if device.Node != "" {
+			selected = append(selected, device)
+		}
+	}
+	return selected
+}
+
+// groupDeviceNodes groups /dev/video* nodes by bus so one physical camera is
+// listed once, under its first capture node.
+func groupDeviceNodes(nodes []string) []DeviceInfo {
+	var devices []DeviceInfo
+	groups := map[string]int{}
+	for _, node := range nodes {
+		caps, err := queryCapability(node)
+		if err != nil {
+			devices = append(devices, DeviceInfo{Node: node, Nodes: []string{node}})
+			continue
+		}
+
+		key := caps.BusInfo
+		if key == "" {
+			key = node
+		}
+		idx, ok := groups[key]
+		if !ok {
+			idx = len(devices)
+			groups[key] = idx
+			devices = append(devices, DeviceInfo{Name: caps.Card})
+		}
+		devices[idx].Nodes = append(devices[idx].Nodes, node)
+		if caps.Capture && devices[idx].Node == "" {
+			devices[idx].Node = node
+		}
+	}
+
+	result := make([]DeviceInfo, 0, len(devices))
+	for _, device := range devices {
+		if device.Node == "" {
+			continue
+		}
+		if device.Name == "" {
+			device.Name = fmt.Sprintf("Camera %d", len(result)+1)
+		}
+		result = append(result, device)
+	}
+	return result
+}
+
+// stableDeviceIDs maps device nodes to their /dev/v4l/by-id link names, which
+// udev derives from the USB vendor, product and serial and so survive
+// renumbering across reboots and re-plugs.
+func stableDeviceIDs() map[string]string {
+	ids := map[string]string{}
+	links, _ := filepath.Glob("/dev/v4l/by-id/*")
+	sort.Strings(links)
+	for _, link := range links {
+		target, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			continue
+		}
+		name := filepath.Base(link)
+		// Prefer the index0 link, which points at the capture interface.
+		if existing, ok := ids[target]; ok && strings.HasSuffix(existing, "-index0") {
+			continue
+		}
+		ids[target] = name
+	}
+	return ids
+}
+
+// stableDeviceID resolves a node to its by-id name, falling back to the USB
+// vendor/product/serial from sysfs. It returns "" when neither is available.
+func stableDeviceID(ids map[string]string, node string) string {
+	if id := ids[node]; id != "" {
+		return id
+	}
+
+	usbDir, err := filepath.EvalSymlinks(filepath.Join("/sys/class/video4linux", filepath.Base(node), "device"))
+	if err != nil {
+		return ""
+	}
+	// The video device hangs off a USB interface; the attributes live on its parent.
+	usbDir = filepath.Dir(usbDir)
+	vendor := readSysfsAttr(filepath.Join(usbDir, "idVendor"))
+	product := readSysfsAttr(filepath.Join(usbDir, "idProduct"))
+	serial := readSysfsAttr(filepath.Join(usbDir, "serial"))
+	if vendor == "" || product == "" || serial == "" {
+		return ""
+	}
+	index := readSysfsAttr(filepath.Join("/sys/class/video4linux", filepath.Base(node), "index"))
+	if index == "" {
+		index = "0"
+	}
+	return fmt.Sprintf("usb-%s:%s-%s-index%s", vendor, product, serial, index)
+}
+
+func readSysfsAttr(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// filterDevices applies DEVICE_INCLUDE/DEVICE_EXCLUDE. When include patterns
+// are set a device must match one of them; any exclude match drops it.
+func filterDevices(devices []DeviceInfo, include, exclude []string) []DeviceInfo {
+	if len(include) == 0 && len(exclude) == 0 {
+		return devices
+	}
+
+	filtered := make([]DeviceInfo, 0, len(devices))
+	for _, device := range devices {
+		if len(include) > 0 && !matchDevice(device, include) {
+			continue
+		}
+		if matchDevice(device, exclude) {
+			continue
+		}
+		filtered = append(filtered, device)
+	}
+	return filtered
+}
+
+func matchDevice(device DeviceInfo, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, device.Node) || matchPattern(pattern, device.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern treats /.../ or re:... as a regular expression and anything
+// else as a shell glob.
+func matchPattern(pattern, value string) bool {
+	if value == "" {
+		return false
+	}
+	if expr, ok := patternExpr(pattern); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			logWarn("invalid device pattern %q: %v", pattern, err)
+			return false
+		}
+		return re.MatchString(value)
+	}
+	ok, _ := filepath.Match(pattern, value)
+	return ok
+}
+
+func patternExpr(pattern string) (string, bool) {
+	switch {
+	case strings.HasPrefix(pattern, "re:"):
+		return strings.TrimPrefix(pattern, "re:"), true
+	case len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		return pattern[1 : len(pattern)-1], true
+	}
+	return "", false
+}
+
 func parseV4L2Output(output string) []DeviceInfo {
 	blocks := splitBlocks(output)
 	var devices []DeviceInfo
 	for _, block := range blocks {
 		lines := strings.Split(block, "\n")
 		var name string
-		var node string
+		var nodes []string
 		for _, line := range lines {
 			line = strings.TrimSpace(line)
 			if line == "" {
@@ -778,12 +3188,11 @@ func parseV4L2Output(output string) []DeviceInfo {
 				continue
 			}
 			if strings.HasPrefix(line, "/dev/video") {
-				node = line
-				break
+				nodes = append(nodes, line)
 			}
 		}
-		if node != "" {
-			devices = append(devices, DeviceInfo{Name: name, Node: node})
+		if len(nodes) > 0 {
+			devices = append(devices, DeviceInfo{Name: name, Node: nodes[0], Nodes: nodes})
 		}
 	}
 	return devices
@@ -810,6 +3219,11 @@ func splitBlocks(input string) []string {
 	return blocks
 }
 
+func lastLine(value string) string {
+	lines := strings.Split(strings.TrimSpace(value), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
 func slugify(value string) string {
 	value = strings.ToLower(value)
 	re := regexp.MustCompile(`[^a-z0-9]+`)
@@ -818,29 +3232,104 @@ func slugify(value string) string {
 	return value
 }
 
-func loadState(path string) map[string]bool {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return map[string]bool{}
+func (a *Agent) settingsLocked(deviceUID string) *CameraSettings {
+	settings := a.state[deviceUID]
+	if settings == nil {
+		settings = &CameraSettings{}
+		a.state[deviceUID] = settings
 	}
-	var state map[string]bool
-	if err := json.Unmarshal(data, &state); err != nil {
-		return map[string]bool{}
+	return settings
+}
+
+// saveStateLocked persists the per-camera settings in a.state.
+func (a *Agent) saveStateLocked() {
+	if err := a.store.SaveSettings(a.state); err != nil {
+		logError("state save failed: %v", err)
 	}
-	return state
 }
 
-func saveState(path string, state map[string]bool) error {
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
-		return err
+// rememberCameraLocked records a camera's details so it can still be
+// reported by name while it is unplugged, including after a restart.
+func (a *Agent) rememberCameraLocked(cam *Camera) {
+	known := KnownCamera{
+		Name:       cam.Name,
+		Node:       cam.Node,
+		StreamPath: cam.StreamPath,
+		RtspURL:    cam.RtspURL,
+		LastSeen:   time.Now(),
+	}
+	a.missing[cam.DeviceUID] = known
+	if err := a.store.SaveCamera(cam.DeviceUID, known); err != nil {
+		logError("state save failed: %v", err)
+	}
+}
+
+// loadAgentID returns the persistent agent identity, generating and storing a
+// random UUID next to the state file on first start. AGENT_ID overrides it.
+func loadAgentID(cfg Config) (string, error) {
+	if cfg.AgentID != "" {
+		return cfg.AgentID, nil
+	}
+
+	path := filepath.Join(filepath.Dir(cfg.StateFile), "agent_id")
+	if data, err := os.ReadFile(path); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
 	}
-	data, err := json.MarshalIndent(state, "", "  ")
+
+	id, err := newUUID()
 	if err != nil {
-		return err
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(path, []byte(id+"\n"), 0o600); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// migrateStateKeys rewrites settings stored under the old hostname-based
+// device UIDs to the agent ID so existing enable flags survive the upgrade.
+func (a *Agent) migrateStateKeys() {
+	prefix := a.hostname + ":"
+	if a.hostname == "" || prefix == a.agentID+":" {
+		return
+	}
+
+	migrated := false
+	for uid, settings := range a.state {
+		if !strings.HasPrefix(uid, prefix) {
+			continue
+		}
+		next := a.agentID + ":" + strings.TrimPrefix(uid, prefix)
+		if _, exists := a.state[next]; !exists {
+			a.state[next] = settings
+		}
+		delete(a.state, uid)
+		migrated = true
+	}
+	if migrated {
+		a.saveStateLocked()
 	}
-	return os.WriteFile(path, data, 0o600)
 }
 
+// dotEnvKeys remembers which variables were set from .env rather than the
+// process environment.
+var dotEnvKeys = map[string]bool{}
+
 func loadDotEnv(path string) error {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -861,8 +3350,11 @@ func loadDotEnv(path string) error {
 		value := strings.TrimSpace(parts[1])
 		value = strings.Trim(value, `"'`)
 		if key != "" {
-			if _, exists := os.LookupEnv(key); !exists {
+			// Real environment variables win, but values that came from .env
+			// may be replaced when the file is read again on reload.
+			if _, exists := os.LookupEnv(key); !exists || dotEnvKeys[key] {
 				_ = os.Setenv(key, value)
+				dotEnvKeys[key] = true
 			}
 		}
 	}
@@ -876,6 +3368,40 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+func getEnvList(key string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	return splitList(value)
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getSecret reads key from the file named by key_FILE when that is set,
+// otherwise from the environment. Surrounding whitespace, such as the
+// trailing newline most secret files have, is dropped. An unreadable file
+// gives "", and validateConfig reports it so the agent refuses to start.
+func getSecret(key string) string {
+	if path := getEnv(key+"_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			logError("cannot read %s_FILE: %v", key, err)
+			return ""
+		}
+		return strings.TrimSpace(string(data))
+	}
+	return getEnv(key, "")
+}
+
 func getEnvDuration(key string, fallback time.Duration) time.Duration {
 	if value, ok := os.LookupEnv(key); ok && value != "" {
 		if ms, err := time.ParseDuration(value); err == nil {
@@ -928,7 +3454,3 @@ func parseInt(value string) (int64, error) {
 	}
 	return n, nil
 }
-
-func logInfo(format string, args ...interface{}) {
-	fmt.Printf(time.Now().Format("2006-01-02 15:04:05")+" "+format+"\n", args...)
-}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// maintenancePath marks maintenance mode on disk; the file exists while it
+// is on, so a host rebooted during service stays quiet.
+func maintenancePath(cfg *Config) string {
+	return filepath.Join(filepath.Dir(cfg.StateFile), "maintenance")
+}
+
+func loadMaintenance(cfg *Config) bool {
+	_, err := os.Stat(maintenancePath(cfg))
+	return err == nil
+}
+
+// setMaintenanceLocked switches maintenance mode. Entering it deregisters
+// from every hub, so cameras are shown as offline on purpose rather than
+// failing one by one, stops heartbeats and winds down the cameras. With
+// waitForViewers, publishers that are being watched keep running until
+// their last viewer leaves. Leaving it restarts the cameras and registers
+// again straight away.
+func (a *Agent) setMaintenanceLocked(enabled, waitForViewers bool) {
+	if a.maintenance == enabled {
+		if enabled && !waitForViewers {
+			// A second request without waiting cuts a drain short.
+			for uid := range a.draining {
+				a.stopCameraLocked(uid)
+			}
+			a.draining = make(map[string]bool)
+		}
+		return
+	}
+	a.maintenance = enabled
+
+	path := maintenancePath(a.config())
+	if enabled {
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			logError("maintenance state save failed: %v", err)
+		}
+	} else if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logError("maintenance state save failed: %v", err)
+	}
+
+	if !enabled {
+		logInfo("maintenance mode off")
+		a.emit("maintenance_disabled", "", nil)
+		a.draining = make(map[string]bool)
+		for _, cam := range a.cameras {
+			if a.activeLocked(cam) {
+				a.startCameraLocked(cam)
+			}
+		}
+		go a.registerCameras()
+		return
+	}
+
+	for uid, cam := range a.cameras {
+		if waitForViewers && a.publishers[uid] != nil && cam.Readers > 0 {
+			a.draining[uid] = true
+			continue
+		}
+		a.stopCameraLocked(uid)
+	}
+	logInfo("maintenance mode on; %d publisher(s) draining", len(a.draining))
+	a.emit("maintenance_enabled", "", map[string]interface{}{"draining": len(a.draining)})
+	go func() {
+		if err := a.deregister(); err != nil {
+			logWarn("deregister failed: %v", err)
+		}
+	}()
+}
+
+// drainLocked stops draining publishers whose viewers have all left. It runs
+// with each reader count update.
+func (a *Agent) drainLocked() {
+	for uid := range a.draining {
+		if cam := a.cameras[uid]; cam == nil || cam.Readers == 0 || a.publishers[uid] == nil {
+			a.stopCameraLocked(uid)
+			delete(a.draining, uid)
+			if len(a.draining) == 0 {
+				logInfo("maintenance mode: all publishers drained")
+				a.emit("maintenance_drained", "", nil)
+			}
+		}
+	}
+}
+
+func (a *Agent) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var payload struct {
+			Enabled        *bool `json:"enabled"`
+			WaitForViewers bool  `json:"waitForViewers"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Enabled == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid payload"})
+			return
+		}
+		a.mu.Lock()
+		a.setMaintenanceLocked(*payload.Enabled, payload.WaitForViewers)
+		a.mu.Unlock()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.mu.Lock()
+	enabled := a.maintenance
+	draining := make([]string, 0, len(a.draining))
+	for uid := range a.draining {
+		draining = append(draining, uid)
+	}
+	a.mu.Unlock()
+	sort.Strings(draining)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"maintenance": enabled, "draining": draining})
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mdnsPort = 5353
+	// mdnsAgentService is the DNS-SD service type agents advertise.
+	mdnsAgentService  = "_camhub-agent._tcp.local."
+	mdnsServiceEnum   = "_services._dns-sd._udp.local."
+	mdnsHostTTL       = 120
+	mdnsServiceTTL    = 4500
+	mdnsRefresh       = 10 * time.Second
+	mdnsMaxPacketSize = 9000
+
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+	dnsClassIN = 1
+	// dnsCacheFlush in a record's class and dnsUnicastResponse in a
+	// question's class are the mDNS uses of the top bit.
+	dnsCacheFlush      = 0x8000
+	dnsUnicastResponse = 0x8000
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+// dnsRecord is a resource record with its RDATA already encoded.
+type dnsRecord struct {
+	Name  string
+	Type  uint16
+	Flush bool
+	TTL   uint32
+	Data  []byte
+}
+
+type dnsQuestion struct {
+	Name    string
+	Type    uint16
+	Unicast bool
+}
+
+// dnsMessage is the part of a DNS message mDNS uses. Names are
+// fully qualified, with the trailing dot.
+type dnsMessage struct {
+	ID         uint16
+	Response   bool
+	Questions  []dnsQuestion
+	Answers    []dnsRecord
+	Additional []dnsRecord
+}
+
+// encodeDNSName writes a name as labels, without compression, which mDNS
+// receivers must accept.
+func encodeDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func (m *dnsMessage) encode() []byte {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], m.ID)
+	if m.Response {
+		// QR and AA; mDNS answers are always authoritative.
+		binary.BigEndian.PutUint16(b[2:], 0x8400)
+	}
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.Additional)))
+	for _, q := range m.Questions {
+		b = encodeDNSName(b, q.Name)
+		class := uint16(dnsClassIN)
+		if q.Unicast {
+			class |= dnsUnicastResponse
+		}
+		b = binary.BigEndian.AppendUint16(b, q.Type)
+		b = binary.BigEndian.AppendUint16(b, class)
+	}
+	for _, section := range [][]dnsRecord{m.Answers, m.Additional} {
+		for _, r := range section {
+			b = encodeDNSName(b, r.Name)
+			class := uint16(dnsClassIN)
+			if r.Flush {
+				class |= dnsCacheFlush
+			}
+			b = binary.BigEndian.AppendUint16(b, r.Type)
+			b = binary.BigEndian.AppendUint16(b, class)
+			b = binary.BigEndian.AppendUint32(b, r.TTL)
+			b = binary.BigEndian.AppendUint16(b, uint16(len(r.Data)))
+			b = append(b, r.Data...)
+		}
+	}
+	return b
+}
+
+var errDNSMessage = errors.New("malformed DNS message")
+
+// readDNSName reads a possibly compressed name at off and returns it with
+// the offset just past it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMessage
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errDNSMessage
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errDNSMessage
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// parseDNSMessage reads the header, questions and records of a message.
+// RDATA is kept as is, except that names in PTR and SRV records are
+// decompressed, so they can be read without the whole message.
+func parseDNSMessage(msg []byte) (*dnsMessage, error) {
+	if len(msg) < 12 {
+		return nil, errDNSMessage
+	}
+	m := &dnsMessage{
+		ID:       binary.BigEndian.Uint16(msg[0:]),
+		Response: msg[2]&0x80 != 0,
+	}
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(msg[4+2*i:]))
+	}
+	off := 12
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return nil, errDNSMessage
+		}
+		class := binary.BigEndian.Uint16(msg[next+2:])
+		m.Questions = append(m.Questions, dnsQuestion{
+			Name:    name,
+			Type:    binary.BigEndian.Uint16(msg[next:]),
+			Unicast: class&dnsUnicastResponse != 0,
+		})
+		off = next + 4
+	}
+	for i := 0; i < counts[1]+counts[2]+counts[3]; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return nil, errDNSMessage
+		}
+		r := dnsRecord{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(msg[next:]),
+			Flush: binary.BigEndian.Uint16(msg[next+2:])&dnsCacheFlush != 0,
+			TTL:   binary.BigEndian.Uint32(msg[next+4:]),
+		}
+		size := int(binary.BigEndian.Uint16(msg[next+8:]))
+		start := next + 10
+		if start+size > len(msg) {
+			return nil, errDNSMessage
+		}
+		r.Data = msg[start : start+size]
+		switch r.Type {
+		case dnsTypePTR:
+			target, _, err := readDNSName(msg, start)
+			if err != nil {
+				return nil, err
+			}
+			r.Data = encodeDNSName(nil, target)
+		case dnsTypeSRV:
+			if size < 7 {
+				return nil, errDNSMessage
+			}
+			target, _, err := readDNSName(msg, start+6)
+			if err != nil {
+				return nil, err
+			}
+			r.Data = encodeDNSName(append([]byte(nil), msg[start:start+6]...), target)
+		}
+		if i < counts[1] {
+			m.Answers = append(m.Answers, r)
+		} else {
+			m.Additional = append(m.Additional, r)
+		}
+		off = start + size
+	}
+	return m, nil
+}
+
+func ptrRecord(name, target string, ttl uint32) dnsRecord {
+	return dnsRecord{Name: name, Type: dnsTypePTR, TTL: ttl, Data: encodeDNSName(nil, target)}
+}
+
+func srvRecord(name, target string, port int, ttl uint32) dnsRecord {
+	data := make([]byte, 6)
+	binary.BigEndian.PutUint16(data[4:], uint16(port))
+	return dnsRecord{Name: name, Type: dnsTypeSRV, Flush: true, TTL: ttl, Data: encodeDNSName(data, target)}
+}
+
+func txtRecord(name string, entries []string, ttl uint32) dnsRecord {
+	var data []byte
+	for _, entry := range entries {
+		if len(entry) > 255 {
+			entry = entry[:255]
+		}
+		data = append(data, byte(len(entry)))
+		data = append(data, entry...)
+	}
+	if len(data) == 0 {
+		data = []byte{0}
+	}
+	return dnsRecord{Name: name, Type: dnsTypeTXT, Flush: true, TTL: ttl, Data: data}
+}
+
+func aRecord(name string, ip net.IP, ttl uint32) dnsRecord {
+	return dnsRecord{Name: name, Type: dnsTypeA, Flush: true, TTL: ttl, Data: ip.To4()}
+}
+
+// mdnsLabel makes a DNS label of a free-form name: dots would split it.
+func mdnsLabel(name string) string {
+	name = strings.ReplaceAll(strings.TrimSpace(name), ".", "-")
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return name
+}
+
+// mdnsResponder answers mDNS queries for the agent's API, as a minimal
+// responder: IPv4 only, on the interface multicast is routed to, without
+// probing for name conflicts.
+type mdnsResponder struct {
+	agent    *Agent
+	conn     *net.UDPConn
+	instance string
+	host     string
+	port     int
+	ip       net.IP
+	https    bool
+	done     chan struct{}
+
+	mu  sync.Mutex
+	txt []string
+}
+
+// advertiseMDNS announces the first TCP listener of AGENT_ADDR as
+// _camhub-agent._tcp and answers queries for it until the agent stops.
+// Listeners on loopback or unix sockets are not advertised.
+func (a *Agent) advertiseMDNS(addrs []listenAddr) {
+	cfg := a.config()
+	r := &mdnsResponder{agent: a, done: make(chan struct{})}
+	for _, addr := range addrs {
+		if _, ok := unixSocketPath(addr.Addr); ok {
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr.Addr)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip != nil && (ip.IsLoopback() || (ip.To4() == nil && !ip.IsUnspecified())) {
+			continue
+		}
+		if host == "localhost" {
+			continue
+		}
+		r.port, _ = strconv.Atoi(port)
+		if ip != nil && !ip.IsUnspecified() {
+			r.ip = ip.To4()
+		}
+		r.https = addr.tls()
+		break
+	}
+	if r.port == 0 {
+		logInfo("mdns: AGENT_ADDR has no LAN listener to advertise")
+		return
+	}
+	name := cfg.MdnsName
+	if name == "" {
+		name = a.hostname
+	}
+	hostLabel := slugify(a.hostname)
+	if hostLabel == "" {
+		hostLabel = "camhub-agent"
+	}
+	r.instance = mdnsLabel(name) + "." + mdnsAgentService
+	r.host = hostLabel + ".local."
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		logWarn("mdns: %v; the agent is not advertised", err)
+		return
+	}
+	r.conn = conn
+	r.txt = r.txtEntries()
+	a.mdns.Store(r)
+	logInfo("mdns: advertising %s on port %d", strings.TrimSuffix(r.instance, "."), r.port)
+
+	go r.serve()
+	r.announce(mdnsServiceTTL)
+	time.Sleep(time.Second)
+	r.announce(mdnsServiceTTL)
+
+	ticker := time.NewTicker(mdnsRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+		txt := r.txtEntries()
+		r.mu.Lock()
+		changed := strings.Join(txt, "\x00") != strings.Join(r.txt, "\x00")
+		r.txt = txt
+		r.mu.Unlock()
+		if changed {
+			r.announce(mdnsServiceTTL)
+		}
+	}
+}
+
+// txtEntries describes the agent for browsers that show TXT records.
+func (r *mdnsResponder) txtEntries() []string {
+	a := r.agent
+	a.mu.Lock()
+	cameras := len(a.cameras)
+	a.mu.Unlock()
+	scheme := "http"
+	if r.https {
+		scheme = "https"
+	}
+	return []string{
+		"id=" + a.agentID,
+		"host=" + a.hostname,
+		"cameras=" + strconv.Itoa(cameras),
+		"version=" + version,
+		"scheme=" + scheme,
+		"path=" + a.config().BasePath + "/",
+	}
+}
+
+// addresses are the IPv4 addresses the service is reachable on: the one
+// AGENT_ADDR names, or every non-loopback address for a wildcard listener.
+func (r *mdnsResponder) addresses() []net.IP {
+	if r.ip != nil {
+		return []net.IP{r.ip}
+	}
+	var ips []net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			ips = append(ips, ipnet.IP.To4())
+		}
+	}
+	return ips
+}
+
+func (r *mdnsResponder) records(ttl uint32) (ptr, srv, txt dnsRecord, a []dnsRecord) {
+	hostTTL := ttl
+	if hostTTL > mdnsHostTTL {
+		hostTTL = mdnsHostTTL
+	}
+	ptr = ptrRecord(mdnsAgentService, r.instance, ttl)
+	srv = srvRecord(r.instance, r.host, r.port, hostTTL)
+	r.mu.Lock()
+	txt = txtRecord(r.instance, r.txt, ttl)
+	r.mu.Unlock()
+	for _, ip := range r.addresses() {
+		a = append(a, aRecord(r.host, ip, hostTTL))
+	}
+	return ptr, srv, txt, a
+}
+
+// announce multicasts every record unasked; a TTL of 0 says goodbye.
+func (r *mdnsResponder) announce(ttl uint32) {
+	ptr, srv, txt, a := r.records(ttl)
+	msg := dnsMessage{Response: true, Answers: append([]dnsRecord{ptr, srv, txt}, a...)}
+	if _, err := r.conn.WriteToUDP(msg.encode(), mdnsGroup); err != nil {
+		logWarn("mdns: announce failed: %v", err)
+	}
+}
+
+// goodbye withdraws the advertisement, so browsers drop the agent at once.
+func (r *mdnsResponder) goodbye() {
+	r.announce(0)
+	close(r.done)
+	r.conn.Close()
+}
+
+func (r *mdnsResponder) serve() {
+	buf := make([]byte, mdnsMaxPacketSize)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		query, err := parseDNSMessage(buf[:n])
+		if err != nil || query.Response || len(query.Questions) == 0 {
+			continue
+		}
+		r.answer(query, from)
+	}
+}
+
+// answer replies to the questions about the agent's records. Queries from a
+// port other than 5353 come from plain DNS resolvers and get a unicast reply
+// in the form they expect; mDNS queries are answered by multicast unless
+// they ask for unicast.
+func (r *mdnsResponder) answer(query *dnsMessage, from *net.UDPAddr) {
+	ptr, srv, txt, a := r.records(mdnsServiceTTL)
+	var answers, additional []dnsRecord
+	unicast := true
+	for _, q := range query.Questions {
+		if !q.Unicast {
+			unicast = false
+		}
+		match := func(types ...uint16) bool {
+			for _, t := range types {
+				if q.Type == t || q.Type == dnsTypeANY {
+					return true
+				}
+			}
+			return false
+		}
+		switch {
+		case strings.EqualFold(q.Name, mdnsServiceEnum) && match(dnsTypePTR):
+			answers = append(answers, ptrRecord(mdnsServiceEnum, mdnsAgentService, mdnsServiceTTL))
+		case strings.EqualFold(q.Name, mdnsAgentService) && match(dnsTypePTR):
+			answers = append(answers, ptr)
+			additional = append(append(additional, srv, txt), a...)
+		case strings.EqualFold(q.Name, r.instance) && match(dnsTypeSRV, dnsTypeTXT):
+			if match(dnsTypeSRV) {
+				answers = append(answers, srv)
+				additional = append(additional, a...)
+			}
+			if match(dnsTypeTXT) {
+				answers = append(answers, txt)
+			}
+		case strings.EqualFold(q.Name, r.host) && match(dnsTypeA):
+			answers = append(answers, a...)
+		}
+	}
+	if len(answers) == 0 {
+		return
+	}
+	reply := dnsMessage{Response: true, Answers: answers, Additional: additional}
+	to := mdnsGroup
+	if from.Port != mdnsPort {
+		// Legacy unicast: echo the ID and questions, and no cache-flush bits.
+		reply.ID, reply.Questions = query.ID, query.Questions
+		for _, section := range [][]dnsRecord{reply.Answers, reply.Additional} {
+			for i := range section {
+				section[i].Flush = false
+				if section[i].TTL > 10 {
+					section[i].TTL = 10
+				}
+			}
+		}
+		to = from
+	} else if unicast {
+		to = from
+	}
+	if _, err := r.conn.WriteToUDP(reply.encode(), to); err != nil {
+		logWarn("mdns: reply to %s failed: %v", from, err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type mediamtxPathList struct {
+	Items []struct {
+		Name    string            `json:"name"`
+		Ready   bool              `json:"ready"`
+		Readers []json.RawMessage `json:"readers"`
+	} `json:"items"`
+}
+
+// mediamtxLoop polls the MediaMTX control API (or the built-in RTSP server)
+// for per-path reader counts and, in on-demand mode, stops publishers nobody
+// has watched for a while.
+func (a *Agent) mediamtxLoop() {
+	for {
+		cfg := a.config()
+		readers, err := a.readerCounts()
+		if err != nil {
+			logWarn("mediamtx api error: %v", err)
+		} else {
+			a.applyReaderCounts(readers)
+		}
+		time.Sleep(cfg.MediamtxPollInterval)
+	}
+}
+
+func (a *Agent) readerCounts() (map[string]int, error) {
+	if a.rtspServer != nil {
+		return a.rtspServer.ReaderCounts(), nil
+	}
+	return a.fetchReaderCounts()
+}
+
+func (a *Agent) fetchReaderCounts() (map[string]int, error) {
+	cfg := a.config()
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(cfg.MediamtxAPIBase, "/")+"/v3/paths/list?itemsPerPage=1000", nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MediamtxAPIUser != "" {
+		req.SetBasicAuth(cfg.MediamtxAPIUser, cfg.MediamtxAPIPass)
+	}
+
+	client := &http.Client{Timeout: cfg.RegisterTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("%s %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	var list mediamtxPathList
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	readers := make(map[string]int, len(list.Items))
+	for _, item := range list.Items {
+		readers[item.Name] = len(item.Readers)
+	}
+	return readers, nil
+}
+
+func (a *Agent) applyReaderCounts(readers map[string]int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for uid, cam := range a.cameras {
+		cam.Readers = readers[cam.StreamPath]
+		if cam.SubstreamPath != "" {
+			cam.Readers += readers[cam.SubstreamPath]
+		}
+		if !a.onDemandLocked(cam) {
+			continue
+		}
+		if cam.Readers > 0 {
+			a.lastDemand[uid] = now
+			continue
+		}
+		if a.publishers[uid] != nil && !a.demandedLocked(uid) {
+			logInfo("stopping idle on-demand publisher for %s", uid)
+			a.stopPublisherLocked(uid)
+			cam.Idle = true
+		}
+	}
+	a.drainLocked()
+}
+
+// onDemandLocked reports whether a camera's publisher should only run while
+// it has viewers. Recording and motion detection need a continuous stream,
+// so cameras using them always publish, and rtmp cameras have no MediaMTX
+// viewers to wait for.
+func (a *Agent) onDemandLocked(cam *Camera) bool {
+	cfg := a.config()
+	return cfg.OnDemand && (cfg.MediamtxAPIBase != "" || a.rtspServer != nil) && !cam.Record && !cfg.MotionEnabled && cam.Output != outputRTMP
+}
+
+func (a *Agent) demandedLocked(uid string) bool {
+	last, ok := a.lastDemand[uid]
+	return ok && time.Since(last) < a.config().OnDemandIdle
+}
+
+// handleDemand starts an on-demand publisher. It is meant for the hub or a
+// MediaMTX runOnDemand hook, e.g. curl -X POST ".../api/demand?path=$MTX_PATH".
+func (a *Agent) handleDemand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamPath := r.URL.Query().Get("path")
+	deviceUID := r.URL.Query().Get("deviceUid")
+
+	a.mu.Lock()
+	var cam *Camera
+	if deviceUID != "" {
+		cam = a.cameras[deviceUID]
+	} else {
+		for _, candidate := range a.cameras {
+			if candidate.StreamPath == streamPath || (candidate.SubstreamPath != "" && candidate.SubstreamPath == streamPath) {
+				cam = candidate
+				break
+			}
+		}
+	}
+	if cam == nil || !a.activeLocked(cam) {
+		a.mu.Unlock()
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "camera not found"})
+		return
+	}
+	a.lastDemand[cam.DeviceUID] = time.Now()
+	cam.Idle = false
+	a.ensurePublisherLocked(cam)
+	a.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
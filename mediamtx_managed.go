@@ -0,0 +1,367 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	mediamtxReleaseURL   = "https://github.com/bluenviron/mediamtx/releases/download/%s/mediamtx_%s_%s.%s"
+	mediamtxChecksumsURL = "https://github.com/bluenviron/mediamtx/releases/download/%s/checksums.sha256"
+)
+
+// runManagedMediamtx launches a local MediaMTX and restarts it whenever it
+// exits, downloading the binary first when it is missing and a version is
+// set. It returns once ctx is cancelled and MediaMTX has stopped.
+func (a *Agent) runManagedMediamtx(ctx context.Context) {
+	binary, err := a.ensureMediamtxBinary(ctx)
+	if err != nil {
+		logError("managed mediamtx disabled: %v", err)
+		return
+	}
+
+	for {
+		configPath, err := a.writeMediamtxConfig()
+		if err != nil {
+			logError("mediamtx config error: %v", err)
+		} else if err := runMediamtxProcess(ctx, binary, configPath); err != nil && ctx.Err() == nil {
+			logError("mediamtx exited: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			logInfo("mediamtx stopped")
+			return
+		case <-time.After(a.config().RestartDelay):
+		}
+	}
+}
+
+// runMediamtxProcess runs MediaMTX until it exits. Cancelling ctx asks it
+// to stop, and kills it if it has not within shutdownTimeout.
+func runMediamtxProcess(ctx context.Context, binary, configPath string) error {
+	cmd := exec.CommandContext(ctx, binary, configPath)
+	cmd.Cancel = func() error {
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			return cmd.Process.Kill()
+		}
+		return nil
+	}
+	cmd.WaitDelay = shutdownTimeout
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	logInfo("mediamtx started (pid %d)", cmd.Process.Pid)
+
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			logAt(outputLineLevel(line), "[mediamtx] "+line)
+		}
+	}
+	return cmd.Wait()
+}
+
+func (a *Agent) mediamtxDir() string {
+	return filepath.Join(filepath.Dir(a.config().StateFile), "mediamtx")
+}
+
+// ensureMediamtxBinary resolves MEDIAMTX_BINARY, falling back to a copy
+// downloaded into the state directory when MEDIAMTX_VERSION is set.
+func (a *Agent) ensureMediamtxBinary(ctx context.Context) (string, error) {
+	cfg := a.config()
+	if path, err := exec.LookPath(cfg.MediamtxBinary); err == nil {
+		return path, nil
+	}
+
+	name := "mediamtx"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	local := filepath.Join(a.mediamtxDir(), name)
+	if _, err := os.Stat(local); err == nil {
+		return local, nil
+	}
+	if cfg.MediamtxVersion == "" {
+		return "", fmt.Errorf("%s not found and MEDIAMTX_VERSION not set", cfg.MediamtxBinary)
+	}
+
+	logInfo("downloading mediamtx %s", cfg.MediamtxVersion)
+	if err := downloadMediamtx(ctx, cfg.MediamtxVersion, cfg.MediamtxSHA256, a.mediamtxDir(), name); err != nil {
+		return "", err
+	}
+	return local, nil
+}
+
+// downloadMediamtx fetches a MediaMTX release archive and installs its
+// binary once the archive matches the expected SHA-256: MEDIAMTX_SHA256
+// when set, otherwise the one listed in the release's checksums file.
+func downloadMediamtx(ctx context.Context, version, pinned, dir, name string) error {
+	platform, ext, err := mediamtxPlatform()
+	if err != nil {
+		return err
+	}
+	archive := fmt.Sprintf("mediamtx_%s_%s.%s", version, platform, ext)
+	source := fmt.Sprintf(mediamtxReleaseURL, version, version, platform, ext)
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	want := strings.ToLower(pinned)
+	if want == "" {
+		sums, err := fetchRelease(ctx, client, fmt.Sprintf(mediamtxChecksumsURL, version))
+		if err != nil {
+			return err
+		}
+		if want = releaseChecksum(sums, archive); want == "" {
+			return fmt.Errorf("%s is not listed in the release checksums", archive)
+		}
+	}
+	data, err := fetchRelease(ctx, client, source)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != want {
+		return errors.New("mediamtx download does not match its sha256")
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	var binary []byte
+	if ext == "zip" {
+		binary, err = extractZipFile(data, name)
+	} else {
+		binary, err = extractTarGzFile(data, name)
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name), binary, 0o755)
+}
+
+func fetchRelease(ctx context.Context, client *http.Client, source string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download %s: %s", source, res.Status)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// releaseChecksum finds a file's hash in sha256sum output.
+func releaseChecksum(sums []byte, file string) string {
+	for _, line := range strings.Split(string(sums), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == file {
+			return strings.ToLower(fields[0])
+		}
+	}
+	return ""
+}
+
+func mediamtxPlatform() (string, string, error) {
+	arch := runtime.GOARCH
+	switch arch {
+	case "arm64":
+		arch = "arm64v8"
+	case "arm":
+		arch = "armv7"
+	}
+	switch runtime.GOOS {
+	case "linux", "darwin":
+		return runtime.GOOS + "_" + arch, "tar.gz", nil
+	case "windows":
+		return "windows_" + arch, "zip", nil
+	}
+	return "", "", fmt.Errorf("no mediamtx release for %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func extractTarGzFile(data []byte, name string) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s not found in archive", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if filepath.Base(header.Name) == name && header.Typeflag == tar.TypeReg {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+func extractZipFile(data []byte, name string) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range zr.File {
+		if filepath.Base(file.Name) != name {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	return nil, fmt.Errorf("%s not found in archive", name)
+}
+
+// writeMediamtxConfig generates mediamtx.yml from the agent configuration
+// with one path per known camera. MediaMTX watches the file and applies
+// changes without restarting.
+func (a *Agent) writeMediamtxConfig() (string, error) {
+	cfg := a.config()
+	rtspPort := urlPort(cfg.MediaMtxRtspBase, "8554")
+	var b strings.Builder
+	b.WriteString("# Generated by camhub-agent; edits are overwritten.\n")
+	b.WriteString("logLevel: info\n")
+	fmt.Fprintf(&b, "rtspAddress: :%s\n", rtspPort)
+	fmt.Fprintf(&b, "webrtcAddress: :%s\n", urlPort(cfg.MediaMtxWhipBase, "8889"))
+	fmt.Fprintf(&b, "srtAddress: :%s\n", urlPort(cfg.MediaMtxSrtBase, "8890"))
+	if cfg.MediamtxAPIBase != "" {
+		b.WriteString("api: yes\n")
+		fmt.Fprintf(&b, "apiAddress: 127.0.0.1:%s\n", urlPort(cfg.MediamtxAPIBase, "9997"))
+	}
+
+	a.mu.Lock()
+	paths := make([]string, 0, len(a.cameras))
+	for _, cam := range a.cameras {
+		paths = append(paths, cam.StreamPath)
+		if cam.SubstreamPath != "" {
+			paths = append(paths, cam.SubstreamPath)
+		}
+	}
+	a.mu.Unlock()
+	sort.Strings(paths)
+
+	b.WriteString("paths:\n")
+	for _, path := range paths {
+		fmt.Fprintf(&b, "  %s:\n", path)
+		b.WriteString("    source: publisher\n")
+		if cfg.OnDemand {
+			fmt.Fprintf(&b, "    runOnDemand: 'curl -fsS -X POST -H \"Authorization: Bearer %s\" %s%s/api/demand?path=%s'\n", a.demandToken, localAgentCurl(cfg.AgentAddr), cfg.BasePath, path)
+		}
+	}
+	b.WriteString("  all_others:\n")
+
+	dir := a.mediamtxDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "mediamtx.yml")
+	if existing, err := os.ReadFile(path); err == nil && string(existing) == b.String() {
+		return path, nil
+	}
+	// The file holds demandToken.
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		return "", err
+	}
+	return path, os.Chmod(path, 0o600)
+}
+
+func (a *Agent) syncMediamtxConfig() {
+	if _, err := a.writeMediamtxConfig(); err != nil {
+		logError("mediamtx config error: %v", err)
+	}
+}
+
+func urlPort(rawURL, fallback string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Port() == "" {
+		return fallback
+	}
+	return parsed.Port()
+}
+
+// localAgentAddr turns a wildcard listen address into one a local process
+// can connect to.
+func localAgentAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// localAgentCurl returns the curl arguments that reach the agent's API root,
+// preferring a unix socket, then plain HTTP, over the AGENT_ADDR listeners.
+func localAgentCurl(agentAddr string) string {
+	addrs, _ := parseListenAddrs(agentAddr)
+	if len(addrs) == 0 {
+		return "http://" + localAgentAddr(agentAddr)
+	}
+	rank := func(l listenAddr) int {
+		_, unix := unixSocketPath(l.Addr)
+		switch {
+		case !l.tls() && unix:
+			return 0
+		case !l.tls():
+			return 1
+		case unix:
+			return 2
+		}
+		return 3
+	}
+	l := addrs[0]
+	for _, candidate := range addrs[1:] {
+		if rank(candidate) < rank(l) {
+			l = candidate
+		}
+	}
+	scheme, insecure := "http://", ""
+	if l.tls() {
+		// The certificate is for the agent's public name, not localhost.
+		scheme, insecure = "https://", "-k "
+	}
+	if path, ok := unixSocketPath(l.Addr); ok {
+		return insecure + "--unix-socket " + path + " " + scheme + "localhost"
+	}
+	return insecure + scheme + localAgentAddr(l.Addr)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	mediaProbeTimeout  = 3 * time.Second
+	mediaProbeWaiting  = 2 * time.Second
+	mediaProbeInterval = 10 * time.Second
+)
+
+// mediaServerReady reports whether RTSP publishers can reach the media
+// server. The built-in RTSP server is always ready.
+func (a *Agent) mediaServerReady() bool {
+	return a.rtspServer != nil || a.mediaReady.Load()
+}
+
+// mediaReadinessLoop probes the RTSP base so publishers wait for MediaMTX
+// instead of burning through restarts with "connection refused" while it
+// starts. Waiting cameras are started as soon as it answers.
+func (a *Agent) mediaReadinessLoop() {
+	waitingLogged := false
+	for {
+		base := a.config().MediaMtxRtspBase
+		err := probeRTSP(a.config(), mediaProbeTimeout)
+		ready := err == nil
+		if ready != a.mediaReady.Load() {
+			a.mediaReady.Store(ready)
+			if ready {
+				logInfo("media server ready at %s", base)
+				a.emit("media_server_ready", "", nil)
+				a.mu.Lock()
+				a.startWaitingLocked()
+				a.mu.Unlock()
+			} else {
+				logWarn("media server unreachable at %s: %v", base, err)
+				a.emit("media_server_down", "", map[string]interface{}{"error": err.Error()})
+			}
+		} else if !ready && !waitingLogged {
+			logWarn("waiting for media server at %s: %v", base, err)
+		}
+		waitingLogged = true
+
+		if ready {
+			time.Sleep(mediaProbeInterval)
+		} else {
+			time.Sleep(mediaProbeWaiting)
+		}
+	}
+}
+
+// startWaitingLocked starts the publishers that were held back while the
+// media server was down.
+func (a *Agent) startWaitingLocked() {
+	for _, cam := range a.cameras {
+		if cam.WaitingMedia && a.activeLocked(cam) {
+			a.ensurePublisherLocked(cam)
+		}
+	}
+}
+
+// probeRTSP connects to MEDIAMTX_RTSP_BASE and sends OPTIONS. Any RTSP reply,
+// including 401, means the server is accepting connections. For rtsps:// the
+// TLS handshake must also succeed.
+func probeRTSP(cfg *Config, timeout time.Duration) error {
+	conn, parsed, err := dialRTSP(cfg, cfg.MediaMtxRtspBase, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	target := parsed.Scheme + "://" + parsed.Host + "/"
+	if _, err := fmt.Fprintf(conn, "OPTIONS %s RTSP/1.0\r\nCSeq: 1\r\nUser-Agent: camhub-agent\r\n\r\n", target); err != nil {
+		return err
+	}
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("no RTSP reply: %v", err)
+	}
+	if !strings.HasPrefix(status, "RTSP/1.0 ") {
+		return fmt.Errorf("not an RTSP server: %q", strings.TrimSpace(status))
+	}
+	return nil
+}
+
+// dialRTSP connects to the server of an rtsp:// or rtsps:// URL, with the
+// default port filled in, and sets the deadline for the whole exchange. The
+// returned URL has the port in its Host.
+func dialRTSP(cfg *Config, rawURL string, timeout time.Duration) (net.Conn, *url.URL, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parsed.Port() == "" {
+		port := "8554"
+		if isRTSPS(rawURL) {
+			port = "8322"
+		}
+		parsed.Host = net.JoinHostPort(parsed.Hostname(), port)
+	}
+	var conn net.Conn
+	if isRTSPS(rawURL) {
+		config, err := rtspTLSConfig(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.ServerName = parsed.Hostname()
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", parsed.Host, config)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if conn, err = net.DialTimeout("tcp", parsed.Host, timeout); err != nil {
+		return nil, nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	return conn, parsed, nil
+}
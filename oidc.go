@@ -0,0 +1,488 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenID Connect sign-in for the UI and API (authorization code flow with
+// PKCE). Once OIDC_ISSUER is set, browsers without a session are sent to the
+// identity provider, and a signed session cookie carries the user's name and
+// role afterwards. API_TOKEN and API_CREDENTIALS keep working for scripts and
+// the hub.
+
+const (
+	oidcSessionCookie = "camhub_session"
+	oidcLoginCookie   = "camhub_oidc_login"
+	oidcLoginTTL      = 10 * time.Minute
+)
+
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// oidcClient caches the provider's discovery document and signing keys, and
+// holds the key that signs session cookies. That key is random per process,
+// so a restart signs everyone out.
+type oidcClient struct {
+	mu         sync.Mutex
+	provider   *oidcProvider
+	keys       map[string]crypto.PublicKey
+	sessionKey []byte
+}
+
+// oidcLogin is kept in a short-lived cookie between the redirect to the
+// provider and the callback.
+type oidcLogin struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	ReturnTo string `json:"r"`
+	Expires  int64  `json:"e"`
+}
+
+type oidcSession struct {
+	Name    string `json:"n"`
+	Role    string `json:"r"`
+	Expires int64  `json:"e"`
+}
+
+func (a *Agent) oidcEnabled() bool {
+	return a.config().OidcIssuer != ""
+}
+
+// discover fetches the provider configuration the first time and whenever
+// OIDC_ISSUER changes on reload.
+func (c *oidcClient) discover(cfg *Config) (*oidcProvider, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	issuer := strings.TrimRight(cfg.OidcIssuer, "/")
+	if c.provider != nil && c.provider.Issuer == issuer {
+		return c.provider, nil
+	}
+	var provider oidcProvider
+	if err := oidcGetJSON(cfg, issuer+"/.well-known/openid-configuration", &provider); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(provider.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q", provider.Issuer)
+	}
+	provider.Issuer = issuer
+	c.provider = &provider
+	c.keys = nil
+	return c.provider, nil
+}
+
+// key returns the provider's signing key kid, refetching the key set once
+// when the key is unknown so rotated keys are picked up.
+func (c *oidcClient) key(cfg *Config, provider *oidcProvider, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := oidcGetJSON(cfg, provider.JwksURI, &set); err != nil {
+		return nil, err
+	}
+	c.keys = map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		switch {
+		case jwk.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN == nil && errE == nil {
+				c.keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			}
+		case jwk.Kty == "EC" && jwk.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if errX == nil && errY == nil {
+				c.keys[jwk.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			}
+		}
+	}
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func oidcGetJSON(cfg *Config, target string, dest interface{}) error {
+	client := &http.Client{Timeout: cfg.RegisterTimeout}
+	resp, err := client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", target, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(dest)
+}
+
+// sign and verify protect the login and session cookies with HMAC-SHA256.
+// Each cookie has its own key derived from the session key, named by
+// purpose, so a login cookie cannot be replayed as a session cookie.
+func (c *oidcClient) sign(purpose string, value interface{}) string {
+	c.mu.Lock()
+	if c.sessionKey == nil {
+		c.sessionKey = make([]byte, 32)
+		_, _ = rand.Read(c.sessionKey)
+	}
+	key := c.sessionKey
+	c.mu.Unlock()
+
+	data, _ := json.Marshal(value)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	mac := hmac.New(sha256.New, purposeKey(key, purpose))
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (c *oidcClient) verify(purpose, signed string, dest interface{}) bool {
+	c.mu.Lock()
+	key := c.sessionKey
+	c.mu.Unlock()
+	payload, sig, ok := strings.Cut(signed, ".")
+	if !ok || key == nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, purposeKey(key, purpose))
+	mac.Write([]byte(payload))
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	return err == nil && json.Unmarshal(data, dest) == nil
+}
+
+func purposeKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// sessionCredential returns the signed-in user of a request, if any.
+func (a *Agent) sessionCredential(r *http.Request) (apiCredential, bool) {
+	cookie, err := r.Cookie(oidcSessionCookie)
+	if err != nil {
+		return apiCredential{}, false
+	}
+	var session oidcSession
+	if !a.oidc.verify(oidcSessionCookie, cookie.Value, &session) || time.Now().Unix() > session.Expires {
+		return apiCredential{}, false
+	}
+	return apiCredential{Name: session.Name, Role: session.Role}, true
+}
+
+func (a *Agent) oidcRedirectURL(r *http.Request) string {
+	cfg := a.config()
+	if cfg.OidcRedirectURL != "" {
+		return cfg.OidcRedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + cfg.BasePath + "/auth/callback"
+}
+
+func (a *Agent) setAuthCookie(w http.ResponseWriter, r *http.Request, name, value string, ttl time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     a.config().BasePath + "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// handleLogin sends the browser to the identity provider. return is the
+// page to come back to, limited to this agent.
+func (a *Agent) handleLogin(w http.ResponseWriter, r *http.Request) {
+	cfg := a.config()
+	if !a.oidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	provider, err := a.oidc.discover(cfg)
+	if err != nil {
+		logWarn("oidc discovery failed: %v", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "identity provider unavailable"})
+		return
+	}
+
+	returnTo := r.URL.Query().Get("return")
+	// Browsers treat a backslash like a slash, so "/\evil.com" would leave
+	// the agent too.
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.Contains(returnTo, "\\") {
+		returnTo = cfg.BasePath + "/"
+	}
+	login := oidcLogin{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken() + randomToken(),
+		ReturnTo: returnTo,
+		Expires:  time.Now().Add(oidcLoginTTL).Unix(),
+	}
+	a.setAuthCookie(w, r, oidcLoginCookie, a.oidc.sign(oidcLoginCookie, login), oidcLoginTTL)
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", cfg.OidcClientID)
+	query.Set("redirect_uri", a.oidcRedirectURL(r))
+	query.Set("scope", cfg.OidcScopes)
+	query.Set("state", login.State)
+	query.Set("nonce", login.Nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, provider.AuthorizationEndpoint+sep+query.Encode(), http.StatusFound)
+}
+
+// handleCallback finishes the sign-in: it redeems the code, checks the ID
+// token and the user's groups, and starts a session.
+func (a *Agent) handleCallback(w http.ResponseWriter, r *http.Request) {
+	cfg := a.config()
+	if !a.oidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	var login oidcLogin
+	cookie, err := r.Cookie(oidcLoginCookie)
+	if err != nil || !a.oidc.verify(oidcLoginCookie, cookie.Value, &login) || time.Now().Unix() > login.Expires ||
+		!subtleEqual(r.URL.Query().Get("state"), login.State) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "sign-in expired or invalid; try again"})
+		return
+	}
+	a.setAuthCookie(w, r, oidcLoginCookie, "", -time.Second)
+	if msg := r.URL.Query().Get("error"); msg != "" {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "identity provider: " + msg})
+		return
+	}
+
+	provider, err := a.oidc.discover(cfg)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "identity provider unavailable"})
+		return
+	}
+	claims, err := a.redeemCode(cfg, provider, r.URL.Query().Get("code"), login, a.oidcRedirectURL(r))
+	if err != nil {
+		logWarn("oidc sign-in failed: %v", err)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "sign-in failed"})
+		return
+	}
+
+	name := firstClaim(claims, "preferred_username", "email", "sub")
+	role, ok := oidcRole(cfg, claimList(claims[cfg.OidcGroupsClaim]))
+	if !ok {
+		logWarn("oidc: %s is not in OIDC_ALLOWED_GROUPS", name)
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "not allowed to use this agent"})
+		return
+	}
+	logInfo("oidc: %s signed in as %s", name, role)
+	session := oidcSession{Name: name, Role: role, Expires: time.Now().Add(cfg.OidcSessionTTL).Unix()}
+	a.setAuthCookie(w, r, oidcSessionCookie, a.oidc.sign(oidcSessionCookie, session), cfg.OidcSessionTTL)
+	http.Redirect(w, r, login.ReturnTo, http.StatusFound)
+}
+
+func (a *Agent) handleLogout(w http.ResponseWriter, r *http.Request) {
+	a.setAuthCookie(w, r, oidcSessionCookie, "", -time.Second)
+	http.Redirect(w, r, a.config().BasePath+"/", http.StatusFound)
+}
+
+// redeemCode exchanges the authorization code and returns the verified ID
+// token claims.
+func (a *Agent) redeemCode(cfg *Config, provider *oidcProvider, code string, login oidcLogin, redirectURL string) (map[string]interface{}, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("code_verifier", login.Verifier)
+	req, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(cfg.OidcClientID), url.QueryEscape(cfg.OidcClientSecret))
+	client := &http.Client{Timeout: cfg.RegisterTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil || tokens.IDToken == "" {
+		return nil, errors.New("token endpoint returned no id_token")
+	}
+
+	claims, err := a.verifyIDToken(cfg, provider, tokens.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if nonce, _ := claims["nonce"].(string); !subtleEqual(nonce, login.Nonce) {
+		return nil, errors.New("id_token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// verifyIDToken checks the signature (RS256 or ES256), issuer, audience and
+// expiry of an ID token.
+func (a *Agent) verifyIDToken(cfg *Config, provider *oidcProvider, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id_token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed id_token signature")
+	}
+	key, err := a.oidc.key(cfg, provider, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("invalid id_token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("invalid id_token signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported id_token algorithm %q", header.Alg)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimRight(iss, "/") != provider.Issuer {
+		return nil, fmt.Errorf("id_token issuer %q", iss)
+	}
+	if !containsString(claimList(claims["aud"]), cfg.OidcClientID) {
+		return nil, errors.New("id_token is for another client")
+	}
+	// A minute of leeway for clock differences with the provider.
+	if exp, _ := claims["exp"].(float64); time.Now().Add(-time.Minute).Unix() > int64(exp) {
+		return nil, errors.New("id_token expired")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, dest interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed id_token")
+	}
+	return json.Unmarshal(data, dest)
+}
+
+// oidcRole maps the user's groups to a role. Without OIDC_ALLOWED_GROUPS
+// everyone the provider signs in may use the agent; without
+// OIDC_ADMIN_GROUPS every allowed user is an admin. Admin groups are always
+// allowed.
+func oidcRole(cfg *Config, groups []string) (string, bool) {
+	member := func(list []string) bool {
+		for _, group := range groups {
+			if containsString(list, group) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(cfg.OidcAllowedGroups) > 0 && !member(cfg.OidcAllowedGroups) && !member(cfg.OidcAdminGroups) {
+		return "", false
+	}
+	if len(cfg.OidcAdminGroups) == 0 || member(cfg.OidcAdminGroups) {
+		return roleAdmin, true
+	}
+	return roleViewer, true
+}
+
+// claimList reads a claim that may be a single string or a list.
+func claimList(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func firstClaim(claims map[string]interface{}, names ...string) string {
+	for _, name := range names {
+		if value, _ := claims[name].(string); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func randomToken() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func subtleEqual(a, b string) bool {
+	return a != "" && hmac.Equal([]byte(a), []byte(b))
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const onvifEnvelope = `<?xml version="1.0" encoding="UTF-8"?>
+<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:ter="http://www.onvif.org/ver10/error" xmlns:tds="http://www.onvif.org/ver10/device/wsdl" xmlns:trt="http://www.onvif.org/ver10/media/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema"><s:Body>%s</s:Body></s:Envelope>`
+
+// onvifRequest is the part of a SOAP request the emulation needs: the
+// operation, its profile token and the WS-Security UsernameToken.
+type onvifRequest struct {
+	Action       string
+	ProfileToken string
+	Username     string
+	Password     string
+	Digest       bool
+	Nonce        string
+	Created      string
+}
+
+// onvifProfile is one media profile: the main stream or the substream of a
+// camera.
+type onvifProfile struct {
+	Token     string
+	Name      string
+	DeviceUID string
+	RtspURL   string
+	Source    string
+	Height    int
+	FPS       int
+}
+
+func parseOnvifRequest(body io.Reader) (onvifRequest, error) {
+	var req onvifRequest
+	decoder := xml.NewDecoder(io.LimitReader(body, 1<<20))
+	inBody := false
+	field := ""
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return req, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			field = t.Name.Local
+			switch {
+			case field == "Body":
+				inBody = true
+			case inBody && req.Action == "":
+				req.Action = field
+			case field == "Password":
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "Type" && strings.HasSuffix(attr.Value, "#PasswordDigest") {
+						req.Digest = true
+					}
+				}
+			}
+		case xml.EndElement:
+			field = ""
+		case xml.CharData:
+			value := strings.TrimSpace(string(t))
+			switch field {
+			case "Username":
+				req.Username = value
+			case "Password":
+				req.Password = value
+			case "Nonce":
+				req.Nonce = value
+			case "Created":
+				req.Created = value
+			case "ProfileToken":
+				req.ProfileToken = value
+			}
+		}
+	}
+	if req.Action == "" {
+		return req, fmt.Errorf("no SOAP operation")
+	}
+	return req, nil
+}
+
+// authorized checks the UsernameToken against ONVIF_USER and ONVIF_PASS,
+// accepting both digest (Base64(SHA1(nonce + created + password))) and plain
+// text passwords.
+func (req onvifRequest) authorized(user, pass string) bool {
+	if subtle.ConstantTimeCompare([]byte(req.Username), []byte(user)) != 1 {
+		return false
+	}
+	if !req.Digest {
+		return subtle.ConstantTimeCompare([]byte(req.Password), []byte(pass)) == 1
+	}
+	nonce, err := base64.StdEncoding.DecodeString(req.Nonce)
+	if err != nil {
+		return false
+	}
+	sum := sha1.Sum(append(append(nonce, req.Created...), pass...))
+	expected := base64.StdEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(req.Password), []byte(expected)) == 1
+}
+
+// handleOnvif emulates a minimal ONVIF Profile S device so NVRs can add the
+// agent's streams. /onvif/device_service offers every enabled camera as a
+// profile; /onvif/{streamPath}/device_service is a device holding just that
+// camera, for NVRs that map one device to one channel. Device and media
+// operations are answered on either service address.
+func (a *Agent) handleOnvif(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/onvif/"), "/")
+	streamPath := ""
+	if len(parts) == 2 {
+		streamPath, parts = parts[0], parts[1:]
+	}
+	if len(parts) != 1 || (parts[0] != "device_service" && parts[0] != "media_service") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := parseOnvifRequest(r.Body)
+	if err != nil {
+		writeOnvifFault(w, http.StatusBadRequest, "s:Sender", "ter:WellFormed", err.Error())
+		return
+	}
+	cfg := a.config()
+	// Clients read the clock before authenticating to compute digests.
+	if cfg.OnvifUser != "" && req.Action != "GetSystemDateAndTime" {
+		if a.lockedOut(w, r) {
+			return
+		}
+		if !req.authorized(cfg.OnvifUser, cfg.OnvifPass) {
+			a.authFailed(r)
+			writeOnvifFault(w, http.StatusBadRequest, "s:Sender", "ter:NotAuthorized", "Sender not authorized")
+			return
+		}
+		a.authSucceeded(r)
+	}
+
+	profiles := a.onvifProfiles(streamPath, r.Host)
+	if streamPath != "" && len(profiles) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	service := scheme + "://" + r.Host + cfg.BasePath + "/onvif/"
+	if streamPath != "" {
+		service += streamPath + "/"
+	}
+
+	var body string
+	switch req.Action {
+	case "GetSystemDateAndTime":
+		now := time.Now().UTC()
+		body = fmt.Sprintf(`<tds:GetSystemDateAndTimeResponse><tds:SystemDateAndTime><tt:DateTimeType>NTP</tt:DateTimeType><tt:DaylightSavings>false</tt:DaylightSavings><tt:TimeZone><tt:TZ>UTC0</tt:TZ></tt:TimeZone><tt:UTCDateTime><tt:Time><tt:Hour>%d</tt:Hour><tt:Minute>%d</tt:Minute><tt:Second>%d</tt:Second></tt:Time><tt:Date><tt:Year>%d</tt:Year><tt:Month>%d</tt:Month><tt:Day>%d</tt:Day></tt:Date></tt:UTCDateTime></tds:SystemDateAndTime></tds:GetSystemDateAndTimeResponse>`,
+			now.Hour(), now.Minute(), now.Second(), now.Year(), int(now.Month()), now.Day())
+	case "GetDeviceInformation":
+		serial := a.agentID
+		if streamPath != "" {
+			serial += "-" + streamPath
+		}
+		body = fmt.Sprintf(`<tds:GetDeviceInformationResponse><tds:Manufacturer>CamHub</tds:Manufacturer><tds:Model>camhub-agent</tds:Model><tds:FirmwareVersion>%s</tds:FirmwareVersion><tds:SerialNumber>%s</tds:SerialNumber><tds:HardwareId>%s</tds:HardwareId></tds:GetDeviceInformationResponse>`,
+			xmlText(version), xmlText(serial), xmlText(a.hostname))
+	case "GetCapabilities":
+		body = fmt.Sprintf(`<tds:GetCapabilitiesResponse><tds:Capabilities><tt:Device><tt:XAddr>%[1]sdevice_service</tt:XAddr></tt:Device><tt:Media><tt:XAddr>%[1]smedia_service</tt:XAddr><tt:StreamingCapabilities><tt:RTPMulticast>false</tt:RTPMulticast><tt:RTP_TCP>true</tt:RTP_TCP><tt:RTP_RTSP_TCP>true</tt:RTP_RTSP_TCP></tt:StreamingCapabilities></tt:Media></tds:Capabilities></tds:GetCapabilitiesResponse>`,
+			xmlText(service))
+	case "GetServices":
+		body = fmt.Sprintf(`<tds:GetServicesResponse><tds:Service><tds:Namespace>http://www.onvif.org/ver10/device/wsdl</tds:Namespace><tds:XAddr>%[1]sdevice_service</tds:XAddr><tds:Version><tt:Major>2</tt:Major><tt:Minor>0</tt:Minor></tds:Version></tds:Service><tds:Service><tds:Namespace>http://www.onvif.org/ver10/media/wsdl</tds:Namespace><tds:XAddr>%[1]smedia_service</tds:XAddr><tds:Version><tt:Major>2</tt:Major><tt:Minor>0</tt:Minor></tds:Version></tds:Service></tds:GetServicesResponse>`,
+			xmlText(service))
+	case "GetScopes":
+		name := a.hostname
+		if streamPath != "" {
+			name = profiles[0].Name
+		}
+		body = fmt.Sprintf(`<tds:GetScopesResponse><tds:Scopes><tt:ScopeDef>Fixed</tt:ScopeDef><tt:ScopeItem>onvif://www.onvif.org/Profile/Streaming</tt:ScopeItem></tds:Scopes><tds:Scopes><tt:ScopeDef>Fixed</tt:ScopeDef><tt:ScopeItem>onvif://www.onvif.org/hardware/camhub-agent</tt:ScopeItem></tds:Scopes><tds:Scopes><tt:ScopeDef>Fixed</tt:ScopeDef><tt:ScopeItem>onvif://www.onvif.org/name/%s</tt:ScopeItem></tds:Scopes></tds:GetScopesResponse>`,
+			xmlText(url.PathEscape(name)))
+	case "GetVideoSources":
+		var sources strings.Builder
+		for _, p := range profiles {
+			if p.Token == p.Source {
+				fmt.Fprintf(&sources, `<trt:VideoSources token="src-%s"><tt:Framerate>%d</tt:Framerate><tt:Resolution><tt:Width>%d</tt:Width><tt:Height>%d</tt:Height></tt:Resolution></trt:VideoSources>`,
+					xmlText(p.Source), p.FPS, p.Height*16/9, p.Height)
+			}
+		}
+		body = `<trt:GetVideoSourcesResponse>` + sources.String() + `</trt:GetVideoSourcesResponse>`
+	case "GetProfiles":
+		var list strings.Builder
+		for _, p := range profiles {
+			list.WriteString(onvifProfileXML("trt:Profiles", p))
+		}
+		body = `<trt:GetProfilesResponse>` + list.String() + `</trt:GetProfilesResponse>`
+	case "GetProfile", "GetStreamUri", "GetSnapshotUri":
+		var profile *onvifProfile
+		for i := range profiles {
+			if profiles[i].Token == req.ProfileToken {
+				profile = &profiles[i]
+			}
+		}
+		if profile == nil {
+			writeOnvifFault(w, http.StatusBadRequest, "s:Sender", "ter:InvalidArgVal", "No such profile")
+			return
+		}
+		uri := profile.RtspURL
+		if req.Action == "GetSnapshotUri" {
+			uri = scheme + "://" + r.Host + cfg.BasePath + "/api/cameras/" + url.PathEscape(profile.DeviceUID) + "/snapshot"
+		}
+		switch req.Action {
+		case "GetProfile":
+			body = `<trt:GetProfileResponse>` + onvifProfileXML("trt:Profile", *profile) + `</trt:GetProfileResponse>`
+		default:
+			body = fmt.Sprintf(`<trt:%[1]sResponse><trt:MediaUri><tt:Uri>%[2]s</tt:Uri><tt:InvalidAfterConnect>false</tt:InvalidAfterConnect><tt:InvalidAfterReboot>false</tt:InvalidAfterReboot><tt:Timeout>PT0S</tt:Timeout></trt:MediaUri></trt:%[1]sResponse>`,
+				req.Action, xmlText(uri))
+		}
+	default:
+		writeOnvifFault(w, http.StatusInternalServerError, "s:Receiver", "ter:ActionNotSupported", req.Action+" is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(w, onvifEnvelope, body)
+}
+
+// onvifProfiles lists the enabled cameras that publish to MediaMTX, or the
+// one at streamPath, as ONVIF profiles. A loopback host in the stream URL is
+// replaced by the host the client reached the agent on, so an NVR on another
+// machine is not sent to its own localhost.
+func (a *Agent) onvifProfiles(streamPath, requestHost string) []onvifProfile {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	uids := make([]string, 0, len(a.cameras))
+	for uid, cam := range a.cameras {
+		if cam.Enabled && cam.Output != outputRTMP && (streamPath == "" || cam.StreamPath == streamPath) {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Strings(uids)
+
+	var profiles []onvifProfile
+	for _, uid := range uids {
+		cam := a.cameras[uid]
+		height := 1080
+		if max := abrLevels[cam.QualityLevel].maxHeight; max > 0 {
+			height = max
+		}
+		fps := int(math.Round(cam.FPS))
+		if fps <= 0 {
+			fps = 30
+		}
+		profiles = append(profiles, onvifProfile{
+			Token:     cam.StreamPath,
+			Name:      cam.Name,
+			DeviceUID: uid,
+			RtspURL:   externalURL(cam.RtspURL, requestHost),
+			Source:    cam.StreamPath,
+			Height:    height,
+			FPS:       fps,
+		})
+		if cam.SubstreamPath != "" {
+			profiles = append(profiles, onvifProfile{
+				Token:     cam.SubstreamPath,
+				Name:      cam.Name + " (substream)",
+				DeviceUID: uid,
+				RtspURL:   externalURL(cam.SubstreamURL, requestHost),
+				Source:    cam.StreamPath,
+				Height:    a.config().SubstreamHeight,
+				FPS:       fps,
+			})
+		}
+	}
+	return profiles
+}
+
+func externalURL(rawURL, requestHost string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	host := parsed.Hostname()
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return rawURL
+	}
+	external := requestHost
+	if h, _, err := net.SplitHostPort(requestHost); err == nil {
+		external = h
+	}
+	external = strings.Trim(external, "[]")
+	if parsed.Port() != "" {
+		external = net.JoinHostPort(external, parsed.Port())
+	} else if strings.Contains(external, ":") {
+		external = "[" + external + "]"
+	}
+	parsed.Host = external
+	return parsed.String()
+}
+
+// onvifProfileXML describes a profile's H.264 encoder. The resolution is
+// nominal: the agent does not know a device's capture size, only the cap
+// adaptive bitrate or the substream puts on it.
+func onvifProfileXML(element string, p onvifProfile) string {
+	return fmt.Sprintf(`<%[1]s token="%[2]s" fixed="true"><tt:Name>%[3]s</tt:Name><tt:VideoSourceConfiguration token="vsc-%[4]s"><tt:Name>%[3]s</tt:Name><tt:UseCount>1</tt:UseCount><tt:SourceToken>src-%[4]s</tt:SourceToken><tt:Bounds x="0" y="0" width="%[5]d" height="%[6]d"/></tt:VideoSourceConfiguration><tt:VideoEncoderConfiguration token="vec-%[2]s"><tt:Name>%[3]s</tt:Name><tt:UseCount>1</tt:UseCount><tt:Encoding>H264</tt:Encoding><tt:Resolution><tt:Width>%[5]d</tt:Width><tt:Height>%[6]d</tt:Height></tt:Resolution><tt:Quality>5</tt:Quality><tt:H264><tt:GovLength>%[7]d</tt:GovLength><tt:H264Profile>Baseline</tt:H264Profile></tt:H264><tt:SessionTimeout>PT60S</tt:SessionTimeout></tt:VideoEncoderConfiguration></%[1]s>`,
+		element, xmlText(p.Token), xmlText(p.Name), xmlText(p.Source), p.Height*16/9, p.Height, defaultGOP)
+}
+
+func writeOnvifFault(w http.ResponseWriter, status int, code, subcode, reason string) {
+	w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, onvifEnvelope, fmt.Sprintf(`<s:Fault><s:Code><s:Value>%s</s:Value><s:Subcode><s:Value>%s</s:Value></s:Subcode></s:Code><s:Reason><s:Text xml:lang="en">%s</s:Text></s:Reason></s:Fault>`,
+		code, subcode, xmlText(reason)))
+}
+
+func xmlText(value string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(value))
+	return buf.String()
+}
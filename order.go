@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// sortCameras puts cameras with an order first, lowest first, and the rest
+// after them by name, so cameras that hang side by side can be listed side
+// by side whatever they are called.
+func sortCameras(list []*Camera) {
+	sort.SliceStable(list, func(i, j int) bool {
+		oi, oj := list[i].Order, list[j].Order
+		switch {
+		case oi != oj && (oi == 0 || oj == 0):
+			return oj == 0
+		case oi != oj:
+			return oi < oj
+		}
+		return list[i].Name < list[j].Name
+	})
+}
+
+// handleCameraOrder sets the order of many cameras at once: the listed
+// cameras are numbered from 1 in the given order, and every other camera
+// loses its order and follows by name.
+func (a *Agent) handleCameraOrder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var payload struct {
+		DeviceUIDs []string `json:"deviceUids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.DeviceUIDs == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid payload"})
+		return
+	}
+	order := make(map[string]int, len(payload.DeviceUIDs))
+	for i, uid := range payload.DeviceUIDs {
+		if _, dup := order[uid]; dup {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "duplicate deviceUid " + uid})
+			return
+		}
+		order[uid] = i + 1
+	}
+
+	a.mu.Lock()
+	var missing []string
+	for _, uid := range payload.DeviceUIDs {
+		if a.cameras[uid] == nil && a.state[uid] == nil {
+			missing = append(missing, uid)
+		}
+	}
+	if len(missing) > 0 {
+		a.mu.Unlock()
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "camera not found", "deviceUids": missing})
+		return
+	}
+	for uid, settings := range a.state {
+		settings.Order = order[uid]
+	}
+	for uid, cam := range a.cameras {
+		a.settingsLocked(uid).Order = order[uid]
+		cam.Order = order[uid]
+	}
+	a.saveStateLocked()
+	a.mu.Unlock()
+
+	a.writeCameraList(w, "")
+}
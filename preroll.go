@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With RECORDING_MODE=motion the recorder writes short segments into a hidden
+// ring buffer instead of continuous recordings. A motion clip is cut from the
+// buffer when motion stops, starting RECORDING_PREROLL_MS before the trigger,
+// so recordings show what led up to the motion and not just what followed.
+
+const (
+	recordingModeContinuous = "continuous"
+	recordingModeMotion     = "motion"
+
+	prerollDirName = ".preroll"
+	prerollSegment = 2 * time.Second
+	// segmentNameLayout matches the recorder's strftime segment names.
+	segmentNameLayout = "20060102-150405"
+)
+
+func (a *Agent) motionRecording() bool {
+	return strings.EqualFold(strings.TrimSpace(a.config().RecordingMode), recordingModeMotion)
+}
+
+// runPrerollProcess is runRecordProcess for motion recording: MPEG-TS
+// segments of prerollSegment length, which can be joined without remuxing
+// each one and stay readable while the newest is still being written.
+func (a *Agent) runPrerollProcess(ctx context.Context, rtspURL, dir string) error {
+	bufferDir := filepath.Join(dir, prerollDirName)
+	if err := os.MkdirAll(bufferDir, 0o755); err != nil {
+		return err
+	}
+
+	args := []string{"-rtsp_transport", "tcp", "-timeout", "5000000"}
+	args = append(args, a.rtspTLSArgs(rtspURL)...)
+	args = append(args,
+		"-i", rtspURL,
+		"-an",
+		"-c:v", "copy",
+		"-f", "segment",
+		"-segment_time", strconv.Itoa(int(prerollSegment.Seconds())),
+		"-segment_format", "mpegts",
+		"-reset_timestamps", "1",
+		"-strftime", "1",
+		filepath.Join(bufferDir, "%Y%m%d-%H%M%S.ts"),
+	)
+
+	cmd := exec.CommandContext(ctx, a.config().FfmpegPath, args...)
+	cmd.Stderr = io.Discard
+	return cmd.Run()
+}
+
+// runPrerollJanitor deletes buffered segments older than the pre-roll, or
+// older than the earliest clip that is open or still being saved.
+func (a *Agent) runPrerollJanitor(ctx context.Context, deviceUID, dir string) {
+	bufferDir := filepath.Join(dir, prerollDirName)
+	ticker := time.NewTicker(prerollSegment)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cutoff := time.Now().Add(-a.config().RecordingPreRoll - 2*prerollSegment)
+		a.mu.Lock()
+		if worker := a.recorders[deviceUID]; worker != nil && !worker.keepFrom.IsZero() && worker.keepFrom.Before(cutoff) {
+			cutoff = worker.keepFrom.Add(-prerollSegment)
+		}
+		a.mu.Unlock()
+
+		entries, err := os.ReadDir(bufferDir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || strings.HasPrefix(entry.Name(), ".") || !info.ModTime().Before(cutoff) {
+				continue
+			}
+			_ = os.Remove(filepath.Join(bufferDir, entry.Name()))
+		}
+	}
+}
+
+// markMotionClipLocked opens a clip when motion starts and saves it when
+// motion stops. Cameras that are not motion recording are ignored.
+func (a *Agent) markMotionClipLocked(deviceUID string, active bool, ts time.Time) {
+	worker := a.recorders[deviceUID]
+	if worker == nil || !worker.preroll {
+		return
+	}
+	if active {
+		if worker.clipStart.IsZero() {
+			worker.clipStart = ts
+			from := ts.Add(-a.config().RecordingPreRoll)
+			if worker.keepFrom.IsZero() || from.Before(worker.keepFrom) {
+				worker.keepFrom = from
+			}
+		}
+		return
+	}
+	if worker.clipStart.IsZero() {
+		return
+	}
+	// Wait for the segment that covers the stop to be closed.
+	a.closeMotionClipLocked(deviceUID, worker, ts, 2*prerollSegment)
+}
+
+func (a *Agent) closeMotionClipLocked(deviceUID string, worker *RecordWorker, stop time.Time, wait time.Duration) {
+	start := worker.clipStart
+	worker.clipStart = time.Time{}
+	worker.saving++
+	go func() {
+		time.Sleep(wait)
+		a.saveMotionClip(deviceUID, worker.dir, start, stop)
+
+		a.mu.Lock()
+		worker.saving--
+		if worker.saving == 0 {
+			worker.keepFrom = time.Time{}
+			if !worker.clipStart.IsZero() {
+				worker.keepFrom = worker.clipStart.Add(-a.config().RecordingPreRoll)
+			}
+		}
+		a.mu.Unlock()
+	}()
+}
+
+// saveMotionClip joins the buffered segments between the pre-roll before
+// start and stop into one recording next to the continuous ones, so listing,
+// upload and pruning treat both the same.
+func (a *Agent) saveMotionClip(deviceUID, dir string, start, stop time.Time) {
+	cfg := a.config()
+	bufferDir := filepath.Join(dir, prerollDirName)
+	from := start.Add(-cfg.RecordingPreRoll)
+	segments, err := bufferedSegments(bufferDir, from, stop)
+	if err != nil || len(segments) == 0 {
+		logWarn("motion clip for %s not saved: no buffered video", deviceUID)
+		return
+	}
+
+	name := from.Format(segmentNameLayout)
+	list := filepath.Join(bufferDir, "."+name+".txt")
+	var b strings.Builder
+	for _, segment := range segments {
+		fmt.Fprintf(&b, "file '%s'\n", segment)
+	}
+	if err := os.WriteFile(list, []byte(b.String()), 0o644); err != nil {
+		logWarn("motion clip for %s not saved: %v", deviceUID, err)
+		return
+	}
+	defer os.Remove(list)
+
+	// Written under a hidden name so the uploader never sees a partial file.
+	ext, format := recordingFormat(cfg.RecordingFormat)
+	tmp := filepath.Join(dir, "."+name+"."+ext)
+	out, err := exec.Command(cfg.FfmpegPath, "-hide_banner", "-y",
+		"-f", "concat", "-safe", "0", "-i", list,
+		"-c", "copy", "-f", format, tmp,
+	).CombinedOutput()
+	if err != nil {
+		_ = os.Remove(tmp)
+		logWarn("motion clip for %s not saved: %v: %s", deviceUID, err, lastLine(string(out)))
+		return
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name+"."+ext)); err != nil {
+		logWarn("motion clip for %s not saved: %v", deviceUID, err)
+		return
+	}
+	logInfo("saved motion clip %s for %s", name+"."+ext, deviceUID)
+	a.emit("recording_saved", deviceUID, map[string]interface{}{
+		"name":            name + "." + ext,
+		"preRollSeconds":  cfg.RecordingPreRoll.Seconds(),
+		"durationSeconds": stop.Sub(from).Seconds(),
+	})
+}
+
+// bufferedSegments lists, oldest first, the buffered segments that overlap
+// from..stop. A segment starts at the time in its name and ends at its
+// modification time.
+func bufferedSegments(bufferDir string, from, stop time.Time) ([]string, error) {
+	entries, err := os.ReadDir(bufferDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		begin, err := time.ParseInLocation(segmentNameLayout, strings.TrimSuffix(name, filepath.Ext(name)), time.Local)
+		if err != nil || begin.After(stop) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().Before(from) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
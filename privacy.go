@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// privacyPath marks privacy mode on disk; the file exists while it is on.
+func privacyPath(cfg *Config) string {
+	return filepath.Join(filepath.Dir(cfg.StateFile), "privacy")
+}
+
+func loadPrivacy(cfg *Config) bool {
+	_, err := os.Stat(privacyPath(cfg))
+	return err == nil
+}
+
+// setPrivacyLocked switches privacy mode. While it is on every publisher,
+// motion detector and recorder is stopped and nothing restarts until it is
+// lifted, regardless of per-camera state.
+func (a *Agent) setPrivacyLocked(enabled bool, source string) {
+	if a.privacy == enabled {
+		return
+	}
+	a.privacy = enabled
+
+	path := privacyPath(a.config())
+	if enabled {
+		if err := os.WriteFile(path, []byte(source+"\n"), 0o600); err != nil {
+			logError("privacy state save failed: %v", err)
+		}
+	} else if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logError("privacy state save failed: %v", err)
+	}
+
+	if enabled {
+		logInfo("privacy mode on (%s)", source)
+		a.emit("privacy_enabled", "", map[string]interface{}{"source": source})
+		for uid := range a.cameras {
+			a.stopCameraLocked(uid)
+		}
+		return
+	}
+
+	logInfo("privacy mode off (%s)", source)
+	a.emit("privacy_disabled", "", map[string]interface{}{"source": source})
+	for _, cam := range a.cameras {
+		if a.activeLocked(cam) {
+			a.startCameraLocked(cam)
+		}
+	}
+}
+
+func (a *Agent) handlePrivacy(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var payload struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Enabled == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid payload"})
+			return
+		}
+		a.mu.Lock()
+		a.setPrivacyLocked(*payload.Enabled, "api")
+		a.mu.Unlock()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.mu.Lock()
+	enabled := a.privacy
+	a.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]bool{"privacy": enabled})
+}
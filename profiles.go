@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const encoderCopy = "copy"
+
+// EncodingProfile bundles the encoder settings a camera can be assigned by
+// name instead of setting each one. Zero values keep the agent's defaults.
+// With encoder "copy" the device's own stream is passed through, so filters,
+// the substream and adaptive bitrate do not apply. Profiles affect the ffmpeg
+// backend only.
+type EncodingProfile struct {
+	// Encoder is an ffmpeg video encoder, libx264 by default. Other
+	// encoders get only the GOP and bitrate options; anything else they
+	// need goes in the camera's OVERRIDES_FILE entry.
+	Encoder     string `json:"encoder,omitempty"`
+	Preset      string `json:"preset,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	FPS         int    `json:"fps,omitempty"`
+	BitrateKbps int    `json:"bitrateKbps,omitempty"`
+}
+
+// builtinProfiles are always available; PROFILES_FILE may override them.
+var builtinProfiles = map[string]EncodingProfile{
+	"low-power": {Preset: "ultrafast", Height: 480, FPS: 10, BitrateKbps: 600},
+	"hq":        {Preset: "fast", BitrateKbps: 4000},
+	"copy":      {Encoder: encoderCopy},
+}
+
+var x264Presets = map[string]bool{
+	"ultrafast": true, "superfast": true, "veryfast": true, "faster": true, "fast": true,
+	"medium": true, "slow": true, "slower": true, "veryslow": true,
+}
+
+// loadProfiles merges the built-in profiles with the JSON object in
+// PROFILES_FILE, e.g. {"night": {"height": 720, "fps": 5}}.
+func loadProfiles(path string) (map[string]EncodingProfile, error) {
+	profiles := make(map[string]EncodingProfile, len(builtinProfiles))
+	for name, profile := range builtinProfiles {
+		profiles[name] = profile
+	}
+	if path == "" {
+		return profiles, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return profiles, err
+	}
+	var listed map[string]EncodingProfile
+	if err := json.Unmarshal(data, &listed); err != nil {
+		return profiles, fmt.Errorf("%s: %w", path, err)
+	}
+	for name, profile := range listed {
+		if err := profile.validate(); err != nil {
+			return profiles, fmt.Errorf("%s: profile %q: %w", path, name, err)
+		}
+		profiles[name] = profile
+	}
+	return profiles, nil
+}
+
+func (p EncodingProfile) validate() error {
+	switch {
+	case strings.ContainsAny(p.Encoder, " \t\r\n"):
+		return fmt.Errorf("invalid encoder %q", p.Encoder)
+	case p.Preset != "" && p.isX264() && !x264Presets[p.Preset]:
+		return fmt.Errorf("unknown libx264 preset %q", p.Preset)
+	case p.Height < 0 || p.Height%2 != 0:
+		return fmt.Errorf("height must be a positive even number")
+	case p.FPS < 0 || p.FPS > 120:
+		return fmt.Errorf("fps must be between 1 and 120")
+	case p.BitrateKbps < 0:
+		return fmt.Errorf("bitrateKbps must not be negative")
+	}
+	return nil
+}
+
+func (p EncodingProfile) isX264() bool {
+	return p.Encoder == "" || p.Encoder == "libx264"
+}
+
+func (p EncodingProfile) isCopy() bool {
+	return p.Encoder == encoderCopy
+}
+
+// encoderArgs returns the video encoder options for a camera. Adaptive
+// bitrate's preset wins over the profile's once it has degraded the camera.
+func (p EncodingProfile) encoderArgs(camera *Camera) []string {
+	var args []string
+	if p.isX264() {
+		preset := abrLevels[camera.QualityLevel].preset
+		if p.Preset != "" && camera.QualityLevel == 0 {
+			preset = p.Preset
+		}
+		args = x264Args(camera.EncoderTuning, preset)
+	} else {
+		gop := camera.GOP
+		if gop == 0 {
+			gop = defaultGOP
+		}
+		args = []string{"-c:v", p.Encoder, "-g", strconv.Itoa(gop), "-bf", strconv.Itoa(camera.BFrames)}
+	}
+	if p.BitrateKbps > 0 {
+		rate := strconv.Itoa(p.BitrateKbps) + "k"
+		args = append(args, "-b:v", rate, "-maxrate", rate, "-bufsize", strconv.Itoa(2*p.BitrateKbps)+"k")
+	}
+	return append(args, camera.OutputArgs...)
+}
+
+// maxHeight is the lower of the profile's and adaptive bitrate's caps.
+func (p EncodingProfile) maxHeight(qualityLevel int) int {
+	height := abrLevels[qualityLevel].maxHeight
+	if p.Height > 0 && (height == 0 || p.Height < height) {
+		height = p.Height
+	}
+	return height
+}
+
+// encodingProfile returns the camera's profile, or the defaults when it has
+// none or its profile is no longer configured.
+func (a *Agent) encodingProfile(camera *Camera) EncodingProfile {
+	return a.config().Profiles[camera.Profile]
+}
+
+func (a *Agent) handleProfiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	profiles := a.config().Profiles
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		list = append(list, map[string]interface{}{"name": name, "profile": profiles[name]})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"strings"
+)
+
+// applyProxy makes PROXY_URL the proxy for outbound HTTP(S) requests unless
+// HTTP_PROXY or HTTPS_PROXY are already set. Every client in the agent uses
+// the default transport, which reads these variables (and NO_PROXY) once on
+// first use, so this must run before any request is made. Loopback
+// destinations such as a local MediaMTX are never proxied.
+func applyProxy(cfg Config) {
+	if cfg.ProxyURL == "" {
+		return
+	}
+	for _, key := range []string{"HTTP_PROXY", "HTTPS_PROXY"} {
+		if os.Getenv(key) == "" && os.Getenv(strings.ToLower(key)) == "" {
+			_ = os.Setenv(key, cfg.ProxyURL)
+		}
+	}
+}
+
+// redactSecret masks a secret in a line of process output, including the
+// percent-encoded form it takes inside a URL.
+func redactSecret(line, secret string) string {
+	if secret == "" {
+		return line
+	}
+	line = strings.ReplaceAll(line, secret, "xxxxx")
+	for _, escaped := range []string{url.QueryEscape(secret), url.PathEscape(secret), url.UserPassword("", secret).String()[1:]} {
+		if escaped != secret {
+			line = strings.ReplaceAll(line, escaped, "xxxxx")
+		}
+	}
+	return line
+}
+
+// redactURL hides credentials in a URL before it is logged.
+func redactURL(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return value
+	}
+	return parsed.Redacted()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strings"
+)
+
+// ptzAxes maps PTZ axes to their UVC absolute controls.
+var ptzAxes = map[string]string{
+	"pan":  "pan_absolute",
+	"tilt": "tilt_absolute",
+	"zoom": "zoom_absolute",
+}
+
+// PTZPosition is an absolute position; axes a camera lacks are omitted.
+type PTZPosition struct {
+	Pan  *int `json:"pan,omitempty"`
+	Tilt *int `json:"tilt,omitempty"`
+	Zoom *int `json:"zoom,omitempty"`
+}
+
+type PTZStatus struct {
+	Position PTZPosition              `json:"position"`
+	Axes     map[string]CameraControl `json:"axes"`
+	Presets  map[string]PTZPosition   `json:"presets"`
+}
+
+func (p PTZPosition) axis(name string) *int {
+	switch name {
+	case "pan":
+		return p.Pan
+	case "tilt":
+		return p.Tilt
+	case "zoom":
+		return p.Zoom
+	}
+	return nil
+}
+
+func (p *PTZPosition) setAxis(name string, value int) {
+	switch name {
+	case "pan":
+		p.Pan = &value
+	case "tilt":
+		p.Tilt = &value
+	case "zoom":
+		p.Zoom = &value
+	}
+}
+
+// ptzAxesFrom picks the PTZ controls out of a camera's control list.
+func ptzAxesFrom(controls []CameraControl) map[string]CameraControl {
+	axes := map[string]CameraControl{}
+	for _, control := range controls {
+		for axis, name := range ptzAxes {
+			if control.Name == name {
+				axes[axis] = control
+			}
+		}
+	}
+	return axes
+}
+
+// detectPTZ records whether a camera exposes any PTZ control, so the hub can
+// offer PTZ only where it works.
+func (a *Agent) detectPTZ(deviceUID, node string) {
+	if (runtime.GOOS != "linux" && runtime.GOOS != "freebsd") || isTestNode(node) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+	defer cancel()
+	controls, err := listControls(ctx, node)
+	if err != nil {
+		return
+	}
+	supported := len(ptzAxesFrom(controls)) > 0
+
+	a.mu.Lock()
+	if cam := a.cameras[deviceUID]; cam != nil {
+		cam.PTZ = supported
+	}
+	a.mu.Unlock()
+}
+
+// handlePTZ reports the position, ranges and presets (GET), moves the camera
+// (POST) or deletes a preset (DELETE ?preset=name). POST bodies are one of:
+//
+//	{"action": "absolute", "pan": 3600, "tilt": 0, "zoom": 100}
+//	{"action": "relative", "pan": -3600}
+//	{"action": "preset", "preset": "door"}
+//	{"action": "savePreset", "preset": "door"}
+func (a *Agent) handlePTZ(w http.ResponseWriter, r *http.Request, deviceUID string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if runtime.GOOS != "linux" && runtime.GOOS != "freebsd" {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "ptz requires V4L2"})
+		return
+	}
+
+	var payload struct {
+		Action string `json:"action"`
+		Preset string `json:"preset"`
+		PTZPosition
+	}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid payload"})
+			return
+		}
+		payload.Preset = strings.TrimSpace(payload.Preset)
+	}
+
+	a.mu.Lock()
+	cam := a.cameras[deviceUID]
+	var node string
+	if cam != nil {
+		node = cam.Node
+	}
+	a.mu.Unlock()
+	if cam == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "camera not found"})
+		return
+	}
+	if isTestNode(node) {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "test cameras have no ptz controls"})
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		name := r.URL.Query().Get("preset")
+		a.mu.Lock()
+		settings := a.settingsLocked(deviceUID)
+		_, ok := settings.PTZPresets[name]
+		delete(settings.PTZPresets, name)
+		a.saveStateLocked()
+		a.mu.Unlock()
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "preset not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), controlTimeout)
+	defer cancel()
+	controls, err := listControls(ctx, node)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	axes := ptzAxesFrom(controls)
+	if len(axes) == 0 {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "camera has no ptz controls"})
+		return
+	}
+
+	var current PTZPosition
+	for axis, control := range axes {
+		current.setAxis(axis, control.Value)
+	}
+
+	if r.Method == http.MethodPost {
+		var target PTZPosition
+		switch payload.Action {
+		case "absolute":
+			target = payload.PTZPosition
+		case "relative":
+			for axis := range axes {
+				if delta := payload.axis(axis); delta != nil {
+					target.setAxis(axis, *current.axis(axis)+*delta)
+				}
+			}
+		case "preset":
+			a.mu.Lock()
+			preset, ok := a.settingsLocked(deviceUID).PTZPresets[payload.Preset]
+			a.mu.Unlock()
+			if !ok {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "preset not found"})
+				return
+			}
+			target = preset
+		case "savePreset":
+			if payload.Preset == "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "preset name required"})
+				return
+			}
+			a.mu.Lock()
+			settings := a.settingsLocked(deviceUID)
+			if settings.PTZPresets == nil {
+				settings.PTZPresets = map[string]PTZPosition{}
+			}
+			settings.PTZPresets[payload.Preset] = current
+			a.saveStateLocked()
+			a.mu.Unlock()
+		default:
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "action must be absolute, relative, preset or savePreset"})
+			return
+		}
+
+		values := map[string]int{}
+		for axis, control := range axes {
+			value := target.axis(axis)
+			if value == nil {
+				continue
+			}
+			values[control.Name] = clampControl(control, *value)
+		}
+		if err := setControls(ctx, node, values); err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		for axis, control := range axes {
+			if value, ok := values[control.Name]; ok {
+				current.setAxis(axis, value)
+			}
+		}
+	}
+
+	a.mu.Lock()
+	presets := map[string]PTZPosition{}
+	for name, preset := range a.settingsLocked(deviceUID).PTZPresets {
+		presets[name] = preset
+	}
+	a.mu.Unlock()
+	writeJSON(w, http.StatusOK, PTZStatus{Position: current, Axes: axes, Presets: presets})
+}
+
+// clampControl keeps a value inside the control's range and on its step.
+func clampControl(control CameraControl, value int) int {
+	if control.Min != nil && value < *control.Min {
+		value = *control.Min
+	}
+	if control.Max != nil && value > *control.Max {
+		value = *control.Max
+	}
+	if control.Step != nil && *control.Step > 1 {
+		base := 0
+		if control.Min != nil {
+			base = *control.Min
+		}
+		value = base + (value-base) / *control.Step * *control.Step
+	}
+	return value
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientLimits tracks each client IP's request budget and failed sign-ins.
+type clientLimits struct {
+	mu        sync.Mutex
+	clients   map[string]*clientState
+	lastPrune time.Time
+}
+
+type clientState struct {
+	tokens      float64
+	refilled    time.Time
+	failures    int
+	lockouts    int
+	lockedUntil time.Time
+	seen        time.Time
+}
+
+// client returns the state for ip, creating it with a full bucket. Clients
+// that have been idle for an hour are dropped now and then. Callers hold mu.
+func (l *clientLimits) client(ip string, burst int, now time.Time) *clientState {
+	if l.clients == nil {
+		l.clients = make(map[string]*clientState)
+	}
+	if now.Sub(l.lastPrune) > time.Minute {
+		l.lastPrune = now
+		for key, state := range l.clients {
+			if now.Sub(state.seen) > time.Hour && now.After(state.lockedUntil) {
+				delete(l.clients, key)
+			}
+		}
+	}
+	state, ok := l.clients[ip]
+	if !ok {
+		state = &clientState{tokens: float64(burst), refilled: now}
+		l.clients[ip] = state
+	}
+	state.seen = now
+	return state
+}
+
+// clientIP is the address rate limits and lockouts are keyed on. Behind a
+// unix socket every request comes from the reverse proxy, which is the only
+// thing that can connect, so its X-Forwarded-For is trusted instead.
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	if ip := strings.TrimSpace(forwarded[len(forwarded)-1]); ip != "" {
+		return ip
+	}
+	return r.RemoteAddr
+}
+
+// rateLimit allows each client RATE_LIMIT_RPS requests a second to /api/,
+// with bursts of up to RATE_LIMIT_BURST, and answers the rest with 429.
+func (a *Agent) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := a.config()
+		if cfg.RateLimitRPS <= 0 || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		burst := cfg.RateLimitBurst
+		if burst < 1 {
+			burst = 1
+		}
+		now := time.Now()
+		a.limits.mu.Lock()
+		state := a.limits.client(clientIP(r), burst, now)
+		state.tokens = math.Min(float64(burst), state.tokens+now.Sub(state.refilled).Seconds()*float64(cfg.RateLimitRPS))
+		state.refilled = now
+		allowed := state.tokens >= 1
+		if allowed {
+			state.tokens--
+		}
+		a.limits.mu.Unlock()
+		if !allowed {
+			w.Header().Set("Retry-After", "1")
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "too many requests"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lockedOut answers with 429 and reports true while the client is locked
+// out after repeated failed sign-ins.
+func (a *Agent) lockedOut(w http.ResponseWriter, r *http.Request) bool {
+	now := time.Now()
+	a.limits.mu.Lock()
+	state := a.limits.client(clientIP(r), a.config().RateLimitBurst, now)
+	wait := state.lockedUntil.Sub(now)
+	a.limits.mu.Unlock()
+	if wait <= 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "too many failed sign-ins; try again later"})
+	return true
+}
+
+// authFailed counts a failed sign-in. Every AUTH_LOCKOUT_FAILURES in a row
+// lock the client out, for AUTH_LOCKOUT_MS the first time and twice as long
+// each time after, up to AUTH_LOCKOUT_MAX_MS.
+func (a *Agent) authFailed(r *http.Request) {
+	cfg := a.config()
+	if cfg.LockoutFailures <= 0 {
+		return
+	}
+	ip := clientIP(r)
+	now := time.Now()
+	a.limits.mu.Lock()
+	defer a.limits.mu.Unlock()
+	state := a.limits.client(ip, cfg.RateLimitBurst, now)
+	state.failures++
+	if state.failures < cfg.LockoutFailures {
+		return
+	}
+	lockout := cfg.LockoutDuration << uint(min(state.lockouts, 30))
+	if lockout <= 0 || lockout > cfg.LockoutMax {
+		lockout = cfg.LockoutMax
+	}
+	state.failures = 0
+	state.lockouts++
+	state.lockedUntil = now.Add(lockout)
+	logWarn("%d failed sign-ins from %s, locked out for %s", cfg.LockoutFailures, ip, lockout)
+}
+
+// authSucceeded clears the client's failed sign-ins and lockout history.
+func (a *Agent) authSucceeded(r *http.Request) {
+	a.limits.mu.Lock()
+	defer a.limits.mu.Unlock()
+	if state, ok := a.limits.clients[clientIP(r)]; ok {
+		state.failures = 0
+		state.lockouts = 0
+	}
+}
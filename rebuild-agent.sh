@@ -1,4 +1,7 @@
-rm ./agent_state.json
-gofmt -w main.go
-go build -o camhub-agent
+rm -f ./agent_state.json ./agent_state.db
+gofmt -w *.go
+VERSION=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
+COMMIT=$(git rev-parse --short HEAD 2>/dev/null || echo unknown)
+BUILD_DATE=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+go build -ldflags "-X main.version=$VERSION -X main.commit=$COMMIT -X main.buildDate=$BUILD_DATE" -o camhub-agent
 ./camhub-agent
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RecordWorker struct {
+	cancel context.CancelFunc
+	dir    string
+
+	// The rest is for motion recording and guarded by Agent.mu. clipStart is
+	// when the open motion clip started; keepFrom is the oldest buffered
+	// video a clip that is open or being saved still needs.
+	preroll   bool
+	clipStart time.Time
+	keepFrom  time.Time
+	saving    int
+}
+
+type RecordingInfo struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+	// StartedAt comes from the file name, which the recorder stamps with the
+	// segment's start time; it is zero for files named otherwise.
+	StartedAt  time.Time `json:"startedAt"`
+	StreamPath string    `json:"streamPath"`
+	// DeviceUID is empty when no current camera publishes to StreamPath.
+	DeviceUID string `json:"deviceUid,omitempty"`
+	// URL downloads or streams the recording, with Range support.
+	URL string `json:"url"`
+}
+
+// recordEnabledLocked reports whether a camera should be recorded. A per-camera
+// setting overrides the RECORDING_ENABLED default.
+func (a *Agent) recordEnabledLocked(deviceUID string) bool {
+	if settings := a.state[deviceUID]; settings != nil && settings.Record != nil {
+		return *settings.Record
+	}
+	return a.config().RecordingEnabled
+}
+
+func (a *Agent) ensureRecorderLocked(camera *Camera) {
+	if !camera.Record || a.recordingPaused || camera.Output == outputRTMP {
+		return
+	}
+	if a.recorders[camera.DeviceUID] != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dir := a.recordingDir(camera.StreamPath)
+	worker := &RecordWorker{cancel: cancel, dir: dir, preroll: a.motionRecording()}
+	a.recorders[camera.DeviceUID] = worker
+	camera.Recording = true
+
+	go a.runRecordLoop(ctx, camera.DeviceUID, camera.RtspURL, dir, worker.preroll)
+}
+
+func (a *Agent) stopRecorderLocked(uid string) {
+	worker := a.recorders[uid]
+	if worker == nil {
+		return
+	}
+	worker.cancel()
+	if !worker.clipStart.IsZero() {
+		a.closeMotionClipLocked(uid, worker, time.Now(), 0)
+	}
+	delete(a.recorders, uid)
+	if cam := a.cameras[uid]; cam != nil {
+		cam.Recording = false
+	}
+}
+
+func (a *Agent) recordingDir(streamPath string) string {
+	return filepath.Join(a.config().RecordingDir, streamPath)
+}
+
+func (a *Agent) runRecordLoop(ctx context.Context, deviceUID, rtspURL, dir string, preroll bool) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		logWarn("recording disabled for %s: %v", deviceUID, err)
+		return
+	}
+	record := a.runRecordProcess
+	if preroll {
+		record = a.runPrerollProcess
+		go a.runPrerollJanitor(ctx, deviceUID, dir)
+	}
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+		err := record(ctx, rtspURL, dir)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logWarn("recorder ended for %s: %v", deviceUID, err)
+		}
+		time.Sleep(a.config().RestartDelay)
+	}
+}
+
+// runRecordProcess reads the published stream back from MediaMTX and copies
+// it into fixed-length segments, so recording never competes with the
+// publisher for the capture device.
+func (a *Agent) runRecordProcess(ctx context.Context, rtspURL, dir string) error {
+	ext, format := recordingFormat(a.config().RecordingFormat)
+	segment := int(a.config().RecordingSegment.Seconds())
+	if segment <= 0 {
+		segment = 300
+	}
+
+	args := []string{"-rtsp_transport", "tcp", "-timeout", "5000000"}
+	args = append(args, a.rtspTLSArgs(rtspURL)...)
+	args = append(args,
+		"-i", rtspURL,
+		"-an",
+		"-c:v", "copy",
+		"-f", "segment",
+		"-segment_time", strconv.Itoa(segment),
+		"-segment_format", format,
+		"-reset_timestamps", "1",
+		"-strftime", "1",
+		filepath.Join(dir, "%Y%m%d-%H%M%S."+ext),
+	)
+
+	cmd := exec.CommandContext(ctx, a.config().FfmpegPath, args...)
+	cmd.Stderr = io.Discard
+	return cmd.Run()
+}
+
+func recordingFormat(value string) (string, string) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "mkv", "matroska":
+		return "mkv", "matroska"
+	default:
+		return "mp4", "mp4"
+	}
+}
+
+func recordingURL(basePath, streamPath, name string) string {
+	return basePath + "/api/recordings/" + url.PathEscape(streamPath) + "/" + url.PathEscape(name)
+}
+
+func listRecordings(dir string) ([]RecordingInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []RecordingInfo{}, nil
+		}
+		return nil, err
+	}
+
+	list := make([]RecordingInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		started, _ := time.ParseInLocation(segmentNameLayout, strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())), time.Local)
+		list = append(list, RecordingInfo{
+			Name:       entry.Name(),
+			Size:       info.Size(),
+			ModifiedAt: info.ModTime(),
+			StartedAt:  started,
+			StreamPath: filepath.Base(dir),
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name > list[j].Name
+	})
+	return list, nil
+}
+
+func (a *Agent) handleRecordings(w http.ResponseWriter, r *http.Request, deviceUID string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.mu.Lock()
+	cam := a.cameras[deviceUID]
+	var dir string
+	if cam != nil {
+		dir = a.recordingDir(cam.StreamPath)
+	}
+	a.mu.Unlock()
+	if cam == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "camera not found"})
+		return
+	}
+
+	list, err := listRecordings(dir)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("list failed: %v", err)})
+		return
+	}
+	basePath := a.config().BasePath
+	for i := range list {
+		list[i].DeviceUID = deviceUID
+		list[i].URL = recordingURL(basePath, list[i].StreamPath, list[i].Name)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleAllRecordings lists recordings of every camera, including cameras
+// that are no longer attached, newest first. deviceUid or streamPath select
+// one camera; from and to (RFC 3339) keep recordings overlapping that range.
+// GET /api/recordings/{streamPath}/{name} serves a single file.
+func (a *Agent) handleAllRecordings(w http.ResponseWriter, r *http.Request) {
+	if rest := strings.TrimPrefix(r.URL.Path, "/api/recordings"); rest != "" && rest != "/" {
+		a.serveRecording(w, r, strings.TrimPrefix(rest, "/"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	var from, to time.Time
+	for _, bound := range []struct {
+		key  string
+		dest *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		value := query.Get(bound.key)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid %s: use RFC 3339", bound.key)})
+			return
+		}
+		*bound.dest = parsed
+	}
+
+	owners := map[string]string{}
+	a.mu.Lock()
+	for uid, cam := range a.cameras {
+		owners[cam.StreamPath] = uid
+	}
+	a.mu.Unlock()
+
+	streamPath := query.Get("streamPath")
+	if uid := query.Get("deviceUid"); uid != "" {
+		streamPath = ""
+		for path, owner := range owners {
+			if owner == uid {
+				streamPath = path
+			}
+		}
+		if streamPath == "" {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "camera not found"})
+			return
+		}
+	}
+
+	root := a.config().RecordingDir
+	dirs, err := os.ReadDir(root)
+	if err != nil && !os.IsNotExist(err) {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("list failed: %v", err)})
+		return
+	}
+	basePath := a.config().BasePath
+	list := []RecordingInfo{}
+	for _, entry := range dirs {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || (streamPath != "" && entry.Name() != streamPath) {
+			continue
+		}
+		recordings, err := listRecordings(filepath.Join(root, entry.Name()))
+		if err != nil {
+			continue
+		}
+		for _, rec := range recordings {
+			start := rec.StartedAt
+			if start.IsZero() {
+				start = rec.ModifiedAt
+			}
+			if (!from.IsZero() && rec.ModifiedAt.Before(from)) || (!to.IsZero() && start.After(to)) {
+				continue
+			}
+			rec.DeviceUID = owners[rec.StreamPath]
+			rec.URL = recordingURL(basePath, rec.StreamPath, rec.Name)
+			list = append(list, rec)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ModifiedAt.After(list[j].ModifiedAt)
+	})
+	writeJSON(w, http.StatusOK, list)
+}
+
+// serveRecording sends one recording with Range support, so players can
+// seek without downloading the whole file; ?download=1 saves it instead.
+func (a *Agent) serveRecording(w http.ResponseWriter, r *http.Request, rest string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) != 2 || !safeRecordingName(parts[0]) || !safeRecordingName(parts[1]) {
+		http.NotFound(w, r)
+		return
+	}
+	path := filepath.Join(a.config().RecordingDir, parts[0], parts[1])
+	file, err := os.Open(path)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "recording not found"})
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "recording not found"})
+		return
+	}
+
+	switch strings.ToLower(filepath.Ext(parts[1])) {
+	case ".mp4":
+		w.Header().Set("Content-Type", "video/mp4")
+	case ".mkv":
+		w.Header().Set("Content-Type", "video/x-matroska")
+	}
+	if r.URL.Query().Get("download") != "" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", parts[0]+"-"+parts[1]))
+	}
+	http.ServeContent(w, r, parts[1], info.ModTime(), file)
+}
+
+// safeRecordingName accepts a single visible path element, so requests
+// cannot leave RECORDING_DIR or reach the pre-roll buffer and index files.
+func safeRecordingName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`) && filepath.Base(name) == name
+}
@@ -0,0 +1,27 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// reexec starts a new agent and exits, as there is no exec in place. A
+// Windows service just returns: the service control manager starts it again.
+func reexec() error {
+	if serviceMode {
+		return nil
+	}
+	exe, err := agentExecutable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
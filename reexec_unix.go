@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reexec replaces the process with a fresh start of the agent binary. The PID
+// stays the same, so service managers and containers see no exit.
+func reexec() error {
+	exe, err := agentExecutable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// watchReloadSignal reloads the configuration whenever the process gets SIGHUP.
+func (a *Agent) watchReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := a.reloadConfig(); err != nil {
+			logError("config reload failed: %v", err)
+		}
+	}
+}
+
+// reloadConfig re-reads .env and the environment and applies the result
+// without restarting the agent. Publishers keep running unless their ffmpeg
+// command line changed. Settings bound at startup keep their old values.
+func (a *Agent) reloadConfig() error {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	next := loadConfig()
+	if problems := validateConfig(next); len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	prev := a.config()
+	pinned := map[string]bool{
+		"AGENT_ADDR":      next.AgentAddr != prev.AgentAddr,
+		"BASE_PATH":       next.BasePath != prev.BasePath,
+		"STATE_FILE":      next.StateFile != prev.StateFile,
+		"AGENT_ID":        next.AgentID != prev.AgentID,
+		"PPROF_ENABLED":   next.PprofEnabled != prev.PprofEnabled,
+		"UPLOAD_ENABLED":  next.UploadEnabled != prev.UploadEnabled,
+		"PROXY_URL":       next.ProxyURL != prev.ProxyURL,
+		"LOG_FILE":        next.LogFile != prev.LogFile || next.LogMaxSizeMB != prev.LogMaxSizeMB || next.LogMaxAge != prev.LogMaxAge || next.LogMaxFiles != prev.LogMaxFiles,
+		"LOG_OUTPUT":      next.LogOutput != prev.LogOutput || next.SyslogAddr != prev.SyslogAddr,
+		"RTSP_SERVER":     next.RtspServer != prev.RtspServer || next.RtspServerAddr != prev.RtspServerAddr,
+		"ONVIF_ENABLED":   next.OnvifEnabled != prev.OnvifEnabled,
+		"DISCOVERY_WATCH": next.DiscoveryWatch != prev.DiscoveryWatch,
+		"MDNS_ENABLED":    next.MdnsEnabled != prev.MdnsEnabled || next.MdnsName != prev.MdnsName,
+	}
+	for key, changed := range pinned {
+		if changed {
+			logWarn("config reload: %s requires a restart to take effect", key)
+		}
+	}
+	next.AgentAddr = prev.AgentAddr
+	next.BasePath = prev.BasePath
+	next.StateFile = prev.StateFile
+	next.AgentID = prev.AgentID
+	next.PprofEnabled = prev.PprofEnabled
+	next.UploadEnabled = prev.UploadEnabled
+	next.ProxyURL = prev.ProxyURL
+	next.LogFile = prev.LogFile
+	next.LogMaxSizeMB = prev.LogMaxSizeMB
+	next.LogMaxAge = prev.LogMaxAge
+	next.LogMaxFiles = prev.LogMaxFiles
+	next.LogOutput = prev.LogOutput
+	next.SyslogAddr = prev.SyslogAddr
+	next.RtspServer = prev.RtspServer
+	next.RtspServerAddr = prev.RtspServerAddr
+	next.OnvifEnabled = prev.OnvifEnabled
+	next.DiscoveryWatch = prev.DiscoveryWatch
+	next.MdnsEnabled = prev.MdnsEnabled
+	next.MdnsName = prev.MdnsName
+	if next.HubDiscovery && prev.HubDiscovery {
+		// Keep the hub discovery found rather than the CAMHUB_URL default.
+		next.CamhubURL = prev.CamhubURL
+	}
+
+	a.cfg.Store(&next)
+	if next.FfmpegPath != prev.FfmpegPath {
+		a.refreshFFmpegCaps()
+	}
+	a.refreshCameras()
+	a.restartChangedPublishers()
+
+	logInfo("config reloaded")
+	a.emit("config_reloaded", "", nil)
+	return nil
+}
+
+// restartChangedPublishers restarts only the publishers whose command line
+// differs from what the current configuration would produce.
+func (a *Agent) restartChangedPublishers() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for uid, proc := range a.publishers {
+		cam := a.cameras[uid]
+		if cam == nil {
+			continue
+		}
+		if equalArgs(proc.Argv(), publisherFor(cam).Command(a, cam)) {
+			continue
+		}
+		logInfo("restarting publisher for %s after config change", uid)
+		a.stopPublisherLocked(uid)
+		a.ensurePublisherLocked(cam)
+	}
+}
+
+func equalArgs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *Agent) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := a.reloadConfig(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
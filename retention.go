@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// retentionLoop applies the retention rules every RETENTION_INTERVAL_MS. The
+// disk guard reacts to a volume that is already full; retention keeps
+// footage within the age and size limits the operator chose, so the guard
+// rarely has to.
+func (a *Agent) retentionLoop() {
+	for {
+		a.applyRetention()
+		time.Sleep(a.config().RetentionInterval)
+	}
+}
+
+type retentionFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// applyRetention deletes finished recordings, oldest first: those older than
+// RETENTION_MAX_AGE_MS, then those over a camera's quota, then those over
+// RETENTION_MAX_SIZE_MB across all cameras.
+func (a *Agent) applyRetention() {
+	cfg := a.config()
+	root := cfg.RecordingDir
+	dirs, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+
+	quotas := map[string]int{}
+	a.mu.Lock()
+	for _, cam := range a.cameras {
+		if cam.RetentionQuotaMB > 0 {
+			quotas[cam.StreamPath] = cam.RetentionQuotaMB
+		}
+	}
+	a.mu.Unlock()
+
+	deleted := map[string]int{}
+	var files int
+	var reclaimed int64
+	remove := func(file retentionFile, rule string) bool {
+		if err := os.Remove(file.path); err != nil {
+			logWarn("retention: %v", err)
+			return false
+		}
+		deleted[rule]++
+		files++
+		reclaimed += file.size
+		return true
+	}
+
+	now := time.Now()
+	var kept []retentionFile
+	var total int64
+	for _, entry := range dirs {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		finished, dirTotal := retentionCandidates(dir, cfg.RecordingSegment)
+
+		var remaining []retentionFile
+		for _, file := range finished {
+			if cfg.RetentionMaxAge > 0 && now.Sub(file.modTime) > cfg.RetentionMaxAge && remove(file, "age") {
+				dirTotal -= file.size
+				continue
+			}
+			remaining = append(remaining, file)
+		}
+
+		quota := cfg.RetentionQuotaMB
+		if q, ok := quotas[entry.Name()]; ok {
+			quota = q
+		}
+		for quota > 0 && len(remaining) > 0 && dirTotal > int64(quota)*1024*1024 {
+			if remove(remaining[0], "quota") {
+				dirTotal -= remaining[0].size
+			}
+			remaining = remaining[1:]
+		}
+		kept = append(kept, remaining...)
+		total += dirTotal
+	}
+
+	if cfg.RetentionMaxSizeMB > 0 {
+		sort.Slice(kept, func(i, j int) bool {
+			return kept[i].modTime.Before(kept[j].modTime)
+		})
+		for _, file := range kept {
+			if total <= int64(cfg.RetentionMaxSizeMB)*1024*1024 {
+				break
+			}
+			if remove(file, "size") {
+				total -= file.size
+			}
+		}
+	}
+
+	a.recordingBytes.Store(total)
+	if files == 0 {
+		return
+	}
+	a.retentionFiles.Add(int64(files))
+	a.retentionBytes.Add(reclaimed)
+	logInfo("retention: deleted %d recording(s), %d MB (age %d, quota %d, size %d)",
+		files, reclaimed/(1024*1024), deleted["age"], deleted["quota"], deleted["size"])
+	a.emit("recordings_pruned", "", map[string]interface{}{
+		"files":  files,
+		"bytes":  reclaimed,
+		"reason": "retention",
+		"rules":  deleted,
+	})
+}
+
+// retentionCandidates returns a camera directory's finished recordings,
+// oldest first, and the size of everything in it including the segment
+// still being written.
+func retentionCandidates(dir string, segment time.Duration) ([]retentionFile, int64) {
+	names, err := completedSegments(dir, segment)
+	if err != nil {
+		return nil, 0
+	}
+	finished := make(map[string]bool, len(names))
+	for _, name := range names {
+		finished[name] = true
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, 0
+	}
+	var files []retentionFile
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		total += info.Size()
+		if finished[entry.Name()] {
+			files = append(files, retentionFile{filepath.Join(dir, entry.Name()), info.Size(), info.ModTime()})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	return files, total
+}
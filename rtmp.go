@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// RTMP output pushes a camera straight to a streaming service or an
+// nginx-rtmp server instead of MediaMTX, so it is set per camera and only
+// with a destination. The destination's last path segment is usually the
+// stream key and is never returned by the API.
+
+// publisherSecret is what the publisher's log output must not show: the
+// stream key for rtmp, the MediaMTX publish password otherwise.
+func (a *Agent) publisherSecret(camera *Camera) string {
+	if camera.Output == outputRTMP {
+		return rtmpStreamKey(camera.RtmpURL)
+	}
+	return camera.PublishPass
+}
+
+func validRTMPURL(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Host == "" {
+		return fmt.Errorf("rtmpUrl must be an rtmp:// or rtmps:// URL")
+	}
+	if parsed.Scheme != "rtmp" && parsed.Scheme != "rtmps" {
+		return fmt.Errorf("rtmpUrl must be an rtmp:// or rtmps:// URL")
+	}
+	return nil
+}
+
+// rtmpStreamKey is the last path segment of an RTMP URL, masked in the
+// publisher's log output.
+func rtmpStreamKey(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	path := strings.TrimSuffix(parsed.Path, "/")
+	if idx := strings.LastIndex(path, "/"); idx > 0 {
+		return path[idx+1:]
+	}
+	return ""
+}
+
+// redactStreamKey hides the stream key and any credentials in an RTMP URL,
+// e.g. rtmp://a.rtmp.youtube.com/live2/xxxx becomes .../live2/****.
+func redactStreamKey(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	parsed.User = nil
+	parsed.RawQuery = ""
+	key := rtmpStreamKey(raw)
+	if key == "" {
+		return parsed.String()
+	}
+	parsed.Path = strings.TrimSuffix(strings.TrimSuffix(parsed.Path, "/"), key)
+	parsed.RawPath = ""
+	return parsed.String() + "****"
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func isRTSPS(rawURL string) bool {
+	return strings.HasPrefix(strings.ToLower(rawURL), "rtsps://")
+}
+
+// rtspTLSArgs returns the ffmpeg TLS options for an rtsps:// URL, or nil for
+// plain RTSP. They go before the -i of a reader or the URL of a publisher.
+func (a *Agent) rtspTLSArgs(rawURL string) []string {
+	if !isRTSPS(rawURL) {
+		return nil
+	}
+	cfg := a.config()
+	verify := "0"
+	if cfg.RtspTLSVerify {
+		verify = "1"
+	}
+	args := []string{"-tls_verify", verify}
+	if cfg.RtspTLSCA != "" {
+		args = append(args, "-ca_file", cfg.RtspTLSCA)
+	}
+	if cfg.RtspTLSCert != "" {
+		args = append(args, "-cert_file", cfg.RtspTLSCert, "-key_file", cfg.RtspTLSKey)
+	}
+	return args
+}
+
+// rtspTLSConfig is the Go equivalent of rtspTLSArgs, used by the readiness
+// probe so it checks the same certificates ffmpeg will.
+func rtspTLSConfig(cfg *Config) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: !cfg.RtspTLSVerify}
+	if cfg.RtspTLSCA != "" {
+		pem, err := os.ReadFile(cfg.RtspTLSCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", cfg.RtspTLSCA)
+		}
+		config.RootCAs = pool
+	}
+	if cfg.RtspTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.RtspTLSCert, cfg.RtspTLSKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rtspReaderQueue = 256
+
+// RTSPServer is a minimal RTSP relay for installs without MediaMTX. It
+// accepts streams published with ANNOUNCE/RECORD and serves them to readers
+// with DESCRIBE/PLAY. Only RTP over the RTSP connection (TCP interleaved) is
+// supported; clients asking for UDP get 461 and usually retry over TCP.
+// Publishing needs the credentials publishAllowed accepts, sent with Basic
+// auth as ffmpeg does for rtsp://user:pass@ URLs.
+type RTSPServer struct {
+	mu      sync.Mutex
+	streams map[string]*rtspStream
+	// publishAllowed reports whether the credentials, empty when none
+	// were sent, may publish to the path.
+	publishAllowed func(path, user, pass string, loopback bool) bool
+}
+
+type rtspStream struct {
+	sdp       []byte
+	publisher *rtspConn
+	readers   map[*rtspConn]struct{}
+}
+
+type rtspConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	session string
+	path    string
+	setups  int
+	// channels maps a track index to the client's RTP interleaved channel;
+	// RTCP uses the next channel.
+	channels map[int]int
+	// tracks maps a publisher's interleaved channel back to its track.
+	tracks map[int]int
+	frames chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+type rtspRequest struct {
+	method  string
+	url     string
+	headers map[string]string
+	body    []byte
+}
+
+func NewRTSPServer(publishAllowed func(path, user, pass string, loopback bool) bool) *RTSPServer {
+	return &RTSPServer{streams: make(map[string]*rtspStream), publishAllowed: publishAllowed}
+}
+
+func (s *RTSPServer) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	logInfo("rtsp server listening on %s", addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// ReaderCounts returns the number of playing readers per stream path.
+func (s *RTSPServer) ReaderCounts() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int, len(s.streams))
+	for path, stream := range s.streams {
+		counts[path] = len(stream.readers)
+	}
+	return counts
+}
+
+func (s *RTSPServer) serveConn(netConn net.Conn) {
+	c := &rtspConn{
+		conn:     netConn,
+		reader:   bufio.NewReader(netConn),
+		channels: make(map[int]int),
+		tracks:   make(map[int]int),
+		closed:   make(chan struct{}),
+	}
+	defer s.closeConn(c)
+
+	for {
+		_ = netConn.SetReadDeadline(time.Now().Add(90 * time.Second))
+		first, err := c.reader.Peek(1)
+		if err != nil {
+			return
+		}
+		if first[0] == '$' {
+			channel, payload, err := readInterleaved(c.reader)
+			if err != nil {
+				return
+			}
+			s.relay(c, channel, payload)
+			continue
+		}
+
+		req, err := readRTSPRequest(c.reader)
+		if err != nil {
+			return
+		}
+		if !s.handle(c, req) {
+			return
+		}
+	}
+}
+
+// handle answers one request and reports whether the connection stays open.
+func (s *RTSPServer) handle(c *rtspConn, req *rtspRequest) bool {
+	cseq := req.headers["cseq"]
+	path := rtspPath(req.url)
+
+	switch req.method {
+	case "OPTIONS":
+		c.respond(200, "OK", cseq, map[string]string{
+			"Public": "OPTIONS, DESCRIBE, ANNOUNCE, SETUP, PLAY, RECORD, TEARDOWN, GET_PARAMETER",
+		}, nil)
+
+	case "ANNOUNCE":
+		if !s.publishAuthorized(c, req, path) {
+			c.respond(401, "Unauthorized", cseq, map[string]string{
+				"WWW-Authenticate": `Basic realm="camhub-agent"`,
+			}, nil)
+			return true
+		}
+		s.mu.Lock()
+		if existing := s.streams[path]; existing != nil && existing.publisher != nil {
+			s.mu.Unlock()
+			c.respond(455, "Method Not Valid In This State", cseq, nil, nil)
+			return true
+		}
+		s.streams[path] = &rtspStream{sdp: req.body, publisher: c, readers: make(map[*rtspConn]struct{})}
+		s.mu.Unlock()
+		c.path = path
+		c.respond(200, "OK", cseq, nil, nil)
+
+	case "DESCRIBE":
+		s.mu.Lock()
+		stream := s.streams[path]
+		var sdp []byte
+		if stream != nil {
+			sdp = readerSDP(stream.sdp)
+		}
+		s.mu.Unlock()
+		if sdp == nil {
+			c.respond(404, "Not Found", cseq, nil, nil)
+			return true
+		}
+		c.respond(200, "OK", cseq, map[string]string{
+			"Content-Type": "application/sdp",
+			"Content-Base": strings.TrimRight(req.url, "/") + "/",
+		}, sdp)
+
+	case "SETUP":
+		channel, ok := interleavedChannel(req.headers["transport"])
+		if !ok {
+			c.respond(461, "Unsupported Transport", cseq, nil, nil)
+			return true
+		}
+		track := setupTrack(req.url, c.setups)
+		c.setups++
+		if c.path == "" {
+			c.path = trackBase(path)
+		}
+		c.channels[track] = channel
+		c.tracks[channel] = track
+		c.tracks[channel+1] = track
+		if c.session == "" {
+			c.session = newSessionID()
+		}
+		c.respond(200, "OK", cseq, map[string]string{
+			"Transport": fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1),
+			"Session":   c.session + ";timeout=60",
+		}, nil)
+
+	case "RECORD":
+		// Only the connection whose ANNOUNCE was accepted may record.
+		s.mu.Lock()
+		stream := s.streams[c.path]
+		publisher := stream != nil && stream.publisher == c
+		s.mu.Unlock()
+		if !publisher {
+			c.respond(455, "Method Not Valid In This State", cseq, nil, nil)
+			return true
+		}
+		c.respond(200, "OK", cseq, map[string]string{"Session": c.session}, nil)
+
+	case "PLAY":
+		s.mu.Lock()
+		stream := s.streams[c.path]
+		if stream == nil || stream.publisher == nil {
+			s.mu.Unlock()
+			c.respond(404, "Not Found", cseq, nil, nil)
+			return true
+		}
+		c.frames = make(chan []byte, rtspReaderQueue)
+		stream.readers[c] = struct{}{}
+		s.mu.Unlock()
+		c.respond(200, "OK", cseq, map[string]string{"Session": c.session}, nil)
+		go c.writeFrames()
+
+	case "GET_PARAMETER", "SET_PARAMETER":
+		c.respond(200, "OK", cseq, map[string]string{"Session": c.session}, nil)
+
+	case "TEARDOWN":
+		c.respond(200, "OK", cseq, nil, nil)
+		return false
+
+	default:
+		c.respond(501, "Not Implemented", cseq, nil, nil)
+	}
+	return true
+}
+
+// publishAuthorized checks an ANNOUNCE's Basic credentials with
+// publishAllowed.
+func (s *RTSPServer) publishAuthorized(c *rtspConn, req *rtspRequest, path string) bool {
+	var user, pass string
+	if encoded, ok := strings.CutPrefix(req.headers["authorization"], "Basic "); ok {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return false
+		}
+		user, pass, _ = strings.Cut(string(decoded), ":")
+	}
+	loopback := false
+	if addr, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok {
+		loopback = addr.IP.IsLoopback()
+	}
+	return s.publishAllowed != nil && s.publishAllowed(path, user, pass, loopback)
+}
+
+// relay forwards a publisher's interleaved packet to every reader of the
+// stream, remapped to the reader's channels. Readers that fall behind drop
+// packets instead of slowing the publisher down.
+func (s *RTSPServer) relay(c *rtspConn, channel int, payload []byte) {
+	track, ok := c.tracks[channel]
+	if !ok {
+		return
+	}
+	rtcp := channel != c.channels[track]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stream := s.streams[c.path]
+	if stream == nil || stream.publisher != c {
+		return
+	}
+	for reader := range stream.readers {
+		out, ok := reader.channels[track]
+		if !ok {
+			continue
+		}
+		if rtcp {
+			out++
+		}
+		frame := make([]byte, 4+len(payload))
+		frame[0] = '$'
+		frame[1] = byte(out)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+		copy(frame[4:], payload)
+		select {
+		case reader.frames <- frame:
+		default:
+		}
+	}
+}
+
+func (s *RTSPServer) closeConn(c *rtspConn) {
+	s.mu.Lock()
+	if stream := s.streams[c.path]; stream != nil {
+		if stream.publisher == c {
+			// Readers of a finished stream are closed so they reconnect.
+			for reader := range stream.readers {
+				reader.close()
+			}
+			delete(s.streams, c.path)
+		} else {
+			delete(stream.readers, c)
+		}
+	}
+	s.mu.Unlock()
+	c.close()
+}
+
+func (c *rtspConn) close() {
+	c.once.Do(func() {
+		close(c.closed)
+		_ = c.conn.Close()
+	})
+}
+
+func (c *rtspConn) writeFrames() {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case frame := <-c.frames:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if _, err := c.conn.Write(frame); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+func (c *rtspConn) respond(code int, status, cseq string, headers map[string]string, body []byte) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "RTSP/1.0 %d %s\r\n", code, status)
+	fmt.Fprintf(&b, "CSeq: %s\r\n", cseq)
+	fmt.Fprintf(&b, "Server: camhub-agent/%s\r\n", version)
+	for key, value := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	}
+	b.WriteString("\r\n")
+	b.Write(body)
+
+	// Responses share the socket with relayed frames once a reader plays,
+	// so they go through the same queue.
+	if c.frames != nil {
+		select {
+		case c.frames <- b.Bytes():
+		case <-c.closed:
+		}
+		return
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, _ = c.conn.Write(b.Bytes())
+}
+
+func readRTSPRequest(r *bufio.Reader) (*rtspRequest, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, fmt.Errorf("invalid request line: %q", strings.TrimSpace(line))
+	}
+
+	req := &rtspRequest{method: parts[0], url: parts[1], headers: map[string]string{}}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if idx := strings.Index(line, ":"); idx > 0 {
+			req.headers[strings.ToLower(strings.TrimSpace(line[:idx]))] = strings.TrimSpace(line[idx+1:])
+		}
+	}
+
+	if value := req.headers["content-length"]; value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 1<<20 {
+			return nil, fmt.Errorf("invalid content length: %q", value)
+		}
+		req.body = make([]byte, n)
+		if _, err := io.ReadFull(r, req.body); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+func readInterleaved(r *bufio.Reader) (int, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return int(header[1]), payload, nil
+}
+
+func rtspPath(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(parsed.Path, "/")
+}
+
+var rtspTrackSuffix = regexp.MustCompile(`/(?:trackID|streamid)=(\d+)$`)
+
+// setupTrack reads the track index from a SETUP URL, falling back to the
+// order of SETUP requests on the connection.
+func setupTrack(rawURL string, order int) int {
+	if m := rtspTrackSuffix.FindStringSubmatch(strings.TrimRight(rawURL, "/")); m != nil {
+		if n, err := strconv.Atoi(m[1]); err == nil {
+			return n
+		}
+	}
+	return order
+}
+
+func trackBase(path string) string {
+	return strings.Trim(rtspTrackSuffix.ReplaceAllString("/"+path, ""), "/")
+}
+
+var rtspInterleaved = regexp.MustCompile(`interleaved=(\d+)`)
+
+func interleavedChannel(transport string) (int, bool) {
+	if !strings.Contains(transport, "RTP/AVP/TCP") {
+		return 0, false
+	}
+	m := rtspInterleaved.FindStringSubmatch(transport)
+	if m == nil {
+		return 0, true
+	}
+	n, err := strconv.Atoi(m[1])
+	return n, err == nil
+}
+
+// readerSDP rewrites the publisher's media control attributes to trackID=N so
+// readers' SETUP URLs map back to track indexes.
+func readerSDP(sdp []byte) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(sdp), "\r\n", "\n"), "\n")
+	out := make([]string, 0, len(lines))
+	track := -1
+	for _, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			track++
+		}
+		if track >= 0 && strings.HasPrefix(line, "a=control:") {
+			line = fmt.Sprintf("a=control:trackID=%d", track)
+		}
+		out = append(out, line)
+	}
+	return []byte(strings.Join(out, "\r\n"))
+}
+
+func newSessionID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
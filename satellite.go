@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const satelliteTimeout = 5 * time.Second
+
+// satellite is another agent on the site, listed in SATELLITE_URLS. This
+// agent fetches its /api/cameras and registers those cameras with its own
+// hubs, so only one agent per site needs hub credentials. The satellites'
+// MEDIAMTX_RTSP_BASE must be reachable by viewers, since their rtspUrl is
+// passed on unchanged.
+type satellite struct {
+	URL       string
+	Connected bool
+	Error     string
+	LastSeen  time.Time
+	Cameras   []*Camera
+	polled    bool
+}
+
+// SatelliteStatus is a satellite as reported by /api/satellites.
+type SatelliteStatus struct {
+	URL       string     `json:"url"`
+	Connected bool       `json:"connected"`
+	Error     string     `json:"error,omitempty"`
+	LastSeen  *time.Time `json:"lastSeen,omitempty"`
+	Cameras   int        `json:"cameras"`
+}
+
+func (a *Agent) satelliteLoop() {
+	for {
+		a.pollSatellites()
+		time.Sleep(a.config().SatellitePoll)
+	}
+}
+
+// pollSatellites fetches every satellite's cameras in parallel. A satellite
+// that does not answer keeps its last camera list, which is then registered
+// as offline.
+func (a *Agent) pollSatellites() {
+	cfg := a.config()
+	type result struct {
+		cameras []*Camera
+		err     error
+	}
+	results := make([]result, len(cfg.SatelliteURLs))
+	var wg sync.WaitGroup
+	for idx, base := range cfg.SatelliteURLs {
+		wg.Add(1)
+		go func(idx int, base string) {
+			defer wg.Done()
+			results[idx].cameras, results[idx].err = fetchSatelliteCameras(cfg, base)
+		}(idx, base)
+	}
+	wg.Wait()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for base := range a.satellites {
+		if !containsString(cfg.SatelliteURLs, base) {
+			delete(a.satellites, base)
+		}
+	}
+	for idx, base := range cfg.SatelliteURLs {
+		sat := a.satellites[base]
+		if sat == nil {
+			sat = &satellite{URL: base}
+			a.satellites[base] = sat
+		}
+		res := results[idx]
+		wasConnected, first := sat.Connected, !sat.polled
+		sat.polled = true
+		if res.err != nil {
+			sat.Connected, sat.Error = false, res.err.Error()
+			if wasConnected || first {
+				logWarn("satellite %s unreachable: %v", redactURL(base), res.err)
+				a.emit("satellite_disconnected", "", map[string]interface{}{"satellite": redactURL(base), "error": sat.Error})
+			}
+			continue
+		}
+		sat.Connected, sat.Error, sat.LastSeen = true, "", time.Now()
+		sat.Cameras = res.cameras
+		if !wasConnected {
+			logInfo("satellite %s connected with %d cameras", redactURL(base), len(res.cameras))
+			a.emit("satellite_connected", "", map[string]interface{}{"satellite": redactURL(base), "cameras": len(res.cameras)})
+		}
+	}
+}
+
+func fetchSatelliteCameras(cfg *Config, base string) ([]*Camera, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(base, "/")+"/api/cameras", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", cfg.RegisterUserAgent)
+	if cfg.SatelliteToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.SatelliteToken)
+	}
+	client := &http.Client{Timeout: satelliteTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("camera list: %s", res.Status)
+	}
+	var cameras []*Camera
+	if err := json.NewDecoder(io.LimitReader(res.Body, 8<<20)).Decode(&cameras); err != nil {
+		return nil, fmt.Errorf("camera list: %w", err)
+	}
+	return cameras, nil
+}
+
+// satelliteCamerasLocked lists the satellites' cameras for registration.
+// Each names the satellite it is attached to; a camera this agent or an
+// earlier satellite already reports is skipped.
+func (a *Agent) satelliteCamerasLocked() []map[string]interface{} {
+	entries := make([]map[string]interface{}, 0)
+	seen := make(map[string]bool)
+	for _, base := range a.config().SatelliteURLs {
+		sat := a.satellites[base]
+		if sat == nil {
+			continue
+		}
+		for _, cam := range sat.Cameras {
+			if cam.DeviceUID == "" || a.cameras[cam.DeviceUID] != nil || seen[cam.DeviceUID] {
+				continue
+			}
+			seen[cam.DeviceUID] = true
+			var entry map[string]interface{}
+			if sat.Connected {
+				entry = cameraEntry(cam, satelliteCameraStatus(cam))
+			} else {
+				entry = map[string]interface{}{
+					"status":     "offline",
+					"deviceUid":  cam.DeviceUID,
+					"enabled":    cam.Enabled,
+					"name":       cam.Name,
+					"streamPath": cam.StreamPath,
+					"rtspUrl":    cam.RtspURL,
+					"lastSeen":   sat.LastSeen,
+				}
+			}
+			entry["satellite"] = redactURL(base)
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// satelliteCameraStatus is the status the satellite reported, or one made
+// up from its flags for agents too old to report it.
+func satelliteCameraStatus(cam *Camera) string {
+	switch {
+	case cam.Status != "":
+		return cam.Status
+	case !cam.Enabled:
+		return "disabled"
+	case cam.Publishing:
+		return "publishing"
+	}
+	return "starting"
+}
+
+// satelliteHealth reports the outcome of the latest poll of each satellite.
+func (a *Agent) satelliteHealth() []componentHealth {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := make([]componentHealth, 0, len(a.satellites))
+	for _, base := range a.config().SatelliteURLs {
+		health := componentHealth{Name: "satellite", Target: redactURL(base), Status: healthOK}
+		switch sat := a.satellites[base]; {
+		case sat == nil || !sat.polled:
+			health.Status, health.Reason = healthDegraded, "not_polled"
+		case !sat.Connected:
+			health.Status, health.Reason, health.Message = healthDegraded, "unreachable", sat.Error
+		}
+		list = append(list, health)
+	}
+	return list
+}
+
+func (a *Agent) handleSatellites(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	a.mu.Lock()
+	list := make([]SatelliteStatus, 0, len(a.satellites))
+	for _, sat := range a.satellites {
+		status := SatelliteStatus{URL: redactURL(sat.URL), Connected: sat.Connected, Error: sat.Error, Cameras: len(sat.Cameras)}
+		if !sat.LastSeen.IsZero() {
+			lastSeen := sat.LastSeen
+			status.LastSeen = &lastSeen
+		}
+		list = append(list, status)
+	}
+	a.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].URL < list[j].URL })
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const scheduleCheckInterval = 30 * time.Second
+
+var scheduleDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// scheduleWindow is a daily time range, in minutes after local midnight, on a
+// set of weekdays. A window whose end is before its start runs past midnight
+// into the next day.
+type scheduleWindow struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+// parseSchedule reads weekly windows separated by ";", each an optional day
+// list followed by a time range, e.g. "mon-fri 08:00-18:00; sat 10:00-14:00".
+// An empty schedule means always on.
+func parseSchedule(value string) ([]scheduleWindow, error) {
+	var windows []scheduleWindow
+	for _, part := range strings.Split(value, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("invalid window %q", strings.TrimSpace(part))
+		}
+
+		var window scheduleWindow
+		if len(fields) == 2 {
+			days, err := parseScheduleDays(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			window.days = days
+		} else {
+			window.days = [7]bool{true, true, true, true, true, true, true}
+		}
+
+		times := strings.SplitN(fields[len(fields)-1], "-", 2)
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid time range %q", fields[len(fields)-1])
+		}
+		var err error
+		if window.start, err = parseClock(times[0]); err != nil {
+			return nil, err
+		}
+		if window.end, err = parseClock(times[1]); err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+func parseScheduleDays(value string) ([7]bool, error) {
+	var days [7]bool
+	value = strings.ToLower(value)
+	if value == "daily" || value == "*" {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+	for _, item := range strings.Split(value, ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		first := dayIndex(bounds[0])
+		last := first
+		if len(bounds) == 2 {
+			last = dayIndex(bounds[1])
+		}
+		if first < 0 || last < 0 {
+			return days, fmt.Errorf("invalid days %q", item)
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func dayIndex(value string) int {
+	for idx, day := range scheduleDays {
+		if value == day {
+			return idx
+		}
+	}
+	return -1
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		if value == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// scheduleActive reports whether t falls inside any window. No windows means
+// no restriction.
+func scheduleActive(windows []scheduleWindow, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	day := int(t.Weekday())
+	prev := (day + 6) % 7
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range windows {
+		switch {
+		case w.start == w.end:
+			if w.days[day] {
+				return true
+			}
+		case w.start < w.end:
+			if w.days[day] && minute >= w.start && minute < w.end {
+				return true
+			}
+		default:
+			if (w.days[day] && minute >= w.start) || (w.days[prev] && minute < w.end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *Agent) offScheduleLocked(cam *Camera, now time.Time) bool {
+	windows, err := parseSchedule(cam.Schedule)
+	if err != nil {
+		return false
+	}
+	return !scheduleActive(windows, now)
+}
+
+// scheduleLoop starts and stops cameras as their schedule windows open and
+// close.
+func (a *Agent) scheduleLoop() {
+	ticker := time.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		a.mu.Lock()
+		for _, cam := range a.cameras {
+			a.applyScheduleLocked(cam, time.Now())
+		}
+		a.mu.Unlock()
+	}
+}
+
+func (a *Agent) applyScheduleLocked(cam *Camera, now time.Time) {
+	off := a.offScheduleLocked(cam, now)
+	if off == cam.OffSchedule {
+		return
+	}
+	cam.OffSchedule = off
+	if !cam.Enabled {
+		return
+	}
+	if off {
+		logInfo("schedule stopping %s", cam.DeviceUID)
+		a.emit("schedule_stopped", cam.DeviceUID, nil)
+		a.stopCameraLocked(cam.DeviceUID)
+	} else if a.activeLocked(cam) {
+		logInfo("schedule starting %s", cam.DeviceUID)
+		a.emit("schedule_started", cam.DeviceUID, nil)
+		a.startCameraLocked(cam)
+	}
+}
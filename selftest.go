@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	selftestFrames  = 10
+	selftestTimeout = 20 * time.Second
+)
+
+// runSelftest exercises the path a camera takes end to end: a synthetic
+// stream is published to MEDIAMTX_RTSP_BASE, read back as a viewer would,
+// and the agent registers with its hubs. Unlike doctor it changes state: the
+// test path exists on the media server while it runs, and the hubs receive
+// a registration marked "selftest" without cameras, which the running
+// agent's next heartbeat replaces.
+func runSelftest(cfg Config) int {
+	if cfg.HubDiscovery {
+		if hubURL := loadDiscoveredHub(&cfg); hubURL != "" {
+			cfg.CamhubURL = hubURL
+		}
+	}
+	agent := &Agent{}
+	agent.cfg.Store(&cfg)
+
+	var failed []string
+	report := func(name string, err error, detail string) bool {
+		if err != nil {
+			failed = append(failed, name)
+			fmt.Printf("FAIL  %-10s %v\n", name, err)
+			return false
+		}
+		fmt.Printf("ok    %-10s %s\n", name, detail)
+		return true
+	}
+	skip := func(name, reason string) {
+		failed = append(failed, name)
+		fmt.Printf("SKIP  %-10s %s\n", name, reason)
+	}
+
+	detail, err := commandVersion(cfg.FfmpegPath, "-version")
+	ffmpegOK := report("ffmpeg", err, detail)
+	mediaOK := report("mediamtx", probeRTSP(&cfg, mediaProbeTimeout), cfg.MediaMtxRtspBase)
+	switch {
+	case !ffmpegOK:
+		skip("publish", "needs ffmpeg")
+		skip("read", "needs ffmpeg")
+	case !mediaOK:
+		skip("publish", "needs the media server")
+		skip("read", "needs the media server")
+	default:
+		agent.selftestStream(report)
+	}
+
+	token := cfg.AuthToken
+	if stored := loadHubToken(&cfg); stored != "" {
+		token = stored
+	}
+	hubs := []hubTarget{{URL: cfg.CamhubURL, Token: token, Primary: true}}
+	for idx, hubURL := range cfg.ExtraHubURLs {
+		hub := hubTarget{URL: hubURL}
+		if idx < len(cfg.ExtraHubTokens) {
+			hub.Token = cfg.ExtraHubTokens[idx]
+		}
+		hubs = append(hubs, hub)
+	}
+	for idx, hub := range hubs {
+		name := "hub"
+		if idx > 0 {
+			name = fmt.Sprintf("hub %d", idx+1)
+		}
+		detail, err := agent.selftestRegister(hub)
+		report(name, err, detail)
+	}
+
+	if len(failed) > 0 {
+		fmt.Printf("selftest failed: %s\n", strings.Join(failed, ", "))
+		return 1
+	}
+	fmt.Println("selftest passed")
+	return 0
+}
+
+// selftestStream publishes a test pattern to a throwaway path and reads
+// selftestFrames frames of it back. The reader retries until the publisher
+// has connected, so a slow encoder start is not taken for a failure.
+func (a *Agent) selftestStream(report func(string, error, string) bool) {
+	cfg := a.config()
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	streamPath := "camhub-selftest-" + hex.EncodeToString(suffix)
+	rtspURL := fmt.Sprintf("%s/%s", strings.TrimRight(cfg.MediaMtxRtspBase, "/"), streamPath)
+	// MediaMTX setups that require credentials usually grant the publish
+	// user read access too, so both sides use them.
+	camera := &Camera{PublishUser: cfg.PublishUser, PublishPass: cfg.PublishPass}
+	target := publishURL(camera, rtspURL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+	defer cancel()
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-re", "-f", "lavfi", "-i", "testsrc=size=320x240:rate=10"}
+	args = append(args, x264Args(EncoderTuning{GOP: 10}, "ultrafast")...)
+	args = append(args, "-f", "rtsp", "-rtsp_transport", "tcp")
+	args = append(args, a.rtspTLSArgs(rtspURL)...)
+	args = append(args, target)
+	publisher := exec.CommandContext(ctx, cfg.FfmpegPath, args...)
+	var publishErr bytes.Buffer
+	publisher.Stderr = &publishErr
+	if err := publisher.Start(); err != nil {
+		report("publish", err, "")
+		report("read", errors.New("nothing published"), "")
+		return
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- publisher.Wait() }()
+	defer func() {
+		cancel()
+		<-exited
+	}()
+
+	started := time.Now()
+	var readErr error
+	for {
+		select {
+		case err := <-exited:
+			exited <- err
+			report("publish", fmt.Errorf("ffmpeg exited: %s", ffmpegError(err, publishErr.String())), "")
+			report("read", errors.New("nothing published"), "")
+			return
+		default:
+		}
+		var frames int
+		frames, readErr = a.selftestRead(ctx, target)
+		if readErr == nil {
+			report("publish", nil, redactURL(rtspURL))
+			report("read", nil, fmt.Sprintf("%d frames in %s", frames, time.Since(started).Round(100*time.Millisecond)))
+			return
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	report("publish", nil, redactURL(rtspURL))
+	report("read", fmt.Errorf("no frames within %s: %v", selftestTimeout, readErr), "")
+}
+
+// selftestRead pulls frames from the test path and returns how many ffmpeg
+// decoded.
+func (a *Agent) selftestRead(ctx context.Context, rtspURL string) (int, error) {
+	args := []string{"-hide_banner", "-loglevel", "error", "-rtsp_transport", "tcp", "-timeout", "5000000"}
+	args = append(args, a.rtspTLSArgs(rtspURL)...)
+	args = append(args, "-i", rtspURL, "-frames:v", fmt.Sprint(selftestFrames), "-f", "framemd5", "-")
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, a.config().FfmpegPath, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, errors.New(ffmpegError(err, stderr.String()))
+	}
+	frames := 0
+	for _, line := range strings.Split(string(out), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			frames++
+		}
+	}
+	if frames == 0 {
+		return 0, errors.New("stream had no video frames")
+	}
+	return frames, nil
+}
+
+// ffmpegError prefers ffmpeg's last error line over the exit status.
+func ffmpegError(err error, stderr string) string {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return last
+	}
+	return err.Error()
+}
+
+// selftestRegister sends one registration and checks that the hub accepts
+// it and answers with JSON.
+func (a *Agent) selftestRegister(hub hubTarget) (string, error) {
+	cfg := a.config()
+	agentID, err := loadAgentID(*cfg)
+	if err != nil {
+		return "", err
+	}
+	hostname, _ := os.Hostname()
+	body, _ := json.Marshal(map[string]interface{}{
+		"agentId":  agentID,
+		"host":     hostname,
+		"version":  versionInfo(),
+		"selftest": true,
+	})
+	req, err := a.newHubRequest(hub, http.MethodPost, "/api/agents/register", body)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{Timeout: cfg.RegisterTimeout}
+	sent := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	elapsed := time.Since(sent)
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	switch {
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return "", fmt.Errorf("credentials rejected: %s", res.Status)
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		return "", fmt.Errorf("registration refused: %s %s", res.Status, strings.TrimSpace(string(data)))
+	}
+	var reply map[string]interface{}
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return "", fmt.Errorf("reply is not JSON: %v", err)
+	}
+	return fmt.Sprintf("%s (%s in %s)", redactURL(hub.URL), res.Status, elapsed.Round(time.Millisecond)), nil
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// serviceMode is only ever set on Windows.
+const serviceMode = false
+
+func runningAsService() bool { return false }
+
+func runService() int { return 1 }
+
+func runServiceCommand([]string) int {
+	fmt.Fprintln(os.Stderr, "service is only available on Windows; on Linux use install")
+	return 1
+}
+
+func newEventlogSink() (logSink, error) {
+	return nil, errors.New("the event log is only available on Windows")
+}
@@ -0,0 +1,258 @@
+//go:build windows
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	serviceDisplayName = "CamHub agent"
+	serviceDescription = "Publishes local cameras to CamHub."
+	serviceStopTimeout = 20 * time.Second
+	eventID            = 1
+)
+
+// serviceMode is set when the service control manager started the agent.
+var serviceMode bool
+
+// runningAsService reports whether the service control manager started the
+// process, rather than a console.
+func runningAsService() bool {
+	isService, err := svc.IsWindowsService()
+	return err == nil && isService
+}
+
+// runService runs the agent under the service control manager. Services
+// start in the system directory, so the working directory moves to the
+// binary's, where .env and data/ live for a console run too. Logs go to the
+// event log unless LOG_OUTPUT or LOG_FILE says otherwise.
+func runService() int {
+	serviceMode = true
+	if exe, err := agentExecutable(); err == nil {
+		_ = os.Chdir(filepath.Dir(exe))
+	}
+	cfg := loadConfig()
+	applyProxy(cfg)
+	if cfg.LogOutput == logOutputStdout && cfg.LogFile == "" {
+		cfg.LogOutput = logOutputEventlog
+	}
+	if err := svc.Run(serviceName, &agentService{cfg: cfg}); err != nil {
+		return 1
+	}
+	return 0
+}
+
+type agentService struct {
+	cfg Config
+}
+
+// Execute runs the agent until the service control manager stops it. The
+// agent returning on its own, as it does to restart after an update, ends
+// the service with an error so the recovery actions start it again.
+func (s *agentService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan struct{})
+	go func() {
+		runAgent(s.cfg)
+		close(done)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case <-done:
+			return false, 1
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32(serviceStopTimeout / time.Millisecond)}
+				select {
+				case stopRequests <- "service stop requested":
+				default:
+				}
+				select {
+				case <-done:
+				case <-time.After(serviceStopTimeout):
+				}
+				return false, 0
+			}
+		}
+	}
+}
+
+// runServiceCommand handles "service install" and "service uninstall".
+func runServiceCommand(args []string) int {
+	if len(args) == 0 {
+		printUsage(os.Stderr)
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "install":
+		err = installService(args[1:])
+	case "uninstall":
+		err = uninstallService()
+	default:
+		printUsage(os.Stderr)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// installService registers the agent with the service control manager. Flags
+// given before the command, such as --camhub-url, become the service's
+// arguments. A failed agent is restarted after 5s, 10s and then every 30s;
+// the count resets after a day without failures.
+func installService(args []string) error {
+	fs := flag.NewFlagSet("service install", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	start := fs.String("start", "auto", "start type: auto, delayed or manual")
+	noStart := fs.Bool("no-start", false, "register the service without starting it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	config := mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: serviceDescription,
+		StartType:   mgr.StartAutomatic,
+	}
+	switch *start {
+	case "auto":
+	case "delayed":
+		config.DelayedAutoStart = true
+	case "manual":
+		config.StartType = mgr.StartManual
+	default:
+		return fmt.Errorf("unknown start type %q", *start)
+	}
+
+	exe, err := agentExecutable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("service manager: %w (run as Administrator)", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists; uninstall it first", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, config, serviceArgs()...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	recovery := []mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 10 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+	}
+	if err := s.SetRecoveryActions(recovery, uint32((24 * time.Hour).Seconds())); err != nil {
+		return fmt.Errorf("recovery actions: %w", err)
+	}
+	// Without this flag a service that stops itself with an exit code is not
+	// restarted, only one that crashes.
+	nonCrash := struct{ FailureActionsOnNonCrashFailures int32 }{1}
+	if err := windows.ChangeServiceConfig2(s.Handle, windows.SERVICE_CONFIG_FAILURE_ACTIONS_FLAG, (*byte)(unsafe.Pointer(&nonCrash))); err != nil {
+		return fmt.Errorf("recovery actions: %w", err)
+	}
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		logWarn("event log source not registered: %v", err)
+	}
+	fmt.Printf("installed service %s (%s)\n", serviceName, exe)
+
+	if *noStart {
+		return nil
+	}
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+	fmt.Printf("started service %s\n", serviceName)
+	return nil
+}
+
+// serviceArgs are the flags before "service install" on the command line.
+func serviceArgs() []string {
+	for i, arg := range os.Args[1:] {
+		if arg == "service" {
+			return os.Args[1 : i+1]
+		}
+	}
+	return nil
+}
+
+// uninstallService stops the service if it runs, then removes it and its
+// event log source.
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("service manager: %w (run as Administrator)", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+
+	if state, err := s.Control(svc.Stop); err == nil {
+		deadline := time.Now().Add(serviceStopTimeout)
+		for state.State != svc.Stopped && time.Now().Before(deadline) {
+			time.Sleep(300 * time.Millisecond)
+			if state, err = s.Query(); err != nil {
+				break
+			}
+		}
+	}
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	if err := eventlog.Remove(serviceName); err != nil {
+		logWarn("event log source not removed: %v", err)
+	}
+	fmt.Printf("removed service %s\n", serviceName)
+	return nil
+}
+
+// eventlogSink writes to the Application event log under the service name.
+type eventlogSink struct {
+	log *eventlog.Log
+}
+
+func newEventlogSink() (logSink, error) {
+	l, err := eventlog.Open(serviceName)
+	if err != nil {
+		return nil, fmt.Errorf("event log: %w", err)
+	}
+	return &eventlogSink{log: l}, nil
+}
+
+func (s *eventlogSink) Log(level logLevel, msg string) error {
+	switch level {
+	case levelError:
+		return s.log.Error(eventID, msg)
+	case levelWarn:
+		return s.log.Warning(eventID, msg)
+	}
+	return s.log.Info(eventID, msg)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	shutdownTimeout = 5 * time.Second
+	// killWaitTimeout is how long a killed publisher gets to go away before
+	// it is reported as stuck.
+	killWaitTimeout = 5 * time.Second
+)
+
+// stopRequests carries stop requests from the Windows service control
+// manager, which does not send signals.
+var stopRequests = make(chan string, 1)
+
+// watchShutdown stops every camera and the managed MediaMTX, tells the hub
+// the agent is going away and closes the HTTP server on SIGINT or SIGTERM, a service stop, or when a
+// restart is requested.
+func (a *Agent) watchShutdown(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		logInfo("received %s, shutting down", sig)
+	case reason := <-stopRequests:
+		logInfo("%s, shutting down", reason)
+	case <-a.restartCh:
+	}
+
+	a.mu.Lock()
+	a.stopping = true
+	for uid := range a.cameras {
+		a.stopCameraLocked(uid)
+	}
+	a.mu.Unlock()
+	a.waitTerminated()
+	if a.stopMediamtx != nil {
+		a.stopMediamtx()
+	}
+
+	if r := a.mdns.Load(); r != nil {
+		r.goodbye()
+	}
+	if err := a.deregister(); err != nil {
+		logWarn("deregister failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	_ = server.Shutdown(ctx)
+}
+
+// requestRestart shuts the agent down as on SIGTERM; main then starts it
+// again with reexec once the HTTP server has closed.
+func (a *Agent) requestRestart(reason string) {
+	if !a.restarting.CompareAndSwap(false, true) {
+		return
+	}
+	logInfo("restarting: %s", reason)
+	a.emit("agent_restarting", "", map[string]interface{}{"reason": reason})
+	close(a.restartCh)
+}
+
+// deregister asks every hub to mark this agent and its cameras offline now
+// rather than after its heartbeat timeout.
+func (a *Agent) deregister() error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"agentId": a.agentID,
+		"host":    a.hostname,
+	})
+	var errs []error
+	for _, hub := range a.hubs() {
+		if err := a.deregisterFrom(hub, body); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", hub.URL, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (a *Agent) deregisterFrom(hub hubTarget, body []byte) error {
+	req, err := a.newHubRequest(hub, http.MethodPost, "/api/agents/deregister", body)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: shutdownTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	logInfo("deregistered from %s", hub.URL)
+	return nil
+}
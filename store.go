@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	storeSchemaVersion = 1
+	// storeBackupDelay batches the .bak refreshes of bursts of settings
+	// changes into one copy.
+	storeBackupDelay = 30 * time.Second
+)
+
+var (
+	bucketMeta     = []byte("meta")
+	bucketSettings = []byte("settings")
+	bucketCameras  = []byte("cameras")
+	bucketEvents   = []byte("events")
+)
+
+// Store persists agent state in a bbolt database next to STATE_FILE:
+// per-camera settings, the last known details of every camera (so offline
+// cameras keep their names across restarts) and event history.
+type Store struct {
+	db   *bolt.DB
+	path string
+
+	backupMu    sync.Mutex
+	backupTimer *time.Timer
+	closed      bool
+}
+
+var (
+	errStoreLocked  = errors.New("state store is locked by another agent")
+	errStoreCorrupt = errors.New("corrupt database")
+)
+
+// KnownCamera is what the store remembers about a camera once it is gone.
+type KnownCamera struct {
+	Name       string    `json:"name"`
+	Node       string    `json:"node"`
+	StreamPath string    `json:"streamPath"`
+	RtspURL    string    `json:"rtspUrl"`
+	LastSeen   time.Time `json:"lastSeen"`
+}
+
+// stateDBPath is STATE_FILE with a .db extension; STATE_FILE itself is only
+// read once to migrate older installs.
+func stateDBPath(cfg *Config) string {
+	return strings.TrimSuffix(cfg.StateFile, filepath.Ext(cfg.StateFile)) + ".db"
+}
+
+// openStore opens or creates the database and imports the JSON state file
+// the first time. A second agent on the same data directory fails here
+// rather than racing the first one.
+//
+// bbolt commits are atomic, but a damaged disk or an interrupted copy can
+// still leave an unreadable file. The last database that opened cleanly is
+// kept as a .bak copy; if the primary is corrupt it is moved aside as
+// .corrupt and the backup is restored, or the agent starts with empty state
+// when there is none. Other errors, such as a permission problem, stop the
+// agent with the state left in place.
+func openStore(cfg *Config) (*Store, error) {
+	path := stateDBPath(cfg)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	store, err := openStoreFile(path, cfg.StateFile)
+	if err != nil {
+		if !errors.Is(err, errStoreCorrupt) {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		logError("state store %s is unreadable: %v", path, err)
+		if err := os.Rename(path, path+".corrupt"); err != nil {
+			return nil, err
+		}
+		if data, err := os.ReadFile(path + ".bak"); err == nil {
+			logInfo("restoring state from %s.bak", path)
+			if err := writeFileAtomic(path, data, 0o600); err != nil {
+				return nil, err
+			}
+		} else {
+			logWarn("no state backup found; starting with empty state")
+		}
+		if store, err = openStoreFile(path, cfg.StateFile); err != nil {
+			return nil, err
+		}
+	}
+	store.backup()
+	return store, nil
+}
+
+func openStoreFile(path, stateFile string) (store *Store, err error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, errStoreLocked
+	}
+	if errors.Is(err, bolt.ErrInvalid) || errors.Is(err, bolt.ErrChecksum) || errors.Is(err, bolt.ErrVersionMismatch) {
+		return nil, fmt.Errorf("%w: %v", errStoreCorrupt, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// bbolt panics on some kinds of page corruption instead of returning an
+	// error.
+	defer func() {
+		if r := recover(); r != nil {
+			db.Close()
+			store, err = nil, fmt.Errorf("%w: %v", errStoreCorrupt, r)
+		}
+	}()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketMeta, bucketSettings, bucketCameras, bucketEvents} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(bucketMeta)
+		if meta.Get([]byte("schema")) != nil {
+			return nil
+		}
+		if err := migrateStateFile(tx, stateFile); err != nil {
+			return err
+		}
+		return meta.Put([]byte("schema"), []byte(fmt.Sprint(storeSchemaVersion)))
+	})
+	if err == nil {
+		err = db.View(func(tx *bolt.Tx) error {
+			var first error
+			for checkErr := range tx.Check() {
+				if first == nil {
+					first = fmt.Errorf("%w: %v", errStoreCorrupt, checkErr)
+				}
+			}
+			return first
+		})
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db, path: path}, nil
+}
+
+// scheduleBackup refreshes the .bak copy storeBackupDelay from now, unless
+// a refresh is already pending, so saving settings neither waits for a copy
+// of the whole database nor makes one per change.
+func (s *Store) scheduleBackup() {
+	s.backupMu.Lock()
+	defer s.backupMu.Unlock()
+	if s.backupTimer != nil || s.closed {
+		return
+	}
+	s.backupTimer = time.AfterFunc(storeBackupDelay, func() {
+		s.backupMu.Lock()
+		defer s.backupMu.Unlock()
+		s.backupTimer = nil
+		if !s.closed {
+			s.backup()
+		}
+	})
+}
+
+// backup snapshots the database to .bak, replacing the previous copy
+// atomically.
+func (s *Store) backup() {
+	var buf bytes.Buffer
+	err := s.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(&buf)
+		return err
+	})
+	if err == nil {
+		err = writeFileAtomic(s.path+".bak", buf.Bytes(), 0o600)
+	}
+	if err != nil {
+		logError("state backup failed: %v", err)
+	}
+}
+
+// migrateStateFile copies agent_state.json into the settings bucket and
+// renames it so it is not mistaken for live state.
+func migrateStateFile(tx *bolt.Tx, path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := parseStateJSON(data)
+	if _, err := putSettings(tx, state); err != nil {
+		return err
+	}
+	logInfo("migrated %d camera settings from %s", len(state), path)
+	return os.Rename(path, path+".migrated")
+}
+
+// parseStateJSON reads the old state file, which holds either a plain
+// enabled flag or a settings object per camera.
+func parseStateJSON(data []byte) map[string]*CameraSettings {
+	state := map[string]*CameraSettings{}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return state
+	}
+	for uid, value := range raw {
+		var enabled bool
+		if err := json.Unmarshal(value, &enabled); err == nil {
+			state[uid] = &CameraSettings{Enabled: enabled}
+			continue
+		}
+		var settings CameraSettings
+		if err := json.Unmarshal(value, &settings); err == nil {
+			state[uid] = &settings
+		}
+	}
+	return state
+}
+
+// Ping writes to the meta bucket to confirm the database still accepts
+// writes, which fails once the disk is full or read-only.
+func (s *Store) Ping() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMeta).Put([]byte("healthCheck"), []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+}
+
+// Close writes a pending backup before closing the database.
+func (s *Store) Close() error {
+	s.backupMu.Lock()
+	if s.backupTimer != nil && s.backupTimer.Stop() {
+		s.backupTimer = nil
+		s.backup()
+	}
+	s.closed = true
+	s.backupMu.Unlock()
+	return s.db.Close()
+}
+
+func (s *Store) LoadSettings() (map[string]*CameraSettings, error) {
+	state := map[string]*CameraSettings{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSettings).ForEach(func(k, v []byte) error {
+			var settings CameraSettings
+			if err := json.Unmarshal(v, &settings); err != nil {
+				logWarn("state: skipping unreadable settings for %s: %v", k, err)
+				return nil
+			}
+			state[string(k)] = &settings
+			return nil
+		})
+	})
+	return state, err
+}
+
+// SaveSettings replaces the stored settings with state and schedules a
+// backup when anything changed.
+func (s *Store) SaveSettings(state map[string]*CameraSettings) error {
+	changed := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		changed, err = putSettings(tx, state)
+		return err
+	})
+	if err == nil && changed {
+		s.scheduleBackup()
+	}
+	return err
+}
+
+func putSettings(tx *bolt.Tx, state map[string]*CameraSettings) (bool, error) {
+	bucket := tx.Bucket(bucketSettings)
+	var stale [][]byte
+	_ = bucket.ForEach(func(k, _ []byte) error {
+		if state[string(k)] == nil {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	for _, k := range stale {
+		if err := bucket.Delete(k); err != nil {
+			return false, err
+		}
+	}
+	changed := len(stale) > 0
+	for uid, settings := range state {
+		data, err := json.Marshal(settings)
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(bucket.Get([]byte(uid)), data) {
+			continue
+		}
+		if err := bucket.Put([]byte(uid), data); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+func (s *Store) LoadCameras() (map[string]KnownCamera, error) {
+	cameras := map[string]KnownCamera{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketCameras).ForEach(func(k, v []byte) error {
+			var known KnownCamera
+			if err := json.Unmarshal(v, &known); err == nil {
+				cameras[string(k)] = known
+			}
+			return nil
+		})
+	})
+	return cameras, err
+}
+
+// EventFilter selects stored events. Before is an exclusive upper bound on
+// the event ID, used to page backwards.
+type EventFilter struct {
+	DeviceUID string
+	Types     []string
+	From, To  time.Time
+	Before    int64
+	Limit     int
+}
+
+func (f EventFilter) matches(event Event) bool {
+	if f.DeviceUID != "" && event.DeviceUID != f.DeviceUID {
+		return false
+	}
+	if len(f.Types) > 0 && !containsString(f.Types, event.Type) {
+		return false
+	}
+	return f.To.IsZero() || !event.Time.After(f.To)
+}
+
+func eventKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// AppendEvents stores events in one transaction, each under the next
+// history ID, which replaces the in-memory one, and drops the oldest events
+// beyond limit.
+func (s *Store) AppendEvents(events []Event, limit int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketEvents)
+		var seq uint64
+		for _, event := range events {
+			var err error
+			if seq, err = bucket.NextSequence(); err != nil {
+				return err
+			}
+			event.ID = int64(seq)
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(eventKey(seq), data); err != nil {
+				return err
+			}
+		}
+		if seq <= uint64(limit) {
+			return nil
+		}
+		var stale [][]byte
+		cursor := bucket.Cursor()
+		for k, _ := cursor.First(); k != nil && binary.BigEndian.Uint64(k) <= seq-uint64(limit); k, _ = cursor.Next() {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		for _, k := range stale {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListEvents returns up to filter.Limit matching events, newest first, and
+// the ID to pass as Before for the next page, or 0 when there is none.
+func (s *Store) ListEvents(filter EventFilter) ([]Event, int64, error) {
+	list := make([]Event, 0)
+	var next int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(bucketEvents).Cursor()
+		k, v := cursor.Last()
+		if filter.Before > 0 {
+			if k, v = cursor.Seek(eventKey(uint64(filter.Before))); k == nil {
+				k, v = cursor.Last()
+			}
+			for k != nil && int64(binary.BigEndian.Uint64(k)) >= filter.Before {
+				k, v = cursor.Prev()
+			}
+		}
+		for ; k != nil; k, v = cursor.Prev() {
+			var event Event
+			if err := json.Unmarshal(v, &event); err != nil {
+				continue
+			}
+			// IDs grow with time, so nothing older can match.
+			if !filter.From.IsZero() && event.Time.Before(filter.From) {
+				return nil
+			}
+			if !filter.matches(event) {
+				continue
+			}
+			if len(list) == filter.Limit {
+				next = list[len(list)-1].ID
+				return nil
+			}
+			list = append(list, event)
+		}
+		return nil
+	})
+	return list, next, err
+}
+
+func (s *Store) SaveCamera(deviceUID string, known KnownCamera) error {
+	data, err := json.Marshal(known)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketCameras).Put([]byte(deviceUID), data)
+	})
+}
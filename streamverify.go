@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// streamVerifyDelay gives a new publisher time to open the device and
+	// connect before its stream is first checked.
+	streamVerifyDelay    = 5 * time.Second
+	streamVerifyRetry    = 3 * time.Second
+	streamVerifyInterval = 15 * time.Second
+	// streamVerifyFailures consecutive failed checks mark a stream
+	// unreadable, so a publisher that is still connecting is not flagged.
+	streamVerifyFailures = 3
+)
+
+// verifyStream checks that the media server serves a running publisher's
+// stream, since ffmpeg can keep running while MediaMTX refuses the path or
+// has dropped the session. It sends DESCRIBE for the camera's rtspUrl, and
+// its substream, until the publisher exits, and sets Unreadable while the
+// checks fail.
+func (a *Agent) verifyStream(uid string, proc Process) {
+	failures := 0
+	wait := streamVerifyDelay
+	for {
+		select {
+		case <-proc.Exited():
+			return
+		case <-time.After(wait):
+		}
+		a.mu.Lock()
+		cam := a.cameras[uid]
+		if cam == nil || a.publishers[uid] != proc {
+			a.mu.Unlock()
+			return
+		}
+		urls := []string{cam.RtspURL}
+		if cam.SubstreamURL != "" {
+			urls = append(urls, cam.SubstreamURL)
+		}
+		user, pass := cam.PublishUser, cam.PublishPass
+		a.mu.Unlock()
+
+		var err error
+		for _, rtspURL := range urls {
+			if err = describeRTSP(a.config(), rtspURL, user, pass, mediaProbeTimeout); err != nil {
+				err = fmt.Errorf("%s: %v", redactURL(rtspURL), err)
+				break
+			}
+		}
+		switch {
+		case err == nil:
+			failures = 0
+			a.setUnreadable(uid, proc, "")
+			wait = streamVerifyInterval
+		case failures+1 < streamVerifyFailures:
+			failures++
+			wait = streamVerifyRetry
+		default:
+			a.setUnreadable(uid, proc, err.Error())
+			wait = streamVerifyInterval
+		}
+	}
+}
+
+// setUnreadable records the outcome of a stream check for the publisher
+// that is still running, reporting when the stream becomes unreadable or
+// readable again.
+func (a *Agent) setUnreadable(uid string, proc Process, reason string) {
+	a.mu.Lock()
+	cam := a.cameras[uid]
+	if cam == nil || a.publishers[uid] != proc || cam.Unreadable == reason {
+		a.mu.Unlock()
+		return
+	}
+	was := cam.Unreadable
+	cam.Unreadable = reason
+	a.mu.Unlock()
+
+	switch {
+	case reason == "":
+		logInfo("stream of %s is readable again", uid)
+		a.emit("stream_readable", uid, nil)
+	case was == "":
+		logWarn("%s is publishing but its stream is unreadable: %s", uid, reason)
+		a.cameraLog(uid).Add("stream unreadable: " + reason)
+		a.emit("stream_unreadable", uid, map[string]interface{}{"error": reason})
+	}
+}
+
+// describeRTSP asks the server for the stream's description and requires a
+// video track in it. A 401 after offering the publish credentials is not an
+// error: a server that needs other read credentials cannot be checked, and
+// the stream is not reported as broken for it.
+func describeRTSP(cfg *Config, rawURL, user, pass string, timeout time.Duration) error {
+	conn, parsed, err := dialRTSP(cfg, rawURL, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	parsed.User = nil
+	target := parsed.String()
+	reader := bufio.NewReader(conn)
+
+	describe := func(cseq int, auth string) (int, string, []byte, error) {
+		request := fmt.Sprintf("DESCRIBE %s RTSP/1.0\r\nCSeq: %d\r\nAccept: application/sdp\r\nUser-Agent: camhub-agent\r\n", target, cseq)
+		if auth != "" {
+			request += "Authorization: " + auth + "\r\n"
+		}
+		if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+			return 0, "", nil, err
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return 0, "", nil, fmt.Errorf("no RTSP reply: %v", err)
+		}
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if len(fields) < 2 || fields[0] != "RTSP/1.0" {
+			return 0, "", nil, fmt.Errorf("not an RTSP reply: %q", strings.TrimSpace(line))
+		}
+		status := fields[1]
+		code, _ := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+		headers, err := textproto.NewReader(reader).ReadMIMEHeader()
+		if err != nil {
+			return 0, "", nil, err
+		}
+		length, _ := strconv.Atoi(headers.Get("Content-Length"))
+		if length < 0 || length > 64*1024 {
+			return 0, "", nil, fmt.Errorf("DESCRIBE reply of %d bytes", length)
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return 0, "", nil, err
+		}
+		return code, status, body, nil
+	}
+
+	code, status, body, err := describe(1, "")
+	if err == nil && code == 401 && user != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+		code, status, body, err = describe(2, "Basic "+credentials)
+	}
+	switch {
+	case err != nil:
+		return err
+	case code == 401:
+		return nil
+	case code != 200:
+		return fmt.Errorf("DESCRIBE refused: %s", status)
+	case !bytes.Contains(body, []byte("m=video")):
+		return errors.New("stream has no video track")
+	}
+	return nil
+}
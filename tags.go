@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxCameraTags caps the tags on one camera; they are sent with every hub
+// registration.
+const maxCameraTags = 16
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,31}$`)
+
+// normalizeTags lowercases, dedupes and sorts tags, so "Warehouse" and
+// "warehouse" name the same group.
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	out := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("invalid tag %q: use up to 32 letters, digits, '.', '_' or '-'", tag)
+		}
+		seen[tag] = true
+		out = append(out, tag)
+	}
+	if len(out) > maxCameraTags {
+		return nil, fmt.Errorf("at most %d tags per camera", maxCameraTags)
+	}
+	sort.Strings(out)
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return out, nil
+}
+
+// TagSummary counts the cameras carrying a tag and how many of them are
+// enabled.
+type TagSummary struct {
+	Tag     string `json:"tag"`
+	Cameras int    `json:"cameras"`
+	Enabled int    `json:"enabled"`
+}
+
+// handleTags lists the tags of the detected cameras, for picking a group to
+// enable or disable through /api/cameras/bulk.
+func (a *Agent) handleTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	summaries := map[string]*TagSummary{}
+	a.mu.Lock()
+	for _, cam := range a.cameras {
+		for _, tag := range cam.Tags {
+			summary := summaries[tag]
+			if summary == nil {
+				summary = &TagSummary{Tag: tag}
+				summaries[tag] = summary
+			}
+			summary.Cameras++
+			if cam.Enabled {
+				summary.Enabled++
+			}
+		}
+	}
+	a.mu.Unlock()
+
+	list := make([]*TagSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		list = append(list, summary)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Tag < list[j].Tag })
+	writeJSON(w, http.StatusOK, list)
+}
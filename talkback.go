@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+type talkbackSession struct {
+	cancel context.CancelFunc
+}
+
+// talkbackOutput returns the ffmpeg arguments that play audio on a local
+// output device, e.g. ALSA "plughw:1,0" on Linux or "/dev/dsp1" on FreeBSD.
+func talkbackOutput(device string) ([]string, error) {
+	switch runtime.GOOS {
+	case "linux":
+		return []string{"-f", "alsa", device}, nil
+	case "freebsd":
+		return []string{"-f", "oss", device}, nil
+	}
+	return nil, fmt.Errorf("talkback is not supported on %s", runtime.GOOS)
+}
+
+// handleTalkback plays the request body out of the camera's speaker for as
+// long as the hub keeps streaming. The body may be any container ffmpeg can
+// read from a pipe (Ogg/Opus, WebM, WAV, MP3, ADTS). DELETE ends the
+// current session.
+func (a *Agent) handleTalkback(w http.ResponseWriter, r *http.Request, deviceUID string) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.mu.Lock()
+	cam := a.cameras[deviceUID]
+	if cam == nil {
+		a.mu.Unlock()
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "camera not found"})
+		return
+	}
+	if r.Method == http.MethodDelete {
+		a.stopTalkbackLocked(deviceUID)
+		a.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+		return
+	}
+	var conflict string
+	switch {
+	case cam.TalkbackDevice == "":
+		conflict = "talkback is not configured for this camera"
+	case !a.activeLocked(cam):
+		conflict = "camera is not active"
+	case a.talkbacks[deviceUID] != nil:
+		conflict = "talkback already in use"
+	}
+	if conflict != "" {
+		a.mu.Unlock()
+		writeJSON(w, http.StatusConflict, map[string]string{"error": conflict})
+		return
+	}
+	output, err := talkbackOutput(cam.TalkbackDevice)
+	if err != nil {
+		a.mu.Unlock()
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": err.Error()})
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	session := &talkbackSession{cancel: cancel}
+	a.talkbacks[deviceUID] = session
+	cam.Talking = true
+	device := cam.TalkbackDevice
+	a.mu.Unlock()
+
+	started := time.Now()
+	logInfo("talkback started on %s (%s)", deviceUID, device)
+	a.emit("talkback_started", deviceUID, map[string]interface{}{"device": device})
+
+	args := append([]string{"-hide_banner", "-loglevel", "error", "-fflags", "nobuffer", "-i", "pipe:0", "-vn"}, output...)
+	cmd := exec.CommandContext(ctx, a.config().FfmpegPath, args...)
+	cmd.Stdin = r.Body
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+
+	a.mu.Lock()
+	if a.talkbacks[deviceUID] == session {
+		delete(a.talkbacks, deviceUID)
+	}
+	if cam := a.cameras[deviceUID]; cam != nil && a.talkbacks[deviceUID] == nil {
+		cam.Talking = false
+	}
+	a.mu.Unlock()
+	cancel()
+
+	seconds := int(time.Since(started).Seconds())
+	a.emit("talkback_stopped", deviceUID, map[string]interface{}{"seconds": seconds})
+	// A session ended by DELETE, shutdown or the hub hanging up is not an
+	// error; only a playback failure is.
+	if err != nil && ctx.Err() == nil {
+		if msg := lastLine(stderr.String()); msg != "" {
+			err = errors.New(msg)
+		}
+		logWarn("talkback failed on %s: %v", deviceUID, err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	logInfo("talkback stopped on %s after %ds", deviceUID, seconds)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "seconds": seconds})
+}
+
+func (a *Agent) stopTalkbackLocked(uid string) {
+	if session := a.talkbacks[uid]; session != nil {
+		session.cancel()
+		delete(a.talkbacks, uid)
+	}
+}
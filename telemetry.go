@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	progressFPS   = regexp.MustCompile(`fps=\s*([0-9.]+)`)
+	progressSpeed = regexp.MustCompile(`speed=\s*([0-9.]+)x`)
+	progressSize  = regexp.MustCompile(`size=\s*([0-9]+)(kB|KiB|MB|MiB|B)\b`)
+)
+
+// systemTelemetry gathers host health for the heartbeat. Values a platform
+// cannot provide are left out.
+func (a *Agent) systemTelemetry() map[string]interface{} {
+	cfg := a.config()
+	telemetry := map[string]interface{}{
+		"uptimeSeconds": int64(time.Since(a.startedAt).Seconds()),
+	}
+	if load, ok := cpuLoad(); ok {
+		telemetry["cpuLoad"] = load
+	}
+	if total, available, ok := memoryInfo(); ok {
+		telemetry["memoryTotalBytes"] = total
+		telemetry["memoryAvailableBytes"] = available
+	}
+	dir := cfg.RecordingDir
+	if _, err := os.Stat(dir); err != nil {
+		dir = filepath.Dir(cfg.StateFile)
+	}
+	if free, ok := diskFree(dir); ok {
+		telemetry["diskFreeBytes"] = free
+	}
+	telemetry["recordingsBytes"] = a.recordingBytes.Load()
+	telemetry["retentionDeletedFiles"] = a.retentionFiles.Load()
+	telemetry["retentionReclaimedBytes"] = a.retentionBytes.Load()
+	if temp, ok := cpuTemperature(); ok {
+		telemetry["cpuTempCelsius"] = temp
+	}
+	return telemetry
+}
+
+// memoryInfo reads MemTotal and MemAvailable from /proc/meminfo.
+func memoryInfo() (uint64, uint64, bool) {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, 0, false
+	}
+	var total, available uint64
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = kb * 1024
+		case "MemAvailable:":
+			available = kb * 1024
+		}
+	}
+	return total, available, total > 0
+}
+
+// cpuTemperature returns the hottest thermal zone, which on single-board
+// computers is the SoC.
+func cpuTemperature() (float64, bool) {
+	zones, _ := filepath.Glob("/sys/class/thermal/thermal_zone*/temp")
+	best, found := 0.0, false
+	for _, zone := range zones {
+		milli, err := strconv.ParseFloat(readSysfsAttr(zone), 64)
+		if err != nil {
+			continue
+		}
+		if temp := milli / 1000; !found || temp > best {
+			best, found = temp, true
+		}
+	}
+	return best, found
+}
+
+// scanOutputLines splits on \r as well as \n, because ffmpeg rewrites its
+// progress line in place with carriage returns.
+func scanOutputLines(data []byte, atEOF bool) (int, []byte, error) {
+	if idx := bytes.IndexAny(data, "\r\n"); idx >= 0 {
+		return idx + 1, data[:idx], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// parseProgressFPS extracts the frame rate from an ffmpeg progress line
+// such as "frame=  120 fps= 15 q=23.0 size= ...".
+func parseProgressFPS(line string) (float64, bool) {
+	if !strings.HasPrefix(line, "frame=") {
+		return 0, false
+	}
+	m := progressFPS.FindStringSubmatch(line)
+	if m == nil {
+		return 0, false
+	}
+	fps, err := strconv.ParseFloat(m[1], 64)
+	return fps, err == nil
+}
+
+// parseProgressSpeed extracts the encoding speed relative to real time from
+// the same progress line, e.g. "speed=0.98x".
+func parseProgressSpeed(line string) (float64, bool) {
+	m := progressSpeed.FindStringSubmatch(line)
+	if m == nil {
+		return 0, false
+	}
+	speed, err := strconv.ParseFloat(m[1], 64)
+	return speed, err == nil
+}
+
+// parseProgressSize extracts the bytes written so far, e.g. "size=  512kB"
+// (or "512KiB" from newer ffmpeg). With several outputs it is their total.
+func parseProgressSize(line string) (int64, bool) {
+	m := progressSize.FindStringSubmatch(line)
+	if m == nil {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	switch m[2] {
+	case "kB", "KiB":
+		size *= 1024
+	case "MB", "MiB":
+		size *= 1024 * 1024
+	}
+	return size, true
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Synthetic cameras have nodes like "lavfi:smptebars=size=1280x720:rate=15",
+// which ffmpeg opens as a lavfi source. They exercise the whole pipeline on
+// machines without cameras.
+const testNodePrefix = "lavfi:"
+
+// testPatterns maps TEST_CAMERAS entries to their GStreamer videotestsrc
+// pattern.
+var testPatterns = map[string]string{
+	"testsrc":     "ball",
+	"testsrc2":    "ball",
+	"smptebars":   "smpte",
+	"smptehdbars": "smpte",
+	"rgbtestsrc":  "colors",
+}
+
+func isTestNode(node string) bool {
+	return strings.HasPrefix(node, testNodePrefix)
+}
+
+// testDevices returns one virtual device per TEST_CAMERAS entry. The ID is
+// stable so settings survive restarts like those of real cameras.
+func testDevices(cfg *Config) []DeviceInfo {
+	devices := make([]DeviceInfo, 0, len(cfg.TestCameras))
+	for idx, pattern := range cfg.TestCameras {
+		node := fmt.Sprintf("%s%s=size=%s:rate=%d", testNodePrefix, pattern, cfg.TestCameraSize, cfg.TestCameraFPS)
+		devices = append(devices, DeviceInfo{
+			Name:  fmt.Sprintf("Test %s %d", pattern, idx+1),
+			Node:  node,
+			ID:    fmt.Sprintf("test-%d-%s", idx, pattern),
+			Nodes: []string{node},
+		})
+	}
+	return devices
+}
+
+// gstTestSource is the videotestsrc equivalent of a lavfi test node.
+func gstTestSource(node string) []string {
+	spec := strings.TrimPrefix(node, testNodePrefix)
+	name, options, _ := strings.Cut(spec, "=")
+	caps := "video/x-raw"
+	for _, option := range strings.Split(options, ":") {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "size":
+			if width, height, ok := strings.Cut(value, "x"); ok {
+				caps += ",width=" + width + ",height=" + height
+			}
+		case "rate":
+			caps += ",framerate=" + value + "/1"
+		}
+	}
+	pattern := testPatterns[name]
+	if pattern == "" {
+		pattern = "smpte"
+	}
+	return []string{"videotestsrc", "is-live=true", "pattern=" + pattern, "!", caps}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// thumbnailLoop captures a small JPEG of every publishing camera each
+// THUMBNAIL_INTERVAL_MS and posts it to the hubs, so the hub's camera grid
+// can show near-live previews without browsers pulling RTSP. Nothing is
+// captured while privacy mode is on.
+func (a *Agent) thumbnailLoop() {
+	for {
+		interval := a.config().ThumbnailInterval
+		if interval <= 0 {
+			// Disabled; check again in case a reload turns it on.
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		time.Sleep(interval)
+		a.uploadThumbnails()
+	}
+}
+
+func (a *Agent) uploadThumbnails() {
+	type target struct {
+		uid     string
+		rtspURL string
+	}
+	a.mu.Lock()
+	if a.privacy {
+		a.mu.Unlock()
+		return
+	}
+	var targets []target
+	for uid, cam := range a.cameras {
+		if a.publishers[uid] == nil || cam.Output != outputRTSP {
+			continue
+		}
+		// The substream is already scaled down, so it is cheaper to decode.
+		rtspURL := cam.RtspURL
+		if cam.SubstreamURL != "" {
+			rtspURL = cam.SubstreamURL
+		}
+		targets = append(targets, target{uid, rtspURL})
+	}
+	a.mu.Unlock()
+	sort.Slice(targets, func(i, j int) bool { return targets[i].uid < targets[j].uid })
+
+	cfg := a.config()
+	for _, t := range targets {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.SnapshotTimeout)
+		frame, err := a.captureSnapshot(ctx, "", t.rtspURL, true, cfg.ThumbnailWidth)
+		cancel()
+		if err != nil {
+			logWarn("thumbnail failed for %s: %v", t.uid, err)
+			continue
+		}
+		now := time.Now()
+		a.thumbnailEntry(t.uid).store(frame, now)
+		if err := a.sendThumbnail(t.uid, frame, now); err != nil {
+			logWarn("thumbnail upload failed for %s: %v", t.uid, err)
+		}
+	}
+}
+
+func (a *Agent) sendThumbnail(deviceUID string, frame []byte, ts time.Time) error {
+	query := url.Values{}
+	query.Set("deviceUid", deviceUID)
+	query.Set("ts", strconv.FormatInt(ts.UnixMilli(), 10))
+	path := "/api/thumbnails?" + query.Encode()
+
+	var errs []error
+	for _, hub := range a.hubs() {
+		if err := a.postThumbnail(hub, path, frame); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", hub.URL, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (a *Agent) postThumbnail(hub hubTarget, path string, frame []byte) error {
+	req, err := a.newHubRequest(hub, http.MethodPost, path, frame)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "image/jpeg")
+
+	client := &http.Client{Timeout: a.config().RegisterTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("thumbnail rejected: %s %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// thumbnail caches a camera's latest small JPEG. mu is held while capturing,
+// so concurrent requests wait for one ffmpeg instead of starting their own.
+type thumbnail struct {
+	mu    sync.Mutex
+	frame []byte
+	at    time.Time
+}
+
+func (t *thumbnail) store(frame []byte, at time.Time) {
+	t.mu.Lock()
+	t.frame, t.at = frame, at
+	t.mu.Unlock()
+}
+
+func (a *Agent) thumbnailEntry(uid string) *thumbnail {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry := a.thumbs[uid]
+	if entry == nil {
+		entry = &thumbnail{}
+		a.thumbs[uid] = entry
+	}
+	return entry
+}
+
+func thumbnailURL(basePath, uid string) string {
+	return basePath + "/api/cameras/" + url.PathEscape(uid) + "/thumbnail"
+}
+
+// handleThumbnail serves the cached thumbnail, capturing a new one when it
+// is older than THUMBNAIL_CACHE_MS.
+func (a *Agent) handleThumbnail(w http.ResponseWriter, r *http.Request, deviceUID string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.mu.Lock()
+	cam := a.cameras[deviceUID]
+	var node, rtspURL string
+	publishing := false
+	if cam != nil {
+		node = cam.Node
+		rtspURL = cam.RtspURL
+		if cam.SubstreamURL != "" {
+			rtspURL = cam.SubstreamURL
+		}
+		publishing = a.publishers[deviceUID] != nil
+	}
+	privacy := a.privacy
+	a.mu.Unlock()
+	if cam == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "camera not found"})
+		return
+	}
+	// Not even the cached frame is served while privacy mode is on.
+	if privacy {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "privacy mode is on"})
+		return
+	}
+
+	cfg := a.config()
+	entry := a.thumbnailEntry(deviceUID)
+	entry.mu.Lock()
+	if entry.frame == nil || time.Since(entry.at) >= cfg.ThumbnailCacheTTL {
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.SnapshotTimeout)
+		frame, err := a.captureSnapshot(ctx, node, rtspURL, publishing, cfg.ThumbnailWidth)
+		cancel()
+		if err != nil && entry.frame == nil {
+			entry.mu.Unlock()
+			logWarn("thumbnail failed for %s: %v", deviceUID, err)
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "thumbnail failed"})
+			return
+		}
+		// A stale frame is better than none while the camera is busy.
+		if err == nil {
+			entry.frame, entry.at = frame, time.Now()
+		}
+	}
+	frame, at := entry.frame, entry.at
+	entry.mu.Unlock()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Last-Modified", at.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(frame)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	updateDownloadTimeout = 10 * time.Minute
+	updateCheckTimeout    = 30 * time.Second
+	updateMaxSize         = 256 << 20
+)
+
+// executablePath is the agent binary, resolved at startup: once an update
+// has renamed the running binary, os.Executable reports the .old copy on
+// Linux.
+var executablePath = func() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+	return exe
+}()
+
+func agentExecutable() (string, error) {
+	if executablePath == "" {
+		return "", errors.New("cannot locate the agent binary")
+	}
+	return executablePath, nil
+}
+
+// updateManifest describes an agent build. Signature is the base64 Ed25519
+// signature by one of UPDATE_PUBLIC_KEYS of the manifest's signed message,
+// which binds the version to the binary's SHA256, so an older signed build
+// cannot be passed off as a newer one. A URL starting with "/" is on the
+// primary hub and fetched with the agent's hub token.
+type updateManifest struct {
+	Version   string `json:"version"`
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+// signedMessage is what release tooling signs:
+// "camhub-agent update <version> <sha256 in lowercase hex>".
+func (m *updateManifest) signedMessage() []byte {
+	return []byte("camhub-agent update " + m.Version + " " + strings.ToLower(m.SHA256))
+}
+
+func parseUpdateKeys(encoded []string) ([]ed25519.PublicKey, error) {
+	keys := make([]ed25519.PublicKey, 0, len(encoded))
+	for _, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%q is not a base64 Ed25519 public key", value)
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	return keys, nil
+}
+
+// updateURL is UPDATE_URL with {os} and {arch} filled in, so one release
+// location can serve every platform.
+func updateURL(cfg *Config) string {
+	return strings.NewReplacer("{os}", runtime.GOOS, "{arch}", runtime.GOARCH).Replace(cfg.UpdateURL)
+}
+
+// updateGet fetches a manifest or binary, from the primary hub when target
+// is a path.
+func (a *Agent) updateGet(ctx context.Context, target string) (*http.Response, error) {
+	var req *http.Request
+	var err error
+	if strings.HasPrefix(target, "/") {
+		if req, err = a.newHubRequest(a.hubs()[0], http.MethodGet, target, nil); err == nil {
+			req = req.WithContext(ctx)
+		}
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res.Body.Close()
+		return nil, fmt.Errorf("%s: %s", redactURL(target), res.Status)
+	}
+	return res, nil
+}
+
+// fetchUpdateManifest reads the manifest at UPDATE_URL.
+func (a *Agent) fetchUpdateManifest() (*updateManifest, error) {
+	cfg := a.config()
+	if cfg.UpdateURL == "" {
+		return nil, errors.New("UPDATE_URL is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), updateCheckTimeout)
+	defer cancel()
+	res, err := a.updateGet(ctx, updateURL(cfg))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var manifest updateManifest
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("update manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+// installUpdate downloads and verifies the build, checks that it runs here,
+// swaps it for the running binary and restarts into it. The previous binary
+// is kept beside it with an .old suffix.
+func (a *Agent) installUpdate(manifest *updateManifest) error {
+	cfg := a.config()
+	keys, err := parseUpdateKeys(cfg.UpdatePublicKeys)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("updates are disabled; set UPDATE_PUBLIC_KEYS")
+	}
+	if manifest.Version == "" || manifest.URL == "" || manifest.SHA256 == "" || manifest.Signature == "" {
+		return errors.New("update manifest needs version, url, sha256 and signature")
+	}
+	// Only newer releases are installed, which stops a replayed older build
+	// from downgrading the agent. A build without a release version cannot
+	// tell, so it does not update itself.
+	if _, _, ok := parseVersion(version); !ok {
+		return fmt.Errorf("running build %s has no release version", version)
+	}
+	if _, _, ok := parseVersion(manifest.Version); !ok {
+		return fmt.Errorf("update version %q is not a release version", manifest.Version)
+	}
+	if compareVersions(manifest.Version, version) <= 0 {
+		return fmt.Errorf("%s is not newer than the running %s", manifest.Version, version)
+	}
+	if !a.updating.CompareAndSwap(false, true) {
+		return errors.New("an update is already in progress")
+	}
+	defer a.updating.Store(false)
+
+	logInfo("downloading update %s from %s", manifest.Version, redactURL(manifest.URL))
+	a.emit("update_started", "", map[string]interface{}{"version": manifest.Version})
+	err = a.replaceBinary(manifest, keys)
+	if err != nil {
+		logError("update to %s failed: %v", manifest.Version, err)
+		a.emit("update_failed", "", map[string]interface{}{"version": manifest.Version, "error": err.Error()})
+		return err
+	}
+	a.emit("update_installed", "", map[string]interface{}{"version": manifest.Version, "previous": version})
+	a.requestRestart("updated to " + manifest.Version)
+	return nil
+}
+
+func (a *Agent) replaceBinary(manifest *updateManifest, keys []ed25519.PublicKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), updateDownloadTimeout)
+	defer cancel()
+	res, err := a.updateGet(ctx, manifest.URL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	binary, err := io.ReadAll(io.LimitReader(res.Body, updateMaxSize+1))
+	if err != nil {
+		return err
+	}
+	if len(binary) > updateMaxSize {
+		return fmt.Errorf("binary is larger than %d MB", updateMaxSize>>20)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(manifest.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+	sum := sha256.Sum256(binary)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), manifest.SHA256) {
+		return errors.New("sha256 mismatch")
+	}
+	verified := false
+	for _, key := range keys {
+		if ed25519.Verify(key, manifest.signedMessage(), signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return errors.New("signature does not match any UPDATE_PUBLIC_KEYS")
+	}
+
+	exe, err := agentExecutable()
+	if err != nil {
+		return err
+	}
+	staged := exe + ".new"
+	if err := writeFileAtomic(staged, binary, 0o755); err != nil {
+		return err
+	}
+	if err := checkBinary(staged, manifest.Version); err != nil {
+		os.Remove(staged)
+		return err
+	}
+
+	// Renaming works on a running binary everywhere, unlike overwriting it.
+	old := exe + ".old"
+	_ = os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		os.Remove(staged)
+		return err
+	}
+	if err := os.Rename(staged, exe); err != nil {
+		_ = os.Rename(old, exe)
+		return err
+	}
+	return nil
+}
+
+// checkBinary runs the new binary's version command, which catches builds
+// for another platform before they replace a working agent.
+func checkBinary(path, expected string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), diagCommandTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "version").Output()
+	if err != nil {
+		return fmt.Errorf("new binary does not run: %v", err)
+	}
+	var info VersionInfo
+	if err := json.Unmarshal(bytes.TrimSpace(out), &info); err != nil {
+		return fmt.Errorf("new binary does not report its version: %v", err)
+	}
+	if expected != "" && info.Version != expected {
+		return fmt.Errorf("new binary is version %s, not %s", info.Version, expected)
+	}
+	return nil
+}
+
+// handleUpdate installs the build in the request body, or the one at
+// UPDATE_URL when the body is empty, and restarts into it. Unlike other
+// admin endpoints it is not left open without API credentials.
+func (a *Agent) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if len(a.credentials()) == 0 && !a.oidcEnabled() {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "self-update over the API needs API_TOKEN, API_CREDENTIALS or OIDC"})
+		return
+	}
+	var manifest *updateManifest
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid payload"})
+		return
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		manifest = &updateManifest{}
+		if err := json.Unmarshal(body, manifest); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid payload"})
+			return
+		}
+	} else if manifest, err = a.fetchUpdateManifest(); err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := a.installUpdate(manifest); err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"version": manifest.Version, "status": "restarting"})
+}
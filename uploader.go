@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const uploadedIndexName = ".uploaded.json"
+
+// uploadLoop periodically pushes completed recording segments to the
+// configured S3-compatible bucket.
+func (a *Agent) uploadLoop() {
+	ticker := time.NewTicker(a.config().UploadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		a.uploadPending()
+	}
+}
+
+func (a *Agent) uploadPending() {
+	dirs, err := os.ReadDir(a.config().RecordingDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logWarn("upload scan failed: %v", err)
+		}
+		return
+	}
+
+	for _, entry := range dirs {
+		if !entry.IsDir() {
+			continue
+		}
+		a.uploadDir(entry.Name())
+	}
+}
+
+func (a *Agent) uploadDir(streamPath string) {
+	cfg := a.config()
+	dir := filepath.Join(cfg.RecordingDir, streamPath)
+	files, err := completedSegments(dir, cfg.RecordingSegment)
+	if err != nil {
+		logWarn("upload scan failed for %s: %v", streamPath, err)
+		return
+	}
+
+	uploaded := loadUploadedIndex(dir)
+	changed := false
+	for _, name := range files {
+		if uploaded[name] {
+			continue
+		}
+
+		key := s3ObjectKey(cfg.S3Prefix, streamPath, name)
+		if err := a.uploadWithRetry(filepath.Join(dir, name), key); err != nil {
+			logError("upload failed for %s: %v", key, err)
+			a.emit("upload_failed", "", map[string]interface{}{"key": key, "error": err.Error()})
+			continue
+		}
+		logInfo("uploaded %s", key)
+		a.emit("upload_completed", "", map[string]interface{}{"key": key})
+
+		if cfg.UploadDeleteAfter {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				logWarn("delete after upload failed for %s: %v", name, err)
+			}
+			continue
+		}
+		uploaded[name] = true
+		changed = true
+	}
+
+	if changed {
+		_ = saveUploadedIndex(dir, uploaded)
+	}
+}
+
+// completedSegments lists segment files that the recorder has finished with:
+// every file except the newest, plus the newest once it is older than two
+// segment lengths (the recorder has stopped).
+func completedSegments(dir string, segment time.Duration) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	sort.Strings(names)
+
+	newest := names[len(names)-1]
+	info, err := os.Stat(filepath.Join(dir, newest))
+	if err != nil || time.Since(info.ModTime()) < 2*segment {
+		names = names[:len(names)-1]
+	}
+	return names, nil
+}
+
+func loadUploadedIndex(dir string) map[string]bool {
+	index := map[string]bool{}
+	data, err := os.ReadFile(filepath.Join(dir, uploadedIndexName))
+	if err != nil {
+		return index
+	}
+	_ = json.Unmarshal(data, &index)
+
+	// Forget entries whose files are gone so the index does not grow forever.
+	for name := range index {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			delete(index, name)
+		}
+	}
+	return index
+}
+
+func saveUploadedIndex(dir string, index map[string]bool) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, uploadedIndexName), data, 0o600)
+}
+
+func s3ObjectKey(prefix, streamPath, name string) string {
+	return strings.TrimPrefix(path.Join(strings.Trim(prefix, "/"), streamPath, name), "/")
+}
+
+func (a *Agent) uploadWithRetry(filePath, key string) error {
+	retries := a.config().UploadRetries
+	if retries < 0 {
+		retries = 0
+	}
+
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * a.config().RestartDelay)
+		}
+		if err = a.uploadObject(filePath, key); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (a *Agent) uploadObject(filePath, key string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	payloadHash := hex.EncodeToString(hash.Sum(nil))
+
+	target, err := a.s3ObjectURL(key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, target.String(), file)
+	if err != nil {
+		return err
+	}
+	cfg := a.config()
+	req.ContentLength = size
+	req.Header.Set("Content-Type", recordingContentType(key))
+	signS3Request(req, cfg.S3Region, cfg.S3AccessKey, cfg.S3SecretKey, payloadHash, time.Now().UTC())
+
+	client := &http.Client{Timeout: cfg.UploadTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("upload rejected: %s %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// s3ObjectURL addresses the object path-style (endpoint/bucket/key), which
+// MinIO requires, or virtual-hosted style (bucket.endpoint/key) for AWS.
+func (a *Agent) s3ObjectURL(key string) (*url.URL, error) {
+	cfg := a.config()
+	endpoint, err := url.Parse(strings.TrimRight(cfg.S3Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint: %s", cfg.S3Endpoint)
+	}
+
+	target := *endpoint
+	if cfg.S3PathStyle {
+		target.Path = endpoint.Path + "/" + cfg.S3Bucket + "/" + key
+	} else {
+		target.Host = cfg.S3Bucket + "." + endpoint.Host
+		target.Path = endpoint.Path + "/" + key
+	}
+	target.RawPath = awsURIEncode(target.Path, false)
+	return &target, nil
+}
+
+func recordingContentType(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mkv":
+		return "video/x-matroska"
+	case ".mp4":
+		return "video/mp4"
+	}
+	return "application/octet-stream"
+}
+
+// signS3Request adds an AWS Signature Version 4 Authorization header.
+func signS3Request(req *http.Request, region, accessKey, secretKey, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(req.URL.Path, false),
+		req.URL.Query().Encode(),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+func awsURIEncode(value string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,5 @@
+package main
+
+// vidiocQueryCap is _IOR('V', 0, struct v4l2_capability) in FreeBSD encoding,
+// as served by webcamd.
+const vidiocQueryCap = 0x40685600
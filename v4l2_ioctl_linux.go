@@ -0,0 +1,4 @@
+package main
+
+// vidiocQueryCap is _IOR('V', 0, struct v4l2_capability) in Linux encoding.
+const vidiocQueryCap = 0x80685600
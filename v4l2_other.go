@@ -0,0 +1,9 @@
+//go:build !linux && !freebsd
+
+package main
+
+import "errors"
+
+func queryCapability(node string) (DeviceCapability, error) {
+	return DeviceCapability{}, errors.New("capability query unsupported")
+}
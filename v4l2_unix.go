@@ -0,0 +1,59 @@
+//go:build linux || freebsd
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	v4l2CapVideoCapture       = 0x00000001
+	v4l2CapVideoCaptureMplane = 0x00001000
+	v4l2CapDeviceCaps         = 0x80000000
+)
+
+type v4l2Capability struct {
+	Driver       [16]byte
+	Card         [32]byte
+	BusInfo      [32]byte
+	Version      uint32
+	Capabilities uint32
+	DeviceCaps   uint32
+	Reserved     [3]uint32
+}
+
+// queryCapability issues VIDIOC_QUERYCAP against a device node.
+func queryCapability(node string) (DeviceCapability, error) {
+	file, err := os.OpenFile(node, os.O_RDWR|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return DeviceCapability{}, err
+	}
+	defer file.Close()
+
+	var raw v4l2Capability
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), vidiocQueryCap, uintptr(unsafe.Pointer(&raw)))
+	if errno != 0 {
+		return DeviceCapability{}, errno
+	}
+
+	// DeviceCaps describes this node; Capabilities covers the whole device.
+	caps := raw.Capabilities
+	if caps&v4l2CapDeviceCaps != 0 {
+		caps = raw.DeviceCaps
+	}
+	return DeviceCapability{
+		Card:    cString(raw.Card[:]),
+		BusInfo: cString(raw.BusInfo[:]),
+		Capture: caps&(v4l2CapVideoCapture|v4l2CapVideoCaptureMplane) != 0,
+	}, nil
+}
+
+func cString(b []byte) string {
+	if idx := bytes.IndexByte(b, 0); idx >= 0 {
+		b = b[:idx]
+	}
+	return string(b)
+}
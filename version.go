@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Build information, injected at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+	// Latest is the newest version the hub advertises; UpdateAvailable is
+	// set when it is newer than this build.
+	Latest          string `json:"latest,omitempty"`
+	UpdateAvailable bool   `json:"updateAvailable,omitempty"`
+}
+
+func versionInfo() VersionInfo {
+	return VersionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+// versionStatus is versionInfo with the latest version the hub advertised.
+func (a *Agent) versionStatus() VersionInfo {
+	info := versionInfo()
+	if latest := a.latestVersion.Load(); latest != nil {
+		info.Latest = *latest
+		info.UpdateAvailable = compareVersions(*latest, version) > 0
+	}
+	return info
+}
+
+// setLatestVersion records the latest version from a registration reply and
+// logs once when it is newer than this build.
+func (a *Agent) setLatestVersion(latest string) {
+	latest = strings.TrimSpace(latest)
+	if latest == "" {
+		return
+	}
+	if prev := a.latestVersion.Swap(&latest); prev != nil && *prev == latest {
+		return
+	}
+	if compareVersions(latest, version) > 0 {
+		logInfo("update available: %s (running %s)", latest, version)
+		a.emit("update_available", "", map[string]interface{}{"version": version, "latest": latest})
+	}
+}
+
+// compareVersions orders dotted versions such as v1.4.2 or 1.5.0-rc1 and
+// returns -1, 0 or 1. Versions it cannot read, like dev builds, compare
+// equal to everything so they never report drift. A pre-release sorts
+// before its release.
+func compareVersions(a, b string) int {
+	partsA, preA, okA := parseVersion(a)
+	partsB, preB, okB := parseVersion(b)
+	if !okA || !okB {
+		return 0
+	}
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var x, y int
+		if i < len(partsA) {
+			x = partsA[i]
+		}
+		if i < len(partsB) {
+			y = partsB[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	case preA < preB:
+		return -1
+	}
+	return 1
+}
+
+func parseVersion(value string) ([]int, string, bool) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "v")
+	value, _, _ = strings.Cut(value, "+")
+	value, pre, _ := strings.Cut(value, "-")
+	fields := strings.Split(value, ".")
+	parts := make([]int, len(fields))
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, "", false
+		}
+		parts[i] = n
+	}
+	return parts, pre, true
+}
+
+func (a *Agent) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.versionStatus())
+}
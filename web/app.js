@@ -1,6 +1,13 @@
 const listEl = document.getElementById("cameras");
 const statusEl = document.getElementById("status");
 const refreshBtn = document.getElementById("refresh");
+const privacyBtn = document.getElementById("privacy");
+const logoutBtn = document.getElementById("logout");
+const enrollmentEl = document.getElementById("enrollment");
+const updateEl = document.getElementById("update");
+let privacy = false;
+let viewer = false;
+let logoutUrl = "";
 const activePreviews = new Set();
 
 async function fetchCameras(force = false) {
@@ -9,7 +16,7 @@ async function fetchCameras(force = false) {
   }
   statusEl.textContent = "Refreshing...";
   try {
-    const res = await fetch("/api/cameras");
+    const res = await fetch("api/cameras");
     const data = await res.json();
     renderCameras(data);
     statusEl.textContent = `Found ${data.length}`;
@@ -18,6 +25,12 @@ async function fetchCameras(force = false) {
   }
 }
 
+// escapeHTML makes API values safe to interpolate into markup; camera names,
+// tags and the like are set by users and hubs.
+function escapeHTML(value) {
+  return String(value ?? "").replace(/[&<>"']/g, (c) => `&#${c.charCodeAt(0)};`);
+}
+
 function renderCameras(cameras) {
   listEl.innerHTML = "";
   if (!cameras.length) {
@@ -25,15 +38,27 @@ function renderCameras(cameras) {
     return;
   }
 
-  cameras.forEach((cam) => {
+  cameras.forEach((cam, index) => {
     const card = document.createElement("div");
     card.className = "camera";
 
     const info = document.createElement("div");
     info.innerHTML = `
-      <div class="camera-title">${cam.name}</div>
-      <div class="camera-meta">${cam.node}</div>
-      <div class="camera-meta">Stream: ${cam.streamPath}</div>
+      ${cam.thumbnailUrl && !cam.unsupported ? `<img class="camera-thumb" src="${escapeHTML(cam.thumbnailUrl)}" alt="" loading="lazy" />` : ""}
+      <div class="camera-title">${escapeHTML(cam.name)}</div>
+      <div class="camera-meta">${escapeHTML(cam.node)}</div>
+      ${cam.tags ? `<div class="camera-meta">Tags: ${escapeHTML(cam.tags.join(", "))}</div>` : ""}
+      ${cam.output === "rtmp" ? `<div class="camera-meta">Broadcasting to ${escapeHTML(cam.rtmpTarget)}</div>` : ""}
+      <div class="camera-meta">Stream: ${escapeHTML(cam.streamPath)}${cam.readers ? ` · ${cam.readers} watching` : ""}${cam.bitrateKbps ? ` · ${Math.round(cam.bitrateKbps)} kbit/s` : ""}</div>
+      ${cam.queued ? `<div class="camera-meta">Queued: ${escapeHTML(cam.queueReason)}</div>` : ""}
+      ${cam.unsupported ? `<div class="camera-meta">Cannot publish: ${escapeHTML(cam.unsupported)}</div>` : ""}
+      ${cam.waitingMedia ? '<div class="camera-meta">Waiting for media server</div>' : ""}
+      ${cam.unreadable ? `<div class="camera-meta">Publishing but unreadable: ${escapeHTML(cam.unreadable)}</div>` : ""}
+      ${cam.offSchedule ? `<div class="camera-meta">Off schedule (${escapeHTML(cam.schedule)})</div>` : ""}
+      ${cam.recording ? '<div class="camera-meta">Recording</div>' : ""}
+      ${cam.motion ? '<div class="camera-meta">Motion detected</div>' : ""}
+      ${cam.talking ? '<div class="camera-meta">Talkback active</div>' : ""}
+      ${cam.audioLevel !== undefined ? `<div class="camera-meta">Audio: ${cam.silent ? "silent" : `${Math.round(cam.audioLevel)} dBFS`}</div>` : ""}
     `;
 
     const preview = document.createElement("div");
@@ -44,7 +69,7 @@ function renderCameras(cameras) {
 
     function startPreview() {
       const img = preview.querySelector("img");
-      img.src = `/api/preview?deviceUid=${encodeURIComponent(cam.deviceUid)}`;
+      img.src = `api/preview?deviceUid=${encodeURIComponent(cam.deviceUid)}`;
       preview.classList.add("active");
     }
 
@@ -58,7 +83,7 @@ function renderCameras(cameras) {
     toggle.textContent = cam.enabled ? "Stop Streaming" : "Start Streaming";
     toggle.addEventListener("click", async () => {
       toggle.disabled = true;
-      await fetch("/api/cameras/toggle", {
+      await fetch("api/cameras/toggle", {
         method: "POST",
         headers: { "Content-Type": "application/json" },
         body: JSON.stringify({ deviceUid: cam.deviceUid, enabled: !cam.enabled })
@@ -67,6 +92,71 @@ function renderCameras(cameras) {
       toggle.disabled = false;
     });
 
+    const output = document.createElement("select");
+    ["rtsp", "whip", "srt", "rtmp"].forEach((value) => {
+      const option = document.createElement("option");
+      option.value = value;
+      option.textContent = value.toUpperCase();
+      output.append(option);
+    });
+    output.value = cam.output;
+    output.addEventListener("change", async () => {
+      const payload = { output: output.value };
+      if (output.value === "rtmp") {
+        const rtmpUrl = window.prompt("RTMP URL including the stream key", cam.rtmpTarget ? "" : "rtmp://");
+        if (rtmpUrl === null || (!rtmpUrl && !cam.rtmpTarget)) {
+          output.value = cam.output;
+          return;
+        }
+        if (rtmpUrl) {
+          payload.rtmpUrl = rtmpUrl;
+        }
+      }
+      output.disabled = true;
+      await fetch(`api/cameras/${encodeURIComponent(cam.deviceUid)}/settings`, {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify(payload)
+      });
+      await fetchCameras(true);
+    });
+
+    const renameBtn = document.createElement("button");
+    renameBtn.className = "ghost";
+    renameBtn.textContent = "Rename";
+    renameBtn.addEventListener("click", async () => {
+      const name = window.prompt("Camera name (empty to reset)", cam.name);
+      if (name === null) {
+        return;
+      }
+      await fetch(`api/cameras/${encodeURIComponent(cam.deviceUid)}`, {
+        method: "PATCH",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ name })
+      });
+      await fetchCameras(true);
+    });
+
+    const tagsBtn = document.createElement("button");
+    tagsBtn.className = "ghost";
+    tagsBtn.textContent = "Tags";
+    tagsBtn.addEventListener("click", async () => {
+      const value = window.prompt("Tags, separated by commas", (cam.tags || []).join(", "));
+      if (value === null) {
+        return;
+      }
+      const res = await fetch(`api/cameras/${encodeURIComponent(cam.deviceUid)}/settings`, {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ tags: value.split(",") })
+      });
+      if (!res.ok) {
+        const body = await res.json().catch(() => ({}));
+        window.alert(body.error || "Tags not saved");
+      }
+      await fetchCameras(true);
+    });
+
     const previewBtn = document.createElement("button");
     previewBtn.className = "ghost";
     const previewActive = activePreviews.has(cam.deviceUid);
@@ -83,11 +173,45 @@ function renderCameras(cameras) {
       previewBtn.textContent = "Stop Preview";
     });
 
+    const recordings = document.createElement("ul");
+    recordings.className = "recordings";
+    const recordingsBtn = document.createElement("button");
+    recordingsBtn.className = "ghost";
+    recordingsBtn.textContent = "Recordings";
+    recordingsBtn.addEventListener("click", async () => {
+      if (recordings.childElementCount) {
+        recordings.innerHTML = "";
+        return;
+      }
+      const res = await fetch(`api/cameras/${encodeURIComponent(cam.deviceUid)}/recordings`);
+      const list = res.ok ? await res.json() : [];
+      recordings.innerHTML = list.length
+        ? list.map((rec) => `<li><a href="${escapeHTML(rec.url)}" target="_blank">${escapeHTML(rec.name)}</a> <span class="muted">${Math.round(rec.size / 1048576)} MB</span></li>`).join("")
+        : "<li class=\"muted\">No recordings</li>";
+    });
+
+    const upBtn = document.createElement("button");
+    upBtn.className = "ghost";
+    upBtn.textContent = "\u2191";
+    upBtn.title = "Move up";
+    upBtn.disabled = index === 0;
+    upBtn.addEventListener("click", () => moveCamera(cameras, index, -1));
+    const downBtn = document.createElement("button");
+    downBtn.className = "ghost";
+    downBtn.textContent = "\u2193";
+    downBtn.title = "Move down";
+    downBtn.disabled = index === cameras.length - 1;
+    downBtn.addEventListener("click", () => moveCamera(cameras, index, 1));
+
     const actions = document.createElement("div");
     actions.className = "toggle";
-    actions.append(previewBtn, toggle);
+    if (viewer) {
+      actions.append(previewBtn);
+    } else {
+      actions.append(upBtn, downBtn, renameBtn, tagsBtn, output, recordingsBtn, previewBtn, toggle);
+    }
 
-    card.append(info, preview, actions);
+    card.append(info, preview, actions, recordings);
     listEl.append(card);
 
     if (previewActive) {
@@ -97,6 +221,110 @@ function renderCameras(cameras) {
   });
 }
 
-refreshBtn.addEventListener("click", () => fetchCameras(true));
-fetchCameras(true);
+async function moveCamera(cameras, index, delta) {
+  const uids = cameras.map((cam) => cam.deviceUid);
+  [uids[index], uids[index + delta]] = [uids[index + delta], uids[index]];
+  await fetch("api/cameras/order", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ deviceUids: uids })
+  });
+  await fetchCameras(true);
+}
+
+async function fetchSession() {
+  try {
+    const res = await fetch("api/session");
+    const session = await res.json();
+    viewer = session.role === "viewer";
+    logoutUrl = session.logoutUrl || "";
+  } catch (err) {
+    viewer = false;
+  }
+  privacyBtn.hidden = viewer;
+  logoutBtn.hidden = !logoutUrl;
+}
+
+async function fetchPrivacy() {
+  try {
+    const res = await fetch("api/privacy");
+    privacy = (await res.json()).privacy;
+  } catch (err) {
+    return;
+  }
+  privacyBtn.textContent = privacy ? "Leave Privacy Mode" : "Privacy Mode";
+}
+
+async function fetchEnrollment() {
+  try {
+    const res = await fetch("api/enrollment");
+    const data = await res.json();
+    enrollmentEl.textContent = data.claimCode ? `Claim code: ${data.claimCode} (approve in the hub)` : "";
+  } catch (err) {
+    enrollmentEl.textContent = "";
+  }
+}
+
+async function fetchVersion() {
+  try {
+    const res = await fetch("api/version");
+    const data = await res.json();
+    updateEl.textContent = data.updateAvailable ? `Update available: ${data.latest} (running ${data.version})` : "";
+  } catch (err) {
+    updateEl.textContent = "";
+  }
+}
+
+function watchEvents() {
+  if (!window.EventSource) {
+    return;
+  }
+  const source = new EventSource("api/events");
+  source.onmessage = (msg) => {
+    const event = JSON.parse(msg.data);
+    if (/^(camera|publisher|motion)_/.test(event.type)) {
+      fetchCameras();
+    }
+    if (/^privacy_/.test(event.type)) {
+      fetchPrivacy();
+    }
+    if (/^enrollment_/.test(event.type)) {
+      fetchEnrollment();
+    }
+    if (event.type === "update_available") {
+      fetchVersion();
+    }
+  };
+}
+
+refreshBtn.addEventListener("click", async () => {
+  refreshBtn.disabled = true;
+  statusEl.textContent = "Scanning...";
+  try {
+    await fetch("api/discover", { method: "POST" });
+  } catch (err) {
+    // Fall through to a plain refresh.
+  }
+  await fetchCameras(true);
+  refreshBtn.disabled = false;
+});
+privacyBtn.addEventListener("click", async () => {
+  privacyBtn.disabled = true;
+  await fetch("api/privacy", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ enabled: !privacy })
+  });
+  await fetchPrivacy();
+  await fetchCameras(true);
+  privacyBtn.disabled = false;
+});
+logoutBtn.addEventListener("click", () => {
+  window.location.href = logoutUrl;
+});
+fetchSession().then(() => fetchCameras(true));
+fetchPrivacy();
+fetchEnrollment();
+fetchVersion();
+watchEvents();
 setInterval(fetchCameras, 10000);
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const webhookTimeout = 5 * time.Second
+
+// defaultWebhookEvents are sent when a webhook does not list its own.
+var defaultWebhookEvents = []string{"camera_added", "camera_removed", "publisher_error", "hub_disconnected"}
+
+// WebhookConfig is one outgoing webhook. Events may contain "*" for every
+// event type. Template is a text/template rendered with a webhookMessage;
+// without one the message is posted as JSON, whose "text" field is enough
+// for Slack-compatible endpoints.
+type WebhookConfig struct {
+	URL      string            `json:"url"`
+	Events   []string          `json:"events,omitempty"`
+	Template string            `json:"template,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+}
+
+type webhook struct {
+	WebhookConfig
+	tmpl *template.Template
+}
+
+// webhookMessage is what templates see, e.g.
+//
+//	{"content": {{json .Text}}}
+//	{{.Camera}} on {{.Host}}: {{.Type}}
+type webhookMessage struct {
+	Type      string                 `json:"event"`
+	DeviceUID string                 `json:"deviceUid,omitempty"`
+	Camera    string                 `json:"camera,omitempty"`
+	Host      string                 `json:"host"`
+	AgentID   string                 `json:"agentId"`
+	Time      time.Time              `json:"ts"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Text      string                 `json:"text"`
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// loadWebhooks combines WEBHOOK_URL with the webhooks listed in the JSON
+// array in WEBHOOKS_FILE.
+func loadWebhooks(cfg *Config) ([]*webhook, error) {
+	var configs []WebhookConfig
+	if cfg.WebhookURL != "" {
+		configs = append(configs, WebhookConfig{URL: cfg.WebhookURL, Events: cfg.WebhookEvents, Template: cfg.WebhookTemplate})
+	}
+	if cfg.WebhooksFile != "" {
+		data, err := os.ReadFile(cfg.WebhooksFile)
+		if err != nil {
+			return nil, err
+		}
+		var listed []WebhookConfig
+		if err := json.Unmarshal(data, &listed); err != nil {
+			return nil, fmt.Errorf("%s: %w", cfg.WebhooksFile, err)
+		}
+		configs = append(configs, listed...)
+	}
+
+	hooks := make([]*webhook, 0, len(configs))
+	for _, c := range configs {
+		if !validURL(c.URL, "http", "https") {
+			return nil, fmt.Errorf("webhook URL must be http(s): %q", redactURL(c.URL))
+		}
+		if len(c.Events) == 0 {
+			c.Events = defaultWebhookEvents
+		}
+		hook := &webhook{WebhookConfig: c}
+		if c.Template != "" {
+			tmpl, err := template.New("webhook").Funcs(webhookFuncs).Parse(c.Template)
+			if err != nil {
+				return nil, fmt.Errorf("webhook template for %s: %w", redactURL(c.URL), err)
+			}
+			hook.tmpl = tmpl
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+func (h *webhook) wants(eventType string) bool {
+	for _, want := range h.Events {
+		if want == "*" || want == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookLoop posts matching events to the configured webhooks, one at a
+// time and in order. Webhooks are rebuilt when the configuration is
+// reloaded.
+func (a *Agent) webhookLoop() {
+	events, _ := a.events.Subscribe()
+
+	var cfg *Config
+	var hooks []*webhook
+	for event := range events {
+		if next := a.config(); next != cfg {
+			cfg = next
+			var err error
+			if hooks, err = loadWebhooks(cfg); err != nil {
+				logError("webhooks disabled: %v", err)
+			}
+		}
+		if len(hooks) == 0 {
+			continue
+		}
+
+		msg := a.webhookMessage(event)
+		for _, hook := range hooks {
+			if !hook.wants(event.Type) {
+				continue
+			}
+			if err := hook.send(msg); err != nil {
+				logWarn("webhook %s failed for %s: %v", redactURL(hook.URL), event.Type, err)
+			}
+		}
+	}
+}
+
+func (a *Agent) webhookMessage(event Event) webhookMessage {
+	msg := webhookMessage{
+		Type:      event.Type,
+		DeviceUID: event.DeviceUID,
+		Host:      a.hostname,
+		AgentID:   a.agentID,
+		Time:      event.Time,
+		Data:      event.Data,
+	}
+	if name, ok := event.Data["name"].(string); ok {
+		msg.Camera = name
+	} else if event.DeviceUID != "" {
+		a.mu.Lock()
+		if cam := a.cameras[event.DeviceUID]; cam != nil {
+			msg.Camera = cam.Name
+		} else if known, ok := a.missing[event.DeviceUID]; ok {
+			msg.Camera = known.Name
+		}
+		a.mu.Unlock()
+	}
+
+	subject := a.hostname
+	if msg.Camera != "" {
+		subject = msg.Camera + " on " + a.hostname
+	}
+	msg.Text = fmt.Sprintf("%s: %s", subject, strings.ReplaceAll(event.Type, "_", " "))
+	if reason, ok := event.Data["error"].(string); ok && reason != "" {
+		msg.Text += " (" + reason + ")"
+	}
+	return msg
+}
+
+func (h *webhook) send(msg webhookMessage) error {
+	var body bytes.Buffer
+	if h.tmpl != nil {
+		if err := h.tmpl.Execute(&body, msg); err != nil {
+			return err
+		}
+	} else if err := json.NewEncoder(&body).Encode(msg); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.URL, &body)
+	if err != nil {
+		return err
+	}
+	contentType := "text/plain; charset=utf-8"
+	if trimmed := bytes.TrimSpace(body.Bytes()); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "camhub-agent/"+version)
+	for key, value := range h.Headers {
+		req.Header.Set(key, value)
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s", res.Status)
+	}
+	return nil
+}